@@ -3,24 +3,169 @@ package api
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/simpleiot/simpleiot/client"
 	"github.com/simpleiot/simpleiot/data"
 )
 
+// Repeated failed logins for an account lock further attempts at it out for a
+// while, so a password cannot be guessed at the speed of the network. The
+// client address is not counted: behind a reverse proxy every login comes from
+// the proxy, and one guesser there would lock every user out.
+const (
+	loginMaxFailures = 5
+	loginWindow      = 15 * time.Minute
+	loginLockout     = 15 * time.Minute
+)
+
+// loginFailures counts the failed logins of one account.
+type loginFailures struct {
+	count int
+	// checking counts the attempts whose password is being checked, each
+	// of which may still fail
+	checking int
+	first    time.Time
+	until    time.Time
+}
+
+// loginLimiter tracks failed logins by account.
+type loginLimiter struct {
+	lock     sync.Mutex
+	failures map[string]*loginFailures
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{failures: make(map[string]*loginFailures)}
+}
+
+// attempt takes a slot for a login to an account before its password is
+// checked, and returns 0. An attempt that is checking holds its slot as if it
+// had failed, so guesses sent at once cannot all be checked before the first
+// failure counts. While the account is locked out, or every failure it has
+// left is held by an attempt, no slot is taken and attempt returns how long to
+// wait. A slot is given back with fail, succeed or release.
+func (l *loginLimiter) attempt(now time.Time, account string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f, ok := l.failures[account]
+	if !ok {
+		f = &loginFailures{}
+		l.failures[account] = f
+	}
+	if f.until.After(now) {
+		return f.until.Sub(now)
+	}
+	if now.Sub(f.first) > loginWindow {
+		f.count = 0
+	}
+	if f.count+f.checking >= loginMaxFailures {
+		return time.Second
+	}
+	f.checking++
+	return 0
+}
+
+// fail gives back the slot of a failed login and counts the failure against
+// the account.
+func (l *loginLimiter) fail(now time.Time, account string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f := l.done(account)
+	if f.count == 0 || now.Sub(f.first) > loginWindow {
+		f.count = 0
+		f.first = now
+	}
+	f.count++
+	if f.count >= loginMaxFailures {
+		f.until = now.Add(loginLockout)
+		log.Printf("Auth: too many failed logins for %v, locked until %v",
+			account, f.until.Format(time.RFC3339))
+	}
+
+	// forget what no longer counts, so the map does not grow without bound
+	for k, f := range l.failures {
+		if f.checking == 0 && now.Sub(f.first) > loginWindow && !f.until.After(now) {
+			delete(l.failures, k)
+		}
+	}
+}
+
+// succeed gives back the slot of a login that worked and clears the failures
+// of the account.
+func (l *loginLimiter) succeed(account string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f := l.done(account)
+	f.count, f.until = 0, time.Time{}
+	l.forget(account, f)
+}
+
+// release gives back the slot of a login that could not be checked, which
+// counts neither way.
+func (l *loginLimiter) release(account string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.forget(account, l.done(account))
+}
+
+// done ends an attempt at an account. The lock must be held.
+func (l *loginLimiter) done(account string) *loginFailures {
+	f, ok := l.failures[account]
+	if !ok {
+		f = &loginFailures{}
+		l.failures[account] = f
+	}
+	if f.checking > 0 {
+		f.checking--
+	}
+	return f
+}
+
+// forget drops an account with nothing left to count. The lock must be held.
+func (l *loginLimiter) forget(account string, f *loginFailures) {
+	if f.count == 0 && f.checking == 0 && f.until.IsZero() {
+		delete(l.failures, account)
+	}
+}
+
 // Auth handles user authentication requests.
 type Auth struct {
-	nc *nats.Conn
+	nc     *nats.Conn
+	limits *loginLimiter
+	// oidc is nil when OIDC login is not configured
+	oidc *oidcHandler
 }
 
 // NewAuthHandler returns a new authentication handler using the given key.
-func NewAuthHandler(nc *nats.Conn) Auth {
-	return Auth{nc: nc}
+func NewAuthHandler(nc *nats.Conn, oidc OIDCConfig) Auth {
+	auth := Auth{nc: nc, limits: newLoginLimiter()}
+	if oidc.Enabled() {
+		auth.oidc = newOIDCHandler(oidc, nc)
+	}
+	return auth
 }
 
 // ServeHTTP serves requests to authenticate.
 func (auth Auth) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+	if head == "oidc" {
+		if auth.oidc == nil {
+			http.Error(res, "OIDC login is not configured", http.StatusNotFound)
+			return
+		}
+		auth.oidc.ServeHTTP(res, req)
+		return
+	}
+
 	if req.Method != http.MethodPost {
 		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
 		return
@@ -28,18 +173,36 @@ func (auth Auth) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	email := req.FormValue("email")
 	password := req.FormValue("password")
+	// the organization the user is in, empty for the instance's own users
+	org := req.FormValue("org")
 
-	nodes, err := client.UserCheck(auth.nc, email, password)
+	account := "email:" + email
+	if org != "" {
+		account = "org:" + org + " " + account
+	}
+
+	if wait := auth.limits.attempt(time.Now(), account); wait > 0 {
+		res.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(res, "too many failed logins, try again later",
+			http.StatusTooManyRequests)
+		return
+	}
+
+	nodes, err := client.OrgUserCheck(auth.nc, org, email, password)
 	if err != nil {
+		auth.limits.release(account)
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if len(nodes) == 0 {
+		auth.limits.fail(time.Now(), account)
 		http.Error(res, "invalid login", http.StatusForbidden)
 		return
 	}
 
+	auth.limits.succeed(account)
+
 	var token string
 
 	for _, n := range nodes {
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Now()
+
+	// attempt and fail one login
+	fail := func(now time.Time, account string) {
+		t.Helper()
+		if l.attempt(now, account) != 0 {
+			t.Fatal("attempt refused at", account)
+		}
+		l.fail(now, account)
+	}
+
+	for i := 0; i < loginMaxFailures-1; i++ {
+		fail(now, "email:a")
+	}
+
+	fail(now, "email:a")
+	if l.attempt(now, "email:a") != loginLockout {
+		t.Fatal("account not locked out at the limit")
+	}
+	if l.attempt(now, "email:b") != 0 {
+		t.Fatal("another account locked out")
+	}
+	l.release("email:b")
+
+	later := now.Add(loginLockout + time.Second)
+	if l.attempt(later, "email:a") != 0 {
+		t.Fatal("lockout did not expire")
+	}
+	l.release("email:a")
+
+	// a login that works clears the account
+	fail(later, "email:c")
+	if l.attempt(later, "email:c") != 0 {
+		t.Fatal("attempt refused")
+	}
+	l.succeed("email:c")
+	if _, ok := l.failures["email:c"]; ok {
+		t.Fatal("failures of the account kept after a login")
+	}
+
+	// failures spread out over more than the window do not add up
+	for i := 0; i < loginMaxFailures; i++ {
+		fail(later.Add(time.Duration(i)*loginWindow), "email:d")
+	}
+	if l.attempt(later.Add(loginMaxFailures*loginWindow), "email:d") != 0 {
+		t.Fatal("failures outside the window locked out")
+	}
+	l.release("email:d")
+
+	// attempts being checked hold the failures the account has left
+	for i := 0; i < loginMaxFailures; i++ {
+		if l.attempt(now, "email:e") != 0 {
+			t.Fatal("attempt refused before the limit")
+		}
+	}
+	if l.attempt(now, "email:e") == 0 {
+		t.Fatal("more attempts checked at once than failures left")
+	}
+	l.release("email:e")
+	if l.attempt(now, "email:e") != 0 {
+		t.Fatal("released slot not given back")
+	}
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// eventsBacklog is how many of a node's recent events are kept for clients
+// that reconnect.
+const eventsBacklog = 1000
+
+// eventsResumeWindow is how long a node's recent events are kept after its
+// last client leaves, so a client that reconnects within it misses nothing.
+const eventsResumeWindow = 5 * time.Minute
+
+// eventsKeepAlive is how often an idle stream sends a comment, so proxies do
+// not close it.
+const eventsKeepAlive = 30 * time.Second
+
+// eventsQueue is how many events a client may fall behind before its stream
+// is closed. The client reconnects and resumes from the backlog.
+const eventsQueue = 256
+
+// PointEvent is a point change sent on a node's event stream, as a points
+// event for node points or an edgePoints event for the points of the edge
+// between Node and Parent.
+type PointEvent struct {
+	Node   string      `json:"node"`
+	Parent string      `json:"parent,omitempty"`
+	Points data.Points `json:"points"`
+}
+
+// pointEvent is a PointEvent numbered in its topic.
+type pointEvent struct {
+	seq uint64
+	PointEvent
+}
+
+// eventTopic holds the NATS subscription to the points of a node and the nodes
+// below it, the events it has seen lately, and the clients listening to it.
+// Event IDs are the topic's epoch and the event's number, so an ID is only
+// resumed by the topic that gave it out.
+type eventTopic struct {
+	node      string
+	epoch     string
+	sub       *nats.Subscription
+	seq       uint64
+	backlog   []pointEvent
+	listeners map[*eventListener]bool
+	idle      *time.Timer
+}
+
+// eventListener is a client listening to a topic. ch is closed when the
+// client falls too far behind. start is the number of the topic's last event
+// when the client started listening.
+type eventListener struct {
+	ch      chan pointEvent
+	node    string
+	subtree bool
+	epoch   string
+	start   uint64
+}
+
+// events shares one subscription for each node streamed over HTTP among its
+// clients.
+type events struct {
+	nc *nats.Conn
+
+	lock   sync.Mutex
+	topics map[string]*eventTopic
+}
+
+func newEvents(nc *nats.Conn) *events {
+	return &events{nc: nc, topics: make(map[string]*eventTopic)}
+}
+
+// eventID returns the ID of an event of the listener's topic.
+func (l *eventListener) eventID(seq uint64) string {
+	return l.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// listen starts a client listening to the points of node, and below it if
+// subtree is set. If lastID is an event of the node's topic that is still in
+// its backlog, the events after it are returned to be sent first and resumed
+// is set. Otherwise the client needs the node's current state.
+func (e *events) listen(node string, subtree bool, lastID string) (l *eventListener, replay []pointEvent, resumed bool, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	t := e.topics[node]
+	if t == nil {
+		t = &eventTopic{
+			node:      node,
+			epoch:     strconv.FormatInt(time.Now().UnixNano(), 36),
+			listeners: make(map[*eventListener]bool),
+		}
+		t.sub, err = e.nc.Subscribe(fmt.Sprintf("up.%v.>", node), func(msg *nats.Msg) {
+			e.receive(t, msg)
+		})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		e.topics[node] = t
+	}
+
+	if t.idle != nil {
+		t.idle.Stop()
+		t.idle = nil
+	}
+
+	l = &eventListener{
+		ch:      make(chan pointEvent, eventsQueue),
+		node:    node,
+		subtree: subtree,
+		epoch:   t.epoch,
+		start:   t.seq,
+	}
+	t.listeners[l] = true
+
+	epoch, seqS, _ := strings.Cut(lastID, "-")
+	seq, errSeq := strconv.ParseUint(seqS, 10, 64)
+	oldest := t.seq + 1
+	if len(t.backlog) > 0 {
+		oldest = t.backlog[0].seq
+	}
+	if epoch == t.epoch && errSeq == nil && seq <= t.seq && seq+1 >= oldest {
+		for _, ev := range t.backlog {
+			if ev.seq > seq && l.wants(ev) {
+				replay = append(replay, ev)
+			}
+		}
+		return l, replay, true, nil
+	}
+
+	return l, nil, false, nil
+}
+
+// leave stops a client listening. A topic with no clients left is kept for
+// eventsResumeWindow for them to come back.
+func (e *events) leave(node string, l *eventListener) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	t := e.topics[node]
+	if t == nil || !t.listeners[l] {
+		return
+	}
+	delete(t.listeners, l)
+	e.idle(t)
+}
+
+// idle drops a topic eventsResumeWindow after its last client leaves, unless
+// one comes back. e.lock must be held.
+func (e *events) idle(t *eventTopic) {
+	if len(t.listeners) > 0 || t.idle != nil {
+		return
+	}
+
+	t.idle = time.AfterFunc(eventsResumeWindow, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if len(t.listeners) > 0 || e.topics[t.node] != t {
+			return
+		}
+		if err := t.sub.Unsubscribe(); err != nil {
+			log.Println("Error unsubscribing from node events:", err)
+		}
+		delete(e.topics, t.node)
+	})
+}
+
+// receive numbers the points of an upstream message and passes them on.
+func (e *events) receive(t *eventTopic, msg *nats.Msg) {
+	points, err := data.DecodePoints(msg.Data)
+	if err != nil {
+		log.Println("Error decoding points for node events:", err)
+		return
+	}
+
+	// up.<upId>.<nodeId>.<type>.<key> for node points
+	// up.<upId>.<nodeId>.<parentId>.<type>.<key> for edge points
+	chunks := strings.Split(msg.Subject, ".")
+	var ev pointEvent
+	switch len(chunks) {
+	case 5:
+		ev.Node = chunks[2]
+	case 6:
+		ev.Node, ev.Parent = chunks[2], chunks[3]
+	default:
+		return
+	}
+	ev.Points = points
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	t.seq++
+	ev.seq = t.seq
+	t.backlog = append(t.backlog, ev)
+	if len(t.backlog) > eventsBacklog {
+		t.backlog = t.backlog[len(t.backlog)-eventsBacklog:]
+	}
+
+	for l := range t.listeners {
+		if !l.wants(ev) {
+			continue
+		}
+		select {
+		case l.ch <- ev:
+		default:
+			// too far behind; the client resumes from the backlog
+			delete(t.listeners, l)
+			close(l.ch)
+		}
+	}
+	e.idle(t)
+}
+
+// wants reports whether an event is for the listener: a point of its node or,
+// for a subtree, of any node below it.
+func (l *eventListener) wants(ev pointEvent) bool {
+	return l.subtree || ev.Node == l.node
+}
+
+// streamEvents streams the point changes of a node, and of the nodes below it
+// with ?subtree=true, as server-sent events. A new stream starts with a nodes
+// event holding the current nodes. Each event has an ID, and a client that
+// reconnects with the last ID it saw, in the Last-Event-ID header or a
+// lastEventId query parameter, gets the events it missed. If they are no
+// longer kept, it gets the current nodes again instead.
+func (h *Nodes) streamEvents(res http.ResponseWriter, req *http.Request, id string) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var subtree bool
+	if s := req.URL.Query().Get("subtree"); s != "" {
+		var err error
+		subtree, err = strconv.ParseBool(s)
+		if err != nil {
+			http.Error(res, "invalid subtree: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.URL.Query().Get("lastEventId")
+	}
+
+	l, replay, resumed, err := h.events.listen(id, subtree, lastID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer h.events.leave(id, l)
+
+	var snapshot []data.NodeEdge
+	if !resumed {
+		if subtree {
+			snapshot, err = client.GetSubtree(h.nc, id)
+		} else {
+			snapshot, err = client.GetNodes(h.nc, "all", id, "", false)
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		if len(snapshot) == 0 {
+			http.Error(res, "node not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// keep reverse proxies such as nginx from buffering the stream
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	send := func(event, id string, v any) bool {
+		d, err := json.Marshal(v)
+		if err != nil {
+			log.Println("Error encoding event:", err)
+			return false
+		}
+		_, err = fmt.Fprintf(res, "id: %v\nevent: %v\ndata: %s\n\n", id, event, d)
+		return err == nil
+	}
+
+	if !resumed {
+		if !send("nodes", l.eventID(l.start), snapshot) {
+			return
+		}
+	}
+
+	sendPoints := func(ev pointEvent) bool {
+		event := "points"
+		if ev.Parent != "" {
+			event = "edgePoints"
+		}
+		return send(event, l.eventID(ev.seq), ev.PointEvent)
+	}
+
+	for _, ev := range replay {
+		if !sendPoints(ev) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-l.ch:
+			if !ok || !sendPoints(ev) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
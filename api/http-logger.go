@@ -12,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 )
 
 // HTTPLogger can be used to log http requests
@@ -40,11 +41,15 @@ func (l *HTTPLogger) Handler(next http.Handler) http.Handler {
 			r.Body = rdr2
 		}
 
+		// the body of a login holds a password and the response a token,
+		// as does the response of an OIDC login
+		creds := r.URL.Path == "/auth" || strings.HasPrefix(r.URL.Path, "/auth/")
+
 		crw := newCustomResponseWriter(w)
 		next.ServeHTTP(crw, r)
 
 		addr := r.RemoteAddr
-		if err == nil {
+		if err == nil && !creds {
 			rBuf := bytes.Buffer{}
 			_, _ = rBuf.ReadFrom(rdr)
 			l.Printf("(%s) \"%s %s\" %d -> %v -> %v", addr, r.Method, r.RequestURI,
@@ -70,7 +75,10 @@ func (c *customResponseWriter) WriteHeader(status int) {
 
 func (c *customResponseWriter) Write(b []byte) (int, error) {
 	size, err := c.ResponseWriter.Write(b)
-	c.buf.Write(b)
+	// an event stream does not end, so is not kept to log
+	if c.Header().Get("Content-Type") != "text/event-stream" {
+		c.buf.Write(b)
+	}
 	c.size += size
 	return size, err
 }
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// influxMaxBody bounds the size of a write, after it is decompressed.
+const influxMaxBody = 32 * 1024 * 1024
+
+// InfluxWrite takes writes of InfluxDB line protocol at the path of the
+// InfluxDB 2 write API, so Telegraf and other tools that write to InfluxDB can
+// write to SIOT. The bucket of a write is the ID of the ingest node that maps
+// it onto nodes; the org is ignored.
+type InfluxWrite struct {
+	check     Authorizer
+	nc        *nats.Conn
+	authToken string
+	canWrite  func(principal, nodeID string) bool
+}
+
+// NewInfluxWriteHandler returns a new handler for InfluxDB writes. canWrite
+// reports whether a user or API key may write to an ingest node; nil lets any
+// valid one.
+func NewInfluxWriteHandler(v Authorizer, authToken string, nc *nats.Conn,
+	canWrite func(principal, nodeID string) bool) http.Handler {
+	return &InfluxWrite{v, nc, authToken, canWrite}
+}
+
+// influxError is the body of an error response, as InfluxDB sends it.
+type influxError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func influxFail(res http.ResponseWriter, status int, code, message string) {
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(status)
+	_ = json.NewEncoder(res).Encode(influxError{code, message})
+}
+
+func (h *InfluxWrite) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		influxFail(res, http.StatusMethodNotAllowed, "method not allowed",
+			"writes are POSTed")
+		return
+	}
+
+	principal, ok := tokenPrincipal(req, h.check, h.authToken)
+	if !ok {
+		influxFail(res, http.StatusUnauthorized, "unauthorized", "unauthorized access")
+		return
+	}
+
+	q := req.URL.Query()
+
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		influxFail(res, http.StatusBadRequest, "invalid",
+			"bucket is required, and is the ID of an ingest node")
+		return
+	}
+
+	precision := q.Get("precision")
+	switch precision {
+	case "", "ns", "us", "ms", "s":
+	default:
+		influxFail(res, http.StatusBadRequest, "invalid",
+			"precision "+precision+" is not one of ns, us, ms or s")
+		return
+	}
+
+	if principal != "" && h.canWrite != nil && !h.canWrite(principal, bucket) {
+		influxFail(res, http.StatusForbidden, "forbidden",
+			"writing to "+bucket+" needs the admin role")
+		return
+	}
+
+	nodes, err := client.GetNodes(h.nc, "all", bucket, data.NodeTypeIngest, false)
+	if err != nil {
+		influxFail(res, http.StatusServiceUnavailable, "unavailable", err.Error())
+		return
+	}
+	if len(nodes) == 0 {
+		influxFail(res, http.StatusNotFound, "not found",
+			"bucket "+bucket+" is not an ingest node")
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(res, req.Body, influxMaxBody)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			influxFail(res, http.StatusBadRequest, "invalid", "gzip: "+err.Error())
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, influxMaxBody+1)
+	}
+
+	lines, err := io.ReadAll(body)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !errors.As(err, &tooLarge) {
+		influxFail(res, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if tooLarge != nil || len(lines) > influxMaxBody {
+		influxFail(res, http.StatusRequestEntityTooLarge, "request too large",
+			"a write may be at most 32MB")
+		return
+	}
+
+	err = client.IngestWrite(h.nc, bucket, lines, precision)
+	switch {
+	case err == nil:
+		res.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, nats.ErrNoResponders), errors.Is(err, nats.ErrTimeout):
+		influxFail(res, http.StatusServiceUnavailable, "unavailable",
+			"ingest node "+bucket+" is not taking writes: "+err.Error())
+	default:
+		influxFail(res, http.StatusBadRequest, "invalid", err.Error())
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestInfluxWriteAuth(t *testing.T) {
+	k, err := NewKey([]byte("test"))
+	if err != nil {
+		t.Fatal("Error creating key:", err)
+	}
+	key := data.FormatAPIKey("key", "secret")
+	k = k.WithAPIKeys(func(s string) (bool, string) {
+		return s == key, "key"
+	})
+
+	// every case is refused before the handler needs NATS
+	h := NewInfluxWriteHandler(k, "siot-token", nil, func(principal, nodeID string) bool {
+		return principal == "key" && nodeID == "ingest"
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		auth   string
+		query  string
+		status int
+	}{
+		{"no token", http.MethodPost, "", "bucket=ingest", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "Token nope", "bucket=ingest", http.StatusUnauthorized},
+		{"wrong scheme", http.MethodPost, "Basic " + key, "bucket=ingest", http.StatusUnauthorized},
+		{"get", http.MethodGet, "Token " + key, "bucket=ingest", http.StatusMethodNotAllowed},
+		{"no bucket", http.MethodPost, "Token " + key, "", http.StatusBadRequest},
+		{"bad precision", http.MethodPost, "Token " + key, "bucket=ingest&precision=h",
+			http.StatusBadRequest},
+		{"other node", http.MethodPost, "Token " + key, "bucket=other", http.StatusForbidden},
+		{"bearer", http.MethodPost, "Bearer " + key, "bucket=other", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/api/v2/write?"+test.query,
+			strings.NewReader("cpu usage=1\n"))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%v: returned %v, expected %v: %v", test.name, res.Code,
+				test.status, res.Body)
+		}
+		if res.Code != http.StatusNoContent &&
+			!strings.Contains(res.Body.String(), `"message":`) {
+			t.Errorf("%v: error is not InfluxDB's JSON: %v", test.name, res.Body)
+		}
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/simpleiot/simpleiot/data"
 )
 
 // Authorizer defines a mechanism needed to authorize stuff
 type Authorizer interface {
 	NewToken(id string) (string, error)
 	Valid(req *http.Request) (bool, string)
+	ValidToken(str string) (bool, string)
 }
 
 // AlwaysValid is used to disable authentication
@@ -25,9 +27,19 @@ func (AlwaysValid) Valid(*http.Request) (bool, string) {
 	return true, ""
 }
 
+// ValidToken stub
+func (AlwaysValid) ValidToken(string) (bool, string) {
+	return true, ""
+}
+
+// APIKeyCheck checks an API key (see data.APIKey), and returns the ID of
+// its apiKey node when it is valid.
+type APIKeyCheck func(key string) (bool, string)
+
 // Key provides a key for signing authentication tokens.
 type Key struct {
-	bytes []byte
+	bytes   []byte
+	apiKeys APIKeyCheck
 }
 
 // NewKey returns a new Key of the given size.
@@ -49,9 +61,24 @@ func (k Key) NewToken(userID string) (string, error) {
 		SignedString(k.bytes)
 }
 
+// WithAPIKeys returns a copy of the Key that also accepts the API keys
+// check accepts. The ID returned for an API key is that of its apiKey node.
+func (k Key) WithAPIKeys(check APIKeyCheck) Key {
+	k.apiKeys = check
+	return k
+}
+
 // ValidToken returns whether the given string
-// is an authentication token signed by the Key.
+// is an authentication token signed by the Key,
+// or an API key.
 func (k Key) ValidToken(str string) (bool, string) {
+	if data.IsAPIKey(str) {
+		if k.apiKeys == nil {
+			return false, ""
+		}
+		return k.apiKeys(str)
+	}
+
 	token, err := jwt.Parse(str, k.keyFunc)
 	if err != nil {
 		return false, ""
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestKeyAPIKeys(t *testing.T) {
+	k, err := NewKey([]byte("test"))
+	if err != nil {
+		t.Fatal("Error creating key:", err)
+	}
+
+	good := data.FormatAPIKey("key", "secret")
+
+	if ok, _ := k.ValidToken(good); ok {
+		t.Fatal("API key accepted with no check set")
+	}
+
+	k = k.WithAPIKeys(func(key string) (bool, string) {
+		if key == good {
+			return true, "key"
+		}
+		return false, ""
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "/v1/nodes", nil)
+	req.Header.Set("Authorization", "Bearer "+good)
+	if ok, id := k.Valid(req); !ok || id != "key" {
+		t.Fatal("API key refused:", ok, id)
+	}
+
+	if ok, _ := k.ValidToken(data.FormatAPIKey("key", "wrong")); ok {
+		t.Fatal("wrong API key accepted")
+	}
+
+	token, err := k.NewToken("user")
+	if err != nil {
+		t.Fatal("Error creating token:", err)
+	}
+	if ok, id := k.ValidToken(token); !ok || id != "user" {
+		t.Fatal("login token refused once API keys are checked")
+	}
+}
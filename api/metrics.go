@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Metrics serves the current numeric points of nodes, and the internal metrics
+// of the instance, for Prometheus to scrape. The nodes exported are the
+// subtrees below the node query parameters, or everything the user or API key
+// scraping can reach when there are none.
+type Metrics struct {
+	check     Authorizer
+	nc        *nats.Conn
+	authToken string
+	canWrite  func(principal, nodeID string) bool
+	internal  func() []client.PromMetric
+}
+
+// NewMetricsHandler returns a new handler for Prometheus scrapes. internal
+// returns the metrics of the store and client managers, which only those who
+// may change the root node see, along with those of the sync connections.
+func NewMetricsHandler(v Authorizer, authToken string, nc *nats.Conn,
+	canWrite func(principal, nodeID string) bool,
+	internal func() []client.PromMetric) http.Handler {
+	return &Metrics{v, nc, authToken, canWrite, internal}
+}
+
+func (h *Metrics) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := tokenPrincipal(req, h.check, h.authToken)
+	if !ok {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := req.URL.Query()
+	selected := q["node"]
+	pointTypes := q["type"]
+	tagPointTypes := q["tagPointType"]
+	if len(tagPointTypes) == 0 {
+		tagPointTypes = []string{data.PointTypeTag}
+	}
+
+	root, err := client.GetRootNode(h.nc)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// the nodes a user or API key can reach, and the ones it may scrape
+	var reachable []data.NodeEdge
+	if principal != "" {
+		reachable, err = client.GetNodesForUser(h.nc, principal)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	var metrics []client.PromMetric
+
+	switch {
+	case len(selected) == 0 && principal != "":
+		metrics = client.PromPoints(reachable, "", tagPointTypes, pointTypes)
+	case len(selected) == 0:
+		selected = []string{root.ID}
+		fallthrough
+	default:
+		for _, id := range selected {
+			if principal != "" && !containsNode(reachable, id) {
+				http.Error(res, "node "+id+" is not reachable", http.StatusForbidden)
+				return
+			}
+
+			nodes, err := client.GetSubtree(h.nc, id)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if len(nodes) == 0 {
+				http.Error(res, "node "+id+" not found", http.StatusNotFound)
+				return
+			}
+
+			metrics = append(metrics, client.PromPoints(nodes, id, tagPointTypes, pointTypes)...)
+		}
+	}
+
+	if principal == "" || (h.canWrite != nil && h.canWrite(principal, root.ID)) {
+		if h.internal != nil {
+			metrics = append(metrics, h.internal()...)
+		}
+		sync, err := client.SyncMetrics(h.nc)
+		if err != nil {
+			log.Println("Metrics: error getting sync metrics:", err)
+		}
+		metrics = append(metrics, sync...)
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = res.Write(promExposition(metrics))
+}
+
+func containsNode(nodes []data.NodeEdge, id string) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// promExposition renders metrics in the Prometheus text format, sorted by
+// name and labels. A series given more than once, as a node in two selected
+// subtrees is, is written once.
+func promExposition(metrics []client.PromMetric) []byte {
+	type series struct {
+		labels string
+		value  float64
+	}
+
+	first := make(map[string]client.PromMetric)
+	samples := make(map[string][]series)
+	seen := make(map[string]bool)
+
+	for _, m := range metrics {
+		labels := promLabels(m.Labels)
+		if seen[m.Name+labels] {
+			continue
+		}
+		seen[m.Name+labels] = true
+
+		if _, ok := first[m.Name]; !ok {
+			first[m.Name] = m
+		}
+		samples[m.Name] = append(samples[m.Name], series{labels, m.Value})
+	}
+
+	names := make([]string, 0, len(first))
+	for n := range first {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, n := range names {
+		m := first[n]
+		typ := "gauge"
+		if m.Counter {
+			typ = "counter"
+		}
+		if m.Help != "" {
+			b.WriteString("# HELP " + n + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.Help) + "\n")
+		}
+		b.WriteString("# TYPE " + n + " " + typ + "\n")
+
+		s := samples[n]
+		sort.Slice(s, func(i, j int) bool { return s[i].labels < s[j].labels })
+		for _, v := range s {
+			b.WriteString(n + v.labels + " " + strconv.FormatFloat(v.value, 'g', -1, 64) + "\n")
+		}
+	}
+
+	return b.Bytes()
+}
+
+// promLabels renders labels in the Prometheus text format, sorted by name.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(names))
+	for _, k := range names {
+		parts = append(parts, k+`="`+r.Replace(labels[k])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
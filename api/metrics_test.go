@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/client"
+)
+
+func TestPromExposition(t *testing.T) {
+	metrics := []client.PromMetric{
+		{Name: "siot_value", Help: "Value.", Value: 2,
+			Labels: map[string]string{"node_id": "b", "node_description": `say "hi"\n`}},
+		{Name: "siot_value", Help: "Value.", Value: 1.5,
+			Labels: map[string]string{"node_id": "a"}},
+		// the same series again, as from a node in two selected subtrees
+		{Name: "siot_value", Help: "Value.", Value: 1.5,
+			Labels: map[string]string{"node_id": "a"}},
+		{Name: "siot_client_starts_total", Help: "Starts.", Counter: true, Value: 3,
+			Labels: map[string]string{"type": "modbus"}},
+	}
+
+	exp := `# HELP siot_client_starts_total Starts.
+# TYPE siot_client_starts_total counter
+siot_client_starts_total{type="modbus"} 3
+# HELP siot_value Value.
+# TYPE siot_value gauge
+siot_value{node_description="say \"hi\"\\n",node_id="b"} 2
+siot_value{node_id="a"} 1.5
+`
+
+	if got := string(promExposition(metrics)); got != exp {
+		t.Errorf("wrong exposition:\n%v\nexpected:\n%v", got, exp)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	k, err := NewKey([]byte("test"))
+	if err != nil {
+		t.Fatal("Error creating key:", err)
+	}
+
+	// every case is refused before the handler needs NATS
+	h := NewMetricsHandler(k, "siot-token", nil, nil, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		auth   string
+		status int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "Bearer nope", http.StatusUnauthorized},
+		{"post", http.MethodPost, "Bearer siot-token", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/metrics", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%v: returned %v, expected %v", test.name, res.Code, test.status)
+		}
+	}
+}
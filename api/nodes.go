@@ -5,6 +5,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
@@ -31,21 +33,28 @@ type NodeDelete struct {
 	Parent string
 }
 
+// NodeRestore is a data structure used with the /node/:id/restore call
+type NodeRestore struct {
+	Parent string
+}
+
 // Nodes handles node requests
 type Nodes struct {
 	check     RequestValidator
 	nc        *nats.Conn
 	authToken string
+	events    *events
+	canWrite  func(principal, nodeID string) bool
 }
 
-// NewNodesHandler returns a new node handler
+// NewNodesHandler returns a new node handler. canWrite reports whether a user
+// or API key is an admin over a node.
 func NewNodesHandler(v RequestValidator, authToken string,
-	nc *nats.Conn) http.Handler {
-	return &Nodes{v, nc, authToken}
+	nc *nats.Conn, canWrite func(principal, nodeID string) bool) http.Handler {
+	return &Nodes{v, nc, authToken, newEvents(nc), canWrite}
 }
 
 // Top level handler for http requests in the coap-server process
-// TODO need to add node auth
 func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	var id string
@@ -103,7 +112,13 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// process requests with an ID.
+	// process requests with an ID, which a user or API key must be able to
+	// reach. A deleted node is not reachable, so a restore checks the parent
+	// it goes back to instead.
+	if head != "restore" && h.forbidden(res, validUser, userID, id) {
+		return
+	}
+
 	switch head {
 	case "":
 		switch req.Method {
@@ -161,6 +176,88 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
 		return
 
+	case "events":
+		if req.Method != http.MethodGet {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.streamEvents(res, req, id)
+		return
+
+	case "audit":
+		if req.Method != http.MethodGet {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.audit(res, req, id)
+		return
+
+	case "trash":
+		switch req.Method {
+		case http.MethodGet:
+			nodes, err := client.GetTrash(h.nc, id)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.encodeTrash(res, nodes)
+
+		case http.MethodDelete:
+			grace := client.DefaultTrashGrace
+			if v := req.URL.Query().Get("grace"); v != "" {
+				var err error
+				grace, err = time.ParseDuration(v)
+				if err != nil {
+					http.Error(res, "invalid grace: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			if validUser && (h.canWrite == nil || !h.canWrite(userID, id)) {
+				http.Error(res, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			nodes, err := client.PurgeTrash(h.nc, id, grace, userID)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.encodeTrash(res, nodes)
+
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+
+	case "restore":
+		if req.Method != http.MethodPost {
+			http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var nodeRestore NodeRestore
+		if err := decode(req.Body, &nodeRestore); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if h.forbidden(res, validUser, userID, nodeRestore.Parent) {
+			return
+		}
+
+		err := client.RestoreNode(h.nc, id, nodeRestore.Parent, userID)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		err = encode(res, data.StandardResponse{Success: true, ID: id})
+		if err != nil {
+			http.Error(res, "encoding error", http.StatusMethodNotAllowed)
+		}
+
 	case "parents":
 		switch req.Method {
 		case http.MethodPost:
@@ -201,7 +298,7 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 					return
 				}
 			} else {
-				err := client.DuplicateNode(h.nc, id, nodeCopy.NewParent, userID)
+				_, err := client.DuplicateNode(h.nc, id, nodeCopy.NewParent, userID)
 
 				if err != nil {
 					log.Println("Error duplicating node:", err)
@@ -268,6 +365,42 @@ type RequestValidator interface {
 	Valid(req *http.Request) (bool, string)
 }
 
+// userSees reports whether a node is one of those a user, or an API key, can
+// reach.
+func (h *Nodes) userSees(userID, id string) (bool, error) {
+	nodes, err := client.GetNodesForUser(h.nc, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range nodes {
+		if n.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// forbidden fails the request of a user or API key for a node it cannot
+// reach, and reports whether it did. The server's auth token reaches every
+// node.
+func (h *Nodes) forbidden(res http.ResponseWriter, validUser bool, userID, id string) bool {
+	if !validUser {
+		return false
+	}
+
+	ok, err := h.userSees(userID, id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if !ok {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return true
+	}
+
+	return false
+}
+
 func (h *Nodes) insertNode(res http.ResponseWriter, req *http.Request, userID string) {
 	var node data.NodeEdge
 	if err := decode(req.Body, &node); err != nil {
@@ -307,7 +440,8 @@ func (h *Nodes) processPoints(res http.ResponseWriter, req *http.Request, id, us
 		return
 	}
 
-	// populate origin for all points
+	// populate origin for all points. The origin is stored with each point
+	// and is how the audit trail knows which user made a change.
 	for i := range points {
 		points[i].Origin = userID
 		//points[i].Time = time.Now()
@@ -327,3 +461,66 @@ func (h *Nodes) processPoints(res http.ResponseWriter, req *http.Request, id, us
 		return
 	}
 }
+
+// audit returns the changes users made to a node. The query can set subtree
+// to include the nodes below it, start and end (RFC3339) to limit the time
+// range, and limit to return only the newest changes.
+func (h *Nodes) audit(res http.ResponseWriter, req *http.Request, id string) {
+	q := req.URL.Query()
+
+	subtree, _ := strconv.ParseBool(q.Get("subtree"))
+
+	var start, end time.Time
+	var limit int
+	var err error
+
+	if v := q.Get("start"); v != "" {
+		start, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(res, "invalid start: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := q.Get("end"); v != "" {
+		end, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(res, "invalid end: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(res, "invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := client.GetAudit(h.nc, id, subtree, start, end, limit)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if entries == nil {
+		entries = []data.AuditEntry{}
+	}
+
+	err = encode(res, entries)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *Nodes) encodeTrash(res http.ResponseWriter, nodes []data.TrashNode) {
+	if nodes == nil {
+		nodes = []data.TrashNode{}
+	}
+
+	err := encode(res, nodes)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,489 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// OIDCConfig configures login through an OpenID Connect identity provider.
+// Login is off unless Issuer and ClientID are set.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, which its discovery document is
+	// found under
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /v1/auth/oidc/callback as registered
+	// with the provider
+	RedirectURL string
+	// GroupsClaim is the ID token claim that lists the user's groups. The
+	// default is groups.
+	GroupsClaim string
+	// UserParent is the node users with none of the mapped groups are
+	// created under. Empty leaves such users out.
+	UserParent string
+}
+
+// Enabled reports whether OIDC login is configured.
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != "" && c.ClientID != ""
+}
+
+// oidcLoginTimeout is how long a user has at the provider to log in.
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcMaxPending is how many logins may be at the provider at once, so
+// requests to start one cannot grow the pending logins without bound.
+const oidcMaxPending = 1000
+
+// oidcStateCookie holds a login's state in the browser that started it. The
+// callback requires it, so a browser cannot be sent back with a login someone
+// else started and be signed in as them.
+const oidcStateCookie = "siot_oidc_state"
+
+// oidcKeysMinAge is how long the provider's signing keys are kept before
+// an ID token signed with an unknown key can fetch them again.
+const oidcKeysMinAge = time.Minute
+
+// oidcMeta is the part of the provider's discovery document the login uses.
+type oidcMeta struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcPending is a login sent to the provider and not yet back.
+type oidcPending struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// oidcHandler serves the OpenID Connect authorization code login. login
+// sends the user to the provider, with the login's state in a cookie, and the
+// provider sends it back to callback with a code. The code is exchanged for an ID token, which is checked against the
+// provider's keys, and the store signs the user in by email and issues the
+// same login token a password login gets.
+type oidcHandler struct {
+	cfg    OIDCConfig
+	client *http.Client
+	// signIn finds or creates the user of a checked login and returns its
+	// nodes and a JWT node
+	signIn func(data.OIDCLogin) ([]data.NodeEdge, error)
+
+	lock        sync.Mutex
+	meta        *oidcMeta
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	pending     map[string]oidcPending
+}
+
+func newOIDCHandler(cfg OIDCConfig, nc *nats.Conn) *oidcHandler {
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return &oidcHandler{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		signIn: func(l data.OIDCLogin) ([]data.NodeEdge, error) {
+			return client.OIDCUser(nc, l)
+		},
+		pending: make(map[string]oidcPending),
+	}
+}
+
+func (h *oidcHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	if req.Method != http.MethodGet {
+		http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch head {
+	case "login":
+		h.login(res, req)
+	case "callback":
+		h.callback(res, req)
+	default:
+		http.Error(res, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (h *oidcHandler) login(res http.ResponseWriter, req *http.Request) {
+	meta, err := h.discover()
+	if err != nil {
+		log.Println("OIDC:", err)
+		http.Error(res, "identity provider not reachable", http.StatusBadGateway)
+		return
+	}
+
+	state, err1 := randomToken()
+	nonce, err2 := randomToken()
+	verifier, err3 := randomToken()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	h.lock.Lock()
+	for s, p := range h.pending {
+		if now.After(p.expires) {
+			delete(h.pending, s)
+		}
+	}
+	if len(h.pending) >= oidcMaxPending {
+		h.lock.Unlock()
+		http.Error(res, "too many logins in progress, please try again later",
+			http.StatusServiceUnavailable)
+		return
+	}
+	h.pending[state] = oidcPending{
+		verifier: verifier,
+		nonce:    nonce,
+		expires:  now.Add(oidcLoginTimeout),
+	}
+	h.lock.Unlock()
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/v1/auth/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.cfg.RedirectURL, "https:"),
+		// the provider sends the browser back with a top level GET
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {h.cfg.ClientID},
+		"redirect_uri":          {h.cfg.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(res, req, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (h *oidcHandler) callback(res http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	if e := q.Get("error"); e != "" {
+		http.Error(res, "login refused by identity provider: "+e+" "+
+			q.Get("error_description"), http.StatusForbidden)
+		return
+	}
+
+	state := q.Get("state")
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(res, "login was not started in this browser, please log in again",
+			http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(res, &http.Cookie{Name: oidcStateCookie, Path: "/v1/auth/oidc",
+		MaxAge: -1})
+
+	h.lock.Lock()
+	p, ok := h.pending[state]
+	delete(h.pending, state)
+	h.lock.Unlock()
+
+	if !ok || time.Now().After(p.expires) {
+		http.Error(res, "unknown or expired login, please log in again",
+			http.StatusBadRequest)
+		return
+	}
+
+	login, err := h.exchange(q.Get("code"), p)
+	if err != nil {
+		log.Println("OIDC: login failed:", err)
+		http.Error(res, "invalid login", http.StatusForbidden)
+		return
+	}
+
+	nodes, err := h.signIn(login)
+	if err != nil {
+		log.Println("OIDC: sign in failed:", err)
+		http.Error(res, "invalid login", http.StatusForbidden)
+		return
+	}
+
+	var token string
+	for _, n := range nodes {
+		if n.Type == data.NodeTypeJWT {
+			token, _ = n.Points.Text(data.PointTypeToken, "")
+		}
+	}
+	if token == "" {
+		http.Error(res, "no login token", http.StatusInternalServerError)
+		return
+	}
+
+	auth := data.Auth{Token: token, Email: login.Email}
+
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		if err := encode(res, auth); err != nil {
+			log.Println("Error encoding:", err)
+		}
+		return
+	}
+
+	// hand the token to the web UI the way its own login stores it
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = oidcDone.Execute(res, map[string]any{"user": auth})
+	if err != nil {
+		log.Println("Error writing OIDC login page:", err)
+	}
+}
+
+var oidcDone = template.Must(template.New("oidc").Parse(`<!DOCTYPE html>
+<html><body><script>
+localStorage.setItem("storage", JSON.stringify({{.}}));
+window.location.replace("/");
+</script></body></html>
+`))
+
+// exchange trades a code for an ID token, checks it, and returns the login
+// it is for.
+func (h *oidcHandler) exchange(code string, p oidcPending) (data.OIDCLogin, error) {
+	meta, err := h.discover()
+	if err != nil {
+		return data.OIDCLogin{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {h.cfg.RedirectURL},
+		"client_id":     {h.cfg.ClientID},
+		"code_verifier": {p.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return data.OIDCLogin{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if h.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(h.cfg.ClientID), url.QueryEscape(h.cfg.ClientSecret))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return data.OIDCLogin{}, fmt.Errorf("error exchanging code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tok)
+	if err != nil {
+		return data.OIDCLogin{}, fmt.Errorf("error decoding token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return data.OIDCLogin{}, fmt.Errorf("token endpoint returned %v %v", resp.Status, tok.Error)
+	}
+
+	return h.verify(tok.IDToken, meta.Issuer, p.nonce)
+}
+
+// verify checks an ID token's signature, issuer, audience, expiry and nonce,
+// and reads the login from its claims.
+func (h *oidcHandler) verify(idToken, issuer, nonce string) (data.OIDCLogin, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(t *jwt.Token) (any, error) {
+		if t.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		return h.key(kid)
+	})
+	if err != nil {
+		return data.OIDCLogin{}, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	if !claims.VerifyIssuer(issuer, true) {
+		return data.OIDCLogin{}, fmt.Errorf("ID token from issuer %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(h.cfg.ClientID, true) {
+		return data.OIDCLogin{}, errors.New("ID token is for another client")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return data.OIDCLogin{}, errors.New("ID token nonce does not match")
+	}
+	// the user is matched by email, so an email the provider has not
+	// verified could sign in as anyone
+	if v, _ := claims["email_verified"].(bool); !v {
+		return data.OIDCLogin{}, errors.New("email is not verified")
+	}
+
+	l := data.OIDCLogin{Parent: h.cfg.UserParent}
+	l.Email, _ = claims["email"].(string)
+	l.FirstName, _ = claims["given_name"].(string)
+	l.LastName, _ = claims["family_name"].(string)
+
+	switch g := claims[h.cfg.GroupsClaim].(type) {
+	case string:
+		l.Groups = []string{g}
+	case []any:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				l.Groups = append(l.Groups, s)
+			}
+		}
+	}
+
+	if l.Email == "" {
+		return data.OIDCLogin{}, errors.New("ID token has no email")
+	}
+
+	return l, nil
+}
+
+// discover fetches the provider's discovery document, once.
+func (h *oidcHandler) discover() (oidcMeta, error) {
+	h.lock.Lock()
+	meta := h.meta
+	h.lock.Unlock()
+	if meta != nil {
+		return *meta, nil
+	}
+
+	u := strings.TrimSuffix(h.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var m oidcMeta
+	if err := h.getJSON(u, &m); err != nil {
+		return oidcMeta{}, fmt.Errorf("error getting discovery document: %v", err)
+	}
+	if m.Issuer != h.cfg.Issuer {
+		return oidcMeta{}, fmt.Errorf("discovery document is for issuer %v, not %v",
+			m.Issuer, h.cfg.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JwksURI == "" {
+		return oidcMeta{}, errors.New("discovery document is missing endpoints")
+	}
+
+	h.lock.Lock()
+	h.meta = &m
+	h.lock.Unlock()
+
+	return m, nil
+}
+
+// key returns the provider's signing key with ID kid, fetching the keys again
+// when it is not known, since providers rotate them.
+func (h *oidcHandler) key(kid string) (*rsa.PublicKey, error) {
+	h.lock.Lock()
+	k, ok := h.keys[kid]
+	stale := time.Since(h.keysFetched) > oidcKeysMinAge
+	h.lock.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	meta, err := h.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := h.getJSON(meta.JwksURI, &set); err != nil {
+		return nil, fmt.Errorf("error getting signing keys: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jk := range set.Keys {
+		if jk.Kty != "RSA" || (jk.Use != "" && jk.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(jk.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(jk.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		keys[jk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	h.lock.Lock()
+	h.keys = keys
+	h.keysFetched = time.Now()
+	h.lock.Unlock()
+
+	k, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+func (h *oidcHandler) getJSON(u string, v any) error {
+	resp, err := h.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// randomToken returns a random URL safe string for a state, nonce or PKCE
+// verifier.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// mockIdP is a minimal OpenID Connect provider. Its authorize endpoint logs
+// in straight away and sends the browser back with a code.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// claims are added to the ID token, and may override the defaults
+	claims jwt.MapClaims
+	// signer signs ID tokens, the provider's key by default
+	signer *rsa.PrivateKey
+
+	nonces    map[string]string
+	challenge map[string]string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+
+	idp := &mockIdP{key: key, signer: key, claims: jwt.MapClaims{},
+		nonces: make(map[string]string), challenge: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcMeta{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JwksURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(e),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := "code-" + q.Get("state")
+		idp.nonces[code] = q.Get("nonce")
+		idp.challenge[code] = q.Get("code_challenge")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{
+			"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "siot" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		code := r.PostFormValue("code")
+		nonce, ok := idp.nonces[code]
+		if !ok || pkceChallenge(r.PostFormValue("code_verifier")) != idp.challenge[code] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":            idp.URL,
+			"aud":            "siot",
+			"sub":            "1234",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          nonce,
+			"email":          "Jo@example.com",
+			"email_verified": true,
+			"given_name":     "Jo",
+			"family_name":    "Doe",
+			"groups":         []string{"eng", "ops"},
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "k1"
+		signed, err := tok.SignedString(idp.signer)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "at", "token_type": "Bearer", "id_token": signed})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// oidcLogin runs a login through the handler and the provider, and returns
+// the callback's response. asJSON asks for the token as JSON rather than the
+// web UI's login page.
+func oidcLogin(t *testing.T, h *oidcHandler, asJSON bool) *httptest.ResponseRecorder {
+	t.Helper()
+	return oidcLoginFrom(t, h, asJSON, true)
+}
+
+// oidcLoginFrom is oidcLogin, with the login's state cookie sent back only if
+// sameBrowser is set.
+func oidcLoginFrom(t *testing.T, h *oidcHandler, asJSON, sameBrowser bool) *httptest.ResponseRecorder {
+	t.Helper()
+
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if res.Code != http.StatusFound {
+		t.Fatalf("login returned %v: %v", res.Code, res.Body)
+	}
+	cookies := res.Result().Cookies()
+
+	// follow the provider's redirect back, without following the one to
+	// the callback
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := c.Get(res.Header().Get("Location"))
+	if err != nil {
+		t.Fatal("Error logging in at provider:", err)
+	}
+	resp.Body.Close()
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal("Error parsing callback:", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?"+back.RawQuery, nil)
+	if sameBrowser {
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+	}
+	if asJSON {
+		req.Header.Set("Accept", "application/json")
+	}
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	return res
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+
+	h := newOIDCHandler(OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "siot",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://siot.local/v1/auth/oidc/callback",
+		UserParent:   "root",
+	}, nil)
+
+	var got data.OIDCLogin
+	h.signIn = func(l data.OIDCLogin) ([]data.NodeEdge, error) {
+		got = l
+		if l.Email == "nobody@example.com" {
+			return nil, errors.New("refused")
+		}
+		return []data.NodeEdge{
+			{ID: "user", Type: data.NodeTypeUser},
+			{Type: data.NodeTypeJWT, Points: data.Points{
+				data.NewPointString(data.PointTypeToken, "0", "jwt")}},
+		}, nil
+	}
+
+	res := oidcLogin(t, h, true)
+	if res.Code != http.StatusOK {
+		t.Fatalf("callback returned %v: %v", res.Code, res.Body)
+	}
+	var auth data.Auth
+	if err := json.NewDecoder(res.Body).Decode(&auth); err != nil {
+		t.Fatal("Error decoding auth:", err)
+	}
+	if auth.Token != "jwt" || auth.Email != "Jo@example.com" {
+		t.Errorf("wrong auth: %+v", auth)
+	}
+	if got.FirstName != "Jo" || got.LastName != "Doe" || got.Parent != "root" ||
+		strings.Join(got.Groups, ",") != "eng,ops" {
+		t.Errorf("wrong login: %+v", got)
+	}
+
+	// a callback cannot be replayed
+	res = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/callback?state=x&code=y", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "x"})
+	h.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("unknown state returned %v", res.Code)
+	}
+
+	// nor finished in a browser that did not start it
+	res = oidcLoginFrom(t, h, true, false)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("login from another browser returned %v", res.Code)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		signer bool
+	}{
+		{"wrong nonce", jwt.MapClaims{"nonce": "other"}, false},
+		{"wrong audience", jwt.MapClaims{"aud": "other"}, false},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com"}, false},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, false},
+		{"unverified email", jwt.MapClaims{"email_verified": false}, false},
+		{"email not said to be verified", jwt.MapClaims{"email_verified": nil}, false},
+		{"refused by store", jwt.MapClaims{"email": "nobody@example.com"}, false},
+		{"wrong signature", nil, true},
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+
+	for _, test := range tests {
+		idp.claims = test.claims
+		idp.signer = idp.key
+		if test.signer {
+			idp.signer = other
+		}
+		res := oidcLogin(t, h, true)
+		if res.Code != http.StatusForbidden {
+			t.Errorf("%v: callback returned %v", test.name, res.Code)
+		}
+	}
+}
+
+func TestOIDCLoginPage(t *testing.T) {
+	idp := newMockIdP(t)
+
+	h := newOIDCHandler(OIDCConfig{Issuer: idp.URL, ClientID: "siot",
+		ClientSecret: "s3cret", RedirectURL: "http://siot.local/cb"}, nil)
+	h.signIn = func(data.OIDCLogin) ([]data.NodeEdge, error) {
+		return []data.NodeEdge{{Type: data.NodeTypeJWT, Points: data.Points{
+			data.NewPointString(data.PointTypeToken, "0", `a"</script>`)}}}, nil
+	}
+
+	res := oidcLogin(t, h, false)
+	body := res.Body.String()
+	if res.Code != http.StatusOK || !strings.Contains(body, `localStorage.setItem("storage"`) {
+		t.Fatalf("callback returned %v: %v", res.Code, body)
+	}
+	if strings.Contains(body, `a"</script>`) {
+		t.Error("token not escaped in login page")
+	}
+}
+
+func TestOIDCLoginPending(t *testing.T) {
+	idp := newMockIdP(t)
+
+	h := newOIDCHandler(OIDCConfig{Issuer: idp.URL, ClientID: "siot",
+		RedirectURL: "https://siot.local/v1/auth/oidc/callback"}, nil)
+
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if res.Code != http.StatusFound {
+		t.Fatalf("login returned %v: %v", res.Code, res.Body)
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure ||
+		cookies[0].MaxAge <= 0 {
+		t.Fatalf("wrong state cookie: %+v", cookies)
+	}
+
+	for len(h.pending) < oidcMaxPending {
+		h.pending[strconv.Itoa(len(h.pending))] = oidcPending{
+			expires: time.Now().Add(time.Minute)}
+	}
+
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("login past the limit returned %v", res.Code)
+	}
+}
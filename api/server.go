@@ -9,12 +9,16 @@ import (
 
 	"github.com/koding/websocketproxy"
 	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
 )
 
 // App is a struct that implements http.Handler interface
 type App struct {
 	PublicHandler  http.Handler
 	V1ApiHandler   http.Handler
+	V2ApiHandler   http.Handler
+	InfluxHandler  http.Handler
+	MetricsHandler http.Handler
 	WebsocketProxy http.Handler
 }
 
@@ -31,6 +35,8 @@ func (h *App) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	case "/sign-in":
 		req.URL.Path = "/"
 		h.PublicHandler.ServeHTTP(res, req)
+	case "/metrics":
+		h.MetricsHandler.ServeHTTP(res, req)
 
 	default:
 		head, path := ShiftPath(req.URL.Path)
@@ -38,6 +44,16 @@ func (h *App) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		case "v1":
 			req.URL.Path = path
 			h.V1ApiHandler.ServeHTTP(res, req)
+		case "v2":
+			req.URL.Path = path
+			h.V2ApiHandler.ServeHTTP(res, req)
+		case "api":
+			// the InfluxDB 2 write API
+			if path != "/v2/write" {
+				http.Error(res, "Not Found", http.StatusNotFound)
+				return
+			}
+			h.InfluxHandler.ServeHTTP(res, req)
 		default:
 			h.PublicHandler.ServeHTTP(res, req)
 		}
@@ -52,6 +68,11 @@ func NewAppHandler(args ServerArgs) http.Handler {
 		v1 = NewHTTPLogger("v1").Handler(v1)
 	}
 
+	v2 := NewV2Handler(args)
+	if args.Debug {
+		v2 = NewHTTPLogger("v2").Handler(v2)
+	}
+
 	var wsProxy http.Handler
 
 	if args.NatsWSPort > 0 {
@@ -65,8 +86,13 @@ func NewAppHandler(args ServerArgs) http.Handler {
 	}
 
 	return &App{
-		PublicHandler:  http.FileServer(args.Filesystem),
-		V1ApiHandler:   v1,
+		PublicHandler: http.FileServer(args.Filesystem),
+		V1ApiHandler:  v1,
+		V2ApiHandler:  v2,
+		InfluxHandler: NewInfluxWriteHandler(args.JwtAuth, args.AuthToken, args.Nc,
+			args.CanWrite),
+		MetricsHandler: NewMetricsHandler(args.JwtAuth, args.AuthToken, args.Nc,
+			args.CanWrite, args.Metrics),
 		WebsocketProxy: wsProxy,
 	}
 }
@@ -80,6 +106,13 @@ type ServerArgs struct {
 	AuthToken  string
 	NatsWSPort int
 	Nc         *nats.Conn
+	// OIDC configures login through an OpenID Connect identity provider
+	OIDC OIDCConfig
+	// CanWrite reports whether a user or API key may write to a node through
+	// a client, such as an ingest node
+	CanWrite func(principal, nodeID string) bool
+	// Metrics returns the internal metrics of the instance for /metrics
+	Metrics func() []client.PromMetric
 }
 
 // Server represents the HTTP API server
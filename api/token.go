@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// tokenPrincipal returns the user or API key a request for a tool, such as a
+// collector writing points or Prometheus scraping them, is authorized by. It
+// is blank when the request bears the server's auth token, or no token when
+// the server has none. Tools send the token as "Token <token>", as InfluxDB
+// clients do, or as "Bearer <token>".
+func tokenPrincipal(req *http.Request, check Authorizer, authToken string) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if auth == authToken {
+		return "", true
+	}
+
+	scheme, token, _ := strings.Cut(auth, " ")
+	if scheme != "Token" && scheme != "Bearer" {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	if authToken != "" && token == authToken {
+		return "", true
+	}
+
+	valid, principal := check.ValidToken(token)
+	if !valid || principal == "" {
+		return "", false
+	}
+	return principal, true
+}
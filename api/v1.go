@@ -31,7 +31,7 @@ func (h *V1) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 func NewV1Handler(args ServerArgs) http.Handler {
 	return &V1{
 		NodesHandler: NewNodesHandler(args.JwtAuth,
-			args.AuthToken, args.Nc),
-		AuthHandler: NewAuthHandler(args.Nc),
+			args.AuthToken, args.Nc, args.CanWrite),
+		AuthHandler: NewAuthHandler(args.Nc, args.OIDC),
 	}
 }
@@ -0,0 +1,791 @@
+package api
+
+import (
+	_ "embed" // the OpenAPI document
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// OpenAPI is the OpenAPI document describing the v2 API, served at
+// /v2/openapi.json.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Page sizes of the v2 node list and point history.
+const (
+	v2DefaultLimit        = 100
+	v2MaxLimit            = 1000
+	v2DefaultHistoryLimit = 1000
+	v2MaxHistoryLimit     = 10000
+)
+
+// v2MaxBody bounds the JSON body of a v2 request.
+const v2MaxBody = 4 << 20
+
+// V2 handles v2 api requests. Unlike v1, every route is described by the
+// OpenAPI document, and every error is returned as a JSON v2Error.
+type V2 struct {
+	check     Authorizer
+	nc        *nats.Conn
+	authToken string
+}
+
+// NewV2Handler returns a handler for the V2 API
+func NewV2Handler(args ServerArgs) http.Handler {
+	return &V2{args.JwtAuth, args.Nc, args.AuthToken}
+}
+
+// v2Error is the body of every v2 error response. Code is one of a small set
+// of strings a program can switch on, and Details lists each invalid field of
+// a request that failed validation.
+type v2Error struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details []v2FieldError `json:"details,omitempty"`
+}
+
+// v2FieldError is one invalid field of a request, such as points[2].type.
+type v2FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// v2NodeList is a page of nodes. Next is the cursor of the following page,
+// and is blank on the last.
+type v2NodeList struct {
+	Nodes []data.NodeEdge `json:"nodes"`
+	Next  string          `json:"next,omitempty"`
+}
+
+// v2NewNode is the body of a node create.
+type v2NewNode struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Parent     string      `json:"parent"`
+	Points     data.Points `json:"points"`
+	EdgePoints data.Points `json:"edgePoints"`
+}
+
+// v2Move is the body of a node move. From may be left out when the node has
+// one parent.
+type v2Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// v2Copy is the body of a node copy. A copy adds the node under another
+// parent, so it appears in both places, and a duplicate creates a new node,
+// and new nodes for everything below it.
+type v2Copy struct {
+	To        string `json:"to"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// v2History is the point history of a node.
+type v2History struct {
+	Points data.Points `json:"points"`
+}
+
+func (h *V2) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+
+	switch head {
+	case "openapi.json":
+		if req.URL.Path != "/" {
+			v2Fail(res, http.StatusNotFound, "not_found", "Not Found")
+			return
+		}
+		if !v2Allow(res, req, http.MethodGet) {
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write(OpenAPI)
+		return
+	case "nodes":
+	default:
+		v2Fail(res, http.StatusNotFound, "not_found", "Not Found")
+		return
+	}
+
+	principal, ok := tokenPrincipal(req, h.check, h.authToken)
+	if !ok {
+		v2Fail(res, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	c := &v2Call{V2: h, res: res, req: req, principal: principal}
+
+	var id, verb string
+	id, req.URL.Path = ShiftPath(req.URL.Path)
+	verb, req.URL.Path = ShiftPath(req.URL.Path)
+	if req.URL.Path != "/" {
+		v2Fail(res, http.StatusNotFound, "not_found", "Not Found")
+		return
+	}
+
+	switch {
+	case id == "":
+		if !v2Allow(res, req, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if req.Method == http.MethodGet {
+			c.listNodes()
+		} else {
+			c.createNode()
+		}
+	case verb == "":
+		if !v2Allow(res, req, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if req.Method == http.MethodGet {
+			c.getNode(id)
+		} else {
+			c.deleteNode(id)
+		}
+	case verb == "points":
+		if v2Allow(res, req, http.MethodPost) {
+			c.writePoints(id)
+		}
+	case verb == "move":
+		if v2Allow(res, req, http.MethodPost) {
+			c.moveNode(id)
+		}
+	case verb == "copy":
+		if v2Allow(res, req, http.MethodPost) {
+			c.copyNode(id)
+		}
+	case verb == "history":
+		if v2Allow(res, req, http.MethodGet) {
+			c.history(id)
+		}
+	default:
+		v2Fail(res, http.StatusNotFound, "not_found", "Not Found")
+	}
+}
+
+// v2Call is one v2 request, by a user or API key, or by the server's auth
+// token when principal is blank.
+type v2Call struct {
+	*V2
+	res       http.ResponseWriter
+	req       *http.Request
+	principal string
+
+	reachable map[string]bool
+}
+
+// sees reports whether the caller can reach a node, as in the v1 events
+// route. The server's auth token reaches everything.
+func (c *v2Call) sees(id string) (bool, error) {
+	if c.principal == "" {
+		return true, nil
+	}
+
+	if c.reachable == nil {
+		nodes, err := client.GetNodesForUser(c.nc, c.principal)
+		if err != nil {
+			return false, err
+		}
+		c.reachable = make(map[string]bool, len(nodes))
+		for _, n := range nodes {
+			c.reachable[n.ID] = true
+		}
+	}
+
+	return c.reachable[id], nil
+}
+
+// instances returns the living instances of a node, one per parent, sorted by
+// parent. It checks that the caller can reach the node, and has failed the
+// request when ok is false.
+func (c *v2Call) instances(id string) (nodes []data.NodeEdge, ok bool) {
+	sees, err := c.sees(id)
+	if err != nil {
+		c.storeFail(err)
+		return nil, false
+	}
+	if !sees {
+		v2Fail(c.res, http.StatusForbidden, "forbidden", "node "+id+" is not reachable")
+		return nil, false
+	}
+
+	nodes, err = client.GetNodes(c.nc, "all", id, "", false)
+	if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+		c.storeFail(err)
+		return nil, false
+	}
+	if len(nodes) == 0 {
+		v2Fail(c.res, http.StatusNotFound, "not_found", "node "+id+" not found")
+		return nil, false
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Parent < nodes[j].Parent })
+	return nodes, true
+}
+
+// field checks a node ID given as a field of the request, which must be set
+// and name a node the caller can reach. It adds to details when it is not.
+func (c *v2Call) field(name, id string, details *[]v2FieldError) error {
+	if id == "" {
+		*details = append(*details, v2FieldError{name, "is required"})
+		return nil
+	}
+
+	sees, err := c.sees(id)
+	if err != nil {
+		return err
+	}
+	if sees {
+		nodes, err := client.GetNodes(c.nc, "all", id, "", false)
+		if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+			return err
+		}
+		if len(nodes) > 0 {
+			return nil
+		}
+	}
+
+	*details = append(*details, v2FieldError{name, "node " + id + " not found"})
+	return nil
+}
+
+func (c *v2Call) listNodes() {
+	q := c.req.URL.Query()
+
+	var details []v2FieldError
+	limit := v2Limit(q.Get("limit"), "limit", v2DefaultLimit, v2MaxLimit, &details)
+
+	var after []string
+	if v := q.Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		after = strings.Split(string(b), "\n")
+		if err != nil || len(after) != 2 {
+			details = append(details, v2FieldError{"cursor", "is not a cursor this API returned"})
+		}
+	}
+
+	parent, subtree := q.Get("parent"), q.Get("subtree")
+	if parent != "" && subtree != "" {
+		details = append(details, v2FieldError{"subtree", "may not be given with parent"})
+	}
+
+	deleted, err := strconv.ParseBool(q.Get("deleted"))
+	if q.Get("deleted") != "" && (err != nil || parent == "") {
+		details = append(details, v2FieldError{"deleted", "must be true or false, and given with parent"})
+	}
+
+	if len(details) > 0 {
+		v2Fail(c.res, http.StatusBadRequest, "bad_request", "invalid query", details...)
+		return
+	}
+
+	var nodes []data.NodeEdge
+
+	switch {
+	case parent != "":
+		if _, ok := c.instances(parent); !ok {
+			return
+		}
+		nodes, err = client.GetNodes(c.nc, parent, "all", "", deleted)
+	case subtree != "":
+		if _, ok := c.instances(subtree); !ok {
+			return
+		}
+		nodes, err = client.GetSubtree(c.nc, subtree)
+	case c.principal != "":
+		nodes, err = client.GetNodesForUser(c.nc, c.principal)
+	default:
+		var root data.NodeEdge
+		root, err = client.GetRootNode(c.nc)
+		if err == nil {
+			nodes, err = client.GetSubtree(c.nc, root.ID)
+		}
+	}
+	if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+		c.storeFail(err)
+		return
+	}
+
+	types := q["type"]
+	desc := strings.ToLower(q.Get("description"))
+
+	nodes = slices.DeleteFunc(nodes, func(n data.NodeEdge) bool {
+		return (len(types) > 0 && !slices.Contains(types, n.Type)) ||
+			(desc != "" && !strings.Contains(strings.ToLower(n.Desc()), desc))
+	})
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].ID != nodes[j].ID {
+			return nodes[i].ID < nodes[j].ID
+		}
+		return nodes[i].Parent < nodes[j].Parent
+	})
+
+	if after != nil {
+		i := sort.Search(len(nodes), func(i int) bool {
+			return nodes[i].ID > after[0] ||
+				(nodes[i].ID == after[0] && nodes[i].Parent > after[1])
+		})
+		nodes = nodes[i:]
+	}
+
+	ret := v2NodeList{Nodes: nodes}
+	if len(nodes) > limit {
+		ret.Nodes = nodes[:limit]
+		last := nodes[limit-1]
+		ret.Next = base64.RawURLEncoding.EncodeToString([]byte(last.ID + "\n" + last.Parent))
+	}
+	if ret.Nodes == nil {
+		ret.Nodes = []data.NodeEdge{}
+	}
+
+	v2Write(c.res, http.StatusOK, ret)
+}
+
+func (c *v2Call) getNode(id string) {
+	nodes, ok := c.instances(id)
+	if !ok {
+		return
+	}
+
+	node := nodes[0]
+	if parent := c.req.URL.Query().Get("parent"); parent != "" {
+		i := slices.IndexFunc(nodes, func(n data.NodeEdge) bool { return n.Parent == parent })
+		if i < 0 {
+			v2Fail(c.res, http.StatusNotFound, "not_found",
+				"node "+id+" is not under "+parent)
+			return
+		}
+		node = nodes[i]
+	}
+
+	v2Write(c.res, http.StatusOK, node)
+}
+
+func (c *v2Call) createNode() {
+	var n v2NewNode
+	if !c.decode(&n) {
+		return
+	}
+
+	var details []v2FieldError
+	if n.Type == "" {
+		details = append(details, v2FieldError{"type", "is required"})
+	} else if !v2Token(n.Type) {
+		details = append(details, v2FieldError{"type", v2TokenMessage})
+	}
+	if n.ID != "" && !v2Token(n.ID) {
+		details = append(details, v2FieldError{"id", v2TokenMessage})
+	}
+	details = append(details, v2CheckPoints("points", n.Points)...)
+	details = append(details, v2CheckPoints("edgePoints", n.EdgePoints)...)
+
+	if err := c.field("parent", n.Parent, &details); err != nil {
+		c.storeFail(err)
+		return
+	}
+	if len(details) > 0 {
+		v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "invalid node", details...)
+		return
+	}
+
+	if n.ID == "" {
+		n.ID = uuid.New().String()
+	} else {
+		existing, err := client.GetNodes(c.nc, "all", n.ID, "", false)
+		if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+			c.storeFail(err)
+			return
+		}
+		if len(existing) > 0 {
+			v2Fail(c.res, http.StatusConflict, "conflict", "node "+n.ID+" already exists")
+			return
+		}
+	}
+
+	node := data.NodeEdge{ID: n.ID, Type: n.Type, Parent: n.Parent,
+		Points: c.origin(n.Points), EdgePoints: c.origin(n.EdgePoints)}
+
+	if err := client.SendNode(c.nc, node, c.principal); err != nil {
+		c.storeFail(err)
+		return
+	}
+
+	c.writeNode(http.StatusCreated, n.ID, n.Parent)
+}
+
+func (c *v2Call) deleteNode(id string) {
+	nodes, ok := c.instances(id)
+	if !ok {
+		return
+	}
+
+	parent, ok := c.parent(id, c.req.URL.Query().Get("parent"), "parent", nodes)
+	if !ok {
+		return
+	}
+
+	if err := client.DeleteNode(c.nc, id, parent, c.principal); err != nil {
+		c.storeFail(err)
+		return
+	}
+
+	c.res.WriteHeader(http.StatusNoContent)
+}
+
+func (c *v2Call) writePoints(id string) {
+	if _, ok := c.instances(id); !ok {
+		return
+	}
+
+	var points data.Points
+	if !c.decode(&points) {
+		return
+	}
+
+	details := v2CheckPoints("", points)
+	if len(points) == 0 {
+		details = append(details, v2FieldError{"", "no points were given"})
+	}
+	if len(details) > 0 {
+		v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "invalid points", details...)
+		return
+	}
+
+	if err := client.SendNodePoints(c.nc, id, c.origin(points), true); err != nil {
+		c.storeFail(err)
+		return
+	}
+
+	c.res.WriteHeader(http.StatusNoContent)
+}
+
+func (c *v2Call) moveNode(id string) {
+	nodes, ok := c.instances(id)
+	if !ok {
+		return
+	}
+
+	var m v2Move
+	if !c.decode(&m) {
+		return
+	}
+
+	from, ok := c.parent(id, m.From, "from", nodes)
+	if !ok {
+		return
+	}
+
+	var details []v2FieldError
+	if err := c.field("to", m.To, &details); err != nil {
+		c.storeFail(err)
+		return
+	}
+	if len(details) == 0 {
+		if err := c.placeable(id, m.To, "to", &details); err != nil {
+			c.storeFail(err)
+			return
+		}
+	}
+	if len(details) == 0 && m.To == from {
+		details = append(details, v2FieldError{"to", "is the parent the node is under"})
+	}
+	if len(details) > 0 {
+		v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "invalid move", details...)
+		return
+	}
+
+	if err := client.MoveNode(c.nc, id, from, m.To, c.principal); err != nil {
+		c.storeFail(err)
+		return
+	}
+
+	c.writeNode(http.StatusOK, id, m.To)
+}
+
+func (c *v2Call) copyNode(id string) {
+	nodes, ok := c.instances(id)
+	if !ok {
+		return
+	}
+
+	var cp v2Copy
+	if !c.decode(&cp) {
+		return
+	}
+
+	var details []v2FieldError
+	if err := c.field("to", cp.To, &details); err != nil {
+		c.storeFail(err)
+		return
+	}
+	if len(details) == 0 {
+		if err := c.placeable(id, cp.To, "to", &details); err != nil {
+			c.storeFail(err)
+			return
+		}
+	}
+	if len(details) > 0 {
+		v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "invalid copy", details...)
+		return
+	}
+
+	copyID := id
+	if cp.Duplicate {
+		var err error
+		copyID, err = client.DuplicateNode(c.nc, id, cp.To, c.principal)
+		if err != nil {
+			c.storeFail(err)
+			return
+		}
+	} else {
+		if slices.ContainsFunc(nodes, func(n data.NodeEdge) bool { return n.Parent == cp.To }) {
+			v2Fail(c.res, http.StatusConflict, "conflict", "node "+id+" is already under "+cp.To)
+			return
+		}
+		if err := client.MirrorNode(c.nc, id, cp.To, c.principal); err != nil {
+			c.storeFail(err)
+			return
+		}
+	}
+
+	c.writeNode(http.StatusCreated, copyID, cp.To)
+}
+
+func (c *v2Call) history(id string) {
+	if _, ok := c.instances(id); !ok {
+		return
+	}
+
+	q := c.req.URL.Query()
+
+	var details []v2FieldError
+	limit := v2Limit(q.Get("limit"), "limit", v2DefaultHistoryLimit, v2MaxHistoryLimit, &details)
+	start := v2Time(q.Get("start"), "start", &details)
+	end := v2Time(q.Get("end"), "end", &details)
+
+	typ, key := q.Get("type"), q.Get("key")
+	if !v2Token(typ) && typ != "" {
+		details = append(details, v2FieldError{"type", v2TokenMessage})
+	}
+	if !v2Token(key) && key != "" {
+		details = append(details, v2FieldError{"key", v2TokenMessage})
+	}
+
+	if len(details) > 0 {
+		v2Fail(c.res, http.StatusBadRequest, "bad_request", "invalid query", details...)
+		return
+	}
+
+	points, err := client.GetHistory(c.nc, id, typ, key, start, end, limit)
+	if err != nil {
+		c.storeFail(err)
+		return
+	}
+	if points == nil {
+		points = data.Points{}
+	}
+
+	v2Write(c.res, http.StatusOK, v2History{points})
+}
+
+// parent returns the parent of a node an operation applies to: the one given,
+// which must be one the node is under, or when none is, the only one.
+func (c *v2Call) parent(id, given, name string, nodes []data.NodeEdge) (string, bool) {
+	if given == "" {
+		if len(nodes) > 1 {
+			v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "the node is under several parents",
+				v2FieldError{name, fmt.Sprintf("is required, as node %v has %v parents", id, len(nodes))})
+			return "", false
+		}
+		given = nodes[0].Parent
+	} else if !slices.ContainsFunc(nodes, func(n data.NodeEdge) bool { return n.Parent == given }) {
+		v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "invalid parent",
+			v2FieldError{name, "node " + id + " is not under " + given})
+		return "", false
+	}
+
+	if given == "root" || given == "none" {
+		v2Fail(c.res, http.StatusUnprocessableEntity, "invalid", "the root node cannot be changed",
+			v2FieldError{name, "is the top of the tree"})
+		return "", false
+	}
+
+	return given, true
+}
+
+// placeable checks that a node can be placed under a new parent: one that is
+// not the node, or below it. It adds to details when it cannot.
+func (c *v2Call) placeable(id, to, name string, details *[]v2FieldError) error {
+	below, err := client.GetSubtree(c.nc, id)
+	if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+		return err
+	}
+
+	if slices.ContainsFunc(below, func(n data.NodeEdge) bool { return n.ID == to }) {
+		*details = append(*details, v2FieldError{name, "is the node or below it"})
+	}
+	return nil
+}
+
+// origin records the caller as the origin of points, as v1 does, so the store
+// checks its role and the audit trail knows who made the change.
+func (c *v2Call) origin(points data.Points) data.Points {
+	for i := range points {
+		points[i].Origin = c.principal
+	}
+	return points
+}
+
+// decode reads a JSON request body, failing the request when it cannot.
+func (c *v2Call) decode(v any) bool {
+	d := json.NewDecoder(http.MaxBytesReader(c.res, c.req.Body, v2MaxBody))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			v2Fail(c.res, http.StatusRequestEntityTooLarge, "too_large",
+				fmt.Sprintf("the body is larger than %v bytes", maxBytes.Limit))
+			return false
+		}
+		if errors.Is(err, io.EOF) {
+			err = errors.New("the body is empty")
+		}
+		v2Fail(c.res, http.StatusBadRequest, "bad_request", "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeNode responds with a node under a parent, and its location.
+func (c *v2Call) writeNode(status int, id, parent string) {
+	nodes, err := client.GetNodes(c.nc, parent, id, "", false)
+	if err != nil || len(nodes) == 0 {
+		if err == nil {
+			err = data.ErrDocumentNotFound
+		}
+		c.storeFail(fmt.Errorf("error reading node back: %w", err))
+		return
+	}
+
+	c.res.Header().Set("Location", "/v2/nodes/"+id)
+	v2Write(c.res, status, nodes[0])
+}
+
+// storeFail fails a request with an error from the store, or from the NATS
+// request that reached it.
+func (c *v2Call) storeFail(err error) {
+	switch {
+	case errors.Is(err, nats.ErrNoResponders), errors.Is(err, nats.ErrTimeout):
+		v2Fail(c.res, http.StatusServiceUnavailable, "unavailable", err.Error())
+	case strings.Contains(err.Error(), "not authorized"):
+		v2Fail(c.res, http.StatusForbidden, "forbidden", err.Error())
+	default:
+		log.Println("v2 API:", c.req.Method, c.req.URL, err)
+		v2Fail(c.res, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
+
+// v2Allow fails a request whose method is not one of those a route takes.
+func v2Allow(res http.ResponseWriter, req *http.Request, methods ...string) bool {
+	if slices.Contains(methods, req.Method) {
+		return true
+	}
+	res.Header().Set("Allow", strings.Join(methods, ", "))
+	v2Fail(res, http.StatusMethodNotAllowed, "method_not_allowed",
+		req.Method+" is not allowed, only "+strings.Join(methods, ", "))
+	return false
+}
+
+func v2Fail(res http.ResponseWriter, status int, code, msg string, details ...v2FieldError) {
+	v2Write(res, status, v2Error{Code: code, Message: msg, Details: details})
+}
+
+func v2Write(res http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(v2Error{Code: "internal", Message: "encoding error: " + err.Error()})
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	_, _ = res.Write(append(b, '\n'))
+}
+
+// v2TokenMessage explains why a node ID, type, or point type or key was
+// refused.
+const v2TokenMessage = "may not contain periods, spaces, '*' or '>'"
+
+// v2Token reports whether s may be used in a NATS subject, as node IDs and
+// types, and point types and keys, are.
+func v2Token(s string) bool {
+	return data.SubjectSafeToken(s) == s
+}
+
+// v2CheckPoints validates the points of a write, naming each invalid field
+// by its index, under the field name of the list.
+func v2CheckPoints(name string, points data.Points) []v2FieldError {
+	var ret []v2FieldError
+	for i, p := range points {
+		f := fmt.Sprintf("%v[%v].", name, i)
+		switch {
+		case p.Type == "":
+			ret = append(ret, v2FieldError{f + "type", "is required"})
+		case !v2Token(p.Type):
+			ret = append(ret, v2FieldError{f + "type", v2TokenMessage})
+		}
+		if !v2Token(p.Key) {
+			ret = append(ret, v2FieldError{f + "key", v2TokenMessage})
+		}
+		if p.Tombstone < 0 {
+			ret = append(ret, v2FieldError{f + "tombstone", "may not be negative"})
+		}
+		if p.DataType > data.PointDataTypeJSON {
+			ret = append(ret, v2FieldError{f + "dataType", "is not a known data type"})
+		}
+	}
+	return ret
+}
+
+// v2Limit parses a page size, which defaults to def and may not pass most.
+func v2Limit(v, name string, def, most int, details *[]v2FieldError) int {
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > most {
+		*details = append(*details, v2FieldError{name, fmt.Sprintf("must be from 1 to %v", most)})
+		return def
+	}
+	return n
+}
+
+// v2Time parses an RFC 3339 time, leaving it zero when v is blank.
+func v2Time(v, name string, details *[]v2FieldError) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		*details = append(*details, v2FieldError{name, "must be an RFC 3339 time"})
+	}
+	return t
+}
@@ -0,0 +1,506 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+// These tests check the v2 API against its OpenAPI document: every request
+// they send is valid by the document, every response has a status the
+// document lists for the operation, and every body matches its schema. Each
+// operation in the document must be exercised.
+
+// contract is the OpenAPI document, and the operations a test exercised.
+type contract struct {
+	t    *testing.T
+	doc  map[string]any
+	base string
+	seen map[string]bool
+}
+
+func newContract(t *testing.T) *contract {
+	var doc map[string]any
+	if err := json.Unmarshal(api.OpenAPI, &doc); err != nil {
+		t.Fatal("Error parsing the OpenAPI document: ", err)
+	}
+
+	return &contract{
+		t:    t,
+		doc:  doc,
+		base: fmt.Sprintf("http://localhost:%v/v2", server.TestServerOptions.HTTPPort),
+		seen: make(map[string]bool),
+	}
+}
+
+// v2Response is a response to a contract call.
+type v2Response struct {
+	status int
+	header http.Header
+	body   map[string]any
+	raw    []byte
+}
+
+// call makes a request of the operation at path (as written in the document,
+// such as /nodes/{id}) and checks the request and the response against it.
+func (c *contract) call(method, path, id, query string, body any) v2Response {
+	c.t.Helper()
+	return c.do(method, path, id, query, body, true)
+}
+
+// callInvalid makes a request whose body the document says is invalid, to
+// check that the API refuses it, and checks the response.
+func (c *contract) callInvalid(method, path, id string, body any) v2Response {
+	c.t.Helper()
+	return c.do(method, path, id, "", body, false)
+}
+
+func (c *contract) do(method, path, id, query string, body any, valid bool) v2Response {
+	c.t.Helper()
+
+	op, ok := c.lookup("paths", path, strings.ToLower(method)).(map[string]any)
+	if !ok {
+		c.t.Fatalf("%v %v is not in the OpenAPI document", method, path)
+	}
+	c.seen[method+" "+path] = true
+	what := method + " " + path
+
+	var rdr io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		rdr = bytes.NewReader(b)
+
+		if rb, ok := op["requestBody"].(map[string]any); ok && valid {
+			schema := rb["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+			var v any
+			_ = json.Unmarshal(b, &v)
+			if errs := c.validate("request", schema, v); len(errs) > 0 {
+				c.t.Fatalf("%v: the request is not valid by the document: %v", what, errs)
+			}
+		}
+	}
+
+	u := c.base + strings.ReplaceAll(path, "{id}", url.PathEscape(id))
+	if query != "" {
+		u += "?" + query
+	}
+
+	req, err := http.NewRequest(method, u, rdr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	// a connection left idle by another test would reach its stopped server
+	req.Close = true
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%v: %v", what, err)
+	}
+	defer resp.Body.Close()
+
+	ret := v2Response{status: resp.StatusCode, header: resp.Header}
+	ret.raw, err = io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%v: error reading response: %v", what, err)
+	}
+
+	r, ok := c.lookup("paths", path, strings.ToLower(method), "responses",
+		fmt.Sprint(resp.StatusCode)).(map[string]any)
+	if !ok {
+		c.t.Fatalf("%v: status %v is not in the document: %s", what, resp.StatusCode, ret.raw)
+	}
+	r = c.resolve(r)
+
+	content, _ := r["content"].(map[string]any)
+	if content == nil {
+		if len(ret.raw) > 0 {
+			c.t.Fatalf("%v: %v has a body the document does not describe: %s",
+				what, resp.StatusCode, ret.raw)
+		}
+		return ret
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		c.t.Fatalf("%v: content type is %q", what, ct)
+	}
+
+	var v any
+	if err := json.Unmarshal(ret.raw, &v); err != nil {
+		c.t.Fatalf("%v: the body is not JSON: %v: %s", what, err, ret.raw)
+	}
+	ret.body, _ = v.(map[string]any)
+
+	schema := content["application/json"].(map[string]any)["schema"].(map[string]any)
+	if errs := c.validate("response", schema, v); len(errs) > 0 {
+		c.t.Fatalf("%v: the %v response does not match the document: %v: %s",
+			what, resp.StatusCode, errs, ret.raw)
+	}
+
+	headers, _ := r["headers"].(map[string]any)
+	for h := range headers {
+		if resp.Header.Get(h) == "" {
+			c.t.Errorf("%v: the %v header is missing", what, h)
+		}
+	}
+
+	return ret
+}
+
+// lookup walks the document from its root.
+func (c *contract) lookup(keys ...string) any {
+	var v any = c.doc
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// resolve follows a $ref within the document.
+func (c *contract) resolve(m map[string]any) map[string]any {
+	for {
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m
+		}
+		r, ok := c.lookup(strings.Split(strings.TrimPrefix(ref, "#/"), "/")...).(map[string]any)
+		if !ok {
+			c.t.Fatalf("%v does not resolve", ref)
+		}
+		m = r
+	}
+}
+
+// validate checks a value against the part of JSON Schema the document uses.
+func (c *contract) validate(at string, schema map[string]any, v any) []string {
+	schema = c.resolve(schema)
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			return []string{fmt.Sprintf("%v: %v is not one of %v", at, v, enum)}
+		}
+	}
+
+	var errs []string
+
+	switch schema["type"] {
+	case "object":
+		m, ok := v.(map[string]any)
+		if !ok {
+			return []string{at + ": is not an object"}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		if req, ok := schema["required"].([]any); ok {
+			for _, r := range req {
+				if _, ok := m[r.(string)]; !ok {
+					errs = append(errs, fmt.Sprintf("%v: %v is missing", at, r))
+				}
+			}
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := props[k].(map[string]any)
+			if !ok {
+				if props != nil {
+					errs = append(errs, fmt.Sprintf("%v: %v is not in the schema", at, k))
+				}
+				continue
+			}
+			errs = append(errs, c.validate(at+"."+k, p, m[k])...)
+		}
+	case "array":
+		a, ok := v.([]any)
+		if !ok {
+			return []string{at + ": is not an array"}
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, e := range a {
+			errs = append(errs, c.validate(fmt.Sprintf("%v[%v]", at, i), items, e)...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{at + ": is not a string"}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				errs = append(errs, at+": is not a date-time")
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			return []string{at + ": is not a number"}
+		}
+		if schema["type"] == "integer" && n != float64(int64(n)) {
+			errs = append(errs, at+": is not an integer")
+		}
+		if lo, ok := schema["minimum"].(float64); ok && n < lo {
+			errs = append(errs, fmt.Sprintf("%v: %v is below %v", at, n, lo))
+		}
+		if hi, ok := schema["maximum"].(float64); ok && n > hi {
+			errs = append(errs, fmt.Sprintf("%v: %v is above %v", at, n, hi))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{at + ": is not a boolean"}
+		}
+	}
+
+	return errs
+}
+
+// covered checks that every operation in the document was exercised.
+func (c *contract) covered() {
+	c.t.Helper()
+
+	for path, item := range c.doc["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			if method == "parameters" {
+				continue
+			}
+			if !c.seen[strings.ToUpper(method)+" "+path] {
+				c.t.Errorf("%v %v is never exercised", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// ids returns the IDs of the nodes in a response.
+func (r v2Response) ids(key string) []string {
+	var ret []string
+	nodes, _ := r.body[key].([]any)
+	for _, n := range nodes {
+		ret = append(ret, n.(map[string]any)["id"].(string))
+	}
+	return ret
+}
+
+// fields returns the fields named in the details of an error.
+func (r v2Response) fields() []string {
+	var ret []string
+	details, _ := r.body["details"].([]any)
+	for _, d := range details {
+		ret = append(ret, d.(map[string]any)["field"].(string))
+	}
+	return ret
+}
+
+func TestV2Contract(t *testing.T) {
+	_, root, stop, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	c := newContract(t)
+
+	expect := func(r v2Response, status int) {
+		t.Helper()
+		if r.status != status {
+			t.Fatalf("returned %v, expected %v: %s", r.status, status, r.raw)
+		}
+	}
+
+	expect(c.call("GET", "/openapi.json", "", "", nil), http.StatusOK)
+
+	// create
+	r := c.call("POST", "/nodes", "", "", map[string]any{
+		"id": "v2-pump", "type": "device", "parent": root.ID,
+		"points": []any{map[string]any{"type": "description", "text": "Pump"}},
+	})
+	expect(r, http.StatusCreated)
+	if r.header.Get("Location") != "/v2/nodes/v2-pump" || r.body["parent"] != root.ID {
+		t.Fatalf("wrong create response: %v %s", r.header, r.raw)
+	}
+
+	expect(c.call("POST", "/nodes", "", "", map[string]any{
+		"type": "group", "id": "v2-site", "parent": root.ID,
+		"points": []any{map[string]any{"type": "description", "text": "Site"}},
+	}), http.StatusCreated)
+
+	expect(c.call("POST", "/nodes", "", "", map[string]any{
+		"id": "v2-pump", "type": "device", "parent": root.ID,
+	}), http.StatusConflict)
+
+	r = c.callInvalid("POST", "/nodes", "", map[string]any{
+		"type": "bad type", "parent": "",
+		"points": []any{map[string]any{"key": "x"}},
+	})
+	expect(r, http.StatusUnprocessableEntity)
+	if fmt.Sprint(r.fields()) != "[type points[0].type parent]" {
+		t.Fatalf("wrong fields: %v", r.fields())
+	}
+
+	expect(c.callInvalid("POST", "/nodes", "", map[string]any{
+		"type": "device", "parent": root.ID, "color": "red",
+	}), http.StatusBadRequest)
+
+	// read
+	r = c.call("GET", "/nodes/{id}", "v2-pump", "", nil)
+	expect(r, http.StatusOK)
+	if r.body["type"] != "device" {
+		t.Fatalf("wrong node: %s", r.raw)
+	}
+	expect(c.call("GET", "/nodes/{id}", "no-such-node", "", nil), http.StatusNotFound)
+
+	r = c.call("GET", "/nodes", "", "parent="+root.ID+"&type=device", nil)
+	expect(r, http.StatusOK)
+	if ids := r.ids("nodes"); len(ids) != 1 || ids[0] != "v2-pump" {
+		t.Fatalf("wrong filtered list: %v", ids)
+	}
+
+	r = c.call("GET", "/nodes", "", "description=SITE", nil)
+	expect(r, http.StatusOK)
+	if ids := r.ids("nodes"); fmt.Sprint(ids) != "[v2-site]" {
+		t.Fatalf("wrong description filter: %v", ids)
+	}
+
+	// the pages of a list, one node at a time, are the whole list
+	all := c.call("GET", "/nodes", "", "limit=1000", nil)
+	expect(all, http.StatusOK)
+	if _, ok := all.body["next"]; ok || len(all.ids("nodes")) < 3 {
+		t.Fatalf("wrong unpaged list: %s", all.raw)
+	}
+
+	var paged []string
+	for cursor := ""; ; {
+		r = c.call("GET", "/nodes", "", "limit=1&cursor="+url.QueryEscape(cursor), nil)
+		expect(r, http.StatusOK)
+		paged = append(paged, r.ids("nodes")...)
+		next, ok := r.body["next"].(string)
+		if !ok {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(paged, all.ids("nodes")) {
+		t.Fatalf("pages %v do not add up to %v", paged, all.ids("nodes"))
+	}
+
+	r = c.call("GET", "/nodes", "", "limit=0&cursor=nope!", nil)
+	expect(r, http.StatusBadRequest)
+	if fmt.Sprint(r.fields()) != "[limit cursor]" {
+		t.Fatalf("wrong fields: %v", r.fields())
+	}
+	expect(c.call("GET", "/nodes", "", "parent=no-such-node", nil), http.StatusNotFound)
+
+	// points and their history
+	expect(c.call("POST", "/nodes/{id}/points", "v2-pump", "", []any{
+		map[string]any{"type": "value", "value": 1.5, "time": "2026-01-01T00:00:00Z"},
+	}), http.StatusNoContent)
+	expect(c.call("POST", "/nodes/{id}/points", "v2-pump", "", []any{
+		map[string]any{"type": "value", "value": 2, "time": "2026-01-01T00:01:00Z"},
+	}), http.StatusNoContent)
+
+	r = c.callInvalid("POST", "/nodes/{id}/points", "v2-pump", []any{
+		map[string]any{"type": "value", "value": 1},
+		map[string]any{"type": "a.b", "key": "c d"},
+	})
+	expect(r, http.StatusUnprocessableEntity)
+	if fmt.Sprint(r.fields()) != "[[1].type [1].key]" {
+		t.Fatalf("wrong fields: %v", r.fields())
+	}
+	expect(c.call("POST", "/nodes/{id}/points", "v2-pump", "", []any{}), http.StatusUnprocessableEntity)
+	expect(c.call("POST", "/nodes/{id}/points", "no-such-node", "", []any{
+		map[string]any{"type": "value", "value": 1},
+	}), http.StatusNotFound)
+
+	r = c.call("GET", "/nodes/{id}/history", "v2-pump", "type=value", nil)
+	expect(r, http.StatusOK)
+	var values []any
+	for _, p := range r.body["points"].([]any) {
+		values = append(values, p.(map[string]any)["value"])
+	}
+	if fmt.Sprint(values) != "[1.5 2]" {
+		t.Fatalf("wrong history: %s", r.raw)
+	}
+
+	r = c.call("GET", "/nodes/{id}/history", "v2-pump",
+		"type=value&start=2026-01-01T00:00:30Z&limit=5", nil)
+	expect(r, http.StatusOK)
+	if n := len(r.body["points"].([]any)); n != 1 {
+		t.Fatalf("the time range kept %v points: %s", n, r.raw)
+	}
+	expect(c.call("GET", "/nodes/{id}/history", "v2-pump", "start=yesterday", nil),
+		http.StatusBadRequest)
+
+	// move, copy and delete
+	r = c.call("POST", "/nodes/{id}/move", "v2-pump", "", map[string]any{"to": "v2-site"})
+	expect(r, http.StatusOK)
+	if r.body["parent"] != "v2-site" {
+		t.Fatalf("wrong move response: %s", r.raw)
+	}
+	r = c.call("POST", "/nodes/{id}/move", "v2-site", "", map[string]any{"to": "v2-pump"})
+	expect(r, http.StatusUnprocessableEntity)
+	expect(c.callInvalid("POST", "/nodes/{id}/move", "v2-pump", map[string]any{}),
+		http.StatusUnprocessableEntity)
+
+	r = c.call("POST", "/nodes/{id}/copy", "v2-pump", "", map[string]any{"to": root.ID})
+	expect(r, http.StatusCreated)
+	if r.body["id"] != "v2-pump" || r.body["parent"] != root.ID {
+		t.Fatalf("wrong copy response: %s", r.raw)
+	}
+	expect(c.call("POST", "/nodes/{id}/copy", "v2-pump", "", map[string]any{"to": root.ID}),
+		http.StatusConflict)
+
+	r = c.call("POST", "/nodes/{id}/copy", "v2-pump", "",
+		map[string]any{"to": "v2-site", "duplicate": true})
+	expect(r, http.StatusCreated)
+	if r.body["id"] == "v2-pump" || r.header.Get("Location") != "/v2/nodes/"+r.body["id"].(string) {
+		t.Fatalf("wrong duplicate response: %v %s", r.header, r.raw)
+	}
+
+	r = c.call("DELETE", "/nodes/{id}", "v2-pump", "", nil)
+	expect(r, http.StatusUnprocessableEntity)
+	if fmt.Sprint(r.fields()) != "[parent]" {
+		t.Fatalf("wrong fields: %v", r.fields())
+	}
+	expect(c.call("DELETE", "/nodes/{id}", "v2-pump", "parent="+root.ID, nil), http.StatusNoContent)
+
+	r = c.call("GET", "/nodes", "", "parent="+root.ID+"&deleted=true&type=device", nil)
+	expect(r, http.StatusOK)
+	if ids := r.ids("nodes"); fmt.Sprint(ids) != "[v2-pump]" {
+		t.Fatalf("the deleted node is not listed: %v", ids)
+	}
+	r = c.call("GET", "/nodes", "", "subtree=v2-site&type=device", nil)
+	expect(r, http.StatusOK)
+	if n := len(r.ids("nodes")); n != 2 {
+		t.Fatalf("the subtree has %v devices: %s", n, r.raw)
+	}
+	expect(c.call("DELETE", "/nodes/{id}", "v2-site", "parent=v2-site", nil),
+		http.StatusUnprocessableEntity)
+
+	c.covered()
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestV2Requests(t *testing.T) {
+	k, err := NewKey([]byte("test"))
+	if err != nil {
+		t.Fatal("Error creating key:", err)
+	}
+
+	// every case is answered before the handler needs NATS
+	h := NewV2Handler(ServerArgs{JwtAuth: k, AuthToken: "siot-token"})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		status int
+		allow  string
+	}{
+		{"document", http.MethodGet, "/openapi.json", "", http.StatusOK, ""},
+		{"document post", http.MethodPost, "/openapi.json", "", http.StatusMethodNotAllowed, "GET"},
+		{"no token", http.MethodGet, "/nodes", "", http.StatusUnauthorized, ""},
+		{"wrong token", http.MethodGet, "/nodes", "Bearer nope", http.StatusUnauthorized, ""},
+		{"unknown route", http.MethodGet, "/things", "Bearer siot-token", http.StatusNotFound, ""},
+		{"unknown verb", http.MethodGet, "/nodes/a/b", "Bearer siot-token", http.StatusNotFound, ""},
+		{"too deep", http.MethodGet, "/nodes/a/history/b", "Bearer siot-token", http.StatusNotFound, ""},
+		{"put", http.MethodPut, "/nodes", "Bearer siot-token", http.StatusMethodNotAllowed, "GET, POST"},
+		{"get points", http.MethodGet, "/nodes/a/points", "Bearer siot-token",
+			http.StatusMethodNotAllowed, "POST"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%v: returned %v, expected %v: %v", test.name, res.Code, test.status, res.Body)
+		}
+		if res.Header().Get("Allow") != test.allow {
+			t.Errorf("%v: allows %q, expected %q", test.name, res.Header().Get("Allow"), test.allow)
+		}
+		if res.Header().Get("Content-Type") != "application/json" ||
+			!json.Valid(res.Body.Bytes()) {
+			t.Errorf("%v: the body is not JSON: %v", test.name, res.Body)
+		}
+	}
+}
+
+func TestV2CheckPoints(t *testing.T) {
+	bad := data.NewPointFloat("value", "", 1)
+	bad.Tombstone = -1
+	bad.DataType = 9
+
+	tests := []struct {
+		points data.Points
+		fields string
+	}{
+		{data.Points{data.NewPointFloat("value", "0", 1)}, "[]"},
+		{data.Points{{}}, "[p[0].type]"},
+		{data.Points{data.NewPointFloat("value", "", 1), data.NewPointFloat("a>", "b c", 1)},
+			"[p[1].type p[1].key]"},
+		{data.Points{bad}, "[p[0].tombstone p[0].dataType]"},
+	}
+
+	for _, test := range tests {
+		var fields []string
+		for _, e := range v2CheckPoints("p", test.points) {
+			fields = append(fields, e.Field)
+		}
+		if fmt.Sprint(fields) != test.fields {
+			t.Errorf("%v: got %v, expected %v", test.points, fields, test.fields)
+		}
+	}
+}
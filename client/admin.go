@@ -1,36 +1,43 @@
 package client
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
 )
 
-// AdminStoreVerify can be used verify the store
-func AdminStoreVerify(nc *nats.Conn) error {
-	resp, err := nc.Request("admin.storeVerify", nil, time.Second*20)
-	if err != nil {
-		return err
-	}
-
-	if len(resp.Data) > 0 {
-		return errors.New(string(resp.Data))
-	}
+// AdminStoreVerify checks the store and returns the problems it found, one
+// description per problem. No problems means the store is consistent.
+func AdminStoreVerify(nc *nats.Conn) ([]string, error) {
+	return adminStoreRequest(nc, "admin.storeVerify")
+}
 
-	return nil
+// AdminStoreMaint repairs what it can of the problems AdminStoreVerify
+// reports and returns the problems that remain afterward.
+func AdminStoreMaint(nc *nats.Conn) ([]string, error) {
+	return adminStoreRequest(nc, "admin.storeMaint")
 }
 
-// AdminStoreMaint can be used fix store issues
-func AdminStoreMaint(nc *nats.Conn) error {
-	resp, err := nc.Request("admin.storeMaint", nil, time.Second*20)
+func adminStoreRequest(nc *nats.Conn, subject string) ([]string, error) {
+	// a check reads the tip of every subject in the store, which takes a
+	// while on a hub holding many devices
+	msg, err := nc.Request(subject, nil, time.Minute*2)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.StoreCheckResponse
+	err = json.Unmarshal(msg.Data, &resp)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(resp.Data) > 0 {
-		return errors.New(string(resp.Data))
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
 	}
 
-	return nil
+	return resp.Issues, nil
 }
@@ -20,10 +20,14 @@ func TestAdminStoreVerify(t *testing.T) {
 	// give store time to init
 	time.Sleep(time.Millisecond * 100)
 
-	err = client.AdminStoreVerify(nc)
+	issues, err := client.AdminStoreVerify(nc)
 	if err != nil {
 		t.Fatal("Verify failed: ", err)
 	}
+
+	if len(issues) > 0 {
+		t.Fatal("Verify found problems in a fresh store: ", issues)
+	}
 }
 
 func TestAdminStoreMaint(t *testing.T) {
@@ -38,8 +42,12 @@ func TestAdminStoreMaint(t *testing.T) {
 	// give store time to init
 	time.Sleep(time.Millisecond * 100)
 
-	err = client.AdminStoreMaint(nc)
+	issues, err := client.AdminStoreMaint(nc)
 	if err != nil {
 		t.Fatal("Maint failed: ", err)
 	}
+
+	if len(issues) > 0 {
+		t.Fatal("Maint left problems in a fresh store: ", issues)
+	}
 }
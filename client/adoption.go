@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// RequestAdoption asks an instance to take a device into its tree. The points
+// describe the device (description and versions) for the admin who approves
+// it, a pubKey point carries the public key of its credential, and an org
+// point names the organization it asks to join. It returns the device's
+// adoption state: approved once the device is in the tree, otherwise pending
+// or rejected. An instance that predates adoption approval does not answer,
+// and the error is nats.ErrNoResponders.
+func RequestAdoption(nc *nats.Conn, deviceID string, points data.Points) (string, error) {
+	resp, err := adoptionRequest(nc, "adoption.request."+deviceID, points.Encode())
+	return resp.State, err
+}
+
+// GetAdoptions returns the devices waiting for approval and those rejected.
+func GetAdoptions(nc *nats.Conn) ([]data.Adoption, error) {
+	resp, err := adoptionRequest(nc, "adoption.list", nil)
+	return resp.Devices, err
+}
+
+// GetOrgAdoptions returns the devices waiting to join an organization and
+// those it rejected. An admin of the organization may ask for them.
+func GetOrgAdoptions(nc *nats.Conn, orgID string) ([]data.Adoption, error) {
+	resp, err := adoptionRequest(nc, "adoption.list."+orgID, nil)
+	return resp.Devices, err
+}
+
+// ApproveAdoption takes a waiting or rejected device into the tree below
+// parent, which is a group or the root node. A device that asked to join an
+// organization may only be taken into it.
+func ApproveAdoption(nc *nats.Conn, deviceID, parent string) error {
+	_, err := adoptionRequest(nc, fmt.Sprintf("adoption.approve.%v.%v", deviceID, parent), nil)
+	return err
+}
+
+// RejectAdoption turns a waiting device away.
+func RejectAdoption(nc *nats.Conn, deviceID string) error {
+	_, err := adoptionRequest(nc, "adoption.reject."+deviceID, nil)
+	return err
+}
+
+// RejectOrgAdoption turns away a device waiting to join an organization.
+func RejectOrgAdoption(nc *nats.Conn, deviceID, orgID string) error {
+	_, err := adoptionRequest(nc, fmt.Sprintf("adoption.reject.%v.%v", deviceID, orgID), nil)
+	return err
+}
+
+func adoptionRequest(nc *nats.Conn, subject string, payload []byte) (data.AdoptionResponse, error) {
+	var resp data.AdoptionResponse
+
+	msg, err := nc.Request(subject, payload, 20*time.Second)
+	if err != nil {
+		return resp, err
+	}
+
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+
+	return resp, nil
+}
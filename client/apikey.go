@@ -0,0 +1,54 @@
+package client
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// APIKeyOptions describe a new API key.
+type APIKeyOptions struct {
+	Description string
+	// Scope limits the key to a node and the nodes below it. Empty leaves
+	// the key with everything its owner can reach.
+	Scope string
+	// Write lets the key change what its owner may change. A key without
+	// it only reads.
+	Write bool
+	// Expires is when the key stops working. A zero time never expires.
+	Expires time.Time
+}
+
+// NewAPIKey creates an apiKey node under owner, a user or a group, and
+// returns the node and the key. Only the hash of the key's secret is stored,
+// so the key cannot be read back later.
+func NewAPIKey(nc *nats.Conn, owner string, o APIKeyOptions, origin string) (data.APIKey, string, error) {
+	secret, err := data.NewAPIKeySecret()
+	if err != nil {
+		return data.APIKey{}, "", err
+	}
+
+	k := data.APIKey{
+		ID:          uuid.New().String(),
+		Parent:      owner,
+		Description: o.Description,
+		KeyHash:     data.APIKeyHash(secret),
+		Scope:       o.Scope,
+		Access:      data.PointValueRead,
+	}
+	if o.Write {
+		k.Access = data.PointValueWrite
+	}
+	if !o.Expires.IsZero() {
+		k.Expires = float64(o.Expires.Unix())
+	}
+
+	err = SendNodeType(nc, k, origin)
+	if err != nil {
+		return data.APIKey{}, "", err
+	}
+
+	return k, data.FormatAPIKey(k.ID, secret), nil
+}
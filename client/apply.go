@@ -3,6 +3,7 @@ package client
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
@@ -107,25 +108,36 @@ func Apply(nc *nats.Conn, f data.NodeFile, o ApplyOptions) (ApplyPlan, error) {
 		return plan, nil
 	}
 
+	return plan, runPlan(nc, plan, o.Origin)
+}
+
+// runPlan carries out a plan: nodes are sent, parents before children, and
+// then the deletes are made.
+func runPlan(nc *nats.Conn, plan ApplyPlan, origin string) error {
 	for _, s := range plan.Send {
-		if err := SendNode(nc, s.Node, o.Origin); err != nil {
-			return plan, fmt.Errorf("error sending node %v: %w", s.Node.ID, err)
+		if err := SendNode(nc, s.Node, origin); err != nil {
+			return fmt.Errorf("error sending node %v: %w", s.Node.ID, err)
 		}
 	}
 
 	for _, d := range plan.Delete {
-		if err := DeleteNode(nc, d.ID, d.Parent, o.Origin); err != nil {
-			return plan, fmt.Errorf("error deleting node %v: %w", d.ID, err)
+		if err := DeleteNode(nc, d.ID, d.Parent, origin); err != nil {
+			return fmt.Errorf("error deleting node %v: %w", d.ID, err)
 		}
 	}
 
-	return plan, nil
+	return nil
 }
 
 // getTree fetches the subtree below a node, flattened, so that matching can
 // work against a snapshot rather than a query per entry.
 func getTree(nc *nats.Conn, rootID string) ([]data.NodeEdge, error) {
-	root, err := GetNodes(nc, "all", rootID, "", false)
+	return getTreeAt(nc, rootID, time.Time{})
+}
+
+// getTreeAt works like getTree on the tree as it stood at a time.
+func getTreeAt(nc *nats.Conn, rootID string, at time.Time) ([]data.NodeEdge, error) {
+	root, err := GetNodesAt(nc, "all", rootID, "", false, at)
 	if err != nil {
 		return nil, fmt.Errorf("error getting root node: %w", err)
 	}
@@ -145,7 +157,7 @@ func getTree(nc *nats.Conn, rootID string) ([]data.NodeEdge, error) {
 		}
 		seen[id] = true
 
-		children, err := GetNodes(nc, id, "all", "", false)
+		children, err := GetNodesAt(nc, id, "all", "", false, at)
 		if err != nil {
 			return fmt.Errorf("error getting children of %v: %w", id, err)
 		}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// GetAudit returns the changes users made to a node, oldest first. With
+// subtree set, changes to every node below it are included. A zero start or
+// end leaves that side of the time range open, and limit, when above zero,
+// keeps only the newest changes.
+func GetAudit(nc *nats.Conn, id string, subtree bool, start, end time.Time, limit int) ([]data.AuditEntry, error) {
+	var requestPoints data.Points
+
+	if subtree {
+		requestPoints = append(requestPoints,
+			data.NewPointFloat(data.PointTypeSubtree, "", 1))
+	}
+
+	if !start.IsZero() {
+		requestPoints = append(requestPoints,
+			data.Point{Type: data.PointTypeStart, Time: start})
+	}
+
+	if !end.IsZero() {
+		requestPoints = append(requestPoints,
+			data.Point{Type: data.PointTypeEnd, Time: end})
+	}
+
+	if limit > 0 {
+		requestPoints = append(requestPoints,
+			data.NewPointFloat(data.PointTypeCount, "", float64(limit)))
+	}
+
+	// the audit trail is read from the point history, which takes a while
+	// on a store holding many devices
+	msg, err := nc.Request(fmt.Sprintf("audit.%v", id), requestPoints.Encode(),
+		time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.AuditResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Entries, nil
+}
@@ -0,0 +1,46 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+func TestGetAudit(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server:", err)
+	}
+	defer stop()
+
+	users, err := client.GetNodes(nc, root.ID, "all", data.NodeTypeUser, false)
+	if err != nil || len(users) < 1 {
+		t.Fatal("Error getting user:", err)
+	}
+	user := users[0]
+
+	// what the HTTP API does with a point a logged in user posts
+	p := data.NewPointString(data.PointTypeDescription, "", "audited")
+	p.Origin = user.ID
+	err = client.SendNodePoint(nc, root.ID, p, true)
+	if err != nil {
+		t.Fatal("Error sending point:", err)
+	}
+
+	entries, err := client.GetAudit(nc, root.ID, false, time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal("Error getting audit:", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatal("expected 1 change, got:", entries)
+	}
+
+	e := entries[0]
+	if e.UserID != user.ID || e.User != "admin" || e.New.Txt() != "audited" {
+		t.Fatal("wrong change:", e)
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -11,10 +12,19 @@ import (
 // UserCheck sends a nats message to check auth of user
 // This function returns user nodes and a JWT node which includes a token
 func UserCheck(nc *nats.Conn, email, pass string) ([]data.NodeEdge, error) {
+	return OrgUserCheck(nc, "", email, pass)
+}
+
+// OrgUserCheck is UserCheck for a user of the organization named org. With
+// org empty, it checks the instance's own users.
+func OrgUserCheck(nc *nats.Conn, org, email, pass string) ([]data.NodeEdge, error) {
 	points := data.Points{
 		data.NewPointString(data.PointTypeEmail, "0", email),
 		data.NewPointString(data.PointTypePass, "0", pass),
 	}
+	if org != "" {
+		points = append(points, data.NewPointString(data.PointTypeOrg, "0", org))
+	}
 
 	pointsData := points.Encode()
 
@@ -32,6 +42,24 @@ func UserCheck(nc *nats.Conn, email, pass string) ([]data.NodeEdge, error) {
 	return nodes, nil
 }
 
+// OIDCUser sends a nats message to sign in a user who logged in through an
+// OpenID Connect identity provider. The store matches the user by email, or
+// creates it, and places it in the groups the login maps to. Like UserCheck,
+// it returns the user nodes and a JWT node which includes a token.
+func OIDCUser(nc *nats.Conn, login data.OIDCLogin) ([]data.NodeEdge, error) {
+	req, err := json.Marshal(login)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeMsg, err := nc.Request("auth.oidc", req, time.Second*20)
+	if err != nil {
+		return []data.NodeEdge{}, err
+	}
+
+	return data.PbDecodeNodesRequest(nodeMsg.Data)
+}
+
 // GetNatsURI returns the nats URI and auth token for the SIOT server
 // this can be used to set up new NATS connections with different requirements
 // (no echo, etc)
@@ -1,9 +1,14 @@
 package client_test
 
 import (
+	"slices"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/server"
 )
 
@@ -74,3 +79,291 @@ func TestAuthMovedUser(t *testing.T) {
 		t.Fatal("after move, expected at least two nodes from auth request: ", len(ne))
 	}
 }
+
+func TestAuthSession(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	site := client.Group{ID: "site", Parent: root.ID, Description: "site"}
+	other := client.Group{ID: "other", Parent: root.ID, Description: "other"}
+	sensor := client.Variable{ID: "sensor", Parent: "site", Description: "sensor"}
+	user := client.User{ID: "session-user", Parent: "site", Email: "test", Pass: "test"}
+
+	for _, n := range []any{site, other, sensor, user} {
+		if err := client.SendNodeType(nc, n, "test"); err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	err = client.SendEdgePoint(nc, user.ID, "site",
+		data.NewPointString(data.PointTypeRole, "", data.PointValueRoleAdmin), true)
+	if err != nil {
+		t.Fatal("Error setting role: ", err)
+	}
+
+	ne, err := client.UserCheck(nc, "test", "test")
+	if err != nil {
+		t.Fatal("User check error: ", err)
+	}
+
+	var token string
+	for _, n := range ne {
+		if n.Type == data.NodeTypeJWT {
+			token, _ = n.Points.Text(data.PointTypeToken, "")
+		}
+	}
+	if token == "" {
+		t.Fatal("no login token")
+	}
+
+	var ncS *nats.Conn
+	waitFor(t, 10*time.Second, "session connection", func() bool {
+		ncS, err = nats.Connect(server.TestServerOptions.NatsServer, nats.Token(token),
+			nats.ReconnectWait(100*time.Millisecond))
+		return err == nil
+	})
+	defer ncS.Close()
+
+	nodes, err := client.GetNodes(ncS, "all", sensor.ID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("a session should read the nodes of its user: ", err)
+	}
+
+	_, err = ncS.Request("nodes.all."+other.ID, nil, time.Second)
+	if err == nil {
+		t.Fatal("a session should not reach other nodes")
+	}
+
+	_, err = ncS.Request("admin.storeVerify", nil, time.Second)
+	if err == nil {
+		t.Fatal("a session should not reach admin subjects")
+	}
+
+	seen := make(chan data.Point, 10)
+	stopSub, err := client.SubscribePoints(nc, sensor.ID, func(points []data.Point) {
+		for _, p := range points {
+			seen <- p
+		}
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+	defer stopSub()
+
+	err = client.SendNodePointsAs(ncS, user.ID, sensor.ID,
+		data.Points{data.NewPointFloat(data.PointTypeValue, "", 1)}, true)
+	if err != nil {
+		t.Fatal("an admin session should write points: ", err)
+	}
+
+	// clients following the node see the write on its plain subject
+	select {
+	case p := <-seen:
+		if p.Type != data.PointTypeValue || p.Origin != user.ID {
+			t.Error("unexpected point: ", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session write not passed on to clients")
+	}
+
+	// the store takes the session's writes as its user's
+	nodes, err = client.GetNodes(nc, "all", sensor.ID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("Error getting sensor: ", err)
+	}
+	for _, p := range nodes[0].Points {
+		if p.Type == data.PointTypeValue && p.Origin != user.ID {
+			t.Errorf("session write has origin %q", p.Origin)
+		}
+	}
+
+	err = client.SendNodePoint(ncS, sensor.ID,
+		data.NewPointFloat(data.PointTypeValue, "", 1), true)
+	if err == nil {
+		t.Fatal("a session wrote a point without its user")
+	}
+
+	p := data.NewPointFloat(data.PointTypeValue, "", 1)
+	p.Origin = "someone-else"
+	err = client.SendNodePointsAs(ncS, user.ID, sensor.ID, data.Points{p}, true)
+	if err == nil {
+		t.Fatal("a session wrote a point as another user")
+	}
+
+	// a point must be the one its subject names
+	wrong := data.Points{data.NewPointString(data.PointTypeDescription, "", "x")}
+	msg := nats.NewMsg(client.SubjectNodePointsAs(user.ID, sensor.ID) + ".value.0")
+	msg.Data = wrong.Encode()
+	resp, err := ncS.RequestMsg(msg, time.Second)
+	if err != nil || len(resp.Data) == 0 {
+		t.Fatal("a point not matching its subject was accepted: ", err)
+	}
+
+	// without the admin role, the session is reconnected read only
+	err = client.SendEdgePoint(nc, user.ID, "site",
+		data.NewPointString(data.PointTypeRole, "", "user"), true)
+	if err != nil {
+		t.Fatal("Error setting role: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "session to lose write access", func() bool {
+		err := client.SendNodePointsAs(ncS, user.ID, sensor.ID,
+			data.Points{data.NewPointFloat(data.PointTypeValue, "", 2)}, true)
+		return err != nil
+	})
+
+	nodes, err = client.GetNodes(ncS, "all", sensor.ID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("a read only session should still read: ", err)
+	}
+}
+
+func TestAuthAPIKey(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	site := client.Group{ID: "site", Parent: root.ID, Description: "site"}
+	area := client.Group{ID: "area", Parent: "site", Description: "area"}
+	sensor := client.Variable{ID: "sensor", Parent: "area", Description: "sensor"}
+	tank := client.Variable{ID: "tank", Parent: "site", Description: "tank"}
+	user := client.User{ID: "key-user", Parent: "site", Email: "test", Pass: "test"}
+
+	for _, n := range []any{site, area, sensor, tank, user} {
+		if err := client.SendNodeType(nc, n, "test"); err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	k, key, err := client.NewAPIKey(nc, user.ID, client.APIKeyOptions{
+		Description: "grafana",
+		Scope:       area.ID,
+		Write:       true,
+		Expires:     time.Now().Add(time.Hour),
+	}, "")
+	if err != nil {
+		t.Fatal("Error creating API key: ", err)
+	}
+
+	var ncK *nats.Conn
+	waitFor(t, 10*time.Second, "key connection", func() bool {
+		ncK, err = nats.Connect(server.TestServerOptions.NatsServer, nats.Token(key),
+			nats.ReconnectWait(100*time.Millisecond))
+		return err == nil
+	})
+	defer ncK.Close()
+
+	nodes, err := client.GetNodes(ncK, "all", sensor.ID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("a key should read the nodes in its scope: ", err)
+	}
+
+	_, err = ncK.Request("nodes.all."+tank.ID, nil, time.Second)
+	if err == nil {
+		t.Fatal("a key should not reach nodes outside its scope")
+	}
+
+	err = client.SendNodePointsAs(ncK, k.ID, sensor.ID,
+		data.Points{data.NewPointFloat(data.PointTypeValue, "", 1)}, true)
+	if err != nil {
+		t.Fatal("a write key should write points in its scope: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "last used point", func() bool {
+		keys, err := client.GetNodesType[data.APIKey](nc, user.ID, k.ID)
+		return err == nil && len(keys) == 1 && keys[0].LastUsed > 0
+	})
+
+	// a revoked key is disconnected
+	err = client.SendNodePoint(nc, k.ID, data.NewPointFloat(data.PointTypeRevoked, "", 1), true)
+	if err != nil {
+		t.Fatal("Error revoking key: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "revoked key to be disconnected", func() bool {
+		return !ncK.IsConnected()
+	})
+}
+
+func TestAuthOIDC(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	eng := client.Group{ID: "eng", Parent: root.ID, Description: "eng"}
+	ops := client.Group{ID: "ops", Parent: root.ID, Description: "ops"}
+	pat := client.User{ID: "pat", Parent: root.ID, Email: "pat@example.com", Pass: "test"}
+
+	for _, n := range []any{eng, ops, pat} {
+		if err := client.SendNodeType(nc, n, "test"); err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	for _, g := range []client.Group{eng, ops} {
+		err := client.SendNodePoint(nc, g.ID,
+			data.NewPointString(data.PointTypeOIDCGroup, "", g.Description), true)
+		if err != nil {
+			t.Fatal("Error mapping group: ", err)
+		}
+	}
+
+	login := func(email string, groups ...string) (string, []string) {
+		t.Helper()
+		ne, err := client.OIDCUser(nc, data.OIDCLogin{Email: email, Groups: groups})
+		if err != nil {
+			t.Fatal("OIDC login error: ", err)
+		}
+		if len(ne) < 2 || ne[len(ne)-1].Type != data.NodeTypeJWT {
+			t.Fatal("Expected user and JWT nodes from OIDC login")
+		}
+		nodes, err := client.GetNodes(nc, "all", ne[0].ID, "", false)
+		if err != nil {
+			t.Fatal("Error getting user: ", err)
+		}
+		var places []string
+		for _, n := range nodes {
+			places = append(places, n.Parent)
+		}
+		sort.Strings(places)
+		return ne[0].ID, places
+	}
+
+	id, places := login("Jo@Example.com", "eng", "other")
+	if !slices.Equal(places, []string{"eng"}) {
+		t.Fatal("new user not in its mapped group: ", places)
+	}
+
+	id2, places := login("jo@example.com", "ops")
+	if id2 != id {
+		t.Fatal("user not matched by email")
+	}
+	if !slices.Equal(places, []string{"ops"}) {
+		t.Fatal("user groups not brought up to date: ", places)
+	}
+
+	// groups that are not mapped are left alone
+	id, places = login("PAT@example.com")
+	if id != pat.ID || !slices.Equal(places, []string{root.ID}) {
+		t.Fatal("existing user not signed in where it is: ", id, places)
+	}
+
+	_, err = client.OIDCUser(nc, data.OIDCLogin{Email: "new@example.com",
+		Groups: []string{"other"}})
+	if err == nil {
+		t.Fatal("a user with no mapped group and no parent should be refused")
+	}
+}
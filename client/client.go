@@ -57,6 +57,9 @@ func DefaultClients(nc *nats.Conn) (*RunGroup, error) {
 	mqtt := NewManager(nc, NewMqttClient, nil)
 	g.Add(mqtt)
 
+	ingest := NewManager(nc, NewIngestClient, nil)
+	g.Add(ingest)
+
 	particle := NewManager(nc, NewParticleClient, nil)
 	g.Add(particle)
 
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// GetSyncConflicts returns the sync conflicts waiting to be resolved, newest
+// first.
+func GetSyncConflicts(nc *nats.Conn) ([]data.SyncConflict, error) {
+	return conflictRequest(nc, "conflict.list")
+}
+
+// ResolveSyncConflict resolves a sync conflict by accepting the value the
+// merge kept.
+func ResolveSyncConflict(nc *nats.Conn, id string) error {
+	_, err := conflictRequest(nc, "conflict.resolve."+id)
+	return err
+}
+
+// RestoreSyncConflict resolves a sync conflict in favor of the value the merge
+// dropped, which is written again and then wins on every instance.
+func RestoreSyncConflict(nc *nats.Conn, id string) error {
+	_, err := conflictRequest(nc, "conflict.restore."+id)
+	return err
+}
+
+func conflictRequest(nc *nats.Conn, subject string) ([]data.SyncConflict, error) {
+	msg, err := nc.Request(subject, nil, 20*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.SyncConflictResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Conflicts, nil
+}
@@ -1,17 +1,22 @@
 package client
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 // EdgeOptions describes options for connecting edge devices
 type EdgeOptions struct {
-	URI          string
-	AuthToken    string
+	URI       string
+	AuthToken string
+	// NkeySeed is a device credential. When set the connection signs in
+	// with the NKey and AuthToken is not sent.
+	NkeySeed     string
 	NoEcho       bool
 	Connected    func()
 	Disconnected func()
@@ -28,6 +33,16 @@ func EdgeConnect(eo EdgeOptions) (*nats.Conn, error) {
 		authEnabled = "yes"
 	}
 
+	var nkeyOpt nats.Option
+	if eo.NkeySeed != "" {
+		var err error
+		nkeyOpt, err = nkeyOption(eo.NkeySeed)
+		if err != nil {
+			return nil, err
+		}
+		authEnabled = "nkey"
+	}
+
 	natsErrHandler := func(_ *nats.Conn, sub *nats.Subscription, natsErr error) {
 		log.Printf("error: %v\n", natsErr)
 		switch natsErr {
@@ -65,7 +80,11 @@ func EdgeConnect(eo EdgeOptions) (*nats.Conn, error) {
 			return delay
 		})(o)
 
-		_ = nats.Token(eo.AuthToken)(o)
+		if nkeyOpt != nil {
+			_ = nkeyOpt(o)
+		} else {
+			_ = nats.Token(eo.AuthToken)(o)
+		}
 
 		if eo.NoEcho {
 			o.NoEcho = true
@@ -126,3 +145,18 @@ func EdgeConnect(eo EdgeOptions) (*nats.Conn, error) {
 
 	return nc, nil
 }
+
+// nkeyOption returns the option that signs in with an NKey user seed.
+func nkeyOption(seed string) (nats.Option, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid nkey seed: %w", err)
+	}
+
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid nkey seed: %w", err)
+	}
+
+	return nats.Nkey(pub, kp.Sign), nil
+}
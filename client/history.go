@@ -0,0 +1,63 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// GetHistory returns the values the points of a node have held, oldest
+// first, as far back as the store's retention reaches. typ and key, when set,
+// limit the points returned. A zero start or end leaves that side of the time
+// range open, and limit, when above zero, keeps only the newest values.
+func GetHistory(nc *nats.Conn, id, typ, key string, start, end time.Time, limit int) (data.Points, error) {
+	var requestPoints data.Points
+
+	if typ != "" {
+		requestPoints = append(requestPoints,
+			data.NewPointString(data.PointTypePointType, "", typ))
+	}
+
+	if key != "" {
+		requestPoints = append(requestPoints,
+			data.NewPointString(data.PointTypePointKey, "", key))
+	}
+
+	if !start.IsZero() {
+		requestPoints = append(requestPoints,
+			data.Point{Type: data.PointTypeStart, Time: start})
+	}
+
+	if !end.IsZero() {
+		requestPoints = append(requestPoints,
+			data.Point{Type: data.PointTypeEnd, Time: end})
+	}
+
+	if limit > 0 {
+		requestPoints = append(requestPoints,
+			data.NewPointFloat(data.PointTypeCount, "", float64(limit)))
+	}
+
+	// like the audit trail, the history is read from the streams
+	msg, err := nc.Request(fmt.Sprintf("history.%v", id), requestPoints.Encode(),
+		time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.HistoryResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Points, nil
+}
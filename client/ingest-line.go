@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file parses InfluxDB line protocol, which is what Telegraf and many
+// gateways write:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Commas, spaces and equals signs in names are escaped with a backslash, and
+// string field values are double quoted. See
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+
+// influxMaxLine is the longest line the scanner will read, so one long string
+// field fails its line rather than the whole write.
+const influxMaxLine = 1024 * 1024
+
+// influxLine is one line of line protocol.
+type influxLine struct {
+	// line is the line number in the write, for errors
+	line        int
+	measurement string
+	tags        map[string]string
+	fields      []influxField
+	// time is zero when the line has no timestamp
+	time time.Time
+}
+
+// influxField is one field of a line. Numbers, integers and booleans are held
+// in num, booleans as 1 or 0, and strings in text.
+type influxField struct {
+	key    string
+	num    float64
+	text   string
+	isText bool
+}
+
+// influxPrecision returns the duration of a timestamp unit. Blank is
+// nanoseconds, as it is for InfluxDB.
+func influxPrecision(p string) (time.Duration, error) {
+	switch p {
+	case "", "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+	return 0, fmt.Errorf("precision %q is not one of ns, us, ms or s", p)
+}
+
+// parseInfluxLines reads a write of line protocol whose first line is numbered
+// first. A line that cannot be parsed is reported and skipped, so the good
+// lines of a write are kept, as InfluxDB does.
+func parseInfluxLines(b []byte, first int, precision time.Duration) (points []influxLine, errs []string) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(make([]byte, 0, 64*1024), influxMaxLine)
+
+	n := first - 1
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p, err := parseInfluxLine(line, precision)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %v: %v", n, err))
+			continue
+		}
+		p.line = n
+		points = append(points, p)
+	}
+
+	if err := s.Err(); err != nil {
+		errs = append(errs, fmt.Sprintf("line %v: %v", n+1, err))
+	}
+
+	return points, errs
+}
+
+// parseInfluxLine reads one line of line protocol.
+func parseInfluxLine(line string, precision time.Duration) (influxLine, error) {
+	sections := splitInflux(line, ' ', true)
+	if len(sections) < 2 {
+		return influxLine{}, fmt.Errorf("no fields")
+	}
+	if len(sections) > 3 {
+		return influxLine{}, fmt.Errorf("unexpected text after the timestamp")
+	}
+
+	var p influxLine
+
+	keys := splitInflux(sections[0], ',', false)
+	p.measurement = influxUnescape(keys[0])
+	if p.measurement == "" {
+		return influxLine{}, fmt.Errorf("no measurement")
+	}
+
+	for _, t := range keys[1:] {
+		k, v, ok := cutInflux(t)
+		if !ok || k == "" || v == "" {
+			return influxLine{}, fmt.Errorf("tag %q is not key=value", t)
+		}
+		if p.tags == nil {
+			p.tags = make(map[string]string)
+		}
+		p.tags[influxUnescape(k)] = influxUnescape(v)
+	}
+
+	for _, f := range splitInflux(sections[1], ',', true) {
+		k, v, ok := cutInflux(f)
+		if !ok || k == "" || v == "" {
+			return influxLine{}, fmt.Errorf("field %q is not key=value", f)
+		}
+		field, err := parseInfluxValue(v)
+		if err != nil {
+			return influxLine{}, fmt.Errorf("field %v: %w", influxUnescape(k), err)
+		}
+		field.key = influxUnescape(k)
+		p.fields = append(p.fields, field)
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return influxLine{}, fmt.Errorf("timestamp %q is not an integer", sections[2])
+		}
+		p.time = time.Unix(0, 0).Add(time.Duration(ts) * precision)
+	}
+
+	return p, nil
+}
+
+// parseInfluxValue reads a field value: a float, an integer ending in i, an
+// unsigned integer ending in u, a boolean, or a double quoted string.
+func parseInfluxValue(v string) (influxField, error) {
+	if v[0] == '"' {
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return influxField{}, fmt.Errorf("string %v is not closed", v)
+		}
+		r := strings.NewReplacer(`\"`, `"`, `\\`, `\`)
+		return influxField{text: r.Replace(v[1 : len(v)-1]), isText: true}, nil
+	}
+
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return influxField{num: 1}, nil
+	case "f", "F", "false", "False", "FALSE":
+		return influxField{num: 0}, nil
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return influxField{}, fmt.Errorf("%v is not an integer", v)
+		}
+		return influxField{num: float64(n)}, nil
+	case 'u':
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return influxField{}, fmt.Errorf("%v is not an unsigned integer", v)
+		}
+		return influxField{num: float64(n)}, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return influxField{}, fmt.Errorf("%v is not a number", v)
+	}
+	return influxField{num: f}, nil
+}
+
+// splitInflux splits s at each sep that is not escaped, nor inside double
+// quotes when quotes is set, which is only the case in the field section.
+func splitInflux(s string, sep byte, quotes bool) []string {
+	var (
+		out    []string
+		start  int
+		quoted bool
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(out, s[start:])
+}
+
+// cutInflux splits a key=value pair at the first equals sign that is not
+// escaped.
+func cutInflux(s string) (key, value string, ok bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// influxUnescape removes the backslashes escaping commas, spaces, equals signs
+// and backslashes in a name. A backslash before anything else is kept.
+func influxUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
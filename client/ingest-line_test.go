@@ -0,0 +1,83 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    influxLine
+		wantErr bool
+	}{
+		{line: "cpu usage=0.5", want: influxLine{measurement: "cpu",
+			fields: []influxField{{key: "usage", num: 0.5}}}},
+		{line: "cpu,host=a,region=us-west usage=1,idle=99i 1700000000000000000",
+			want: influxLine{measurement: "cpu",
+				tags:   map[string]string{"host": "a", "region": "us-west"},
+				fields: []influxField{{key: "usage", num: 1}, {key: "idle", num: 99}},
+				time:   time.Unix(1700000000, 0)}},
+		{line: `disk\ io,path=/var\,log used=12u,ok=t,state="a \"b\", c"`,
+			want: influxLine{measurement: "disk io",
+				tags: map[string]string{"path": "/var,log"},
+				fields: []influxField{{key: "used", num: 12}, {key: "ok", num: 1},
+					{key: "state", text: `a "b", c`, isText: true}}}},
+		{line: `m,k\=1=v\ 2 f\,x=FALSE`, want: influxLine{measurement: "m",
+			tags:   map[string]string{"k=1": "v 2"},
+			fields: []influxField{{key: "f,x", num: 0}}}},
+		{line: "cpu", wantErr: true},
+		{line: "cpu usage", wantErr: true},
+		{line: "cpu,host usage=1", wantErr: true},
+		{line: "cpu usage=abc", wantErr: true},
+		{line: "cpu usage=1x", wantErr: true},
+		{line: `cpu state="open`, wantErr: true},
+		{line: "cpu usage=1 now", wantErr: true},
+		{line: "cpu usage=1 1 2", wantErr: true},
+		{line: ",host=a usage=1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseInfluxLine(test.line, time.Nanosecond)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.line, err)
+			continue
+		}
+		if !got.time.Equal(test.want.time) {
+			t.Errorf("%v: time %v, expected %v", test.line, got.time, test.want.time)
+		}
+		got.time = test.want.time
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v:\n got %+v\nwant %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseInfluxLines(t *testing.T) {
+	write := "# a comment\ncpu usage=1 1700000000\n\ncpu usage\nmem used=2 1700000001\n"
+
+	lines, errs := parseInfluxLines([]byte(write), 10, time.Second)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %v", len(lines))
+	}
+	if lines[0].line != 11 || lines[1].line != 14 {
+		t.Errorf("wrong line numbers %v and %v", lines[0].line, lines[1].line)
+	}
+	if !lines[1].time.Equal(time.Unix(1700000001, 0)) {
+		t.Errorf("wrong time %v", lines[1].time)
+	}
+	if len(errs) != 1 || errs[0] != "line 13: field \"usage\" is not key=value" {
+		t.Errorf("wrong errors %q", errs)
+	}
+
+	if _, err := influxPrecision("h"); err == nil {
+		t.Error("hours are not a precision")
+	}
+}
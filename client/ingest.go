@@ -0,0 +1,727 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ingestMaxNodesDefault bounds how many nodes a tag schema creates when the
+// ingest node does not set a limit of its own.
+const ingestMaxNodesDefault = 1000
+
+// ingestMeasurement is the tag schema level that stands for the measurement.
+const ingestMeasurement = "_measurement"
+
+// ingestMaxErrors is how many rejected lines a write reports, so a write of
+// bad lines does not get a reply as long as itself.
+const ingestMaxErrors = 5
+
+// ingestTCPBatch is how many lines read from a TCP connection are written
+// together.
+const ingestTCPBatch = 5000
+
+// ingestPrecisionHeader is the NATS header the HTTP API passes the precision
+// of a write in.
+const ingestPrecisionHeader = "Precision"
+
+// ingestRestartWait is how long a write waits for an ingest node that is not
+// taking writes, as it does for a moment when the nodes below it change.
+const ingestRestartWait = 5 * time.Second
+
+// ingestLineHeader is the NATS header holding the number of the first line of
+// a message in the write it was split from, so errors name the right line.
+const ingestLineHeader = "Line"
+
+// SubjectIngest returns the NATS subject an ingest node takes writes of line
+// protocol on. The reply is empty, or says which lines were rejected.
+func SubjectIngest(nodeID string) string {
+	return "ingest." + nodeID
+}
+
+// IngestWrite writes line protocol to an ingest node, with timestamps in the
+// precision given, and returns the lines it rejected as an error. A write
+// larger than a NATS message is split at line boundaries. The ingest client
+// restarts when it adds a node, so a write waits a little for it to come back.
+func IngestWrite(nc *nats.Conn, nodeID string, lines []byte, precision string) error {
+	// leave room for the headers
+	limit := int(nc.MaxPayload()) - 1024
+	if limit <= 0 {
+		limit = 512 * 1024
+	}
+
+	var rejected []string
+	first := 1
+
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > limit {
+			i := bytes.LastIndexByte(lines[:limit], '\n')
+			if i < 0 {
+				return fmt.Errorf("line %v is longer than %v bytes", first, limit)
+			}
+			n = i + 1
+		}
+
+		msg := nats.NewMsg(SubjectIngest(nodeID))
+		msg.Header.Set(ingestPrecisionHeader, precision)
+		msg.Header.Set(ingestLineHeader, strconv.Itoa(first))
+		msg.Data = lines[:n]
+
+		var resp *nats.Msg
+		var err error
+		start := time.Now()
+		for {
+			resp, err = nc.RequestMsg(msg, 20*time.Second)
+			if !errors.Is(err, nats.ErrNoResponders) || time.Since(start) > ingestRestartWait {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Data) > 0 {
+			rejected = append(rejected, string(resp.Data))
+		}
+
+		first += bytes.Count(lines[:n], []byte{'\n'})
+		lines = lines[n:]
+	}
+
+	if len(rejected) > 0 {
+		return errors.New(strings.Join(rejected, "; "))
+	}
+
+	return nil
+}
+
+// Ingest accepts InfluxDB line protocol and writes it as points on nodes
+// created from its tags. The tag schema names the tags whose values name the
+// nodes, outermost first, and the measurement, the other tags and the field
+// name make up the key of each point.
+type Ingest struct {
+	ID          string `node:"id"`
+	Parent      string `node:"parent"`
+	Description string `point:"description"`
+	Disabled    bool   `point:"disabled"`
+	Debug       int    `point:"debug"`
+	Error       string `point:"error"`
+	// TagSchema names the tags that make up the nodes, such as "site/host".
+	// Blank uses the measurement alone.
+	TagSchema string `point:"tagSchema"`
+	// MaxNodes bounds how many nodes the tag schema creates. Zero uses the
+	// default of 1000.
+	MaxNodes int `point:"maxNodes"`
+	// ListenUDP and ListenTCP are addresses to accept line protocol on, such
+	// as ":8089". Blank does not listen.
+	ListenUDP string `point:"listenUDP"`
+	ListenTCP string `point:"listenTCP"`
+	// Precision is the unit of the timestamps that arrive on the listeners.
+	// Blank is nanoseconds.
+	Precision string `point:"precision"`
+}
+
+// ingestWrite is a write of line protocol for the client run loop. done
+// receives the result, unless the write came from a listener, which has no one
+// to tell and takes its precision from the node.
+type ingestWrite struct {
+	lines     []byte
+	precision string
+	// first is the number of the first line
+	first    int
+	listener bool
+	done     chan error
+}
+
+// IngestClient writes line protocol from the HTTP API and its listeners.
+type IngestClient struct {
+	nc            *nats.Conn
+	config        Ingest
+	stop          chan struct{}
+	newPoints     chan NewPoints
+	newEdgePoints chan NewPoints
+	writes        chan ingestWrite
+
+	sub *nats.Subscription
+	udp net.PacketConn
+	tcp net.Listener
+	// listening holds the addresses the listeners were opened on, so an edit
+	// reopens them
+	listenUDP, listenTCP string
+
+	// schema is the tag schema nodes was built for
+	schema []string
+	// nodes indexes auto-created nodes by the tag values they came from,
+	// joined with "/"
+	nodes map[string]string
+	// full records whether the node limit has been reported
+	full bool
+}
+
+// NewIngestClient returns a new ingest client for the given node
+func NewIngestClient(nc *nats.Conn, config Ingest) Client {
+	return &IngestClient{
+		nc:            nc,
+		config:        config,
+		stop:          make(chan struct{}),
+		newPoints:     make(chan NewPoints),
+		newEdgePoints: make(chan NewPoints),
+		writes:        make(chan ingestWrite),
+	}
+}
+
+// Run runs the main logic for this client and blocks until stopped
+func (c *IngestClient) Run() error {
+	log.Println("Starting ingest client:", c.config.Description)
+
+	var err error
+	c.sub, err = c.nc.Subscribe(SubjectIngest(c.config.ID), func(msg *nats.Msg) {
+		first, _ := strconv.Atoi(msg.Header.Get(ingestLineHeader))
+		w := ingestWrite{
+			lines:     msg.Data,
+			precision: msg.Header.Get(ingestPrecisionHeader),
+			first:     max(first, 1),
+			done:      make(chan error, 1),
+		}
+
+		var reply string
+		select {
+		case c.writes <- w:
+			if err := <-w.done; err != nil {
+				reply = err.Error()
+			}
+		case <-c.stop:
+			reply = "ingest node is restarting"
+		}
+
+		if err := msg.Respond([]byte(reply)); err != nil {
+			log.Println("Ingest: error replying to write:", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to writes: %w", err)
+	}
+
+	c.sync()
+
+done:
+	for {
+		select {
+		case <-c.stop:
+			break done
+
+		case pts := <-c.newPoints:
+			// points also arrive for the nodes created below this one,
+			// which are not part of this client's configuration
+			if pts.ID != c.config.ID {
+				break
+			}
+
+			if err := data.MergePoints(pts.ID, pts.Points, &c.config); err != nil {
+				log.Println("Ingest: error merging new points:", err)
+			}
+
+			c.sync()
+
+		case pts := <-c.newEdgePoints:
+			if pts.ID != c.config.ID {
+				break
+			}
+
+			if err := data.MergeEdgePoints(pts.ID, pts.Parent, pts.Points, &c.config); err != nil {
+				log.Println("Ingest: error merging new edge points:", err)
+			}
+
+		case w := <-c.writes:
+			err := c.write(w)
+			if !w.listener {
+				w.done <- err
+			} else if err != nil && c.config.Debug > 0 {
+				log.Printf("Ingest %v: %v\n", c.config.Description, err)
+			}
+		}
+	}
+
+	log.Println("Stopping ingest client:", c.config.Description)
+
+	if err := c.sub.Unsubscribe(); err != nil {
+		log.Println("Ingest: error unsubscribing:", err)
+	}
+	c.closeUDP()
+	c.closeTCP()
+
+	return nil
+}
+
+// Stop sends a signal to the Run function to exit
+func (c *IngestClient) Stop(_ error) {
+	close(c.stop)
+}
+
+// Points is called by the Manager when new points for this node are received.
+func (c *IngestClient) Points(nodeID string, points []data.Point) {
+	c.newPoints <- NewPoints{nodeID, "", points}
+}
+
+// EdgePoints is called by the Manager when new edge points for this node are
+// received.
+func (c *IngestClient) EdgePoints(nodeID, parentID string, points []data.Point) {
+	c.newEdgePoints <- NewPoints{nodeID, parentID, points}
+}
+
+// sync brings the listeners and the node index in line with the
+// configuration.
+func (c *IngestClient) sync() {
+	schema := ingestSchema(c.config.TagSchema)
+	if c.nodes == nil || strings.Join(schema, "/") != strings.Join(c.schema, "/") {
+		c.schema = schema
+		c.nodes = make(map[string]string)
+		if err := c.load(); err != nil {
+			log.Printf("Ingest %v: error loading nodes: %v\n", c.config.Description, err)
+		}
+	}
+
+	var errs []string
+
+	udp, tcp := c.config.ListenUDP, c.config.ListenTCP
+	if c.config.Disabled {
+		udp, tcp = "", ""
+	}
+
+	if udp != c.listenUDP {
+		c.closeUDP()
+		if udp != "" {
+			if err := c.openUDP(udp); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if tcp != c.listenTCP {
+		c.closeTCP()
+		if tcp != "" {
+			if err := c.openTCP(tcp); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if _, err := influxPrecision(c.config.Precision); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	c.setError(strings.Join(errs, "; "))
+}
+
+// ingestSchema reads a tag schema. Blank is the measurement alone.
+func ingestSchema(s string) []string {
+	var levels []string
+	for _, l := range strings.Split(s, "/") {
+		if l = strings.TrimSpace(l); l != "" {
+			levels = append(levels, l)
+		}
+	}
+	if len(levels) == 0 {
+		return []string{ingestMeasurement}
+	}
+	return levels
+}
+
+// load indexes the nodes a previous run created. Intermediate levels are group
+// nodes and the last level is an ingestDevice, and each carries an id point
+// holding the tag value it came from.
+func (c *IngestClient) load() error {
+	depth := len(c.schema)
+
+	var walk func(parentID string, path []string, level int) error
+
+	walk = func(parentID string, path []string, level int) error {
+		nodeType := data.NodeTypeGroup
+		if level == depth-1 {
+			nodeType = data.NodeTypeIngestDevice
+		}
+
+		nodes, err := GetNodes(c.nc, parentID, "all", nodeType, false)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range nodes {
+			identity := nodeIdentity(n)
+			if identity == "" {
+				continue
+			}
+
+			p := append(append([]string{}, path...), identity)
+			c.nodes[strings.Join(p, "/")] = n.ID
+
+			if level < depth-1 {
+				if err := walk(n.ID, p, level+1); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return walk(c.config.ID, nil, 0)
+}
+
+// write writes the points of a write of line protocol to the nodes their tags
+// name, creating the nodes the first time. Lines that cannot be written are
+// returned as the error, after the others are written.
+func (c *IngestClient) write(w ingestWrite) error {
+	if c.config.Disabled {
+		return errors.New("ingest node is disabled")
+	}
+
+	p := w.precision
+	if w.listener {
+		p = c.config.Precision
+	}
+
+	precision, err := influxPrecision(p)
+	if err != nil {
+		return err
+	}
+
+	lines, errs := parseInfluxLines(w.lines, w.first, precision)
+
+	now := time.Now()
+	byNode := make(map[string]data.Points)
+	var order []string
+
+	for _, l := range lines {
+		values, ok := c.levels(l)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("line %v: missing a tag of the tag schema %v",
+				l.line, strings.Join(c.schema, "/")))
+			continue
+		}
+
+		nodeID, err := c.ensureNodes(values)
+		if err != nil {
+			c.reportFull(err)
+			errs = append(errs, fmt.Sprintf("line %v: %v", l.line, err))
+			continue
+		}
+
+		if _, ok := byNode[nodeID]; !ok {
+			order = append(order, nodeID)
+		}
+		byNode[nodeID] = append(byNode[nodeID], c.points(l, now)...)
+	}
+
+	// an HTTP write is answered once the store has its points; the listeners
+	// have no one to answer
+	for _, id := range order {
+		if err := SendNodePoints(c.nc, id, byNode[id], !w.listener); err != nil {
+			return fmt.Errorf("error sending points: %w", err)
+		}
+	}
+
+	if c.config.Debug > 0 {
+		log.Printf("Ingest %v: wrote %v lines, rejected %v\n", c.config.Description,
+			len(lines), len(errs))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	rejected := len(errs)
+	if len(errs) > ingestMaxErrors {
+		errs = errs[:ingestMaxErrors]
+	}
+	return fmt.Errorf("%v lines rejected: %v", rejected, strings.Join(errs, "; "))
+}
+
+// levels returns the values of the schema levels of a line.
+func (c *IngestClient) levels(l influxLine) ([]string, bool) {
+	values := make([]string, 0, len(c.schema))
+	for _, s := range c.schema {
+		v := l.measurement
+		if s != ingestMeasurement {
+			v = l.tags[s]
+		}
+		if v == "" {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+// points maps the fields of a line into points. The key is the measurement,
+// unless the schema uses it, then the values of the tags the schema does not
+// use, in order of the tag names, then the field name.
+func (c *IngestClient) points(l influxLine, now time.Time) data.Points {
+	var prefix []string
+
+	inSchema := make(map[string]bool)
+	for _, s := range c.schema {
+		inSchema[s] = true
+	}
+
+	if !inSchema[ingestMeasurement] {
+		prefix = append(prefix, data.SubjectSafeToken(l.measurement))
+	}
+
+	tags := make([]string, 0, len(l.tags))
+	for t := range l.tags {
+		if !inSchema[t] {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	for _, t := range tags {
+		prefix = append(prefix, data.SubjectSafeToken(l.tags[t]))
+	}
+
+	ts := l.time
+	if ts.IsZero() {
+		ts = now
+	}
+
+	pts := make(data.Points, 0, len(l.fields))
+	for _, f := range l.fields {
+		key := strings.Join(append(append([]string{}, prefix...),
+			data.SubjectSafeToken(f.key)), "/")
+
+		var p data.Point
+		if f.isText {
+			p = data.NewPointString(data.PointTypeValue, key, f.text)
+		} else {
+			p = data.NewPointFloat(data.PointTypeValue, key, f.num)
+		}
+		p.Time = ts
+		p.Origin = c.config.ID
+		pts = append(pts, p)
+	}
+
+	return pts
+}
+
+// ensureNodes walks the schema levels of a line, creating a node for each one
+// that does not have one yet, and returns the device node the points belong
+// on.
+func (c *IngestClient) ensureNodes(values []string) (string, error) {
+	maxNodes := c.config.MaxNodes
+	if maxNodes <= 0 {
+		maxNodes = ingestMaxNodesDefault
+	}
+
+	parentID := c.config.ID
+
+	for i, v := range values {
+		key := strings.Join(values[:i+1], "/")
+
+		id, ok := c.nodes[key]
+
+		if !ok {
+			if len(c.nodes) >= maxNodes {
+				return "", fmt.Errorf(
+					"the tag schema has created its limit of %v nodes; new series are being dropped",
+					maxNodes)
+			}
+
+			id = uuid.New().String()
+
+			nodeType := data.NodeTypeGroup
+			if i == len(values)-1 {
+				nodeType = data.NodeTypeIngestDevice
+			}
+
+			label := strings.TrimPrefix(c.schema[i], "_")
+
+			node := data.NodeEdge{
+				ID:     id,
+				Parent: parentID,
+				Type:   nodeType,
+				Points: data.Points{
+					data.NewPointString(data.PointTypeDescription, "", v),
+					data.NewPointString(data.PointTypeID, "", v),
+					data.NewPointString(data.PointTypeTag, data.SubjectSafeToken(label), v),
+				},
+			}
+
+			if err := SendNode(c.nc, node, c.config.ID); err != nil {
+				return "", fmt.Errorf("error creating %v node %v: %w", nodeType, key, err)
+			}
+
+			log.Printf("Ingest %v: added %v %v\n", c.config.Description, nodeType, key)
+
+			c.nodes[key] = id
+			c.clearFull()
+		}
+
+		parentID = id
+	}
+
+	return parentID, nil
+}
+
+// reportFull writes the node limit error on the ingest node once.
+func (c *IngestClient) reportFull(err error) {
+	if c.full {
+		return
+	}
+
+	c.full = true
+
+	log.Printf("Ingest %v: %v\n", c.config.Description, err)
+	c.setError(err.Error())
+}
+
+func (c *IngestClient) clearFull() {
+	if !c.full {
+		return
+	}
+
+	c.full = false
+	c.setError("")
+}
+
+// setError writes the error point of the ingest node when it changes.
+func (c *IngestClient) setError(e string) {
+	if c.config.Error == e {
+		return
+	}
+
+	c.config.Error = e
+
+	p := data.NewPointString(data.PointTypeError, "", e)
+	p.Origin = c.config.ID
+
+	if err := SendNodePoint(c.nc, c.config.ID, p, false); err != nil {
+		log.Println("Ingest: error sending error point:", err)
+	}
+}
+
+// queue hands lines from a listener to the run loop. It returns false once the
+// client is stopping.
+func (c *IngestClient) queue(lines []byte) bool {
+	select {
+	case c.writes <- ingestWrite{lines: lines, first: 1, listener: true}:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+func (c *IngestClient) openUDP(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on UDP %v: %w", addr, err)
+	}
+
+	c.udp = conn
+	c.listenUDP = addr
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !c.queue(append([]byte{}, buf[:n]...)) {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *IngestClient) closeUDP() {
+	if c.udp != nil {
+		_ = c.udp.Close()
+	}
+	c.udp = nil
+	c.listenUDP = ""
+}
+
+func (c *IngestClient) openTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on TCP %v: %w", addr, err)
+	}
+
+	c.tcp = ln
+	c.listenTCP = addr
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.readTCP(conn)
+		}
+	}()
+
+	return nil
+}
+
+// readTCP writes the lines of a TCP connection, a batch at a time: the lines
+// already read when no more are waiting, up to ingestTCPBatch.
+func (c *IngestClient) readTCP(conn net.Conn) {
+	defer conn.Close()
+
+	// the connection ends when the client stops
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-c.stop:
+		case <-stop:
+		}
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	var batch []byte
+	n := 0
+
+	for {
+		line, err := r.ReadBytes('\n')
+		batch = append(batch, line...)
+		if len(line) > 0 {
+			n++
+		}
+
+		if len(batch) > 0 && (err != nil || r.Buffered() == 0 || n >= ingestTCPBatch) {
+			if !c.queue(batch) {
+				return
+			}
+			batch, n = nil, 0
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *IngestClient) closeTCP() {
+	if c.tcp != nil {
+		_ = c.tcp.Close()
+	}
+	c.tcp = nil
+	c.listenTCP = ""
+}
@@ -0,0 +1,132 @@
+package client_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+// influxWrite posts line protocol to the test server's InfluxDB write API and
+// returns the status and error message.
+func influxWrite(t *testing.T, bucket, lines string) (int, string) {
+	t.Helper()
+
+	u := fmt.Sprintf("http://localhost:%v/api/v2/write?org=siot&bucket=%v&precision=s",
+		server.TestServerOptions.HTTPPort, bucket)
+
+	resp, err := http.Post(u, "text/plain; charset=utf-8", strings.NewReader(lines))
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	var e struct{ Message string }
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	return resp.StatusCode, e.Message
+}
+
+// TestIngest writes line protocol over HTTP, TCP and UDP, and checks the nodes
+// the tag schema creates, the point keys, and the node limit.
+func TestIngest(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	in := client.Ingest{
+		ID:          "ingest-test",
+		Parent:      root.ID,
+		Description: "Telegraf",
+		TagSchema:   "site/host",
+		MaxNodes:    3,
+	}
+
+	if err := client.SendNodeType(nc, in, "test"); err != nil {
+		t.Fatal("Error creating ingest node: ", err)
+	}
+
+	// the client starts a little after its node is created
+	waitFor(t, 10*time.Second, "the ingest node to take writes", func() bool {
+		status, _ := influxWrite(t, in.ID, "cpu,site=s1,host=h1,cpu=cpu0 usage=1.5 1700000000\n")
+		return status == http.StatusNoContent
+	})
+
+	hostID := schemaFind(t, nc, in.ID, "s1", "h1")
+	if hostID == "" {
+		t.Fatal("the site and host nodes were not created")
+	}
+
+	p, ok := spNodePoint(t, nc, hostID, data.PointTypeValue, "cpu/cpu0/usage")
+	if !ok || p.Val() != 1.5 || !p.Time.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("wrong point: %v", p)
+	}
+
+	if p, ok := spNodePoint(t, nc, hostID, data.PointTypeTag, "host"); !ok || p.Txt() != "h1" {
+		t.Fatal("the host node did not get its tag")
+	}
+
+	// the good lines of a write are kept
+	status, msg := influxWrite(t, in.ID,
+		"mem,site=s1,host=h1 used=2\nmem,site=s1 used=3\nmem,site=s1,host=h1 used=\n")
+	if status != http.StatusBadRequest || !strings.Contains(msg, "2 lines rejected") ||
+		!strings.Contains(msg, "line 2:") || !strings.Contains(msg, "line 3:") {
+		t.Fatalf("write with bad lines returned %v: %v", status, msg)
+	}
+	if v := pointValue(t, nc, hostID, "mem/used"); v != 2 {
+		t.Fatalf("the good line was not written: %v", v)
+	}
+
+	// s1, h1 and h2 fill the limit of three nodes
+	if status, msg := influxWrite(t, in.ID, "mem,site=s1,host=h2 used=4\n"); status != http.StatusNoContent {
+		t.Fatalf("write returned %v: %v", status, msg)
+	}
+	status, msg = influxWrite(t, in.ID, "mem,site=s2,host=h1 used=5\n")
+	if status != http.StatusBadRequest || !strings.Contains(msg, "limit of 3 nodes") {
+		t.Fatalf("write past the node limit returned %v: %v", status, msg)
+	}
+	waitFor(t, 5*time.Second, "the node limit to be reported on the ingest node", func() bool {
+		p, ok := spNodePoint(t, nc, in.ID, data.PointTypeError, "")
+		return ok && strings.Contains(p.Txt(), "limit")
+	})
+
+	if status, _ := influxWrite(t, "no-such-node", "cpu usage=1\n"); status != http.StatusNotFound {
+		t.Fatal("write to an unknown bucket returned", status)
+	}
+
+	// the listeners
+	tcpAddr := "127.0.0.1:" + freePort(t)
+	udpAddr := "127.0.0.1:" + freePort(t)
+	sendPoint(t, nc, in.ID, data.NewPointString(data.PointTypeListenTCP, "", tcpAddr))
+	sendPoint(t, nc, in.ID, data.NewPointString(data.PointTypeListenUDP, "", udpAddr))
+
+	for _, l := range []struct{ network, addr, measurement string }{
+		{"tcp", tcpAddr, "tcp"},
+		{"udp", udpAddr, "udp"},
+	} {
+		line := fmt.Sprintf("%v,site=s1,host=h2 n=7\n", l.measurement)
+		waitFor(t, 10*time.Second, l.network+" lines to be written", func() bool {
+			conn, err := net.Dial(l.network, l.addr)
+			if err != nil {
+				return false
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return false
+			}
+			time.Sleep(50 * time.Millisecond)
+			id := schemaFind(t, nc, in.ID, "s1", "h2")
+			return math.Abs(pointValue(t, nc, id, l.measurement+"/n")-7) < 1e-9
+		})
+	}
+}
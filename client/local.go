@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// GetLocalPoints returns the points of a node that are secret to this
+// instance, such as the nkeySeed of a sync node. The store keeps them out of
+// the streams and out of the nodes it returns, and only the instance's own
+// connections may ask for them.
+func GetLocalPoints(nc *nats.Conn, nodeID string) (data.Points, error) {
+	return localRequest(nc, nodeID, nil)
+}
+
+// SendLocalPoints writes local points of a node. They are not sent to the
+// subscribers of the node's points.
+func SendLocalPoints(nc *nats.Conn, nodeID string, points data.Points) error {
+	_, err := localRequest(nc, nodeID, points.Encode())
+	return err
+}
+
+func localRequest(nc *nats.Conn, nodeID string, payload []byte) (data.Points, error) {
+	msg, err := nc.Request(fmt.Sprintf("local.%v", nodeID), payload, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.LocalPointsResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Points, nil
+}
+
+// localText returns the text of a node's local point, or "" if it has none.
+func localText(nc *nats.Conn, nodeID, typ string) (string, error) {
+	pts, err := GetLocalPoints(nc, nodeID)
+	if err != nil {
+		return "", err
+	}
+	txt, _ := pts.Text(typ, "")
+	return txt, nil
+}
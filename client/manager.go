@@ -34,6 +34,8 @@ type Manager[T any] struct {
 
 	// subscription to listen for new points
 	upSub *nats.Subscription
+
+	counts managerCounts
 }
 
 // NewManager takes constructor for a node client and returns a Manager for that client
@@ -69,6 +71,9 @@ func (m *Manager[T]) Run() error {
 		return err
 	}
 
+	registerManager(m)
+	defer unregisterManager(m)
+
 	// TODO: it may make sense at some point to have a special topic
 	// for new nodes so that all client managers don't have to listen
 	// to all points
@@ -161,6 +166,7 @@ done:
 			// client state must be deleted after the subscription is stopped
 			// as the subscription uses it
 			delete(m.clientStates, key)
+			m.counts.clients.Store(int64(len(m.clientStates)))
 
 			if stopping {
 				if len(m.clientStates) <= 0 {
@@ -184,6 +190,10 @@ done:
 	return nil
 }
 
+func (m *Manager[T]) stats() (string, int64, int64) {
+	return m.nodeType, m.counts.clients.Load(), m.counts.starts.Load()
+}
+
 // Stop manager. This also stops all registered clients and causes Start to exit.
 func (m *Manager[T]) Stop(_ error) {
 	close(m.stop)
@@ -270,6 +280,8 @@ func (m *Manager[T]) scan() error {
 		}()
 
 		m.clientStates[key] = cs
+		m.counts.clients.Store(int64(len(m.clientStates)))
+		m.counts.starts.Add(1)
 
 		// Set up subscriptions
 		subject := fmt.Sprintf("up.%v.>", cs.node.ID)
@@ -570,11 +570,15 @@ func TestManagerChildren(t *testing.T) {
 	}
 
 	// since this test does a lot of node modifications, let's use this as an opportunity
-	// to verify the database hashes
-	err = client.AdminStoreVerify(nc)
+	// to verify the store
+	issues, err := client.AdminStoreVerify(nc)
 	if err != nil {
 		t.Fatal("Verify failed: ", err)
 	}
+
+	if len(issues) > 0 {
+		t.Fatal("Verify found problems: ", issues)
+	}
 }
 
 // Some clients, like rules, rely on child nodes and we want to make sure if
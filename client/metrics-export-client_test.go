@@ -0,0 +1,91 @@
+package client_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+// scrape fetches the test server's /metrics endpoint. The connection is not
+// kept alive, since one left idle by an earlier test would reach the stopped
+// server of that test.
+func scrape(t *testing.T, query string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%v/metrics?%v",
+		server.TestServerOptions.HTTPPort, query), nil)
+	if err != nil {
+		t.Fatal("Error creating request: ", err)
+	}
+	req.Close = true
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error scraping: ", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Error reading scrape: ", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// TestMetricsExport scrapes the point values of a variable node, labelled with
+// the tag it inherits from the root node, and the internal metrics.
+func TestMetricsExport(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	sendPoint(t, nc, root.ID, data.NewPointString(data.PointTypeTag, "site", "plant-07"))
+
+	v := client.Variable{
+		ID:          "tank-level",
+		Parent:      root.ID,
+		Description: "Tank",
+		Value:       map[string]float64{"0": 42.5},
+	}
+	if err := client.SendNodeType(nc, v, "test"); err != nil {
+		t.Fatal("Error creating variable node: ", err)
+	}
+
+	exp := `siot_value{node_description="Tank",node_id="tank-level",` +
+		`node_tag_site="plant-07",node_type="variable"} 42.5`
+
+	var body string
+	waitFor(t, 5*time.Second, "the variable to be scraped", func() bool {
+		var status int
+		status, body = scrape(t, "")
+		return status == http.StatusOK && strings.Contains(body, exp)
+	})
+
+	for _, m := range []string{"# TYPE siot_value gauge", "siot_store_nodes ",
+		"# TYPE siot_store_points_total counter", `siot_clients{type="db"}`} {
+		if !strings.Contains(body, m) {
+			t.Errorf("scrape is missing %q:\n%v", m, body)
+		}
+	}
+
+	// a selected subtree sets the tag boundary and limits the nodes
+	status, body := scrape(t, "node=tank-level&type=value")
+	if status != http.StatusOK || !strings.Contains(body,
+		`siot_value{node_description="Tank",node_id="tank-level",node_type="variable"} 42.5`) {
+		t.Fatalf("subtree scrape returned %v:\n%v", status, body)
+	}
+
+	if status, _ := scrape(t, "node=no-such-node"); status != http.StatusNotFound {
+		t.Fatal("scrape of an unknown node returned", status)
+	}
+}
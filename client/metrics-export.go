@@ -0,0 +1,235 @@
+package client
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// This file turns SIOT state into Prometheus metrics for the HTTP API's
+// /metrics endpoint: the current numeric points of the nodes in a subtree, and
+// the internal metrics of the client managers and sync connections.
+
+// PromMetric is one sample of a Prometheus metric.
+type PromMetric struct {
+	Name    string
+	Help    string
+	Counter bool
+	Labels  map[string]string
+	Value   float64
+}
+
+// PromPointPrefix starts the name of every metric exported from a point. The
+// rest of the name is the point type.
+const PromPointPrefix = "siot_"
+
+// PromPoints returns the current numeric points of nodes as gauges named by
+// their point type, such as siot_value. Each is labelled with its point key,
+// and with the node's ID, description, type and tags, including those it
+// inherits from the nodes above it up to and including boundary, the way the
+// Db client tags points (see nodeCache). tagPointTypes are the point types
+// that make tags, and pointTypes, if any are given, limits the points
+// exported. A node in the tree more than once is exported once.
+func PromPoints(nodes []data.NodeEdge, boundary string, tagPointTypes, pointTypes []string) []PromMetric {
+	instances := make(map[string][]data.NodeEdge)
+	var ids []string
+	for _, n := range nodes {
+		if _, ok := instances[n.ID]; !ok {
+			ids = append(ids, n.ID)
+		}
+		instances[n.ID] = append(instances[n.ID], n)
+	}
+
+	cache := newNodeCache(tagPointTypes, boundary)
+	cache.fetch = func(_ *nats.Conn, id string) ([]data.NodeEdge, error) {
+		return instances[id], nil
+	}
+
+	var ret []PromMetric
+
+	for _, id := range ids {
+		if err := cache.Update(nil, NewPoints{ID: id}); err != nil {
+			continue
+		}
+
+		tags := make(map[string]string)
+		cache.CopyTags(id, tags)
+
+		labels := make(map[string]string, len(tags))
+		for k, v := range tags {
+			if v != "" {
+				labels[PromName(k)] = v
+			}
+		}
+
+		for _, p := range instances[id][0].Points {
+			if !p.Numeric() || p.Tombstone%2 == 1 {
+				continue
+			}
+			if len(pointTypes) > 0 && !slices.Contains(pointTypes, p.Type) {
+				continue
+			}
+
+			l := labels
+			if p.Key != "" && p.Key != "0" {
+				l = make(map[string]string, len(labels)+1)
+				for k, v := range labels {
+					l[k] = v
+				}
+				l["key"] = p.Key
+			}
+
+			ret = append(ret, PromMetric{
+				Name:   PromPointPrefix + PromName(p.Type),
+				Help:   "Current value of the " + p.Type + " points of SIOT nodes.",
+				Labels: l,
+				Value:  p.Val(),
+			})
+		}
+	}
+
+	return ret
+}
+
+// PromName makes s a valid Prometheus metric or label name by replacing what
+// may not be in one with underscores.
+func PromName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// managerStats is what a running Manager reports for /metrics.
+type managerStats interface {
+	stats() (nodeType string, clients, starts int64)
+}
+
+// runningManagers holds the Managers running in this process.
+var runningManagers = struct {
+	sync.Mutex
+	m map[managerStats]bool
+}{m: make(map[managerStats]bool)}
+
+// managerCounts are the counts a Manager keeps for /metrics. They are updated
+// by the manager's run loop and read by scrapes.
+type managerCounts struct {
+	clients atomic.Int64
+	starts  atomic.Int64
+}
+
+func registerManager(m managerStats) {
+	runningManagers.Lock()
+	defer runningManagers.Unlock()
+	runningManagers.m[m] = true
+}
+
+func unregisterManager(m managerStats) {
+	runningManagers.Lock()
+	defer runningManagers.Unlock()
+	delete(runningManagers.m, m)
+}
+
+// ManagerMetrics returns how many clients each running client manager runs,
+// and how many it has started, which climbs when clients restart.
+func ManagerMetrics() []PromMetric {
+	runningManagers.Lock()
+	defer runningManagers.Unlock()
+
+	clients := make(map[string]int64)
+	starts := make(map[string]int64)
+	for m := range runningManagers.m {
+		t, c, s := m.stats()
+		clients[t] += c
+		starts[t] += s
+	}
+
+	var ret []PromMetric
+	for t := range clients {
+		ret = append(ret,
+			PromMetric{
+				Name:   "siot_clients",
+				Help:   "Clients running, by node type.",
+				Labels: map[string]string{"type": t},
+				Value:  float64(clients[t]),
+			},
+			PromMetric{
+				Name:    "siot_client_starts_total",
+				Help:    "Clients started, by node type, which grows as clients restart.",
+				Counter: true,
+				Labels:  map[string]string{"type": t},
+				Value:   float64(starts[t]),
+			})
+	}
+
+	return ret
+}
+
+// syncMetrics are the status points of a sync node exported by SyncMetrics,
+// with the help for each.
+var syncMetrics = []struct{ typ, name, help string }{
+	{data.PointTypeSyncConnected, "siot_sync_connected",
+		"1 while a sync connection is connected to its upstream."},
+	{data.PointTypeSyncBacklog, "siot_sync_backlog",
+		"Messages a sync connection has not yet pushed upstream."},
+	{data.PointTypeSyncLag, "siot_sync_lag_seconds",
+		"Age of the oldest message a sync connection has not yet pushed."},
+	{data.PointTypeSyncLastSync, "siot_sync_last_sync_timestamp_seconds",
+		"When a sync connection was last caught up in both directions."},
+	{data.PointTypeSyncRate, "siot_sync_rate_bytes_per_second",
+		"Bytes per second a sync connection moved lately."},
+	{data.PointTypeSyncBytesToday, "siot_sync_bytes_today",
+		"Bytes a sync connection used so far this UTC day."},
+	{data.PointTypeSyncPending, "siot_sync_pending",
+		"Messages waiting on a stream a sync connection pushes or pulls."},
+}
+
+// SyncMetrics returns the status of the sync connections below the root node,
+// from the points the sync clients keep on their nodes.
+func SyncMetrics(nc *nats.Conn) ([]PromMetric, error) {
+	root, err := GetRootNode(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := GetNodes(nc, root.ID, "all", data.NodeTypeSync, false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting sync nodes: %w", err)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	var ret []PromMetric
+	for _, n := range nodes {
+		desc := n.Desc()
+		for _, m := range syncMetrics {
+			for _, p := range n.Points {
+				if p.Type != m.typ || !p.Numeric() || p.Tombstone%2 == 1 {
+					continue
+				}
+				labels := map[string]string{"node_id": n.ID, "node_description": desc}
+				if m.typ == data.PointTypeSyncPending {
+					labels["stream"] = p.Key
+				}
+				ret = append(ret, PromMetric{Name: m.name, Help: m.help,
+					Labels: labels, Value: p.Val()})
+			}
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestPromName(t *testing.T) {
+	for in, exp := range map[string]string{
+		"value":          "value",
+		"node.tag.site":  "node_tag_site",
+		"1wire":          "_wire",
+		"temp-c":         "temp_c",
+		"":               "_",
+		"sys_cpu_temp_1": "sys_cpu_temp_1",
+	} {
+		if got := PromName(in); got != exp {
+			t.Errorf("PromName(%q) = %q, expected %q", in, got, exp)
+		}
+	}
+}
+
+func TestPromPoints(t *testing.T) {
+	gone := data.NewPointFloat(data.PointTypeValue, "gone", 1)
+	gone.Tombstone = 1
+
+	nodes := []data.NodeEdge{
+		{ID: "site", Type: data.NodeTypeGroup, Parent: "root", Points: data.Points{
+			data.NewPointString(data.PointTypeDescription, "", "Plant 7"),
+			data.NewPointString(data.PointTypeTag, "site", "plant-07"),
+		}},
+		{ID: "tank", Type: data.NodeTypeVariable, Parent: "site", Points: data.Points{
+			data.NewPointString(data.PointTypeDescription, "", "Tank"),
+			data.NewPointFloat(data.PointTypeValue, "", 12.5),
+			data.NewPointFloat(data.PointTypeValue, "2", 3),
+			data.NewPointFloat(data.PointTypeTemperature, "", 20),
+			gone,
+		}},
+	}
+
+	metrics := PromPoints(nodes, "site", []string{data.PointTypeTag},
+		[]string{data.PointTypeValue})
+
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %v: %+v", len(metrics), metrics)
+	}
+
+	m := metrics[0]
+	if m.Name != "siot_value" || m.Value != 12.5 || m.Counter {
+		t.Errorf("wrong metric: %+v", m)
+	}
+	if m.Labels["node_id"] != "tank" || m.Labels["node_description"] != "Tank" ||
+		m.Labels["node_tag_site"] != "plant-07" {
+		t.Errorf("wrong labels: %v", m.Labels)
+	}
+	if _, ok := m.Labels["key"]; ok {
+		t.Errorf("a point without a key got a key label: %v", m.Labels)
+	}
+	if metrics[1].Labels["key"] != "2" || metrics[1].Value != 3 {
+		t.Errorf("wrong keyed metric: %+v", metrics[1])
+	}
+}
@@ -22,6 +22,14 @@ import (
 // If parent is set and id is "all", then all child nodes are returned.
 // Parent can be set to "root" and id to "all" to fetch the root node(s).
 func GetNodes(nc *nats.Conn, parent, id, typ string, includeDel bool) ([]data.NodeEdge, error) {
+	return GetNodesAt(nc, parent, id, typ, includeDel, time.Time{})
+}
+
+// GetNodesAt works like [GetNodes], returning the nodes as they stood at a
+// time rather than as they are now. The store rebuilds the past tree from the
+// point history in its streams, so a node whose history before that time has
+// aged out of retention is not returned. A zero time returns current nodes.
+func GetNodesAt(nc *nats.Conn, parent, id, typ string, includeDel bool, at time.Time) ([]data.NodeEdge, error) {
 	if parent == "" {
 		parent = "none"
 	}
@@ -42,6 +50,11 @@ func GetNodes(nc *nats.Conn, parent, id, typ string, includeDel bool) ([]data.No
 			data.NewPointString(data.PointTypeNodeType, "", typ))
 	}
 
+	if !at.IsZero() {
+		requestPoints = append(requestPoints,
+			data.Point{Type: data.PointTypeAsOf, Time: at})
+	}
+
 	reqData := requestPoints.Encode()
 
 	subject := fmt.Sprintf("nodes.%v.%v", parent, id)
@@ -100,7 +113,8 @@ func GetRootNode(nc *nats.Conn) (data.NodeEdge, error) {
 	return rootNodes[0], nil
 }
 
-// GetNodesForUser gets all nodes for a user
+// GetNodesForUser gets all nodes for a user. For an API key, it gets the
+// nodes of the key's owner, limited to the key's scope.
 func GetNodesForUser(nc *nats.Conn, userID string) ([]data.NodeEdge, error) {
 	var none []data.NodeEdge
 	var ret []data.NodeEdge
@@ -109,6 +123,10 @@ func GetNodesForUser(nc *nats.Conn, userID string) ([]data.NodeEdge, error) {
 		return none, err
 	}
 
+	if len(userNodes) > 0 && userNodes[0].Type == data.NodeTypeAPIKey {
+		return getNodesForAPIKey(nc, userNodes)
+	}
+
 	var getChildren func(id string) ([]data.NodeEdge, error)
 
 	// getNodesHelper recursively gets children of a node
@@ -160,6 +178,110 @@ func GetNodesForUser(nc *nats.Conn, userID string) ([]data.NodeEdge, error) {
 	return ret, nil
 }
 
+// getNodesForAPIKey gets the nodes an API key can reach: those of the user
+// it is under, or those of the group it is under as if it were a user there,
+// within the subtree of its scope node.
+func getNodesForAPIKey(nc *nats.Conn, keyNodes []data.NodeEdge) ([]data.NodeEdge, error) {
+	var ret []data.NodeEdge
+	for _, kn := range keyNodes {
+		owner, err := GetNodes(nc, "all", kn.Parent, "", false)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(owner) > 0 && owner[0].Type == data.NodeTypeUser {
+			nodes, err := GetNodesForUser(nc, kn.Parent)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, nodes...)
+			continue
+		}
+
+		// the frontend expects the top level nodes to have Parent set to
+		// root
+		for i := range owner {
+			owner[i].Parent = "root"
+		}
+		ret = append(ret, owner...)
+
+		c, err := getDescendants(nc, kn.Parent)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c...)
+	}
+
+	scope, _ := keyNodes[0].Points.Text(data.PointTypeScope, "")
+	if scope != "" {
+		ret = nodesInSubtree(ret, scope)
+	}
+
+	return data.RemoveDuplicateNodesIDParent(ret), nil
+}
+
+// GetSubtree gets a node and the nodes below it.
+func GetSubtree(nc *nats.Conn, id string) ([]data.NodeEdge, error) {
+	ret, err := GetNodes(nc, "all", id, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := getDescendants(nc, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.RemoveDuplicateNodesIDParent(append(ret, c...)), nil
+}
+
+// getDescendants gets the nodes below id.
+func getDescendants(nc *nats.Conn, id string) ([]data.NodeEdge, error) {
+	children, err := GetNodes(nc, id, "all", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := children
+	for _, c := range children {
+		grands, err := getDescendants(nc, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, grands...)
+	}
+
+	return ret, nil
+}
+
+// nodesInSubtree returns the nodes of a list that are top or below it, with
+// top as a top level node.
+func nodesInSubtree(nodes []data.NodeEdge, top string) []data.NodeEdge {
+	in := map[string]bool{top: true}
+	for grew := true; grew; {
+		grew = false
+		for _, n := range nodes {
+			if in[n.Parent] && !in[n.ID] {
+				in[n.ID] = true
+				grew = true
+			}
+		}
+	}
+
+	var ret []data.NodeEdge
+	for _, n := range nodes {
+		switch {
+		case n.ID == top:
+			n.Parent = "root"
+			ret = append(ret, n)
+		case in[n.ID] && in[n.Parent]:
+			ret = append(ret, n)
+		}
+	}
+
+	return ret
+}
+
 // SendNode is used to send a node to a nats server. Can be
 // used to create nodes.
 func SendNode(nc *nats.Conn, node data.NodeEdge, origin string) error {
@@ -240,10 +362,10 @@ func SendNodeType[T any](nc *nats.Conn, node T, origin string) error {
 	return SendNode(nc, ne, origin)
 }
 
-func duplicateNodeHelper(nc *nats.Conn, node data.NodeEdge, newParent, origin string) error {
+func duplicateNodeHelper(nc *nats.Conn, node data.NodeEdge, newParent, origin string) (string, error) {
 	children, err := GetNodes(nc, node.ID, "all", "", false)
 	if err != nil {
-		return fmt.Errorf("GetNodes error: %v", err)
+		return "", fmt.Errorf("GetNodes error: %v", err)
 	}
 
 	// create new ID for duplicate node
@@ -252,28 +374,29 @@ func duplicateNodeHelper(nc *nats.Conn, node data.NodeEdge, newParent, origin st
 
 	err = SendNode(nc, node, origin)
 	if err != nil {
-		return fmt.Errorf("SendNode error: %v", err)
+		return "", fmt.Errorf("SendNode error: %v", err)
 	}
 
 	for _, c := range children {
-		err := duplicateNodeHelper(nc, c, node.ID, origin)
+		_, err := duplicateNodeHelper(nc, c, node.ID, origin)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	return nil
+	return node.ID, nil
 }
 
-// DuplicateNode is used to Duplicate a node and all its children
-func DuplicateNode(nc *nats.Conn, id, newParent, origin string) error {
+// DuplicateNode is used to Duplicate a node and all its children. It returns
+// the ID of the copy.
+func DuplicateNode(nc *nats.Conn, id, newParent, origin string) (string, error) {
 	nodes, err := GetNodes(nc, "all", id, "", false)
 	if err != nil {
-		return fmt.Errorf("GetNode error: %v", err)
+		return "", fmt.Errorf("GetNode error: %v", err)
 	}
 
 	if len(nodes) < 1 {
-		return fmt.Errorf("no nodes returned")
+		return "", fmt.Errorf("no nodes returned")
 	}
 
 	node := nodes[0]
@@ -302,7 +425,9 @@ func DeleteNode(nc *nats.Conn, id, parent string, origin string) error {
 	return err
 }
 
-// MoveNode moves a node from one parent to another
+// MoveNode moves a node from one parent to another. The node leaves the old
+// parent before it joins the new one, since the store refuses a node in two
+// organizations at once, and goes back if the new parent will not take it.
 func MoveNode(nc *nats.Conn, id, oldParent, newParent, origin string) error {
 	if newParent == oldParent {
 		return errors.New("can't move node to itself")
@@ -318,6 +443,12 @@ func MoveNode(nc *nats.Conn, id, oldParent, newParent, origin string) error {
 		return errors.New("error fetching node to get type")
 	}
 
+	err = SendEdgePoint(nc, id, oldParent, data.NewPointFloat(data.PointTypeTombstone, "", 1), true)
+
+	if err != nil {
+		return err
+	}
+
 	err = SendEdgePoints(nc, id, newParent, data.Points{
 		func() data.Point {
 			p := data.NewPointFloat(data.PointTypeTombstone, "", 0)
@@ -332,12 +463,10 @@ func MoveNode(nc *nats.Conn, id, oldParent, newParent, origin string) error {
 	}, true)
 
 	if err != nil {
-		return err
-	}
-
-	err = SendEdgePoint(nc, id, oldParent, data.NewPointFloat(data.PointTypeTombstone, "", 1), true)
-
-	if err != nil {
+		errBack := SendEdgePoint(nc, id, oldParent, data.NewPointFloat(data.PointTypeTombstone, "", 0), true)
+		if errBack != nil {
+			return fmt.Errorf("%w, and putting the node back failed: %v", err, errBack)
+		}
 		return err
 	}
 
@@ -469,12 +598,23 @@ func NodeWatcher[T any](nc *nats.Conn, id, parent string) (get func() T, stop fu
 // export usable as a provisioning file. It carries no node IDs, since nodes are
 // matched by description when a file is applied; a nodeID point is written as
 // the description of the node it points at. Points that carry no value, points
-// carrying raw bytes, tombstoned points, and point origins are all left out.
+// carrying raw bytes, tombstoned points, and point origins are all left out, as
+// are user passwords and the auth token and device credential of a sync node.
 //
 // Exporting the root node exports what is under it rather than the node
 // itself: the root is the instance rather than configuration, and a file
 // describing it would match nothing anywhere else.
+//
+// Siblings are written in order of type and description, so two exports of
+// the same tree are identical and exports of one tree at different times diff
+// cleanly.
 func ExportNodes(nc *nats.Conn, id string) ([]byte, error) {
+	return ExportNodesAt(nc, id, time.Time{})
+}
+
+// ExportNodesAt works like [ExportNodes] on the tree as it stood at a time
+// (see [GetNodesAt]). A zero time exports the current tree.
+func ExportNodesAt(nc *nats.Conn, id string, at time.Time) ([]byte, error) {
 	root, err := GetRootNode(nc)
 	if err != nil {
 		return nil, fmt.Errorf("error getting root node: %w", err)
@@ -487,21 +627,23 @@ func ExportNodes(nc *nats.Conn, id string) ([]byte, error) {
 	var necs []data.NodeEdgeChildren
 
 	if id == root.ID {
-		children, err := GetNodes(nc, id, "all", "", false)
+		children, err := GetNodesAt(nc, id, "all", "", false, at)
 		if err != nil {
 			return nil, fmt.Errorf("error getting nodes: %w", err)
 		}
 
+		sortExportNodes(children)
+
 		for _, c := range children {
 			nec := data.NodeEdgeChildren{NodeEdge: c, Children: nil}
-			if err := exportNodesHelper(nc, &nec); err != nil {
+			if err := exportNodesHelper(nc, &nec, at); err != nil {
 				return nil, err
 			}
 
 			necs = append(necs, nec)
 		}
 	} else {
-		nodes, err := GetNodes(nc, "all", id, "", false)
+		nodes, err := GetNodesAt(nc, "all", id, "", false, at)
 		if err != nil {
 			return nil, fmt.Errorf("error getting nodes: %w", err)
 		}
@@ -512,7 +654,7 @@ func ExportNodes(nc *nats.Conn, id string) ([]byte, error) {
 
 		// we only export one node as there may be multiple mirrors of the node in the tree
 		nec := data.NodeEdgeChildren{NodeEdge: nodes[0], Children: nil}
-		if err := exportNodesHelper(nc, &nec); err != nil {
+		if err := exportNodesHelper(nc, &nec, at); err != nil {
 			return nil, err
 		}
 
@@ -526,7 +668,7 @@ func ExportNodes(nc *nats.Conn, id string) ([]byte, error) {
 	// a nodeID point holds the ID of the node it refers to, and a file names
 	// that node by description instead, so we need every node in the tree
 	// rather than only the ones being exported
-	tree, err := getTree(nc, root.ID)
+	tree, err := getTreeAt(nc, root.ID, at)
 	if err != nil {
 		return nil, err
 	}
@@ -635,6 +777,18 @@ func exportNodeYAML(nec data.NodeEdgeChildren, descriptions map[string]string) d
 			continue
 		}
 
+		if nec.Type == data.NodeTypeSync &&
+			(p.Type == data.PointTypeAuthToken || p.Type == data.PointTypeNkeySeed) {
+			// the shared token opens every instance in the fleet and the
+			// seed is this device's identity; neither belongs in a file
+			continue
+		}
+
+		if p.Type == data.PointTypePass {
+			// even hashed, a password can be guessed at offline
+			continue
+		}
+
 		if p.Type == data.PointTypeNodeID {
 			if desc, ok := descriptions[p.Txt()]; ok && desc != "" {
 				p.PutString(desc)
@@ -653,7 +807,18 @@ func exportNodeYAML(nec data.NodeEdgeChildren, descriptions map[string]string) d
 	return out
 }
 
-func exportNodesHelper(nc *nats.Conn, node *data.NodeEdgeChildren) error {
+// sortExportNodes orders siblings by type and then description, so an export
+// does not depend on the order the store happens to hold them in.
+func sortExportNodes(nodes []data.NodeEdge) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].Type != nodes[j].Type {
+			return nodes[i].Type < nodes[j].Type
+		}
+		return nodes[i].Points.MatchKey() < nodes[j].Points.MatchKey()
+	})
+}
+
+func exportNodesHelper(nc *nats.Conn, node *data.NodeEdgeChildren, at time.Time) error {
 	// sort edge and node points
 	sort.Sort(data.ByTypeKey(node.Points))
 	sort.Sort(data.ByTypeKey(node.EdgePoints))
@@ -689,14 +854,16 @@ func exportNodesHelper(nc *nats.Conn, node *data.NodeEdgeChildren) error {
 
 	node.EdgePoints = node.EdgePoints[:i]
 
-	children, err := GetNodes(nc, node.ID, "all", "", false)
+	children, err := GetNodesAt(nc, node.ID, "all", "", false, at)
 	if err != nil {
 		return fmt.Errorf("error getting children: %w", err)
 	}
 
+	sortExportNodes(children)
+
 	for _, c := range children {
 		nec := data.NodeEdgeChildren{NodeEdge: c, Children: nil}
-		err := exportNodesHelper(nc, &nec)
+		err := exportNodesHelper(nc, &nec, at)
 		if err != nil {
 			return err
 		}
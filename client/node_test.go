@@ -96,6 +96,69 @@ func TestExportDuplicateDescriptions(t *testing.T) {
 
 }
 
+func TestExportOmitsSyncSecrets(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	err = client.SendNode(nc, data.NodeEdge{
+		ID:     uuid.New().String(),
+		Type:   data.NodeTypeSync,
+		Parent: root.ID,
+		Points: data.Points{
+			data.NewPointString(data.PointTypeDescription, "", "Cloud"),
+			data.NewPointString(data.PointTypeURI, "", "nats://localhost:4222"),
+			data.NewPointString(data.PointTypeAuthToken, "", "fleet-secret"),
+			data.NewPointString(data.PointTypeNkeySeed, "", "SUAdeviceseed"),
+			data.NewPointFloat(data.PointTypeDisabled, "", 1),
+		},
+	}, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	y, err := client.ExportNodes(nc, root.ID)
+	if err != nil {
+		t.Fatal("Error exporting nodes: ", err)
+	}
+
+	if strings.Contains(string(y), "fleet-secret") || strings.Contains(string(y), "SUAdeviceseed") {
+		t.Fatalf("the export carries a sync secret:\n%v", string(y))
+	}
+
+	if !strings.Contains(string(y), "nats://localhost:4222") {
+		t.Fatalf("the rest of the sync node should be exported:\n%v", string(y))
+	}
+}
+
+func TestExportOmitsPasswords(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	// the admin user created with the instance
+	y, err := client.ExportNodes(nc, root.ID)
+	if err != nil {
+		t.Fatal("Error exporting nodes: ", err)
+	}
+
+	if !strings.Contains(string(y), "user:") {
+		t.Fatalf("the admin user should be exported:\n%v", string(y))
+	}
+
+	if strings.Contains(string(y), "pass:") {
+		t.Fatalf("the export carries a password:\n%v", string(y))
+	}
+}
+
 func TestExportImportNodes(t *testing.T) {
 	nc, root, stop, err := server.TestServer()
 
@@ -0,0 +1,135 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+func TestOrganizations(t *testing.T) {
+	opts := server.TestServerOptions
+	opts.AdoptionApproval = true
+	nc, root, stop, err := server.TestServerOpts(opts)
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+	defer stop()
+
+	place := func(id, parent, typ string, points ...data.Point) {
+		t.Helper()
+		err := client.SendNodePoints(nc, id, points, true)
+		if err != nil {
+			t.Fatalf("Error writing %v: %v", id, err)
+		}
+		err = client.SendEdgePoints(nc, id, parent, data.Points{
+			data.NewPointFloat(data.PointTypeTombstone, "", 0),
+			data.NewPointString(data.PointTypeNodeType, "", typ),
+		}, true)
+		if err != nil {
+			t.Fatalf("Error placing %v: %v", id, err)
+		}
+	}
+
+	for _, org := range []string{"acme", "globex"} {
+		place(org, root.ID, data.NodeTypeOrganization,
+			data.NewPointString(data.PointTypeOrgName, "", org))
+		place(org+"-site", org, data.NodeTypeGroup,
+			data.NewPointString(data.PointTypeDescription, "", "site"))
+		// the same email in both
+		place("alice-"+org, org, data.NodeTypeUser,
+			data.NewPointString(data.PointTypeEmail, "", "alice@example.com"),
+			data.NewPointString(data.PointTypePass, "", org+"-pass"))
+	}
+
+	login := func(org, pass string) string {
+		t.Helper()
+		nodes, err := client.OrgUserCheck(nc, org, "alice@example.com", pass)
+		if err != nil {
+			t.Fatal("Error logging in: ", err)
+		}
+		if len(nodes) == 0 {
+			return ""
+		}
+		return nodes[0].ID
+	}
+
+	if id := login("acme", "acme-pass"); id != "alice-acme" {
+		t.Error("acme login got: ", id)
+	}
+	if id := login("globex", "globex-pass"); id != "alice-globex" {
+		t.Error("globex login got: ", id)
+	}
+	if id := login("", "acme-pass"); id != "" {
+		t.Error("organization user logged in to the instance: ", id)
+	}
+
+	// a name may not be taken twice
+	err = client.SendNodePoint(nc, "globex",
+		data.NewPointString(data.PointTypeOrgName, "", "acme"), true)
+	if err == nil {
+		t.Error("second organization named acme")
+	}
+
+	// a node is in one organization only, but can move to another
+	err = client.SendEdgePoints(nc, "acme-site", "globex", data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", 0),
+		data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeGroup),
+	}, true)
+	if err == nil {
+		t.Error("node mirrored into another organization")
+	}
+
+	err = client.MoveNode(nc, "acme-site", "acme", "globex", "")
+	if err != nil {
+		t.Fatal("Error moving node to another organization: ", err)
+	}
+	nodes, err := client.GetNodes(nc, "globex", "acme-site", "", false)
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("moved node not found: %v, %v", nodes, err)
+	}
+
+	// a device that asks to join an organization only goes there
+	_, err = client.RequestAdoption(nc, "dev", data.Points{
+		data.NewPointString(data.PointTypeOrg, "", "initech")})
+	if err == nil {
+		t.Error("adoption into unknown organization accepted")
+	}
+
+	state, err := client.RequestAdoption(nc, "dev", data.Points{
+		data.NewPointString(data.PointTypeOrg, "", "acme")})
+	if err != nil || state != data.AdoptionPending {
+		t.Fatalf("expected pending, got %v, %v", state, err)
+	}
+
+	devices, err := client.GetOrgAdoptions(nc, "acme")
+	if err != nil || len(devices) != 1 || devices[0].Org != "acme" {
+		t.Fatalf("device not waiting for acme: %v, %v", devices, err)
+	}
+	devices, err = client.GetOrgAdoptions(nc, "globex")
+	if err != nil || len(devices) != 0 {
+		t.Fatalf("acme device waiting for globex: %v, %v", devices, err)
+	}
+
+	if client.ApproveAdoption(nc, "dev", "globex-site") == nil {
+		t.Error("device approved into another organization")
+	}
+	if client.ApproveAdoption(nc, "dev", root.ID) == nil {
+		t.Error("device approved out of its organization")
+	}
+	if client.RejectOrgAdoption(nc, "dev", "globex") == nil {
+		t.Error("device rejected by another organization")
+	}
+
+	err = client.ApproveAdoption(nc, "dev", "acme")
+	if err != nil {
+		t.Fatal("Error approving device: ", err)
+	}
+
+	waitFor(t, 5*time.Second, "approved device not in acme", func() bool {
+		nodes, err := client.GetNodes(nc, "acme", "dev", "", false)
+		return err == nil && len(nodes) == 1
+	})
+}
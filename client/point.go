@@ -37,6 +37,23 @@ func SendEdgePoints(nc *nats.Conn, nodeID, parentID string, points data.Points,
 	return SendPointsBatch(nc, SubjectEdgePoints(nodeID, parentID), points, ack)
 }
 
+// SendNodePointsAs sends node points from a browser session or an API key
+// connection, which may only write as the user or apiKey node it signed in
+// as. See SubjectNodePointsAs.
+func SendNodePointsAs(nc *nats.Conn, principal, nodeID string, points data.Points, ack bool) error {
+	return SendPoints(nc, SubjectNodePointsAs(principal, nodeID), points, ack)
+}
+
+// SendEdgePointsAs is SendEdgePoints for a browser session or an API key
+// connection. See SendNodePointsAs.
+func SendEdgePointsAs(nc *nats.Conn, principal, nodeID, parentID string, points data.Points,
+	ack bool) error {
+	if parentID == "" {
+		parentID = "none"
+	}
+	return SendPointsBatch(nc, SubjectEdgePointsAs(principal, nodeID, parentID), points, ack)
+}
+
 // SendPoints sends points to specified base subject. Each point is sent as a
 // separate NATS message with type/key appended to the subject:
 // <baseSubject>.<type>.<key>
@@ -0,0 +1,92 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+func TestSnapshotRollback(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server:", err)
+	}
+	defer stop()
+
+	v := testX{ID: "ID-testX", Parent: root.ID, Description: "test X node"}
+	err = client.SendNodeType(nc, v, "test")
+	if err != nil {
+		t.Fatal("Error sending node:", err)
+	}
+
+	snap, err := client.TakeSnapshot(nc, root.ID, "before")
+	if err != nil {
+		t.Fatal("Error taking snapshot:", err)
+	}
+	if len(snap.Nodes) < 2 {
+		t.Fatal("snapshot is missing nodes:", snap)
+	}
+
+	plan, err := client.SnapshotDiff(nc, root.ID, "before")
+	if err != nil || !plan.Empty() {
+		t.Fatal("diff of an unchanged tree is not empty:", plan, err)
+	}
+
+	// change the node and add another
+	p := data.NewPointString(data.PointTypeDescription, "0", "changed")
+	p.Origin = "test"
+	err = client.SendNodePoint(nc, v.ID, p, true)
+	if err != nil {
+		t.Fatal("Error sending point:", err)
+	}
+
+	added := testX{ID: "ID-added", Parent: root.ID, Description: "added"}
+	err = client.SendNodeType(nc, added, "test")
+	if err != nil {
+		t.Fatal("Error sending node:", err)
+	}
+
+	plan, err = client.SnapshotDiff(nc, root.ID, "before")
+	if err != nil {
+		t.Fatal("Error getting diff:", err)
+	}
+	if len(plan.Send) != 1 || len(plan.Delete) != 1 {
+		t.Fatal("diff did not find the changes:\n", plan)
+	}
+
+	_, err = client.SnapshotRollback(nc, root.ID, "before")
+	if err != nil {
+		t.Fatal("Error rolling back:", err)
+	}
+
+	nodes, err := client.GetNodesType[testX](nc, root.ID, v.ID)
+	if err != nil || len(nodes) != 1 || nodes[0].Description != v.Description {
+		t.Fatal("node not rolled back:", nodes, err)
+	}
+
+	nodes, err = client.GetNodesType[testX](nc, root.ID, added.ID)
+	if err != nil || len(nodes) != 0 {
+		t.Fatal("added node not deleted:", nodes, err)
+	}
+
+	plan, err = client.SnapshotDiff(nc, root.ID, "before")
+	if err != nil || !plan.Empty() {
+		t.Fatal("diff after rollback is not empty:\n", plan, err)
+	}
+
+	snaps, err := client.GetSnapshots(nc, root.ID)
+	if err != nil || len(snaps) != 1 || snaps[0].Name != "before" {
+		t.Fatal("snapshot not listed:", snaps, err)
+	}
+
+	err = client.DeleteSnapshot(nc, root.ID, "before")
+	if err != nil {
+		t.Fatal("Error deleting snapshot:", err)
+	}
+
+	if _, err = client.GetSnapshot(nc, root.ID, "before"); err == nil {
+		t.Fatal("deleted snapshot still there")
+	}
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// TakeSnapshot saves the configuration of the subtree below a node in the
+// store under a name, replacing any earlier snapshot of that name.
+func TakeSnapshot(nc *nats.Conn, id, name string) (data.Snapshot, error) {
+	return snapshotRequestOne(nc, id, "take", name)
+}
+
+// GetSnapshot returns a saved snapshot, including its nodes.
+func GetSnapshot(nc *nats.Conn, id, name string) (data.Snapshot, error) {
+	return snapshotRequestOne(nc, id, "get", name)
+}
+
+// GetSnapshots returns the snapshots taken of a node, oldest first. The
+// snapshots returned do not include their nodes.
+func GetSnapshots(nc *nats.Conn, id string) ([]data.Snapshot, error) {
+	return snapshotRequest(nc, id, "list", "")
+}
+
+// DeleteSnapshot removes a saved snapshot.
+func DeleteSnapshot(nc *nats.Conn, id, name string) error {
+	_, err := snapshotRequest(nc, id, "delete", name)
+	return err
+}
+
+// SnapshotDiff returns the plan that would roll the subtree below a node back
+// to a snapshot. An empty plan means the configuration has not changed since
+// the snapshot was taken.
+func SnapshotDiff(nc *nats.Conn, id, name string) (ApplyPlan, error) {
+	snap, err := GetSnapshot(nc, id, name)
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+
+	live, err := snapshotRequestOne(nc, id, "live", "")
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+
+	return planRollback(snap, live), nil
+}
+
+// SnapshotRollback makes the configuration of the subtree below a node what
+// it was when a snapshot was taken, sending only what differs. Nodes a user
+// created since are deleted, nodes deleted since are restored, and points a
+// user added since are removed. What clients report, and the nodes they
+// create, are left alone. The points written are recorded with origin
+// "snapshot:<name>".
+func SnapshotRollback(nc *nats.Conn, id, name string) (ApplyPlan, error) {
+	plan, err := SnapshotDiff(nc, id, name)
+	if err != nil {
+		return plan, err
+	}
+
+	return plan, runPlan(nc, plan, "snapshot:"+name)
+}
+
+func snapshotRequestOne(nc *nats.Conn, id, op, name string) (data.Snapshot, error) {
+	snaps, err := snapshotRequest(nc, id, op, name)
+	if err != nil {
+		return data.Snapshot{}, err
+	}
+
+	if len(snaps) < 1 {
+		return data.Snapshot{}, errors.New("no snapshot returned")
+	}
+
+	return snaps[0], nil
+}
+
+func snapshotRequest(nc *nats.Conn, id, op, name string) ([]data.Snapshot, error) {
+	var pts data.Points
+	if name != "" {
+		pts = append(pts, data.NewPointString(data.PointTypeName, "", name))
+	}
+
+	msg, err := nc.Request(fmt.Sprintf("snapshot.%v.%v", id, op), pts.Encode(),
+		time.Second*20)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.SnapshotResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Snapshots, nil
+}
+
+// planRollback works out what rolls the live configuration back to a
+// snapshot. Nodes are matched by ID and parent, so a node moved since the
+// snapshot is attached where it was and detached from where it is. Like
+// planApply it is pure.
+func planRollback(snap, live data.Snapshot) ApplyPlan {
+	plan := ApplyPlan{}
+
+	if len(snap.Nodes) < 1 || len(live.Nodes) < 1 {
+		return plan
+	}
+
+	edgeKey := func(n data.SnapshotNode) string {
+		return n.Parent + "|" + n.ID
+	}
+
+	liveByEdge := make(map[string]data.SnapshotNode)
+	for _, n := range live.Nodes[1:] {
+		liveByEdge[edgeKey(n)] = n
+	}
+
+	snapByEdge := make(map[string]bool)
+	for _, n := range snap.Nodes[1:] {
+		snapByEdge[edgeKey(n)] = true
+	}
+
+	for i, s := range snap.Nodes {
+		l, ok := liveByEdge[edgeKey(s)]
+		if i == 0 {
+			// the node the snapshot was taken of is found by ID, since
+			// where it sits is not part of the snapshot
+			l, ok = live.Nodes[0], true
+			s.Parent = l.Parent
+		}
+
+		if ok {
+			points := rollbackPoints(s.Points, l.Points)
+			edgePoints := rollbackPoints(s.EdgePoints, l.EdgePoints)
+
+			if len(points) == 0 && len(edgePoints) == 0 {
+				continue
+			}
+
+			plan.Send = append(plan.Send, ApplySend{
+				Node: data.NodeEdge{
+					ID:         s.ID,
+					Type:       s.Type,
+					Parent:     s.Parent,
+					Points:     points,
+					EdgePoints: edgePoints,
+				},
+				Key: s.Points.MatchKey(),
+			})
+
+			continue
+		}
+
+		// deleted or moved away since: attach it again with everything the
+		// snapshot holds for it
+		edgePoints := append(rollbackPoints(s.EdgePoints, nil),
+			data.NewPointFloat(data.PointTypeTombstone, "", 0))
+
+		plan.Send = append(plan.Send, ApplySend{
+			Node: data.NodeEdge{
+				ID:         s.ID,
+				Type:       s.Type,
+				Parent:     s.Parent,
+				Points:     rollbackPoints(s.Points, nil),
+				EdgePoints: edgePoints,
+			},
+			Key:     s.Points.MatchKey(),
+			Created: true,
+		})
+	}
+
+	// live nodes come parents first, so a node is only deleted when its
+	// parent is not being deleted too
+	deleting := make(map[string]bool)
+	for _, l := range live.Nodes[1:] {
+		if snapByEdge[edgeKey(l)] || !l.Config || deleting[l.Parent] {
+			continue
+		}
+
+		deleting[l.ID] = true
+
+		plan.Delete = append(plan.Delete, ApplyDelete{
+			ID:     l.ID,
+			Parent: l.Parent,
+			Key:    describeNode(l.NodeEdge),
+			Type:   l.Type,
+		})
+	}
+
+	return plan
+}
+
+// rollbackPoints returns the points to send so that a node holds the
+// snapshot's points: the ones whose value differs, and a tombstone for each
+// live point the snapshot does not have. The points are sent as new writes,
+// so they carry no time or origin of their own.
+func rollbackPoints(snap, live data.Points) data.Points {
+	out := changedPoints(snap, live)
+
+	for _, l := range live {
+		if _, ok := snap.Find(l.Type, l.Key); ok {
+			continue
+		}
+		l.Tombstone++
+		out = append(out, l)
+	}
+
+	for i := range out {
+		out[i].Time = time.Time{}
+		out[i].Origin = ""
+	}
+
+	return out
+}
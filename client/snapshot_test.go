@@ -0,0 +1,120 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func testSnapshot() data.Snapshot {
+	return data.Snapshot{
+		Name:   "before",
+		NodeID: "group-id",
+		Nodes: []data.SnapshotNode{
+			{NodeEdge: data.NodeEdge{ID: "group-id", Type: data.NodeTypeGroup, Parent: testRoot,
+				Points: data.Points{data.NewPointString(data.PointTypeDescription, "0", "Sensors")}},
+				Config: true},
+			{NodeEdge: data.NodeEdge{ID: "modbus-id", Type: "modbus", Parent: "group-id",
+				Points: data.Points{
+					data.NewPointString(data.PointTypeDescription, "0", "Modbus sensors"),
+					data.NewPointFloat("baud", "0", 9600),
+				}},
+				Config: true},
+		},
+	}
+}
+
+func TestRollbackUnchangedIsEmpty(t *testing.T) {
+	plan := planRollback(testSnapshot(), testSnapshot())
+	if !plan.Empty() {
+		t.Fatal("expected an empty plan, got:\n", plan)
+	}
+}
+
+func TestRollbackSendsOnlyChangedPoints(t *testing.T) {
+	live := testSnapshot()
+	live.Nodes[1].Points = data.Points{
+		data.NewPointString(data.PointTypeDescription, "0", "Modbus sensors"),
+		data.NewPointFloat("baud", "0", 115200),
+		data.NewPointFloat("timeout", "0", 5),
+	}
+
+	plan := planRollback(testSnapshot(), live)
+	if len(plan.Send) != 1 || len(plan.Delete) != 0 {
+		t.Fatal("expected one send, got:\n", plan)
+	}
+
+	pts := plan.Send[0].Node.Points
+	if len(pts) != 2 {
+		t.Fatal("expected baud and timeout, got:", pts)
+	}
+
+	baud, ok := pts.Find("baud", "0")
+	if !ok || baud.Val() != 9600 || !baud.Time.IsZero() {
+		t.Fatal("baud not rolled back as a new write:", baud)
+	}
+
+	timeout, ok := pts.Find("timeout", "0")
+	if !ok || timeout.Tombstone%2 != 1 {
+		t.Fatal("point added since the snapshot not removed:", timeout)
+	}
+}
+
+func TestRollbackRestoresDeletedNode(t *testing.T) {
+	live := testSnapshot()
+	live.Nodes = live.Nodes[:1]
+
+	plan := planRollback(testSnapshot(), live)
+	if len(plan.Send) != 1 || !plan.Send[0].Created {
+		t.Fatal("expected the node to be attached again, got:\n", plan)
+	}
+
+	n := plan.Send[0].Node
+	if n.ID != "modbus-id" || n.Parent != "group-id" || len(n.Points) != 2 {
+		t.Fatal("wrong node sent:", n)
+	}
+
+	undeleted := false
+	for _, p := range n.EdgePoints {
+		if p.Type == data.PointTypeTombstone && p.Val() == 0 {
+			undeleted = true
+		}
+	}
+	if !undeleted {
+		t.Fatal("edge not undeleted:", n.EdgePoints)
+	}
+}
+
+func TestRollbackDeletesNewConfigNodes(t *testing.T) {
+	live := testSnapshot()
+	live.Nodes = append(live.Nodes,
+		data.SnapshotNode{NodeEdge: data.NodeEdge{ID: "new-id", Type: "modbus", Parent: "group-id"},
+			Config: true},
+		data.SnapshotNode{NodeEdge: data.NodeEdge{ID: "new-child-id", Type: "modbusIo", Parent: "new-id"},
+			Config: true},
+		// created by a client, which a rollback leaves alone
+		data.SnapshotNode{NodeEdge: data.NodeEdge{ID: "found-id", Type: "modbusIo", Parent: "modbus-id"}},
+	)
+
+	plan := planRollback(testSnapshot(), live)
+	if len(plan.Send) != 0 {
+		t.Fatal("expected no sends, got:\n", plan)
+	}
+
+	if len(plan.Delete) != 1 || plan.Delete[0].ID != "new-id" || plan.Delete[0].Parent != "group-id" {
+		t.Fatal("expected only the new top node to be deleted, got:\n", plan)
+	}
+}
+
+func TestRollbackMovedNode(t *testing.T) {
+	live := testSnapshot()
+	live.Nodes[1].Parent = testRoot
+
+	plan := planRollback(testSnapshot(), live)
+	if len(plan.Send) != 1 || plan.Send[0].Node.Parent != "group-id" || !plan.Send[0].Created {
+		t.Fatal("node not attached where it was, got:\n", plan)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0].Parent != testRoot {
+		t.Fatal("node not detached from where it is, got:\n", plan)
+	}
+}
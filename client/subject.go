@@ -1,15 +1,21 @@
 package client
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // create subject strings for various types of messages
 
 // OriginHeader is the NATS message header carrying the root node ID of
 // the instance a point originated from. The store sets it when
-// re-broadcasting points delivered by a replica stream; a store
-// receiving a message tagged with a remote origin merges it into its
-// caches and fans it out, but never persists it — the replica stream is
-// the persistent copy (single-writer streams, see ADR-7).
+// re-broadcasting points delivered by a replica stream, which it has
+// already merged into its caches; a store receiving a message tagged with
+// a remote origin only fans out the points it merged from that origin, and
+// never persists them — the replica stream is the persistent copy
+// (single-writer streams, see ADR-7). The store also sets it, to its own root
+// node ID, when it passes on points a session or an API key wrote (see
+// SubjectNodePointsAs), which it has already written.
 const OriginHeader = "Siot-Origin"
 
 // SubjectNodePoint constructs a NATS subject for a single node point
@@ -32,6 +38,31 @@ func SubjectEdgePoints(nodeID, parentID string) string {
 	return fmt.Sprintf("ep.%v.%v", nodeID, parentID)
 }
 
+// SubjectNodePointsAs constructs the NATS subject a browser session or an
+// API key connection writes node points on (without type/key). principal is
+// the user or apiKey node the connection signed in as, and the server only
+// lets the connection publish under its own, which is how the store knows
+// who wrote the points.
+func SubjectNodePointsAs(principal, nodeID string) string {
+	return fmt.Sprintf("as.%v.%v", principal, SubjectNodePoints(nodeID))
+}
+
+// SubjectEdgePointsAs is SubjectNodePointsAs for edge points.
+func SubjectEdgePointsAs(principal, nodeID, parentID string) string {
+	return fmt.Sprintf("as.%v.%v", principal, SubjectEdgePoints(nodeID, parentID))
+}
+
+// SplitPrincipal splits a subject built with SubjectNodePointsAs or
+// SubjectEdgePointsAs into the principal and the point subject it writes. A
+// subject without a principal is returned as is, with principal "".
+func SplitPrincipal(subject string) (principal, points string) {
+	tok := strings.SplitN(subject, ".", 3)
+	if len(tok) < 3 || tok[0] != "as" {
+		return "", subject
+	}
+	return tok[1], tok[2]
+}
+
 // SubjectNodeAllPoints provides subject for all points for any node
 func SubjectNodeAllPoints() string {
 	return "p.>"
@@ -0,0 +1,790 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// syncBundleVersion is the version of the bundle format this code writes and
+// reads.
+const syncBundleVersion = 1
+
+// syncBundle carries what a sync would have replicated between a device and
+// its upstream, for a site that has no link. A device writes one for its
+// upstream with what it would push, and the upstream writes one for a device
+// with what the device would pull.
+type syncBundle struct {
+	Version int `json:"version"`
+	// Up is set on a bundle a device wrote for its upstream
+	Up bool `json:"up"`
+	// From is the root node ID of the instance that wrote the bundle, and
+	// To that of the instance it is for. A device that has not yet taken in
+	// a bundle from its upstream does not know the upstream's ID, and
+	// leaves To empty.
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Created time.Time      `json:"created"`
+	Streams []bundleStream `json:"streams"`
+}
+
+type bundleStream struct {
+	Boundary string      `json:"boundary"`
+	Origin   string      `json:"origin"`
+	Messages []bundleMsg `json:"messages"`
+}
+
+func (bs bundleStream) name() string {
+	return fmt.Sprintf("inst_%v_%v", bs.Boundary, bs.Origin)
+}
+
+// bundleMsg is one stream message, which an import sends to the replica
+// stream the way a pump does.
+type bundleMsg struct {
+	Seq     uint64 `json:"seq"`
+	Subj    string `json:"subject"`
+	Payload []byte `json:"data"`
+}
+
+func (m bundleMsg) Subject() string { return m.Subj }
+func (m bundleMsg) Data() []byte    { return m.Payload }
+func (m bundleMsg) Ack() error      { return nil }
+
+// signedBundle is the file a bundle is written as. The signature covers Body,
+// the gzipped JSON of a syncBundle.
+type signedBundle struct {
+	PubKey string `json:"pubKey"`
+	Sig    []byte `json:"sig"`
+	Body   []byte `json:"body"`
+}
+
+// BundleStream describes what a sync bundle carried for one stream.
+type BundleStream struct {
+	Name string
+	// First and Last are the sequences in the sending stream of the first
+	// and last message, and Count how many messages were written or taken
+	// in
+	First, Last uint64
+	Count       int
+}
+
+// BundleSummary describes a sync bundle that was written or taken in.
+type BundleSummary struct {
+	Up       bool
+	From, To string
+	Streams  []BundleStream
+}
+
+func (bs BundleSummary) String() string {
+	dir := "down"
+	if bs.Up {
+		dir = "up"
+	}
+	to := bs.To
+	if to == "" {
+		to = "(upstream not yet known)"
+	}
+
+	ret := fmt.Sprintf("Sync bundle %v from %v to %v\n", dir, bs.From, to)
+	if len(bs.Streams) == 0 {
+		ret += "  nothing to sync\n"
+	}
+	for _, s := range bs.Streams {
+		ret += fmt.Sprintf("  %v: %v messages (%v-%v)\n", s.Name, s.Count, s.First, s.Last)
+	}
+	return ret
+}
+
+// GetDeviceAccess returns a device node's credential on the instance nc is
+// connected to, and the streams the device replicates.
+func GetDeviceAccess(nc *nats.Conn, id string) (data.DeviceAccess, error) {
+	var ret data.DeviceAccess
+
+	msg, err := nc.Request("credential."+id, nil, 20*time.Second)
+	if err != nil {
+		return ret, err
+	}
+
+	err = json.Unmarshal(msg.Data, &ret)
+	if err != nil {
+		return ret, err
+	}
+
+	if ret.Error != "" {
+		return ret, errors.New(ret.Error)
+	}
+
+	return ret, nil
+}
+
+// ExportBundle writes a sync bundle for a site without a link. With deviceID
+// empty, it holds what this instance would push to its upstream through the
+// sync node syncID, which may be empty if the root has only one. With
+// deviceID set, it holds what that device would pull from this instance.
+//
+// A bundle starts where the receiving side has got to: the resume point it
+// reported in the last bundle it sent back, or the position of the sync
+// consumer if the two have also synced over a link. So a bundle written before
+// the last one came back repeats what that one carried, and the receiving side
+// skips what it already has.
+func ExportBundle(nc *nats.Conn, syncID, deviceID string) ([]byte, BundleSummary, error) {
+	var sum BundleSummary
+
+	root, err := GetRootNode(nc)
+	if err != nil {
+		return nil, sum, fmt.Errorf("error getting root node: %v", err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, sum, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	b := syncBundle{
+		Version: syncBundleVersion,
+		From:    root.ID,
+		Created: time.Now(),
+	}
+
+	var seed, receiver, link string
+	var streams []streamID
+	var filter *syncFilter
+
+	if deviceID == "" {
+		// a device writing for its upstream
+		sync, err := bundleSyncNode(nc, root.ID, syncID)
+		if err != nil {
+			return nil, sum, err
+		}
+
+		seed, err = syncSeed(nc, sync)
+		if err != nil {
+			return nil, sum, err
+		}
+
+		b.Up = true
+		b.To = sync.UpstreamID
+		receiver = sync.UpstreamID
+		link = root.ID
+
+		_, streams, err = forwardStreams(ctx, js, root.ID, sync.UpstreamID)
+		if err != nil {
+			return nil, sum, fmt.Errorf("error listing streams: %v", err)
+		}
+
+		filter = newSyncFilter(nc)
+		filter.set(sync)
+	} else {
+		// an upstream writing for a device
+		access, err := GetDeviceAccess(nc, deviceID)
+		if err != nil {
+			return nil, sum, fmt.Errorf("error getting device %v: %v", deviceID, err)
+		}
+		if access.Revoked {
+			return nil, sum, fmt.Errorf("the credential of device %v is revoked", deviceID)
+		}
+
+		seed, err = bundleSeed(nc, root)
+		if err != nil {
+			return nil, sum, err
+		}
+
+		b.To = deviceID
+		receiver = deviceID
+		link = deviceID
+
+		for _, name := range access.Pull {
+			var bo, o string
+			if _, err := fmt.Sscanf(strings.ReplaceAll(name, "_", " "), "inst %s %s", &bo, &o); err != nil {
+				continue
+			}
+			streams = append(streams, streamID{bo, o})
+		}
+	}
+
+	acks, err := bundleSeqs(nc, link)
+	if err != nil {
+		return nil, sum, err
+	}
+
+	for _, st := range streams {
+		bs, err := readBundleStream(ctx, js, st, receiver, acks, filter)
+		if err != nil {
+			return nil, sum, err
+		}
+		if len(bs.Messages) == 0 {
+			continue
+		}
+		b.Streams = append(b.Streams, bs)
+	}
+
+	sort.Slice(b.Streams, func(i, j int) bool {
+		return b.Streams[i].name() < b.Streams[j].name()
+	})
+
+	ret, err := signBundle(b, seed)
+	if err != nil {
+		return nil, sum, err
+	}
+
+	return ret, summarize(b, nil), nil
+}
+
+// readBundleStream reads what a stream holds past where the receiving side
+// has got to.
+func readBundleStream(ctx context.Context, js jetstream.JetStream, st streamID,
+	receiver string, acks map[string]uint64, filter *syncFilter) (bundleStream, error) {
+
+	bs := bundleStream{Boundary: st.boundary, Origin: st.origin}
+	name := bs.name()
+
+	s, err := js.Stream(ctx, name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return bs, nil
+	} else if err != nil {
+		return bs, fmt.Errorf("error getting stream %v: %v", name, err)
+	}
+
+	after := acks[name]
+	if receiver != "" {
+		if c, err := s.Consumer(ctx, "sync-"+receiver); err == nil {
+			after = max(after, c.CachedInfo().AckFloor.Stream)
+		}
+	}
+
+	last := s.CachedInfo().State.LastSeq
+	if last <= after {
+		return bs, nil
+	}
+
+	c, err := s.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		DeliverPolicy: jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:   after + 1,
+	})
+	if err != nil {
+		return bs, fmt.Errorf("error reading stream %v: %v", name, err)
+	}
+
+	for {
+		batch, err := c.Fetch(pumpWindowSize, jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			return bs, fmt.Errorf("error reading stream %v: %v", name, err)
+		}
+
+		done, n := false, 0
+		for msg := range batch.Messages() {
+			n++
+			meta, err := msg.Metadata()
+			if err != nil {
+				continue
+			}
+
+			ok := true
+			if filter != nil {
+				ok, err = filter.pass(st.boundary, msg.Subject(), msg.Data())
+				if err != nil {
+					return bs, err
+				}
+			}
+			if ok {
+				bs.Messages = append(bs.Messages, bundleMsg{
+					Seq:     meta.Sequence.Stream,
+					Subj:    msg.Subject(),
+					Payload: msg.Data(),
+				})
+			}
+
+			if meta.Sequence.Stream >= last || meta.NumPending == 0 {
+				done = true
+			}
+		}
+		if err := batch.Error(); err != nil {
+			return bs, fmt.Errorf("error reading stream %v: %v", name, err)
+		}
+
+		if done || n == 0 {
+			return bs, nil
+		}
+	}
+}
+
+// ImportBundle takes in a sync bundle the way the pumps of a sync would: each
+// stream's messages go to its replica here, with the same subjects and
+// payloads, in order. A message the bundle carries that was taken in before is
+// skipped, so a bundle can be imported twice, or one written before the last
+// came back can still be imported, without anything arriving twice.
+//
+// A bundle from a device is checked against the device's credential here. A
+// device that has none yet is adopted, and the key its bundle is signed with
+// becomes its credential, as with a device that first connects with the shared
+// token. A bundle from the upstream is checked against the key of the first
+// bundle the sync node syncID took in.
+func ImportBundle(nc *nats.Conn, syncID string, file []byte) (BundleSummary, error) {
+	var sum BundleSummary
+
+	b, pubKey, err := openBundle(file)
+	if err != nil {
+		return sum, err
+	}
+
+	root, err := GetRootNode(nc)
+	if err != nil {
+		return sum, fmt.Errorf("error getting root node: %v", err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return sum, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var link string
+	// allowed reports whether a stream is one the sending side replicates
+	// to this instance
+	var allowed func() (func(streamID) bool, error)
+
+	if b.Up {
+		if b.To != "" && b.To != root.ID {
+			return sum, fmt.Errorf("bundle is for %v, this is %v", b.To, root.ID)
+		}
+
+		link = b.From
+		err = bundleAdopt(nc, b.From, pubKey)
+		if err != nil {
+			return sum, err
+		}
+
+		allowed = func() (func(streamID) bool, error) {
+			access, err := GetDeviceAccess(nc, b.From)
+			if err != nil {
+				return nil, err
+			}
+			in := make(map[string]bool)
+			for _, bo := range access.Boundaries {
+				in[bo] = true
+			}
+			return func(st streamID) bool {
+				return in[st.boundary] && in[st.origin]
+			}, nil
+		}
+	} else {
+		if b.To != root.ID {
+			return sum, fmt.Errorf("bundle is for %v, this is %v", b.To, root.ID)
+		}
+
+		link = root.ID
+		err = bundleUpstream(nc, root.ID, syncID, b.From, pubKey)
+		if err != nil {
+			return sum, err
+		}
+
+		allowed = func() (func(streamID) bool, error) {
+			boundaries, _, err := forwardStreams(ctx, js, root.ID, b.From)
+			if err != nil {
+				return nil, err
+			}
+			return func(st streamID) bool {
+				return boundaries[st.boundary] && !boundaries[st.origin]
+			}, nil
+		}
+	}
+
+	acks, err := bundleSeqs(nc, link)
+	if err != nil {
+		return sum, err
+	}
+
+	taken := make(map[string]int)
+	pending := b.Streams
+
+	// a gateway's bundle carries the streams of the devices below it, which
+	// are only known to sync through it once its own stream is in, so the
+	// streams refused on one pass are tried again while any are taken in
+	for len(pending) > 0 {
+		ok, err := allowed()
+		if err != nil {
+			return sum, fmt.Errorf("error checking streams: %v", err)
+		}
+
+		var refused []bundleStream
+		for _, bs := range pending {
+			st := streamID{bs.Boundary, bs.Origin}
+			if !ok(st) {
+				refused = append(refused, bs)
+				continue
+			}
+
+			n, err := importBundleStream(ctx, nc, js, link, bs, acks[bs.name()])
+			if err != nil {
+				return summarize(b, taken), err
+			}
+			taken[bs.name()] = n
+		}
+
+		if len(refused) == len(pending) {
+			var names []string
+			for _, bs := range refused {
+				names = append(names, bs.name())
+			}
+			return summarize(b, taken), fmt.Errorf("bundle carries streams %v does not sync here: %v",
+				b.From, strings.Join(names, ", "))
+		}
+		pending = refused
+	}
+
+	return summarize(b, taken), nil
+}
+
+// importBundleStream sends a stream's messages past the resume point to its
+// replica here, one window at a time, and moves the resume point on after
+// each window lands.
+func importBundleStream(ctx context.Context, nc *nats.Conn, js jetstream.JetStream,
+	link string, bs bundleStream, after uint64) (int, error) {
+
+	name := bs.name()
+	prefix := fmt.Sprintf("inst.%v.%v.", bs.Boundary, bs.Origin)
+
+	var msgs []pumpMsg
+	for _, m := range bs.Messages {
+		if !strings.HasPrefix(m.Subj, prefix) {
+			return 0, fmt.Errorf("bundle message %v is not in stream %v", m.Subj, name)
+		}
+		if m.Seq > after {
+			msgs = append(msgs, m)
+		}
+	}
+
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	err := ensureReplica(ctx, js, bs.Boundary, bs.Origin)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(msgs) > 0 {
+		window := msgs[:min(len(msgs), pumpWindowSize)]
+		msgs = msgs[len(window):]
+
+		err := sendWindow(ctx, js, window)
+		if err != nil {
+			return n, fmt.Errorf("error importing %v: %v", name, err)
+		}
+		n += len(window)
+
+		seq := window[len(window)-1].(bundleMsg).Seq
+		err = SendNodePoint(nc, link,
+			data.NewPointFloat(data.PointTypeBundleSeq, name, float64(seq)), true)
+		if err != nil {
+			return n, fmt.Errorf("error recording where %v got to: %v", name, err)
+		}
+	}
+
+	return n, nil
+}
+
+// bundleAdopt checks a device's bundle against its credential here, adopting
+// the device and taking the bundle's key as its credential if it has none.
+func bundleAdopt(nc *nats.Conn, deviceID, pubKey string) error {
+	nodes, err := GetNodes(nc, "all", deviceID, "", true)
+	if err != nil && err != data.ErrDocumentNotFound {
+		return fmt.Errorf("error getting device %v: %v", deviceID, err)
+	}
+
+	if len(nodes) > 0 {
+		attached := false
+		for _, n := range nodes {
+			if del, _ := n.IsTombstone(); !del {
+				attached = true
+			}
+		}
+		if !attached {
+			return fmt.Errorf("device %v was deleted here; restore it to take in its bundles",
+				deviceID)
+		}
+	}
+
+	access, err := GetDeviceAccess(nc, deviceID)
+	if err != nil {
+		return fmt.Errorf("error getting device %v: %v", deviceID, err)
+	}
+
+	if access.Revoked {
+		return fmt.Errorf("the credential of device %v is revoked", deviceID)
+	}
+
+	if access.PubKey != "" && access.PubKey != pubKey {
+		return fmt.Errorf("bundle is signed with %v, device %v has credential %v",
+			pubKey, deviceID, access.PubKey)
+	}
+
+	if len(nodes) == 0 {
+		// a new device is adopted as a sync would, held to the
+		// credential the bundle is signed with, and waits for an admin
+		// when this instance approves devices
+		state, err := RequestAdoption(nc, deviceID, data.Points{
+			data.NewPointString(data.PointTypePubKey, "", pubKey)})
+		if err != nil {
+			return fmt.Errorf("error adding device %v: %v", deviceID, err)
+		}
+		switch state {
+		case data.AdoptionPending:
+			return fmt.Errorf("device %v is waiting for adoption approval; import the bundle again once it is approved",
+				deviceID)
+		case data.AdoptionRejected:
+			return fmt.Errorf("device %v was rejected", deviceID)
+		}
+	}
+
+	if access.PubKey == "" {
+		err = SendNodePoint(nc, deviceID,
+			data.NewPointString(data.PointTypePubKey, "", pubKey), true)
+		if err != nil {
+			return fmt.Errorf("error registering credential of device %v: %v", deviceID, err)
+		}
+	}
+
+	return nil
+}
+
+// bundleUpstream checks an upstream's bundle against the sync node, recording
+// the upstream and its key on the first one.
+func bundleUpstream(nc *nats.Conn, rootID, syncID, upstreamID, pubKey string) error {
+	sync, err := bundleSyncNode(nc, rootID, syncID)
+	if err != nil {
+		return err
+	}
+
+	if sync.UpstreamID != "" && sync.UpstreamID != upstreamID {
+		return fmt.Errorf("bundle is from %v, the upstream of sync node %v is %v",
+			upstreamID, sync.ID, sync.UpstreamID)
+	}
+
+	if sync.UpstreamPubKey != "" && sync.UpstreamPubKey != pubKey {
+		return fmt.Errorf("bundle is signed with %v, upstream %v signs with %v",
+			pubKey, upstreamID, sync.UpstreamPubKey)
+	}
+
+	var pts data.Points
+	if sync.UpstreamID == "" {
+		pts = append(pts, data.NewPointString(data.PointTypeUpstreamID, "", upstreamID))
+	}
+	if sync.UpstreamPubKey == "" {
+		pts = append(pts, data.NewPointString(data.PointTypeUpstreamPubKey, "", pubKey))
+	}
+	if len(pts) == 0 {
+		return nil
+	}
+
+	err = SendNodePoints(nc, sync.ID, pts, true)
+	if err != nil {
+		return fmt.Errorf("error recording upstream on sync node: %v", err)
+	}
+
+	return nil
+}
+
+// bundleSyncNode returns the sync node a device exchanges bundles through:
+// the one named, or the only one on the root.
+func bundleSyncNode(nc *nats.Conn, rootID, syncID string) (Sync, error) {
+	id := syncID
+	if id == "" {
+		id = "all"
+	}
+
+	nodes, err := GetNodesType[Sync](nc, rootID, id)
+	if err != nil && err != data.ErrDocumentNotFound {
+		return Sync{}, fmt.Errorf("error getting sync nodes: %v", err)
+	}
+
+	switch {
+	case len(nodes) == 1:
+		return nodes[0], nil
+	case syncID != "":
+		return Sync{}, fmt.Errorf("no sync node %v on the root node", syncID)
+	case len(nodes) == 0:
+		return Sync{}, errors.New("add a sync node for the upstream to the root node; " +
+			"it needs no URI")
+	default:
+		return Sync{}, fmt.Errorf("the root node has %v sync nodes, pick one", len(nodes))
+	}
+}
+
+// syncSeed returns the device credential of a sync node, creating it if the
+// device has never enrolled. The upstream takes it as the device's credential
+// with the first bundle.
+func syncSeed(nc *nats.Conn, sync Sync) (string, error) {
+	current, err := localText(nc, sync.ID, data.PointTypeNkeySeed)
+	if err != nil || current != "" {
+		return current, err
+	}
+
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return "", err
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return "", err
+	}
+
+	err = SendLocalPoints(nc, sync.ID, data.Points{
+		data.NewPointString(data.PointTypeNkeySeed, "", string(seed))})
+	if err != nil {
+		return "", fmt.Errorf("error storing device credential: %v", err)
+	}
+
+	return string(seed), nil
+}
+
+// bundleSeed returns the seed this instance signs the bundles it writes for
+// its devices with, creating it the first time.
+func bundleSeed(nc *nats.Conn, root data.NodeEdge) (string, error) {
+	current, err := localText(nc, root.ID, data.PointTypeBundleSeed)
+	if err != nil || current != "" {
+		return current, err
+	}
+
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return "", err
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return "", err
+	}
+
+	err = SendLocalPoints(nc, root.ID, data.Points{
+		data.NewPointString(data.PointTypeBundleSeed, "", string(seed))})
+	if err != nil {
+		return "", fmt.Errorf("error storing bundle key: %v", err)
+	}
+
+	return string(seed), nil
+}
+
+// bundleSeqs returns the resume points recorded on a device node, by stream.
+func bundleSeqs(nc *nats.Conn, id string) (map[string]uint64, error) {
+	ret := make(map[string]uint64)
+
+	nodes, err := GetNodes(nc, "all", id, "", false)
+	if err != nil && err != data.ErrDocumentNotFound {
+		return nil, fmt.Errorf("error getting node %v: %v", id, err)
+	}
+
+	for _, n := range nodes {
+		for _, p := range n.Points {
+			if p.Type == data.PointTypeBundleSeq && p.Tombstone == 0 {
+				ret[p.Key] = uint64(p.Val())
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func summarize(b syncBundle, taken map[string]int) BundleSummary {
+	sum := BundleSummary{Up: b.Up, From: b.From, To: b.To}
+
+	for _, bs := range b.Streams {
+		s := BundleStream{Name: bs.name(), Count: len(bs.Messages)}
+		if taken != nil {
+			s.Count = taken[s.Name]
+		}
+		if len(bs.Messages) > 0 {
+			s.First = bs.Messages[0].Seq
+			s.Last = bs.Messages[len(bs.Messages)-1].Seq
+		}
+		sum.Streams = append(sum.Streams, s)
+	}
+
+	return sum
+}
+
+func signBundle(b syncBundle, seed string) ([]byte, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	err = json.NewEncoder(zw).Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := kp.Sign(body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(signedBundle{PubKey: pub, Sig: sig, Body: body.Bytes()})
+}
+
+// openBundle checks a bundle's signature and returns it with the key it was
+// signed with.
+func openBundle(file []byte) (syncBundle, string, error) {
+	var b syncBundle
+	var sb signedBundle
+
+	err := json.Unmarshal(file, &sb)
+	if err != nil {
+		return b, "", fmt.Errorf("not a sync bundle: %v", err)
+	}
+
+	kp, err := nkeys.FromPublicKey(sb.PubKey)
+	if err != nil {
+		return b, "", fmt.Errorf("bundle has a bad key: %v", err)
+	}
+	if kp.Verify(sb.Body, sb.Sig) != nil {
+		return b, "", errors.New("bundle signature does not match; the file was changed")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(sb.Body))
+	if err != nil {
+		return b, "", fmt.Errorf("error reading bundle: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return b, "", fmt.Errorf("error reading bundle: %v", err)
+	}
+
+	err = json.Unmarshal(body, &b)
+	if err != nil {
+		return b, "", fmt.Errorf("error reading bundle: %v", err)
+	}
+
+	if b.Version != syncBundleVersion {
+		return b, "", fmt.Errorf("bundle version %v is not supported", b.Version)
+	}
+
+	return b, sb.PubKey, nil
+}
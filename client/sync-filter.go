@@ -0,0 +1,265 @@
+package client
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// syncFilterMaxDepth bounds the walk up the tree when matching a subtree, so a
+// loop in the tree cannot hang a pump.
+const syncFilterMaxDepth = 64
+
+// filterNode is what a syncFilter knows about a node: its type and the
+// parents it lives under.
+type filterNode struct {
+	typ     string
+	parents []string
+}
+
+// syncFilter decides which messages a sync client keeps local rather than
+// pushing upstream, from the include and exclude lists on the sync node.
+//
+// Node types and subtrees select nodes. An excluded node stays local entirely,
+// edges included, so it does not appear upstream. When any node is included,
+// only the points of included nodes are pushed, but the edges of every node
+// that is not excluded still are, so the tree upstream keeps its shape. Point
+// types then select among the points of the nodes that pass.
+//
+// The sync nodes themselves are never filtered, so the filter is visible
+// upstream, and the device node of a stream always keeps its edges and
+// passes the node filters. The one exception is the nkeySeed point, the
+// secret half of the device's credential, which the store keeps out of the
+// streams but an older device may still have in its own.
+type syncFilter struct {
+	lock sync.Mutex
+
+	excludeNodeTypes  []string
+	includeNodeTypes  []string
+	excludePointTypes []string
+	includePointTypes []string
+	excludeNodes      []string
+	includeNodes      []string
+
+	nodes map[string]filterNode
+
+	// fetch returns every instance of a node, deleted ones included. It is a
+	// field so tests can stand in a tree.
+	fetch func(id string) ([]data.NodeEdge, error)
+}
+
+func newSyncFilter(nc *nats.Conn) *syncFilter {
+	return &syncFilter{
+		nodes: make(map[string]filterNode),
+		fetch: func(id string) ([]data.NodeEdge, error) {
+			return GetNodes(nc, "all", id, "", true)
+		},
+	}
+}
+
+// set applies the lists on a sync node.
+func (f *syncFilter) set(c Sync) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.excludeNodeTypes = slices.Clone(c.ExcludeNodeTypes)
+	f.includeNodeTypes = slices.Clone(c.IncludeNodeTypes)
+	f.excludePointTypes = slices.Clone(c.ExcludePointTypes)
+	f.includePointTypes = slices.Clone(c.IncludePointTypes)
+	f.excludeNodes = slices.Clone(c.ExcludeNodes)
+	f.includeNodes = slices.Clone(c.IncludeNodes)
+}
+
+// split divides a window of the stream of a boundary into the messages to
+// push and the ones to keep local. A nil filter keeps nothing local.
+func (f *syncFilter) split(boundary string, window []pumpMsg) (send, skip []pumpMsg, err error) {
+	if f == nil {
+		return window, nil, nil
+	}
+
+	send = make([]pumpMsg, 0, len(window))
+	for _, m := range window {
+		ok, err := f.pass(boundary, m.Subject(), m.Data())
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			send = append(send, m)
+		} else {
+			skip = append(skip, m)
+		}
+	}
+
+	return send, skip, nil
+}
+
+// pass reports whether a message from the stream of a boundary goes upstream.
+// It returns an error when the tree could not be read, and the pump tries the
+// message again later rather than guess.
+func (f *syncFilter) pass(boundary, subject string, payload []byte) (bool, error) {
+	// inst.<b>.<o>.<parent>.ep.<child> or inst.<b>.<o>.<node>.p.<type>.<key>
+	tok := strings.Split(subject, ".")
+
+	var id, pointType string
+	edge := false
+
+	switch {
+	case len(tok) == 6 && tok[4] == "ep":
+		id = tok[5]
+		edge = true
+	case len(tok) == 7 && tok[4] == "p":
+		id = tok[3]
+		pointType = tok[5]
+	default:
+		return true, nil
+	}
+
+	if pointType == data.PointTypeNkeySeed {
+		return false, nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if edge {
+		f.learnEdge(id, tok[3], payload)
+	}
+
+	if len(f.excludeNodeTypes)+len(f.includeNodeTypes)+len(f.excludePointTypes)+
+		len(f.includePointTypes)+len(f.excludeNodes)+len(f.includeNodes) == 0 {
+		return true, nil
+	}
+
+	n, err := f.node(id)
+	if err != nil {
+		return false, err
+	}
+
+	if n.typ == data.NodeTypeSync {
+		return true, nil
+	}
+
+	if id != boundary {
+		if slices.Contains(f.excludeNodeTypes, n.typ) {
+			return false, nil
+		}
+
+		if len(f.excludeNodes) > 0 {
+			in, err := f.under(id, f.excludeNodes)
+			if err != nil || in {
+				return false, err
+			}
+		}
+
+		if edge {
+			return true, nil
+		}
+
+		if len(f.includeNodeTypes)+len(f.includeNodes) > 0 {
+			in := slices.Contains(f.includeNodeTypes, n.typ)
+			if !in && len(f.includeNodes) > 0 {
+				in, err = f.under(id, f.includeNodes)
+				if err != nil {
+					return false, err
+				}
+			}
+			if !in {
+				return false, nil
+			}
+		}
+	} else if edge {
+		return true, nil
+	}
+
+	if slices.Contains(f.excludePointTypes, pointType) {
+		return false, nil
+	}
+
+	if len(f.includePointTypes) > 0 && !slices.Contains(f.includePointTypes, pointType) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// learnEdge keeps a known node up to date from an edge message, which is how a
+// node moving or getting its type shows up in the stream. A node keeps every
+// parent it had an edge to, deleted or not, so the delete of a node in an
+// excluded subtree stays local too.
+func (f *syncFilter) learnEdge(id, parent string, payload []byte) {
+	n, ok := f.nodes[id]
+	if !ok {
+		return
+	}
+
+	if !slices.Contains(n.parents, parent) {
+		n.parents = append(slices.Clone(n.parents), parent)
+	}
+
+	pts, _ := data.DecodePoints(payload)
+	for _, p := range pts {
+		if p.Type == data.PointTypeNodeType {
+			n.typ = p.Txt()
+		}
+	}
+
+	f.nodes[id] = n
+}
+
+// node returns what is known about a node, reading it from the tree the first
+// time. A node the tree does not have yet matches no node filter, and is read
+// again next time.
+func (f *syncFilter) node(id string) (filterNode, error) {
+	if n, ok := f.nodes[id]; ok {
+		return n, nil
+	}
+
+	nodes, err := f.fetch(id)
+	if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+		return filterNode{}, err
+	}
+
+	var n filterNode
+	for _, ne := range nodes {
+		n.typ = ne.Type
+		if ne.Parent != "" && !slices.Contains(n.parents, ne.Parent) {
+			n.parents = append(n.parents, ne.Parent)
+		}
+	}
+
+	if len(nodes) > 0 {
+		f.nodes[id] = n
+	}
+	return n, nil
+}
+
+// under reports whether a node is one of roots or lives below one of them.
+func (f *syncFilter) under(id string, roots []string) (bool, error) {
+	seen := make(map[string]bool)
+	next := []string{id}
+
+	for depth := 0; len(next) > 0 && depth < syncFilterMaxDepth; depth++ {
+		var parents []string
+		for _, id := range next {
+			if slices.Contains(roots, id) {
+				return true, nil
+			}
+			if seen[id] || id == "root" {
+				continue
+			}
+			seen[id] = true
+
+			n, err := f.node(id)
+			if err != nil {
+				return false, err
+			}
+			parents = append(parents, n.parents...)
+		}
+		next = parents
+	}
+
+	return false, nil
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// testSyncFilter returns a filter on a tree the test builds, with node IDs
+// mapped to their type and parent.
+func testSyncFilter(c Sync, tree map[string][2]string) *syncFilter {
+	f := newSyncFilter(nil)
+	f.fetch = func(id string) ([]data.NodeEdge, error) {
+		n, ok := tree[id]
+		if !ok {
+			return nil, data.ErrDocumentNotFound
+		}
+		return []data.NodeEdge{{ID: id, Type: n[0], Parent: n[1]}}, nil
+	}
+	f.set(c)
+	return f
+}
+
+var syncFilterTree = map[string][2]string{
+	"dev":     {data.NodeTypeDevice, "root"},
+	"sync":    {data.NodeTypeSync, "dev"},
+	"metrics": {data.NodeTypeMetrics, "dev"},
+	"diag":    {data.NodeTypeGroup, "dev"},
+	"diagVar": {data.NodeTypeVariable, "diag"},
+	"var":     {data.NodeTypeVariable, "dev"},
+}
+
+func pointSubject(node, typ string) string {
+	return "inst.dev.dev." + node + ".p." + typ + ".0"
+}
+
+func edgeSubject(parent, child string) string {
+	return "inst.dev.dev." + parent + ".ep." + child
+}
+
+func TestSyncFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Sync
+		subject string
+		expect  bool
+	}{
+		{"no filter", Sync{}, pointSubject("var", "value"), true},
+		{"excluded node type", Sync{ExcludeNodeTypes: []string{data.NodeTypeMetrics}},
+			pointSubject("metrics", "value"), false},
+		{"excluded node type edge", Sync{ExcludeNodeTypes: []string{data.NodeTypeMetrics}},
+			edgeSubject("dev", "metrics"), false},
+		{"other node type", Sync{ExcludeNodeTypes: []string{data.NodeTypeMetrics}},
+			pointSubject("var", "value"), true},
+		{"excluded subtree root", Sync{ExcludeNodes: []string{"diag"}},
+			pointSubject("diag", "description"), false},
+		{"excluded subtree", Sync{ExcludeNodes: []string{"diag"}},
+			pointSubject("diagVar", "value"), false},
+		{"excluded subtree edge", Sync{ExcludeNodes: []string{"diag"}},
+			edgeSubject("diag", "diagVar"), false},
+		{"outside subtree", Sync{ExcludeNodes: []string{"diag"}},
+			pointSubject("var", "value"), true},
+		{"excluded point type", Sync{ExcludePointTypes: []string{"value"}},
+			pointSubject("var", "value"), false},
+		{"excluded point type on device", Sync{ExcludePointTypes: []string{"value"}},
+			pointSubject("dev", "value"), false},
+		{"other point type", Sync{ExcludePointTypes: []string{"value"}},
+			pointSubject("var", "description"), true},
+		{"included point type", Sync{IncludePointTypes: []string{"value"}},
+			pointSubject("var", "value"), true},
+		{"not included point type", Sync{IncludePointTypes: []string{"value"}},
+			pointSubject("var", "description"), false},
+		{"edge with point types included", Sync{IncludePointTypes: []string{"value"}},
+			edgeSubject("dev", "var"), true},
+		{"included node type", Sync{IncludeNodeTypes: []string{data.NodeTypeVariable}},
+			pointSubject("diagVar", "value"), true},
+		{"not included node type", Sync{IncludeNodeTypes: []string{data.NodeTypeVariable}},
+			pointSubject("metrics", "value"), false},
+		{"edge of node not included", Sync{IncludeNodeTypes: []string{data.NodeTypeVariable}},
+			edgeSubject("dev", "metrics"), true},
+		{"included subtree", Sync{IncludeNodes: []string{"diag"}},
+			pointSubject("diagVar", "value"), true},
+		{"outside included subtree", Sync{IncludeNodes: []string{"diag"}},
+			pointSubject("var", "value"), false},
+		{"device passes node filters", Sync{IncludeNodes: []string{"diag"}},
+			pointSubject("dev", "description"), true},
+		{"sync node never filtered", Sync{
+			ExcludeNodeTypes:  []string{data.NodeTypeSync},
+			IncludePointTypes: []string{"value"},
+		}, pointSubject("sync", data.PointTypeSyncExcludeNodeType), true},
+		{"unknown node", Sync{ExcludeNodeTypes: []string{data.NodeTypeMetrics}},
+			pointSubject("gone", "value"), true},
+		{"seed never pushed", Sync{}, pointSubject("sync", data.PointTypeNkeySeed), false},
+		{"seed never pushed with point types included", Sync{
+			IncludePointTypes: []string{data.PointTypeNkeySeed},
+		}, pointSubject("sync", data.PointTypeNkeySeed), false},
+	}
+
+	for _, test := range tests {
+		f := testSyncFilter(test.config, syncFilterTree)
+		got, err := f.pass("dev", test.subject, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if got != test.expect {
+			t.Errorf("%v: got %v, expected %v", test.name, got, test.expect)
+		}
+	}
+}
+
+// TestSyncFilterMove verifies that a node moved into an excluded subtree is
+// kept local from the edge that moves it on.
+func TestSyncFilterMove(t *testing.T) {
+	f := testSyncFilter(Sync{ExcludeNodes: []string{"diag"}}, syncFilterTree)
+
+	if ok, _ := f.pass("dev", pointSubject("var", "value"), nil); !ok {
+		t.Fatal("node outside the subtree should be pushed")
+	}
+
+	if ok, _ := f.pass("dev", edgeSubject("diag", "var"), nil); ok {
+		t.Fatal("edge into the excluded subtree should stay local")
+	}
+
+	if ok, _ := f.pass("dev", pointSubject("var", "value"), nil); ok {
+		t.Fatal("node moved into the subtree should stay local")
+	}
+}
+
+func TestSyncFilterSplit(t *testing.T) {
+	f := testSyncFilter(Sync{ExcludePointTypes: []string{"value"}}, syncFilterTree)
+
+	acked := 0
+	window := []pumpMsg{
+		fakeMsg{subject: pointSubject("var", "value"), acked: &acked},
+		fakeMsg{subject: pointSubject("var", "description"), acked: &acked},
+	}
+
+	send, skip, err := f.split("dev", window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(send) != 1 || len(skip) != 1 || send[0].Subject() != pointSubject("var", "description") {
+		t.Fatalf("unexpected split: send %v, skip %v", send, skip)
+	}
+
+	var none *syncFilter
+	send, skip, _ = none.split("dev", window)
+	if len(send) != 2 || len(skip) != 0 {
+		t.Fatal("a pump without a filter should send everything")
+	}
+}
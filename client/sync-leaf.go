@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// leafDomains are the JetStream domains of the two ends of a sync over a
+// leafnode connection. A stream source names the domain it reads from, which
+// is how a request to set one up crosses the leafnode to the right server.
+type leafDomains struct {
+	local, remote string
+}
+
+// leafReason returns why a sync node replicates with pumps rather than over
+// its leafnode connection, or "" when it can use the leafnode. Filters, rate
+// limits and budgets are applied by the pumps, which stream sourcing has no
+// place for, so a sync node that sets any of them keeps its pumps.
+func leafReason(c Sync) string {
+	switch {
+	case c.LeafURI == "":
+		return "no leaf URI"
+	case len(c.ExcludeNodeTypes)+len(c.IncludeNodeTypes)+len(c.ExcludePointTypes)+
+		len(c.IncludePointTypes)+len(c.ExcludeNodes)+len(c.IncludeNodes) > 0:
+		return "include or exclude filters are set"
+	case c.RateLimit > 0 || c.DailyBudget > 0:
+		return "a rate limit or daily budget is set"
+	}
+
+	return ""
+}
+
+// leafMode works out whether a session replicates over the leafnode
+// connection, and the domains it does so with. Our replica upstream is
+// created if it is missing, since its info is where the upstream's domain is
+// read from.
+func (up *SyncClient) leafMode(ctx context.Context, ncRemote *nats.Conn,
+	jsRemote jetstream.JetStream) (leafDomains, bool) {
+
+	reason := leafReason(up.config)
+	if reason == "" {
+		name := fmt.Sprintf("inst_%v_%v", up.rootLocal.ID, up.rootLocal.ID)
+
+		var d leafDomains
+		var err error
+		d.local, err = streamDomain(up.nc, name)
+		if err == nil {
+			_, err = jsRemote.Stream(ctx, name)
+			if errors.Is(err, jetstream.ErrStreamNotFound) {
+				_, err = jsRemote.CreateStream(ctx, jetstream.StreamConfig{
+					Name:     name,
+					Subjects: []string{fmt.Sprintf("inst.%v.%v.>", up.rootLocal.ID, up.rootLocal.ID)},
+				})
+			}
+		}
+		if err == nil {
+			d.remote, err = streamDomain(ncRemote, name)
+		}
+
+		switch {
+		case err != nil:
+			reason = fmt.Sprintf("error reading JetStream domains: %v", err)
+		case d.local == "" || d.remote == "" || d.local == d.remote:
+			reason = "the two instances are not in JetStream domains of their own"
+		default:
+			log.Printf("Sync %v: replicating over the leafnode connection, domains %v and %v\n",
+				up.config.Description, d.local, d.remote)
+			return d, true
+		}
+	}
+
+	if up.config.LeafURI != "" {
+		log.Printf("Sync %v: not replicating over the leafnode connection, %v\n",
+			up.config.Description, reason)
+	}
+
+	return leafDomains{}, false
+}
+
+// streamDomain returns the JetStream domain of the server a connection is to.
+// It is read from the info of one of its streams, the one request a device
+// credential may make that carries it.
+func streamDomain(nc *nats.Conn, name string) (string, error) {
+	msg, err := nc.Request("$JS.API.STREAM.INFO."+name, nil, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		Domain string `json:"domain"`
+		Error  *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(msg.Data, &info); err != nil {
+		return "", err
+	}
+	if info.Error != nil {
+		return "", errors.New(info.Error.Description)
+	}
+
+	return info.Domain, nil
+}
+
+// sourceDomain returns the domain a stream source reads from. The server
+// hands the domain back only as the API prefix it became.
+func sourceDomain(ss *jetstream.StreamSource) string {
+	if ss.Domain != "" {
+		return ss.Domain
+	}
+	if ss.External == nil {
+		return ""
+	}
+
+	tok := strings.Split(ss.External.APIPrefix, ".")
+	if len(tok) != 3 || tok[0] != "$JS" || tok[2] != "API" {
+		return ""
+	}
+	return tok[1]
+}
+
+// ensureSourced makes the replica of a boundary-origin stream source the
+// stream of the same name in another domain, from a start sequence on. A
+// replica that already sources it is left alone, since the server keeps its
+// own place in a source and a new start would send it all again.
+func ensureSourced(ctx context.Context, dst jetstream.JetStream, boundary, origin,
+	domain string, start uint64) error {
+
+	name := fmt.Sprintf("inst_%v_%v", boundary, origin)
+	source := []*jetstream.StreamSource{{Name: name, Domain: domain, OptStartSeq: start}}
+
+	s, err := dst.Stream(ctx, name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = dst.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     name,
+			Subjects: []string{fmt.Sprintf("inst.%v.%v.>", boundary, origin)},
+			Sources:  source,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating sourced replica %v: %v", name, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error checking replica stream %v: %v", name, err)
+	}
+
+	cfg := s.CachedInfo().Config
+	if len(cfg.Sources) == 1 && cfg.Sources[0].Name == name &&
+		sourceDomain(cfg.Sources[0]) == domain {
+		return nil
+	}
+
+	cfg.Sources = source
+	_, err = dst.UpdateStream(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("error sourcing replica %v: %v", name, err)
+	}
+
+	return nil
+}
+
+// sourceStart returns the sequence a stream's source starts at: the first one
+// the durable consumer a pump reads it with has not had acknowledged, so a
+// sync node that moves from pumps to the leafnode does not send the stream
+// again. Without that consumer the source starts at the beginning.
+func sourceStart(ctx context.Context, js jetstream.JetStream, name, durable string) uint64 {
+	c, err := js.Consumer(ctx, name, durable)
+	if err != nil {
+		return 1
+	}
+	return c.CachedInfo().AckFloor.Stream + 1
+}
+
+// sourceLag returns how many messages the source of a replica has still to
+// take in, as far as the server sourcing it knows.
+func sourceLag(ctx context.Context, js jetstream.JetStream, name string) (uint64, error) {
+	s, err := js.Stream(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	info := s.CachedInfo()
+	if len(info.Sources) == 0 {
+		return 0, fmt.Errorf("replica %v is not sourced", name)
+	}
+	return info.Sources[0].Lag, nil
+}
+
+// scanLeaf does what scanPushes and scanPulls do for a session over a
+// leafnode connection. Rather than run pumps, it sets each stream up to be
+// sourced by the instance that receives it: the streams we forward by our
+// replicas upstream, and the upstream's streams for our boundaries by our
+// replicas here. It returns how far behind each pulled stream is, and records
+// how far the upstream has got with each stream we forward for pushHealth.
+func (up *SyncClient) scanLeaf(ctx context.Context, jsLocal, jsRemote jetstream.JetStream,
+	d leafDomains, upstream string, boundaries map[string]bool, forward []streamID,
+	sourced map[string]bool) map[string]int64 {
+
+	self := up.rootLocal.ID
+
+	reached := make(map[string]uint64, len(forward))
+	for _, st := range forward {
+		name := fmt.Sprintf("inst_%v_%v", st.boundary, st.origin)
+
+		s, err := jsLocal.Stream(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		start := sourceStart(ctx, jsLocal, name, "sync-"+upstream)
+		err = ensureSourced(ctx, jsRemote, st.boundary, st.origin, d.local, start)
+		if err != nil {
+			log.Printf("Sync %v: %v\n", up.config.Description, err)
+			continue
+		}
+		if !sourced[name] {
+			log.Printf("Sync %v: upstream sources %v\n", up.config.Description, name)
+			sourced[name] = true
+		}
+
+		lag, err := sourceLag(ctx, jsRemote, name)
+		last := s.CachedInfo().State.LastSeq
+		if err == nil && lag <= last {
+			reached[name] = last - lag
+		}
+	}
+	up.health.setSourced(reached)
+
+	pending := make(map[string]int64)
+	for boundary := range boundaries {
+		lister := jsRemote.ListStreams(ctx,
+			jetstream.WithStreamListSubject(fmt.Sprintf("inst.%v.>", boundary)))
+
+		for si := range lister.Info() {
+			b, o, ok := streamBoundaryOrigin(si.Config)
+			if !ok || b != boundary || boundaries[o] {
+				continue
+			}
+			name := si.Config.Name
+
+			start := sourceStart(ctx, jsRemote, name, "sync-"+self)
+			err := ensureSourced(ctx, jsLocal, b, o, d.remote, start)
+			if err != nil {
+				log.Printf("Sync %v: %v\n", up.config.Description, err)
+				continue
+			}
+			if !sourced[name] {
+				log.Printf("Sync %v: sourcing %v from upstream\n",
+					up.config.Description, name)
+				sourced[name] = true
+			}
+
+			lag, err := sourceLag(ctx, jsLocal, name)
+			if err == nil {
+				pending[name] = int64(lag)
+			}
+		}
+		if err := lister.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("Sync %v: error listing upstream streams: %v\n",
+				up.config.Description, err)
+		}
+	}
+
+	return pending
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// syncLimitPoll is the longest a send waits on the limiter before looking
+// again, so a new limit set on the sync node applies to a send already
+// waiting.
+const syncLimitPoll = 5 * time.Second
+
+// syncLimiter paces what a sync client sends and receives over a link that is
+// slow or paid for by the byte. It enforces a cap in bytes per second and a
+// budget in bytes per UTC day, and lets urgent sends -- configuration and
+// alarms -- go ahead of telemetry. Urgent sends honor the cap but not the
+// budget: a device that has used its data for the day still takes
+// configuration and still raises alarms.
+//
+// Bytes are counted as the subject and payload of each message. NATS protocol
+// overhead and TLS are not counted, so a cap should leave some headroom.
+type syncLimiter struct {
+	lock sync.Mutex
+
+	// rate is the cap in bytes per second, 0 for none
+	rate int64
+	// budget is the daily budget in bytes, 0 for none
+	budget int64
+
+	// day is the UTC day today counts bytes for
+	day   time.Time
+	today int64
+	// total is every byte sent since the client started, which the rate
+	// reported on the sync node is worked out from
+	total int64
+	// free is when the link is free again under the cap
+	free time.Time
+
+	urgentWaiting int
+
+	now func() time.Time
+}
+
+func newSyncLimiter() *syncLimiter {
+	return &syncLimiter{now: time.Now}
+}
+
+// set changes the cap and budget. Zero turns either off.
+func (l *syncLimiter) set(rate, budget int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+	l.budget = budget
+}
+
+// restore carries on counting a day's bytes after a restart, so restarting a
+// device does not give it a fresh budget. Bytes counted on an earlier day are
+// ignored.
+func (l *syncLimiter) restore(at time.Time, bytes int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollDay(l.now())
+	if utcDay(at).Equal(l.day) {
+		l.today = bytes
+	}
+}
+
+// usage returns the bytes counted today and since the client started.
+func (l *syncLimiter) usage() (today, total int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollDay(l.now())
+	return l.today, l.total
+}
+
+// spent reports whether today's budget is used up, which holds telemetry
+// until the next UTC day.
+func (l *syncLimiter) spent() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rollDay(l.now())
+	return l.budget > 0 && l.today >= l.budget
+}
+
+// wait blocks until n bytes may be sent, and counts them.
+func (l *syncLimiter) wait(ctx context.Context, n int, urgent bool) error {
+	if urgent {
+		l.lock.Lock()
+		l.urgentWaiting++
+		l.lock.Unlock()
+
+		defer func() {
+			l.lock.Lock()
+			l.urgentWaiting--
+			l.lock.Unlock()
+		}()
+	}
+
+	for {
+		d := l.reserve(n, urgent)
+		if d <= 0 {
+			return nil
+		}
+
+		d = min(d, syncLimitPoll)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+}
+
+// reserve counts n bytes and returns zero if they may be sent now, or
+// returns how long to wait before asking again.
+func (l *syncLimiter) reserve(n int, urgent bool) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.rollDay(now)
+
+	if !urgent {
+		if l.urgentWaiting > 0 {
+			// let the urgent send have the link first
+			return 50 * time.Millisecond
+		}
+		if l.budget > 0 && l.today+int64(n) > l.budget {
+			return l.day.AddDate(0, 0, 1).Sub(now)
+		}
+	}
+
+	if l.rate > 0 && l.free.After(now) {
+		return l.free.Sub(now)
+	}
+
+	if l.rate > 0 {
+		l.free = now.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	}
+
+	l.today += int64(n)
+	l.total += int64(n)
+
+	return 0
+}
+
+func (l *syncLimiter) rollDay(now time.Time) {
+	day := utcDay(now)
+	if !day.Equal(l.day) {
+		l.day = day
+		l.today = 0
+	}
+}
+
+func utcDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// windowBytes returns what a window counts against the limiter.
+func windowBytes(window []pumpMsg) int {
+	n := 0
+	for _, m := range window {
+		n += len(m.Subject()) + len(m.Data())
+	}
+	return n
+}
+
+// syncUrgent reports whether a stream message belongs to the urgent class,
+// which is sent ahead of a telemetry backlog:
+//
+//   - edges, which add, move and delete nodes
+//   - notifications, messages and rule state, which are how alarms travel
+//   - points with an origin, written by a user, a configuration tool, or a
+//     client acting on another node, such as a rule setting an output
+//
+// Everything else is what a client reports about its own node, which it
+// writes without an origin, and is telemetry.
+func syncUrgent(subject string, payload []byte) bool {
+	// inst.<b>.<o>.<parent>.ep.<child> or inst.<b>.<o>.<node>.p.<type>.<key>
+	tok := strings.Split(subject, ".")
+
+	if len(tok) == 6 && tok[4] == "ep" {
+		return true
+	}
+
+	if len(tok) != 7 || tok[4] != "p" {
+		return false
+	}
+
+	switch tok[5] {
+	case data.PointTypeNotification, data.PointTypeMessage, data.PointTypeActive:
+		return true
+	}
+
+	pts, err := data.DecodePoints(payload)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range pts {
+		if p.Origin != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// testLimiter returns a limiter on a clock the test moves by hand.
+func testLimiter(rate, budget int64) (*syncLimiter, *time.Time) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	l := newSyncLimiter()
+	l.now = func() time.Time { return now }
+	l.set(rate, budget)
+	return l, &now
+}
+
+func TestSyncLimiterRate(t *testing.T) {
+	l, now := testLimiter(1000, 0)
+
+	if d := l.reserve(2000, false); d != 0 {
+		t.Fatalf("first send should go at once, waited %v", d)
+	}
+
+	if d := l.reserve(100, false); d != 2*time.Second {
+		t.Fatalf("2000 bytes at 1000/s should hold the link 2s, got %v", d)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if d := l.reserve(100, true); d != 0 {
+		t.Fatalf("link should be free again, waited %v", d)
+	}
+
+	if today, total := l.usage(); today != 2100 || total != 2100 {
+		t.Fatalf("expected 2100 bytes counted, got %v today, %v total", today, total)
+	}
+}
+
+func TestSyncLimiterBudget(t *testing.T) {
+	l, now := testLimiter(0, 1000)
+
+	if d := l.reserve(800, false); d != 0 {
+		t.Fatalf("send within budget waited %v", d)
+	}
+
+	if d := l.reserve(300, false); d != 12*time.Hour {
+		t.Fatalf("telemetry past the budget should wait for the next day, got %v", d)
+	}
+	if d := l.reserve(300, true); d != 0 {
+		t.Fatalf("urgent send should ignore the budget, waited %v", d)
+	}
+	if !l.spent() {
+		t.Fatal("budget should be spent")
+	}
+
+	*now = now.Add(12 * time.Hour)
+	if l.spent() {
+		t.Fatal("budget should be fresh on a new day")
+	}
+	if d := l.reserve(300, false); d != 0 {
+		t.Fatalf("telemetry should go on a new day, waited %v", d)
+	}
+	if today, total := l.usage(); today != 300 || total != 1400 {
+		t.Fatalf("expected 300 today and 1400 total, got %v and %v", today, total)
+	}
+}
+
+func TestSyncLimiterUrgentFirst(t *testing.T) {
+	l, _ := testLimiter(0, 0)
+
+	l.urgentWaiting = 1
+	if d := l.reserve(10, false); d == 0 {
+		t.Fatal("telemetry should wait while an urgent send is waiting")
+	}
+	if d := l.reserve(10, true); d != 0 {
+		t.Fatalf("urgent send waited %v", d)
+	}
+}
+
+func TestSyncLimiterRestore(t *testing.T) {
+	l, now := testLimiter(0, 1000)
+
+	l.restore(now.Add(-time.Hour), 900)
+	if today, _ := l.usage(); today != 900 {
+		t.Fatalf("expected today's bytes restored, got %v", today)
+	}
+
+	l2, now2 := testLimiter(0, 1000)
+	l2.restore(now2.Add(-24*time.Hour), 900)
+	if today, _ := l2.usage(); today != 0 {
+		t.Fatalf("bytes from yesterday should not count, got %v", today)
+	}
+}
+
+func TestSyncUrgent(t *testing.T) {
+	encode := func(origin string) []byte {
+		p := data.NewPointFloat(data.PointTypeValue, "0", 1)
+		p.Origin = origin
+		pts := data.Points{p}
+		return pts.Encode()
+	}
+
+	tests := []struct {
+		name    string
+		subject string
+		payload []byte
+		expect  bool
+	}{
+		{"edge", "inst.b.o.parent.ep.child", nil, true},
+		{"notification", "inst.b.o.n.p.notification.0", nil, true},
+		{"rule active", "inst.b.o.n.p.active.0", nil, true},
+		{"user edit", "inst.b.o.n.p.value.0", encode("user"), true},
+		{"reading", "inst.b.o.n.p.value.0", encode(""), false},
+		{"bad payload", "inst.b.o.n.p.value.0", []byte{0xff}, false},
+		{"other subject", "p.n.value.0", nil, false},
+	}
+
+	for _, test := range tests {
+		if got := syncUrgent(test.subject, test.payload); got != test.expect {
+			t.Errorf("%v: got %v, expected %v", test.name, got, test.expect)
+		}
+	}
+}
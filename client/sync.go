@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
 	"github.com/simpleiot/simpleiot/data"
 )
 
@@ -19,10 +22,24 @@ type Sync struct {
 	Parent         string `node:"parent"`
 	Description    string `point:"description"`
 	URI            string `point:"uri"`
+	LeafURI        string `point:"leafURI"`
 	AuthToken      string `point:"authToken"`
+	NkeySeed       string `point:"nkeySeed"`
+	UpstreamPubKey string `point:"upstreamPubKey"`
 	Disabled       bool   `point:"disabled"`
 	SyncCount      int    `point:"syncCount"`
 	SyncCountReset bool   `point:"syncCountReset"`
+	UpstreamID     string `point:"upstreamID"`
+	Org            string `point:"org"`
+	RateLimit      int64  `point:"syncRateLimit"`
+	DailyBudget    int64  `point:"syncDailyBudget"`
+
+	ExcludeNodeTypes  []string `point:"syncExcludeNodeType"`
+	IncludeNodeTypes  []string `point:"syncIncludeNodeType"`
+	ExcludePointTypes []string `point:"syncExcludePointType"`
+	IncludePointTypes []string `point:"syncIncludePointType"`
+	ExcludeNodes      []string `point:"syncExcludeNode"`
+	IncludeNodes      []string `point:"syncIncludeNode"`
 }
 
 // SyncClient handles a connection to an upstream instance by
@@ -37,6 +54,11 @@ type Sync struct {
 //     for this instance) are copied into local replica streams, using
 //     durable consumers on the upstream streams.
 //
+// An instance that devices sync to (a site gateway) does the same for
+// their boundaries, so a device's data reaches every tier above it and
+// configuration written at any tier reaches the device (see
+// forwardSet).
+//
 // The store on each side consumes replica streams, merges tips into
 // its caches, and re-broadcasts changes locally (see store/replica.go).
 // No instance ever writes remote data into its own origin streams, so
@@ -52,6 +74,22 @@ type SyncClient struct {
 	rootLocal data.NodeEdge
 	ncRemote  *nats.Conn
 	sessions  int
+	// usingNkey is set when the connection signed in with the device
+	// credential rather than the shared auth token
+	usingNkey bool
+	// chSeed carries a credential a token session registered upstream
+	// back to Run, which stores it and reconnects with it
+	chSeed chan string
+
+	// limiter paces every session, so today's bytes carry across reconnects
+	limiter *syncLimiter
+	// health is what the running session knows about how far behind it is
+	health syncHealth
+	// filter keeps what the sync node lists as local out of the pushes
+	filter *syncFilter
+	// usage is how far the data usage of the connection upstream has
+	// been reported
+	usage connUsage
 
 	sessionCancel context.CancelFunc
 	sessionDone   chan struct{}
@@ -61,6 +99,58 @@ type SyncClient struct {
 // for new origin streams in this instance's boundary.
 const syncPullScanPeriod = 2 * time.Second
 
+// syncStatusPeriod is how often the health of the sync is reported on the
+// sync node.
+const syncStatusPeriod = 10 * time.Second
+
+// syncAdoptionPeriod is how often a session waiting for the upstream to
+// approve this instance asks again.
+const syncAdoptionPeriod = 5 * time.Second
+
+// syncLastSyncPeriod is how often the time of the last sync is moved on while
+// the sync stays caught up, so a healthy link does not write a point every
+// status period.
+const syncLastSyncPeriod = time.Minute
+
+// syncHealth is shared between a session, which knows the upstream and the
+// streams it pulls, and Run, which reports it.
+type syncHealth struct {
+	lock     sync.Mutex
+	upstream string
+	// pulls is how many messages each pulled stream has waiting, nil
+	// while no session runs
+	pulls map[string]int64
+	// sourced is, for each stream the upstream sources over a leafnode,
+	// the last sequence it has taken in. It outlives the session, so the
+	// backlog keeps growing from there while the link is down.
+	sourced map[string]uint64
+}
+
+func (h *syncHealth) set(upstream string, pulls map[string]int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.upstream = upstream
+	h.pulls = pulls
+}
+
+func (h *syncHealth) get() (string, map[string]int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.upstream, h.pulls
+}
+
+func (h *syncHealth) setSourced(sourced map[string]uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sourced = sourced
+}
+
+func (h *syncHealth) getSourced() map[string]uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sourced
+}
+
 // NewSyncClient constructor
 func NewSyncClient(nc *nats.Conn, config Sync) Client {
 	return &SyncClient{
@@ -70,6 +160,9 @@ func NewSyncClient(nc *nats.Conn, config Sync) Client {
 		newPoints:     make(chan NewPoints),
 		newEdgePoints: make(chan NewPoints),
 		chConnected:   make(chan bool),
+		chSeed:        make(chan string, 1),
+		limiter:       newSyncLimiter(),
+		filter:        newSyncFilter(nc),
 	}
 }
 
@@ -81,9 +174,31 @@ func (up *SyncClient) Run() error {
 		return fmt.Errorf("error getting root node: %v", err)
 	}
 
+	// the credential is not one of the sync node's points (see
+	// GetLocalPoints)
+	up.config.NkeySeed, err = localText(up.nc, up.config.ID, data.PointTypeNkeySeed)
+	if err != nil {
+		return fmt.Errorf("error getting device credential: %v", err)
+	}
+
+	up.limiter.set(up.config.RateLimit, up.config.DailyBudget)
+	up.filter.set(up.config)
+	up.health.set(up.config.UpstreamID, nil)
+	up.restoreUsage()
+
+	jsLocal, err := jetstream.New(up.nc)
+	if err != nil {
+		return fmt.Errorf("error creating JetStream context: %v", err)
+	}
+
 	connectTimer := time.NewTimer(time.Millisecond * 10)
 	connected := false
 
+	statusTicker := time.NewTicker(syncStatusPeriod)
+	defer statusTicker.Stop()
+	var status syncStatus
+	statusAt := time.Now()
+
 done:
 	for {
 		select {
@@ -99,6 +214,11 @@ done:
 				connectTimer.Reset(30 * time.Second)
 			}
 
+		case now := <-statusTicker.C:
+			status = up.sendStatus(jsLocal, status, connected, now, now.Sub(statusAt))
+			statusAt = now
+			up.reportUsage()
+
 		case conn := <-up.chConnected:
 			if conn && !connected {
 				connected = true
@@ -108,6 +228,12 @@ done:
 				up.stopSession()
 			}
 
+			if connected != status.connected {
+				now := time.Now()
+				status = up.sendStatus(jsLocal, status, connected, now, now.Sub(statusAt))
+				statusAt = now
+			}
+
 		case pts := <-up.newPoints:
 			err := data.MergePoints(pts.ID, pts.Points, &up.config)
 			if err != nil {
@@ -118,6 +244,7 @@ done:
 				switch p.Type {
 				case data.PointTypeURI,
 					data.PointTypeAuthToken,
+					data.PointTypeNkeySeed,
 					data.PointTypeDisabled:
 					// we need to restart the sync connection
 					connected = false
@@ -127,6 +254,9 @@ done:
 				}
 			}
 
+			up.limiter.set(up.config.RateLimit, up.config.DailyBudget)
+			up.filter.set(up.config)
+
 			if up.config.SyncCountReset {
 				up.config.SyncCount = 0
 				up.config.SyncCountReset = false
@@ -142,6 +272,22 @@ done:
 				}
 			}
 
+		case seed := <-up.chSeed:
+			err := SendLocalPoints(up.nc, up.config.ID, data.Points{
+				data.NewPointString(data.PointTypeNkeySeed, "", seed)})
+			if err != nil {
+				log.Println("Error storing device credential:", err)
+				break
+			}
+
+			// reconnect with the credential; connect drops the shared
+			// token once the upstream accepts it
+			up.config.NkeySeed = seed
+			connected = false
+			up.stopSession()
+			up.disconnect()
+			connectTimer.Reset(10 * time.Millisecond)
+
 		case pts := <-up.newEdgePoints:
 			err := data.MergeEdgePoints(pts.ID, pts.Parent, pts.Points, &up.config)
 			if err != nil {
@@ -156,6 +302,195 @@ done:
 	return nil
 }
 
+// syncStatus is what was last reported on the sync node.
+type syncStatus struct {
+	connected                   bool
+	backlog, rate, today, total int64
+	lag                         int64
+	pending                     map[string]int64
+	lastSync                    time.Time
+}
+
+// sendStatus reports the health of the sync on the sync node, sending only
+// what changed: whether the upstream is connected, how many messages each
+// stream has waiting and how old the oldest unsent one is, when the sync was
+// last caught up, and the bytes it moves.
+func (up *SyncClient) sendStatus(jsLocal jetstream.JetStream, last syncStatus,
+	connected bool, now time.Time, period time.Duration) syncStatus {
+
+	today, total := up.limiter.usage()
+
+	cur := syncStatus{
+		connected: connected,
+		today:     today,
+		total:     total,
+		pending:   make(map[string]int64),
+		lastSync:  last.lastSync,
+	}
+	if period > 0 {
+		cur.rate = int64(float64(total-last.total) / period.Seconds())
+	}
+
+	upstream, pulls := up.health.get()
+
+	var oldest time.Time
+	for name, h := range up.pushHealth(jsLocal, upstream) {
+		cur.pending[name] = h.pending
+		cur.backlog += h.pending
+		if !h.oldest.IsZero() && (oldest.IsZero() || h.oldest.Before(oldest)) {
+			oldest = h.oldest
+		}
+	}
+	// caught up needs a running session to know what the pulls have
+	// waiting
+	caughtUp := connected && pulls != nil && cur.backlog == 0
+
+	for name, n := range pulls {
+		cur.pending[name] = n
+		caughtUp = caughtUp && n == 0
+	}
+	// while no session runs, what the pulls have waiting is unknown, so
+	// the last count stands
+	for name, n := range last.pending {
+		if _, ok := cur.pending[name]; !ok {
+			cur.pending[name] = n
+		}
+	}
+
+	if !oldest.IsZero() {
+		cur.lag = int64(now.Sub(oldest).Seconds())
+	}
+
+	var points data.Points
+	if cur.connected != last.connected {
+		points = append(points, data.NewPointFloat(data.PointTypeSyncConnected, "",
+			data.BoolToFloat(cur.connected)))
+	}
+	if cur.backlog != last.backlog {
+		points = append(points,
+			data.NewPointFloat(data.PointTypeSyncBacklog, "", float64(cur.backlog)))
+	}
+	for name, n := range cur.pending {
+		if old, ok := last.pending[name]; !ok || old != n {
+			points = append(points,
+				data.NewPointFloat(data.PointTypeSyncPending, name, float64(n)))
+		}
+	}
+	if cur.lag != last.lag {
+		points = append(points,
+			data.NewPointFloat(data.PointTypeSyncLag, "", float64(cur.lag)))
+	}
+	if caughtUp && now.Sub(last.lastSync) >= syncLastSyncPeriod {
+		cur.lastSync = now
+		points = append(points, data.NewPointFloat(data.PointTypeSyncLastSync, "",
+			float64(now.Unix())))
+	}
+	if cur.rate != last.rate {
+		points = append(points,
+			data.NewPointFloat(data.PointTypeSyncRate, "", float64(cur.rate)))
+	}
+	if cur.today != last.today {
+		points = append(points,
+			data.NewPointFloat(data.PointTypeSyncBytesToday, "", float64(cur.today)))
+	}
+
+	if len(points) == 0 {
+		return cur
+	}
+
+	err := SendPoints(up.nc, SubjectNodePoints(up.config.ID), points, false)
+	if err != nil {
+		log.Println("Error sending sync status:", err)
+		return last
+	}
+
+	return cur
+}
+
+// streamHealth is how far behind the push of one stream is.
+type streamHealth struct {
+	pending int64
+	// oldest is when the oldest message not yet sent was written, zero
+	// if there is none
+	oldest time.Time
+}
+
+// pushHealth reads how far behind each stream this instance pushes is from the
+// durable consumer its push reads, which the upstream's acknowledgements move
+// on. It needs no connection to the upstream, so the backlog and its age keep
+// growing on the sync node while the link is down. A stream the upstream
+// sources over a leafnode is measured from where the source last got to
+// instead.
+func (up *SyncClient) pushHealth(jsLocal jetstream.JetStream, upstream string) map[string]streamHealth {
+	ret := make(map[string]streamHealth)
+	if upstream == "" {
+		// never connected, so nothing was pushed yet
+		return ret
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sourced := up.health.getSourced()
+
+	_, forward := up.forwardSet(ctx, jsLocal, up.rootLocal.ID, upstream)
+	for _, st := range forward {
+		name := fmt.Sprintf("inst_%v_%v", st.boundary, st.origin)
+
+		s, err := jsLocal.Stream(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		if reached, ok := sourced[name]; ok {
+			var h streamHealth
+			if last := s.CachedInfo().State.LastSeq; last > reached {
+				h.pending = int64(last - reached)
+				msg, err := s.GetMsg(ctx, reached+1, jetstream.WithGetMsgSubject("inst.>"))
+				if err == nil {
+					h.oldest = msg.Time
+				}
+			}
+			ret[name] = h
+			continue
+		}
+
+		c, err := s.Consumer(ctx, "sync-"+upstream)
+		if err != nil {
+			// not pushed yet
+			continue
+		}
+
+		info := c.CachedInfo()
+		h := streamHealth{pending: int64(info.NumPending) + int64(info.NumAckPending)}
+		if h.pending > 0 {
+			msg, err := s.GetMsg(ctx, info.AckFloor.Stream+1,
+				jetstream.WithGetMsgSubject("inst.>"))
+			if err == nil {
+				h.oldest = msg.Time
+			}
+		}
+		ret[name] = h
+	}
+
+	return ret
+}
+
+// restoreUsage picks up the bytes used today from the sync node, so a restart
+// does not give the device a fresh daily budget.
+func (up *SyncClient) restoreUsage() {
+	nodes, err := GetNodes(up.nc, "all", up.config.ID, "", false)
+	if err != nil || len(nodes) == 0 {
+		return
+	}
+
+	for _, p := range nodes[0].Points {
+		if p.Type == data.PointTypeSyncBytesToday {
+			up.limiter.restore(p.Time, int64(p.Val()))
+		}
+	}
+}
+
 // Stop sends a signal to the Run function to exit
 func (up *SyncClient) Stop(_ error) {
 	close(up.stop)
@@ -179,6 +514,23 @@ func (up *SyncClient) connect() error {
 		return nil
 	}
 
+	if up.config.URI == "" {
+		// a site without a link exchanges sync bundles instead
+		log.Printf("Sync %v has no URI, not connecting", up.config.Description)
+		return nil
+	}
+
+	up.usingNkey = false
+	if up.config.NkeySeed != "" {
+		if up.config.AuthToken != "" {
+			err := up.dropToken()
+			if err != nil {
+				return err
+			}
+		}
+		up.usingNkey = up.config.AuthToken == ""
+	}
+
 	opts := EdgeOptions{
 		URI:       up.config.URI,
 		AuthToken: up.config.AuthToken,
@@ -201,6 +553,10 @@ func (up *SyncClient) connect() error {
 		},
 	}
 
+	if up.usingNkey {
+		opts.NkeySeed = up.config.NkeySeed
+	}
+
 	var err error
 	up.ncRemote, err = EdgeConnect(opts)
 
@@ -211,13 +567,87 @@ func (up *SyncClient) connect() error {
 	return nil
 }
 
+// dropToken removes the shared auth token from the sync node once the upstream
+// accepts the device credential, so the device no longer holds a secret that
+// opens every instance in the fleet. If the upstream refuses the credential --
+// it is revoked, or the upstream does not know it yet -- the token is kept and
+// used for this connection.
+func (up *SyncClient) dropToken() error {
+	uri, err := sanitizeURI(up.config.URI)
+	if err != nil {
+		return err
+	}
+
+	nkeyOpt, err := nkeyOption(up.config.NkeySeed)
+	if err != nil {
+		return err
+	}
+
+	nc, err := nats.Connect(uri, nkeyOpt, nats.Timeout(10*time.Second))
+	if errors.Is(err, nats.ErrAuthorization) {
+		log.Printf("Sync %v: upstream refused the device credential, using the auth token\n",
+			up.config.Description)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error checking device credential: %v", err)
+	}
+	nc.Close()
+
+	err = SendNodePoint(up.nc, up.config.ID, data.Point{
+		Type:      data.PointTypeAuthToken,
+		Tombstone: 1,
+	}, true)
+	if err != nil {
+		return fmt.Errorf("error removing auth token: %v", err)
+	}
+
+	log.Printf("Sync %v: upstream accepted the device credential, auth token removed\n",
+		up.config.Description)
+	up.config.AuthToken = ""
+
+	return nil
+}
+
 func (up *SyncClient) disconnect() {
 	if up.ncRemote != nil {
 		up.ncRemote.Close()
+		up.reportUsage()
 		up.ncRemote = nil
 	}
 }
 
+// connUsage is what a connection upstream had moved when it was last read.
+type connUsage struct {
+	nc      *nats.Conn
+	in, out uint64
+}
+
+// reportUsage adds what the connection upstream moved since it was last read
+// to this instance's data usage. The counts are message payloads: protocol,
+// TCP and TLS overhead come on top.
+func (up *SyncClient) reportUsage() {
+	nc := up.ncRemote
+	if nc != up.usage.nc {
+		// a new connection counts from zero
+		up.usage = connUsage{nc: nc}
+	}
+	if nc == nil {
+		return
+	}
+
+	s := nc.Stats()
+	sent, received := s.OutBytes-up.usage.out, s.InBytes-up.usage.in
+	up.usage.in, up.usage.out = s.InBytes, s.OutBytes
+	if sent+received == 0 {
+		return
+	}
+
+	err := SendDataUsage(up.nc, int64(sent), int64(received))
+	if err != nil {
+		log.Println("Error reporting data usage:", err)
+	}
+}
+
 func (up *SyncClient) startSession() {
 	if up.sessionDone != nil {
 		return
@@ -240,10 +670,14 @@ func (up *SyncClient) startSession() {
 		log.Println("Error sending sync count:", err)
 	}
 
+	// a session opened with the shared token registers a device
+	// credential upstream
 	ncRemote := up.ncRemote
+	enroll := up.config.AuthToken != "" && !up.usingNkey
+	seed := up.config.NkeySeed
 	go func() {
 		defer close(done)
-		err := up.runSession(ctx, ncRemote)
+		err := up.runSession(ctx, ncRemote, enroll, seed)
 		if err != nil && ctx.Err() == nil {
 			log.Printf("Sync %v: session error: %v\n",
 				up.config.Description, err)
@@ -261,8 +695,12 @@ func (up *SyncClient) stopSession() {
 	up.sessionDone = nil
 }
 
-// runSession runs one replication session over a connected upstream.
-func (up *SyncClient) runSession(ctx context.Context, ncRemote *nats.Conn) error {
+// runSession runs one replication session over a connected upstream. When
+// enroll is set the session was opened with the shared auth token, and it
+// registers seed, or a new credential if seed is empty, on this instance's
+// node upstream.
+func (up *SyncClient) runSession(ctx context.Context, ncRemote *nats.Conn,
+	enroll bool, seed string) error {
 	X := up.rootLocal.ID
 
 	rootRemote, err := GetRootNode(ncRemote)
@@ -270,24 +708,42 @@ func (up *SyncClient) runSession(ctx context.Context, ncRemote *nats.Conn) error
 		return fmt.Errorf("error getting upstream root: %v", err)
 	}
 
+	// the upstream root is the origin of every stream this session pulls,
+	// which is how the store attributes those replicas to this node
+	err = SendNodePoint(up.nc, up.config.ID,
+		data.NewPointString(data.PointTypeUpstreamID, "", rootRemote.ID), false)
+	if err != nil {
+		log.Println("Error recording upstream ID:", err)
+	}
+
 	// adoption: make sure this instance exists in the upstream tree.
-	// The edge lives in the upstream's boundary (its origin streams);
-	// a plain (untagged) edge message makes the upstream persist it as
-	// its own write. If the upstream deleted us (tombstoned edge), we
-	// stay detached — only the upstream can restore the edge.
+	// If the upstream deleted us (tombstoned edge), we stay detached —
+	// only the upstream can restore the edge.
 	nodes, err := GetNodes(ncRemote, "all", X, "", true)
 	if err != nil && err != data.ErrDocumentNotFound {
 		return fmt.Errorf("error checking upstream for our node: %v", err)
 	}
 	if len(nodes) == 0 {
-		log.Printf("Sync %v: announcing this instance upstream\n",
-			up.config.Description)
-		err = SendEdgePoints(ncRemote, X, rootRemote.ID, data.Points{
-			data.NewPointFloat(data.PointTypeTombstone, "", 0),
-			data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
-		}, true)
+		if enroll && seed == "" {
+			// the credential is created now, so the upstream holds
+			// us for approval with the key we enroll
+			seed, err = syncSeed(up.nc, up.config)
+			if err != nil {
+				return fmt.Errorf("error creating device credential: %v", err)
+			}
+		}
+
+		err = up.announce(ctx, ncRemote, X, rootRemote.ID, seed)
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	if enroll {
+		err = up.enroll(ncRemote, X, nodes, seed)
 		if err != nil {
-			return fmt.Errorf("error announcing instance upstream: %v", err)
+			log.Printf("Sync %v: error registering device credential: %v\n",
+				up.config.Description, err)
 		}
 	}
 
@@ -300,17 +756,31 @@ func (up *SyncClient) runSession(ctx context.Context, ncRemote *nats.Conn) error
 		return fmt.Errorf("error creating remote JetStream context: %v", err)
 	}
 
+	// over a leafnode the servers replicate the streams themselves, and
+	// the session only sets the sources up
+	domains, leaf := up.leafMode(ctx, ncRemote, jsRemote)
+	sourced := make(map[string]bool)
+
 	// push our origin stream for our root boundary upstream
-	pushCC, err := runPump(ctx, jsLocal, jsRemote, X, X, rootRemote.ID)
-	if err != nil {
-		return fmt.Errorf("error starting push replication: %v", err)
+	pushes := make(map[string]*pump)
+	if !leaf {
+		up.health.setSourced(nil)
+		pushCC, err := runPump(ctx, jsLocal, jsRemote, X, X, rootRemote.ID,
+			up.limiter, up.filter)
+		if err != nil {
+			return fmt.Errorf("error starting push replication: %v", err)
+		}
+		pushes[fmt.Sprintf("inst_%v_%v", X, X)] = pushCC
 	}
-	defer pushCC.Stop()
 
 	// pull upstream-origin streams for our boundary; rescan for new
 	// ones (e.g. the first time the upstream writes configuration)
-	pulls := make(map[string]pumpStopper)
+	pulls := make(map[string]*pump)
 	defer func() {
+		up.health.set(rootRemote.ID, nil)
+		for _, cc := range pushes {
+			cc.Stop()
+		}
 		for _, cc := range pulls {
 			cc.Stop()
 		}
@@ -320,7 +790,24 @@ func (up *SyncClient) runSession(ctx context.Context, ncRemote *nats.Conn) error
 	defer ticker.Stop()
 
 	for {
-		up.scanPulls(ctx, jsLocal, jsRemote, X, pulls)
+		// devices syncing to us add boundaries as they are adopted, so
+		// what we forward is rescanned along with what we pull
+		boundaries, forward := up.forwardSet(ctx, jsLocal, X, rootRemote.ID)
+
+		var pending map[string]int64
+		if leaf {
+			pending = up.scanLeaf(ctx, jsLocal, jsRemote, domains, rootRemote.ID,
+				boundaries, forward, sourced)
+		} else {
+			up.scanPushes(ctx, jsLocal, jsRemote, forward, rootRemote.ID, pushes)
+			up.scanPulls(ctx, jsLocal, jsRemote, boundaries, pulls)
+
+			pending = make(map[string]int64, len(pulls))
+			for name, p := range pulls {
+				pending[name] = p.pending.Load()
+			}
+		}
+		up.health.set(rootRemote.ID, pending)
 
 		select {
 		case <-ctx.Done():
@@ -330,37 +817,258 @@ func (up *SyncClient) runSession(ctx context.Context, ncRemote *nats.Conn) error
 	}
 }
 
-// scanPulls discovers upstream-origin streams for our boundary and
-// starts a pull pump for each new one.
-func (up *SyncClient) scanPulls(ctx context.Context, jsLocal, jsRemote jetstream.JetStream,
-	boundary string, pulls map[string]pumpStopper) {
+// announce asks the upstream to take this instance into its tree. An upstream
+// that holds new devices for approval answers pending until an admin decides,
+// and announce asks again until then. The request carries the public key of
+// seed, the device credential, whose fingerprint the upstream lists and we log
+// while we wait. An upstream that predates adoption
+// approval is sent our edge instead. The edge lives in the upstream's
+// boundary (its origin streams); a plain (untagged) edge message makes the
+// upstream persist it as its own write.
+func (up *SyncClient) announce(ctx context.Context, ncRemote *nats.Conn, id,
+	upstream, seed string) error {
+
+	var info data.Points
+	for _, p := range up.rootLocal.Points {
+		switch p.Type {
+		case data.PointTypeDescription, data.PointTypeVersionApp,
+			data.PointTypeVersionOS, data.PointTypeVersionHW:
+			info = append(info, p)
+		}
+	}
+	if up.config.Org != "" {
+		// an upstream shared by several organizations adopts us
+		// into ours
+		info = append(info, data.NewPointString(data.PointTypeOrg, "", up.config.Org))
+	}
+
+	fingerprint := "none, no device credential"
+	if seed != "" {
+		kp, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return fmt.Errorf("error reading device credential: %v", err)
+		}
+		pub, err := kp.PublicKey()
+		if err != nil {
+			return err
+		}
+		info = append(info, data.NewPointString(data.PointTypePubKey, "", pub))
+		fingerprint = data.AdoptionFingerprint(pub)
+	}
 
-	lister := jsRemote.ListStreams(ctx,
-		jetstream.WithStreamListSubject(fmt.Sprintf("inst.%v.>", boundary)))
+	log.Printf("Sync %v: announcing this instance upstream\n", up.config.Description)
 
+	waiting := false
+	for {
+		state, err := RequestAdoption(ncRemote, id, info)
+		if errors.Is(err, nats.ErrNoResponders) {
+			err = SendEdgePoints(ncRemote, id, upstream, data.Points{
+				data.NewPointFloat(data.PointTypeTombstone, "", 0),
+				data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
+			}, true)
+			if err != nil {
+				return fmt.Errorf("error announcing instance upstream: %v", err)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error announcing instance upstream: %v", err)
+		}
+
+		switch state {
+		case data.AdoptionApproved:
+			return nil
+		case data.AdoptionRejected:
+			return errors.New("the upstream rejected this instance")
+		}
+
+		if !waiting {
+			log.Printf("Sync %v: waiting for the upstream to approve this instance, fingerprint %v\n",
+				up.config.Description, fingerprint)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(syncAdoptionPeriod):
+		}
+	}
+}
+
+// enroll registers this instance's device credential on its node upstream and
+// hands the seed to Run, which stores it and reconnects with it. The upstream
+// writes the public key as its own point, which is the only kind it honors, so
+// the device cannot set or change its key once it stops using the token. A key
+// the upstream already has is not registered again: it was refused, so it is
+// revoked, and the device keeps the token until an operator steps in.
+func (up *SyncClient) enroll(ncRemote *nats.Conn, id string, nodes []data.NodeEdge,
+	seed string) error {
+
+	var kp nkeys.KeyPair
+	var err error
+	if seed == "" {
+		kp, err = nkeys.CreateUser()
+	} else {
+		kp, err = nkeys.FromSeed([]byte(seed))
+	}
+	if err != nil {
+		return err
+	}
+
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) > 0 {
+		for _, p := range nodes[0].Points {
+			if p.Type == data.PointTypePubKey && p.Txt() == pub {
+				return nil
+			}
+		}
+	}
+
+	newSeed, err := kp.Seed()
+	if err != nil {
+		return err
+	}
+
+	err = SendNodePoint(ncRemote, id,
+		data.NewPointString(data.PointTypePubKey, "", pub), true)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sync %v: registered device credential %v upstream\n",
+		up.config.Description, pub)
+
+	select {
+	case up.chSeed <- string(newSeed):
+	default:
+	}
+
+	return nil
+}
+
+// streamID names a boundary-origin stream by its two IDs.
+type streamID struct {
+	boundary, origin string
+}
+
+// forwardSet works out what this instance replicates with its upstream.
+// The boundaries are our own plus the boundary of every device that
+// pushes its stream to us, at any depth: a device syncing to a device
+// syncing to us pushes to its own upstream, which forwards it here. The
+// streams forwarded are the ones in those boundaries that we or one of
+// those devices wrote. Everything else in those boundaries was written
+// above us, so it is pulled rather than pushed, and each stream keeps
+// the single writer it has everywhere.
+func (up *SyncClient) forwardSet(ctx context.Context, jsLocal jetstream.JetStream,
+	self, upstream string) (map[string]bool, []streamID) {
+
+	boundaries, forward, err := forwardStreams(ctx, jsLocal, self, upstream)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Sync %v: error listing local streams: %v\n",
+			up.config.Description, err)
+	}
+
+	return boundaries, forward
+}
+
+// forwardStreams does the work of forwardSet. A sync bundle carries the same
+// streams a push would.
+func forwardStreams(ctx context.Context, jsLocal jetstream.JetStream,
+	self, upstream string) (map[string]bool, []streamID, error) {
+
+	boundaries := map[string]bool{self: true}
+	var streams []streamID
+
+	lister := jsLocal.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
 	for si := range lister.Info() {
 		b, o, ok := streamBoundaryOrigin(si.Config)
-		if !ok || b != boundary || o == boundary {
+		if !ok {
 			continue
 		}
-		if _, running := pulls[si.Config.Name]; running {
+		streams = append(streams, streamID{b, o})
+		// a device's own stream is what marks its boundary as one that
+		// syncs through us
+		if b == o && b != upstream {
+			boundaries[b] = true
+		}
+	}
+
+	var forward []streamID
+	for _, st := range streams {
+		if boundaries[st.boundary] && boundaries[st.origin] {
+			forward = append(forward, st)
+		}
+	}
+
+	return boundaries, forward, lister.Err()
+}
+
+// scanPushes starts a push pump for each stream to forward that is not
+// already being pushed.
+func (up *SyncClient) scanPushes(ctx context.Context, jsLocal, jsRemote jetstream.JetStream,
+	forward []streamID, upstream string, pushes map[string]*pump) {
+
+	for _, st := range forward {
+		name := fmt.Sprintf("inst_%v_%v", st.boundary, st.origin)
+		if _, running := pushes[name]; running {
 			continue
 		}
 
-		cc, err := runPump(ctx, jsRemote, jsLocal, b, o, boundary)
+		cc, err := runPump(ctx, jsLocal, jsRemote, st.boundary, st.origin, upstream,
+			up.limiter, up.filter)
 		if err != nil {
-			log.Printf("Sync %v: error starting pull replication %v: %v\n",
-				up.config.Description, si.Config.Name, err)
+			log.Printf("Sync %v: error starting push replication %v: %v\n",
+				up.config.Description, name, err)
 			continue
 		}
 
-		log.Printf("Sync %v: replicating %v from upstream\n",
-			up.config.Description, si.Config.Name)
-		pulls[si.Config.Name] = cc
+		log.Printf("Sync %v: forwarding %v upstream\n", up.config.Description, name)
+		pushes[name] = cc
 	}
-	if err := lister.Err(); err != nil && ctx.Err() == nil {
-		log.Printf("Sync %v: error listing upstream streams: %v\n",
-			up.config.Description, err)
+}
+
+// scanPulls discovers upstream-origin streams for the boundaries we
+// replicate and starts a pull pump for each new one. A stream written by
+// us or by a device below us is never pulled back down, since we are the
+// ones pushing it.
+func (up *SyncClient) scanPulls(ctx context.Context, jsLocal, jsRemote jetstream.JetStream,
+	boundaries map[string]bool, pulls map[string]*pump) {
+
+	self := up.rootLocal.ID
+
+	for boundary := range boundaries {
+		lister := jsRemote.ListStreams(ctx,
+			jetstream.WithStreamListSubject(fmt.Sprintf("inst.%v.>", boundary)))
+
+		for si := range lister.Info() {
+			b, o, ok := streamBoundaryOrigin(si.Config)
+			if !ok || b != boundary || boundaries[o] {
+				continue
+			}
+			if _, running := pulls[si.Config.Name]; running {
+				continue
+			}
+
+			cc, err := runPump(ctx, jsRemote, jsLocal, b, o, self, up.limiter, nil)
+			if err != nil {
+				log.Printf("Sync %v: error starting pull replication %v: %v\n",
+					up.config.Description, si.Config.Name, err)
+				continue
+			}
+
+			log.Printf("Sync %v: replicating %v from upstream\n",
+				up.config.Description, si.Config.Name)
+			pulls[si.Config.Name] = cc
+		}
+		if err := lister.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("Sync %v: error listing upstream streams: %v\n",
+				up.config.Description, err)
+		}
 	}
 }
 
@@ -402,9 +1110,14 @@ type asyncPublisher interface {
 		opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error)
 }
 
-// pumpStopper shuts a running pump down.
-type pumpStopper interface {
-	Stop()
+// ackAll acknowledges messages a pump keeps local.
+func ackAll(msgs []pumpMsg) error {
+	for _, m := range msgs {
+		if err := m.Ack(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // sendWindow publishes every message in a window, waits for the receiving
@@ -449,6 +1162,23 @@ func sendWindow(ctx context.Context, dst asyncPublisher, window []pumpMsg) error
 	return nil
 }
 
+// pump is a running copy of one stream.
+type pump struct {
+	its []jetstream.MessagesContext
+	// pending is how many messages in the source the pump has not yet
+	// sent, as of the last window it read
+	pending atomic.Int64
+	// sent is the stream sequence of the last message the pump sent
+	sent atomic.Uint64
+}
+
+// Stop shuts the pump down.
+func (p *pump) Stop() {
+	for _, it := range p.its {
+		it.Stop()
+	}
+}
+
 // runPump copies messages from a boundary-origin stream on src into the
 // same-named replica stream on dst, preserving subjects. A durable
 // consumer on src (named for the receiving instance) makes the copy
@@ -456,26 +1186,24 @@ func sendWindow(ctx context.Context, dst asyncPublisher, window []pumpMsg) error
 // redelivered. Messages move in windows and are acknowledged only after dst
 // confirms every write in the window; a window that fails is resent rather
 // than skipped, so the receiving stream sees each subject in source order.
+//
+// Every window goes through the limiter. A push sends this instance's data at
+// telemetry priority, and a second consumer picks the urgent messages out of
+// a backlog and sends them ahead (see runUrgent). A pull brings configuration
+// down, so it is urgent throughout.
+//
+// A push is given the filter of the sync node, and a message the filter keeps
+// local is acknowledged without being sent. A pull has no filter.
 func runPump(ctx context.Context, src, dst jetstream.JetStream,
-	boundary, origin, durableFor string) (pumpStopper, error) {
+	boundary, origin, durableFor string, lim *syncLimiter, filter *syncFilter) (*pump, error) {
+
+	push := filter != nil
 
 	name := fmt.Sprintf("inst_%v_%v", boundary, origin)
 
-	// make sure the replica stream exists on the receiving side —
-	// create only, never update: the receiving instance's store owns
-	// stream configuration (retention etc.) and applies its policy
-	// when it discovers the stream
-	_, err := dst.Stream(ctx, name)
-	if errors.Is(err, jetstream.ErrStreamNotFound) {
-		_, err = dst.CreateStream(ctx, jetstream.StreamConfig{
-			Name:     name,
-			Subjects: []string{fmt.Sprintf("inst.%v.%v.>", boundary, origin)},
-		})
-		if err != nil && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
-			return nil, fmt.Errorf("error creating replica stream %v: %v", name, err)
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error checking replica stream %v: %v", name, err)
+	err := ensureReplica(ctx, dst, boundary, origin)
+	if err != nil {
+		return nil, err
 	}
 
 	s, err := src.Stream(ctx, name)
@@ -496,18 +1224,42 @@ func runPump(ctx context.Context, src, dst jetstream.JetStream,
 		return nil, fmt.Errorf("error iterating %v: %v", name, err)
 	}
 
+	p := &pump{its: []jetstream.MessagesContext{it}}
+	p.pending.Store(int64(c.CachedInfo().NumPending))
+
+	if push {
+		uit, err := urgentMessages(ctx, s, c, durableFor)
+		if err != nil {
+			p.Stop()
+			return nil, fmt.Errorf("error creating urgent consumer on %v: %v", name, err)
+		}
+		p.its = append(p.its, uit)
+
+		go p.runUrgent(ctx, dst, name, boundary, uit, lim, filter)
+	}
+
 	go func() {
 		for {
-			window, err := fillWindow(it)
+			window, pending, err := fillWindow(it)
 			if err != nil {
 				// the iterator was stopped, or the session ended
 				return
 			}
+			p.pending.Store(int64(pending) + int64(len(window)))
 
 			// resend until it lands: moving on would let a later
 			// message overtake this window on the receiving side
 			for {
-				err := sendWindow(ctx, dst, window)
+				send, skip, err := filter.split(boundary, window)
+				if err == nil && len(send) > 0 {
+					if lim.wait(ctx, windowBytes(send), !push) != nil {
+						return
+					}
+					err = sendWindow(ctx, dst, send)
+				}
+				if err == nil {
+					err = ackAll(skip)
+				}
 				if err == nil {
 					break
 				}
@@ -521,29 +1273,165 @@ func runPump(ctx context.Context, src, dst jetstream.JetStream,
 				case <-time.After(pumpRetryPeriod):
 				}
 			}
+
+			p.pending.Store(int64(pending))
+			if m, ok := window[len(window)-1].(jetstream.Msg); ok {
+				if meta, err := m.Metadata(); err == nil {
+					p.sent.Store(meta.Sequence.Stream)
+				}
+			}
 		}
 	}()
 
-	return it, nil
+	return p, nil
+}
+
+// ensureReplica makes sure the replica of a boundary-origin stream exists on
+// the receiving side. It creates the stream but does not otherwise update one:
+// the receiving instance's store owns stream configuration (retention etc.)
+// and applies its policy when it discovers the stream. The one exception is
+// the source a sync over a leafnode set up (see ensureSourced), which is
+// dropped so a sync node that went back to pumps does not replicate twice.
+func ensureReplica(ctx context.Context, dst jetstream.JetStream, boundary, origin string) error {
+	name := fmt.Sprintf("inst_%v_%v", boundary, origin)
+
+	s, err := dst.Stream(ctx, name)
+	if err == nil && len(s.CachedInfo().Config.Sources) > 0 {
+		cfg := s.CachedInfo().Config
+		cfg.Sources = nil
+		_, err = dst.UpdateStream(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("error dropping the source of replica %v: %v", name, err)
+		}
+	} else if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = dst.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     name,
+			Subjects: []string{fmt.Sprintf("inst.%v.%v.>", boundary, origin)},
+		})
+		if err != nil && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+			return fmt.Errorf("error creating replica stream %v: %v", name, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("error checking replica stream %v: %v", name, err)
+	}
+
+	return nil
+}
+
+// urgentMessages returns the second consumer a push reads, which finds the
+// urgent messages in the stream. It is durable like the first, and starts
+// where the first one is when it is created, so what was already sent is not
+// looked at again.
+func urgentMessages(ctx context.Context, s jetstream.Stream, ordered jetstream.Consumer,
+	durableFor string) (jetstream.MessagesContext, error) {
+
+	durable := "sync-" + durableFor + "-urgent"
+
+	c, err := s.Consumer(ctx, durable)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		c, err = s.CreateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       durable,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			DeliverPolicy: jetstream.DeliverByStartSequencePolicy,
+			OptStartSeq:   ordered.CachedInfo().AckFloor.Stream + 1,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Messages(jetstream.PullMaxMessages(pumpWindowSize))
+}
+
+// runUrgent sends the urgent messages of a stream (see syncUrgent) while the
+// pump is behind, so a change to configuration or an alarm does not wait for
+// a backlog of telemetry to drain. The pump is behind when more than a window
+// of messages is waiting, or when today's budget is spent and telemetry is
+// held. A message sent here is sent again, in order, when the pump gets to
+// it. That is what keeps each subject in source order on the receiving side,
+// which reads the last message on a subject as its current value; the store
+// ignores the repeat.
+func (p *pump) runUrgent(ctx context.Context, dst asyncPublisher, name, boundary string,
+	it jetstream.MessagesContext, lim *syncLimiter, filter *syncFilter) {
+
+	for {
+		var send []pumpMsg
+
+		for len(send) < pumpWindowSize {
+			msg, err := it.Next()
+			if err != nil {
+				return
+			}
+
+			meta, err := msg.Metadata()
+			if err != nil {
+				continue
+			}
+
+			behind := p.pending.Load() > pumpWindowSize || lim.spent()
+			urgent := behind && meta.Sequence.Stream > p.sent.Load() &&
+				syncUrgent(msg.Subject(), msg.Data())
+			if urgent {
+				// a message the filter keeps local, or cannot decide on
+				// yet, is left to the ordered pump
+				ok, err := filter.pass(boundary, msg.Subject(), msg.Data())
+				urgent = ok && err == nil
+			}
+
+			if urgent {
+				send = append(send, msg)
+			} else if err := msg.Ack(); err != nil {
+				return
+			}
+
+			if meta.NumPending == 0 {
+				break
+			}
+		}
+
+		for len(send) > 0 {
+			if lim.wait(ctx, windowBytes(send), true) != nil {
+				return
+			}
+			err := sendWindow(ctx, dst, send)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Sync: error sending urgent points from %v, retrying: %v\n", name, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pumpRetryPeriod):
+			}
+		}
+	}
 }
 
 // fillWindow collects up to a full window from the iterator, returning early
 // once the source has nothing further waiting so a caught-up pump does not sit
-// on a partial window.
-func fillWindow(it jetstream.MessagesContext) ([]pumpMsg, error) {
+// on a partial window. It also returns how many messages are waiting behind
+// the window.
+func fillWindow(it jetstream.MessagesContext) ([]pumpMsg, uint64, error) {
 	window := make([]pumpMsg, 0, pumpWindowSize)
+	var pending uint64
 
 	for len(window) < pumpWindowSize {
 		msg, err := it.Next()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		window = append(window, msg)
 
-		if meta, err := msg.Metadata(); err == nil && meta.NumPending == 0 {
-			break
+		if meta, err := msg.Metadata(); err == nil {
+			pending = meta.NumPending
+			if pending == 0 {
+				break
+			}
 		}
 	}
 
-	return window, nil
+	return window, pending, nil
 }
@@ -1,10 +1,16 @@
 package client_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
 	"github.com/simpleiot/simpleiot/client"
 	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/server"
@@ -278,3 +284,1029 @@ func TestSyncOfflineCatchup(t *testing.T) {
 		return err == nil && len(nodes) > 0 && nodes[0].Description == "offline config"
 	})
 }
+
+// TestSyncNested verifies multi-tier sync: a device syncs to a gateway,
+// which syncs to a cloud instance. The device's data reaches the cloud
+// through the gateway, and configuration the cloud writes for the device
+// reaches it two levels down.
+func TestSyncNested(t *testing.T) {
+	ncC, _, stopC, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting cloud test server: ", err)
+	}
+	defer stopC()
+
+	ncG, rootG, stopG, err := server.TestServerOpts(server.TestServerOptions3)
+	if err != nil {
+		t.Fatal("Error starting gateway test server: ", err)
+	}
+	defer stopG()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting device test server: ", err)
+	}
+	defer stopD()
+
+	err = client.SendNodeType(ncG, client.Sync{
+		ID:          "sync-gateway",
+		Parent:      rootG.ID,
+		Description: "gateway to cloud",
+		URI:         server.TestServerOptions2.NatsServer,
+	}, "test")
+	if err != nil {
+		t.Fatal("Error sending gateway sync node: ", err)
+	}
+
+	err = client.SendNodeType(ncD, client.Sync{
+		ID:          "sync-device",
+		Parent:      rootD.ID,
+		Description: "device to gateway",
+		URI:         server.TestServerOptions3.NatsServer,
+	}, "test")
+	if err != nil {
+		t.Fatal("Error sending device sync node: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "device not adopted by gateway", func() bool {
+		nodes, err := client.GetNodes(ncG, rootG.ID, rootD.ID, "", false)
+		return err == nil && len(nodes) > 0
+	})
+
+	waitFor(t, 15*time.Second, "device not visible in cloud", func() bool {
+		nodes, err := client.GetNodes(ncC, rootG.ID, rootD.ID, "", false)
+		return err == nil && len(nodes) > 0
+	})
+
+	fmt.Println("**** device data up two levels")
+	varD := client.Variable{ID: "varNested", Parent: rootD.ID, Description: "from device"}
+	err = client.SendNodeType(ncD, varD, "test")
+	if err != nil {
+		t.Fatal("Error sending variable: ", err)
+	}
+
+	waitFor(t, 15*time.Second, "device node not forwarded to cloud", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncC, rootD.ID, varD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "from device"
+	})
+
+	fmt.Println("**** gateway config for the device up to the cloud")
+	err = client.SendNodePoint(ncG, varD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "set on gateway"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	waitFor(t, 15*time.Second, "gateway config not forwarded to cloud", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncC, rootD.ID, varD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set on gateway"
+	})
+
+	fmt.Println("**** cloud config down two levels")
+	err = client.SendNodePoint(ncC, varD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "set in cloud"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	waitFor(t, 15*time.Second, "cloud config not on gateway", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncG, rootD.ID, varD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set in cloud"
+	})
+
+	waitFor(t, 15*time.Second, "cloud config not on device", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncD, rootD.ID, varD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set in cloud"
+	})
+
+	fmt.Println("**** cloud node created on the device")
+	varC := client.Variable{ID: "varCloud", Parent: rootD.ID, Description: "from cloud"}
+	err = client.SendNodeType(ncC, varC, "test")
+	if err != nil {
+		t.Fatal("Error sending variable: ", err)
+	}
+
+	waitFor(t, 15*time.Second, "cloud node not on device", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncD, rootD.ID, varC.ID)
+		return err == nil && len(nodes) > 0
+	})
+}
+
+// TestSyncDeviceCredential covers per-device credentials: a device that
+// connects with the shared token registers its own NKey upstream, switches to
+// it and drops the token, and is locked out when the upstream revokes it.
+func TestSyncDeviceCredential(t *testing.T) {
+	optsU := server.TestServerOptions2
+	optsU.AuthToken = "fleet-token"
+
+	ncU, _, stopU, err := server.TestServerOpts(optsU)
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         optsU.NatsServer,
+		AuthToken:   optsU.AuthToken,
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	fmt.Println("**** device registers a credential and drops the token")
+	pubKey := ""
+	waitFor(t, 10*time.Second, "device credential not registered upstream", func() bool {
+		nodes, err := client.GetNodes(ncU, "all", rootD.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			return false
+		}
+		p, ok := nodes[0].Points.Find(data.PointTypePubKey, "")
+		pubKey = p.Txt()
+		return ok && pubKey != ""
+	})
+
+	seed := ""
+	waitFor(t, 10*time.Second, "token not replaced by the credential", func() bool {
+		syncs, err := client.GetNodesType[client.Sync](ncD, "all", sync.ID)
+		if err != nil || len(syncs) < 1 {
+			return false
+		}
+		local, err := client.GetLocalPoints(ncD, sync.ID)
+		if err != nil {
+			return false
+		}
+		seed, _ = local.Text(data.PointTypeNkeySeed, "")
+		return seed != "" && syncs[0].AuthToken == "" && syncs[0].NkeySeed == ""
+	})
+
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		t.Fatal("Error parsing seed: ", err)
+	}
+	if pub, _ := kp.PublicKey(); pub != pubKey {
+		t.Fatal("stored seed does not match the key registered upstream")
+	}
+
+	fmt.Println("**** sync works with the credential")
+	err = client.SendNodePoint(ncD, rootD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "set down"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "description not propagated upstream", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncU, "all", rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set down"
+	})
+
+	varU := client.Variable{ID: "varUp", Parent: rootD.ID, Description: "varUp"}
+	err = client.SendNodeType(ncU, varU, "test")
+	if err != nil {
+		t.Fatal("Error sending varU: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "varUp not propagated downstream", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncD, "all", "varUp")
+		return err == nil && len(nodes) > 0
+	})
+
+	fmt.Println("**** the credential reaches only what the device needs")
+	ncDev, err := nats.Connect(optsU.NatsServer, nats.Nkey(pubKey, kp.Sign))
+	if err != nil {
+		t.Fatal("Error connecting with the device credential: ", err)
+	}
+	defer ncDev.Close()
+
+	_, err = ncDev.Request("nodes.all.varUp", nil, time.Second)
+	if err == nil {
+		t.Fatal("a device credential should not reach other nodes")
+	}
+
+	other, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _ := other.PublicKey()
+	_, err = nats.Connect(optsU.NatsServer, nats.Nkey(otherPub, other.Sign))
+	if !errors.Is(err, nats.ErrAuthorization) {
+		t.Fatal("an unknown credential should be refused, got: ", err)
+	}
+
+	fmt.Println("**** revoke the credential")
+	err = client.SendNodePoint(ncU, rootD.ID,
+		data.NewPointFloat(data.PointTypeRevoked, "", 1), true)
+	if err != nil {
+		t.Fatal("error revoking credential: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "revoked connection not closed", func() bool {
+		return !ncDev.IsConnected()
+	})
+
+	_, err = nats.Connect(optsU.NatsServer, nats.Nkey(pubKey, kp.Sign))
+	if !errors.Is(err, nats.ErrAuthorization) {
+		t.Fatal("a revoked credential should be refused, got: ", err)
+	}
+
+	err = client.SendNodePoint(ncD, rootD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "after revoke"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	nodes, err := client.GetNodesType[client.Device](ncU, "all", rootD.ID)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("device node missing upstream: ", err)
+	}
+	if nodes[0].Description != "set down" {
+		t.Fatal("a revoked device still syncs: ", nodes[0].Description)
+	}
+}
+
+// TestSyncDailyBudget verifies that a device whose daily budget is spent holds
+// its telemetry but still sends a configuration change upstream.
+func TestSyncDailyBudget(t *testing.T) {
+	ncU, _, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         server.TestServerOptions2.NatsServer,
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	v := client.Variable{ID: "varBudget", Parent: rootD.ID, Description: "before"}
+	err = client.SendNodeType(ncD, v, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 10*time.Second, "variable not synced", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncU, "all", "varBudget")
+		return err == nil && len(nodes) > 0
+	})
+
+	// the first sync has already used more than this
+	budget := data.NewPointFloat(data.PointTypeSyncDailyBudget, "", 1)
+	budget.Origin = "test"
+	err = client.SendNodePoint(ncD, "sync-id", budget, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// a reading the device makes itself carries no origin
+	err = client.SendNodePoint(ncD, "varBudget",
+		data.NewPointFloat(data.PointTypeValue, "0", 42), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edit := data.NewPointString(data.PointTypeDescription, "", "after")
+	edit.Origin = "test"
+	err = client.SendNodePoint(ncD, "varBudget", edit, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 10*time.Second, "configuration held by the budget", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncU, "all", "varBudget")
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "after"
+	})
+
+	nodes, err := client.GetNodesType[client.Variable](ncU, "all", "varBudget")
+	if err != nil || len(nodes) == 0 {
+		t.Fatal("error getting variable upstream: ", err)
+	}
+	if nodes[0].Value["0"] == 42 {
+		t.Fatal("telemetry sent past the daily budget")
+	}
+
+	waitFor(t, 15*time.Second, "sync status not reported", func() bool {
+		nodes, err := client.GetNodes(ncD, "all", "sync-id", "", false)
+		if err != nil || len(nodes) == 0 {
+			return false
+		}
+		for _, p := range nodes[0].Points {
+			if p.Type == data.PointTypeSyncBytesToday && p.Val() > 1 {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TestSyncFilterLocal verifies that a subtree a sync node excludes stays
+// local, while the rest of the tree and the filter itself reach the upstream.
+func TestSyncFilterLocal(t *testing.T) {
+	ncU, _, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:           "sync-id",
+		Parent:       rootD.ID,
+		Description:  "sync to up",
+		URI:          server.TestServerOptions2.NatsServer,
+		ExcludeNodes: []string{"varLocal"},
+	}
+
+	local := client.Variable{ID: "varLocal", Parent: rootD.ID, Description: "diagnostics"}
+	err = client.SendNodeType(ncD, local, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	shared := client.Variable{ID: "varShared", Parent: rootD.ID, Description: "shared"}
+	err = client.SendNodeType(ncD, shared, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 10*time.Second, "shared variable not synced", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncU, "all", "varShared")
+		return err == nil && len(nodes) > 0
+	})
+
+	syncs, err := client.GetNodesType[client.Sync](ncU, "all", "sync-id")
+	if err != nil || len(syncs) == 0 {
+		t.Fatal("sync node not visible upstream: ", err)
+	}
+	if len(syncs[0].ExcludeNodes) != 1 || syncs[0].ExcludeNodes[0] != "varLocal" {
+		t.Fatal("filter not visible upstream: ", syncs[0].ExcludeNodes)
+	}
+
+	nodes, err := client.GetNodes(ncU, "all", "varLocal", "", true)
+	if err == nil && len(nodes) > 0 {
+		t.Fatal("excluded node reached the upstream")
+	}
+}
+
+// TestSyncHealth verifies the health points on the sync node: connected and
+// caught up while the link is up, and a backlog that grows while it is down.
+func TestSyncHealth(t *testing.T) {
+	ncU, _, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         server.TestServerOptions2.NatsServer,
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	point := func(typ, key string) (data.Point, bool) {
+		nodes, err := client.GetNodes(ncD, "all", "sync-id", "", false)
+		if err != nil || len(nodes) == 0 {
+			return data.Point{}, false
+		}
+		return nodes[0].Points.Find(typ, key)
+	}
+
+	waitFor(t, 25*time.Second, "sync not reported connected and caught up", func() bool {
+		c, okC := point(data.PointTypeSyncConnected, "")
+		l, okL := point(data.PointTypeSyncLastSync, "")
+		return okC && c.Val() == 1 && okL && l.Val() > 0
+	})
+
+	fmt.Println("**** disable sync (go offline)")
+	disable := data.NewPointFloat(data.PointTypeDisabled, "", 1)
+	disable.Origin = "test"
+	err = client.SendNodePoint(ncD, "sync-id", disable, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := client.Variable{ID: "varOffline", Parent: rootD.ID, Description: "made offline"}
+	err = client.SendNodeType(ncD, v, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := fmt.Sprintf("inst_%v_%v", rootD.ID, rootD.ID)
+
+	waitFor(t, 25*time.Second, "backlog not reported while offline", func() bool {
+		c, okC := point(data.PointTypeSyncConnected, "")
+		b, okB := point(data.PointTypeSyncBacklog, "")
+		p, okP := point(data.PointTypeSyncPending, stream)
+		return okC && c.Val() == 0 && okB && b.Val() > 0 && okP && p.Val() > 0
+	})
+
+	// the upstream sees the health of the device as well
+	waitFor(t, 5*time.Second, "health not visible upstream", func() bool {
+		nodes, err := client.GetNodes(ncU, "all", "sync-id", "", false)
+		if err != nil || len(nodes) == 0 {
+			return false
+		}
+		_, ok := nodes[0].Points.Find(data.PointTypeSyncLastSync, "")
+		return ok
+	})
+}
+
+// TestSyncBundle carries a device's data to its upstream on a bundle and the
+// upstream's changes back the same way, with no link between them.
+func TestSyncBundle(t *testing.T) {
+	ncU, rootU, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{ID: "sync-id", Parent: rootD.ID, Description: "sneakernet"}
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	varD := client.Variable{ID: "varDown", Parent: rootD.ID, Description: "varDown"}
+	err = client.SendNodeType(ncD, varD, "test")
+	if err != nil {
+		t.Fatal("Error sending varD: ", err)
+	}
+
+	fmt.Println("**** bundle up")
+	bundle, sum, err := client.ExportBundle(ncD, "", "")
+	if err != nil {
+		t.Fatal("Error exporting bundle: ", err)
+	}
+	if !sum.Up || len(sum.Streams) != 1 || sum.Streams[0].Count == 0 {
+		t.Fatal("unexpected bundle: ", sum)
+	}
+
+	tampered := []byte(string(bundle))
+	tampered[len(tampered)/2] ^= 1
+	_, err = client.ImportBundle(ncU, "", tampered)
+	if err == nil {
+		t.Fatal("tampered bundle was taken in")
+	}
+
+	sum, err = client.ImportBundle(ncU, "", bundle)
+	if err != nil {
+		t.Fatal("Error importing bundle: ", err)
+	}
+	if sum.Streams[0].Count == 0 {
+		t.Fatal("nothing taken in: ", sum)
+	}
+
+	waitFor(t, 10*time.Second, "varDown not carried upstream", func() bool {
+		nodes, err := client.GetNodesType[client.Variable](ncU, rootD.ID, "varDown")
+		return err == nil && len(nodes) > 0
+	})
+
+	access, err := client.GetDeviceAccess(ncU, rootD.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.PubKey == "" {
+		t.Fatal("bundle key not registered as the device credential")
+	}
+
+	sum, err = client.ImportBundle(ncU, "", bundle)
+	if err != nil {
+		t.Fatal("Error importing bundle again: ", err)
+	}
+	if sum.Streams[0].Count != 0 {
+		t.Fatal("bundle applied twice: ", sum)
+	}
+
+	fmt.Println("**** bundle down")
+	err = client.SendNodePoint(ncU, rootD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "set up"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	bundle, sum, err = client.ExportBundle(ncU, "", rootD.ID)
+	if err != nil {
+		t.Fatal("Error exporting bundle: ", err)
+	}
+	if sum.Up || len(sum.Streams) != 1 {
+		t.Fatal("unexpected bundle: ", sum)
+	}
+
+	_, err = client.ImportBundle(ncD, "", bundle)
+	if err != nil {
+		t.Fatal("Error importing bundle: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "description not carried downstream", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncD, "all", rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set up"
+	})
+
+	syncs, err := client.GetNodesType[client.Sync](ncD, rootD.ID, "sync-id")
+	if err != nil || len(syncs) == 0 {
+		t.Fatal("sync node missing: ", err)
+	}
+	if syncs[0].UpstreamID != rootU.ID || syncs[0].UpstreamPubKey == "" {
+		t.Fatal("upstream not recorded on the sync node: ", syncs[0])
+	}
+
+	sum, err = client.ImportBundle(ncD, "", bundle)
+	if err != nil {
+		t.Fatal("Error importing bundle again: ", err)
+	}
+	if sum.Streams[0].Count != 0 {
+		t.Fatal("bundle applied twice: ", sum)
+	}
+
+	fmt.Println("**** bundle up resumes")
+	// the resume point the upstream recorded came down with the last
+	// bundle, so the next one up carries only what is new
+	waitFor(t, 10*time.Second, "resume point not carried downstream", func() bool {
+		b, sum, err := client.ExportBundle(ncD, "", "")
+		if err != nil || len(sum.Streams) == 0 {
+			return false
+		}
+		bundle = b
+		return sum.Streams[0].First > 1
+	})
+
+	sum, err = client.ImportBundle(ncU, "", bundle)
+	if err != nil {
+		t.Fatal("Error importing bundle: ", err)
+	}
+}
+
+// TestSyncLeafnode replicates over a leafnode connection, where the hub
+// sources the device's stream and the device the hub's, rather than through
+// pumps.
+func TestSyncLeafnode(t *testing.T) {
+	ncU, rootU, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         server.TestServerOptions2.NatsServer,
+		LeafURI:     fmt.Sprintf("nats-leaf://localhost:%v", server.TestServerOptions2.NatsLeafPort),
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	fmt.Println("**** update description down")
+	err = client.SendNodePoint(ncD, rootD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "set down"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	waitFor(t, 60*time.Second, "description not sourced upstream", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncU, "all", rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set down"
+	})
+
+	jsU, err := jetstream.New(ncU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := jsU.Stream(context.Background(), fmt.Sprintf("inst_%v_%v", rootD.ID, rootD.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.CachedInfo().Config.Sources) != 1 {
+		t.Fatal("replica upstream is not sourced from the device")
+	}
+
+	fmt.Println("**** update description up")
+	err = client.SendNodePoint(ncU, rootD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "set up"), true)
+	if err != nil {
+		t.Fatal("error sending node point: ", err)
+	}
+
+	waitFor(t, 60*time.Second, "description not sourced down", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncD, "all", rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "set up"
+	})
+
+	jsD, err := jetstream.New(ncD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = jsD.Stream(context.Background(), fmt.Sprintf("inst_%v_%v", rootD.ID, rootU.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.CachedInfo().Config.Sources) != 1 {
+		t.Fatal("replica on the device is not sourced from the hub")
+	}
+}
+
+// TestSyncAdoptionApproval holds a new device for approval on a hub that asks
+// for it, and turns a rejected one away.
+func TestSyncAdoptionApproval(t *testing.T) {
+	opts := server.TestServerOptions2
+	opts.AdoptionApproval = true
+	opts.AuthToken = "fleet-token"
+	ncU, rootU, stopU, err := server.TestServerOpts(opts)
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	group := client.Group{ID: "group-id", Parent: rootU.ID, Description: "site"}
+	err = client.SendNodeType(ncU, group, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         opts.NatsServer,
+		AuthToken:   opts.AuthToken,
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	// the device waits with the credential it enrolls once approved
+	pubKey := func() string {
+		pts, err := client.GetLocalPoints(ncD, sync.ID)
+		if err != nil {
+			return ""
+		}
+		seed, _ := pts.Text(data.PointTypeNkeySeed, "")
+		kp, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return ""
+		}
+		pub, _ := kp.PublicKey()
+		return pub
+	}
+
+	waitFor(t, 10*time.Second, "device not waiting for approval", func() bool {
+		devices, err := client.GetAdoptions(ncU)
+		pub := pubKey()
+		return err == nil && len(devices) == 1 && devices[0].DeviceID == rootD.ID &&
+			devices[0].State == data.AdoptionPending && pub != "" &&
+			devices[0].PubKey == pub &&
+			devices[0].Fingerprint == data.AdoptionFingerprint(pub)
+	})
+
+	// the device is not in the tree and cannot put itself there
+	nodes, err := client.GetNodes(ncU, "all", rootD.ID, "", true)
+	if err != nil && !errors.Is(err, data.ErrDocumentNotFound) {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Fatal("waiting device is in the tree")
+	}
+	err = client.SendEdgePoints(ncU, rootD.ID, rootU.ID, data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", 0),
+		data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
+	}, true)
+	if err == nil {
+		t.Fatal("edge of a waiting device was accepted")
+	}
+
+	fmt.Println("**** approve into group")
+	err = client.ApproveAdoption(ncU, rootD.ID, group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.SendNodePoint(ncD, rootD.ID,
+		data.NewPointString(data.PointTypeDescription, "", "approved"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 20*time.Second, "approved device not synced into the group", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncU, group.ID, rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "approved"
+	})
+
+	devices, err := client.GetAdoptions(ncU)
+	if err != nil || len(devices) != 0 {
+		t.Fatalf("approved device still listed: %v, %v", devices, err)
+	}
+
+	fmt.Println("**** reject another device")
+	keys := make([]string, 2)
+	for i := range keys {
+		kp, err := nkeys.CreateUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i], err = kp.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := client.RequestAdoption(ncU, "other-dev", data.Points{
+		data.NewPointString(data.PointTypeVersionHW, "", "board v2"),
+		data.NewPointString(data.PointTypePubKey, "", keys[0]),
+	})
+	if err != nil || state != data.AdoptionPending {
+		t.Fatalf("expected pending, got %v, %v", state, err)
+	}
+
+	// another device that claims its ID is turned away
+	_, err = client.RequestAdoption(ncU, "other-dev", data.Points{
+		data.NewPointString(data.PointTypePubKey, "", keys[1]),
+	})
+	if err == nil {
+		t.Fatal("request with another credential accepted")
+	}
+
+	err = client.RejectAdoption(ncU, "other-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = client.RequestAdoption(ncU, "other-dev", data.Points{
+		data.NewPointString(data.PointTypePubKey, "", keys[0]),
+	})
+	if err != nil || state != data.AdoptionRejected {
+		t.Fatalf("expected rejected, got %v, %v", state, err)
+	}
+
+	// a replica stream the rejected device creates is removed
+	jsU, err := jetstream.New(ncU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jsU.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:     "inst_other-dev_other-dev",
+		Subjects: []string{"inst.other-dev.other-dev.>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 10*time.Second, "replica of rejected device not removed", func() bool {
+		_, err := jsU.Stream(context.Background(), "inst_other-dev_other-dev")
+		return errors.Is(err, jetstream.ErrStreamNotFound)
+	})
+}
+
+// TestSyncConflict changes a device's description on both sides while sync
+// is off, and checks that the upstream records the conflict when the device
+// catches up, and that restoring the dropped value makes it win everywhere.
+func TestSyncConflict(t *testing.T) {
+	ncU, rootU, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         server.TestServerOptions2.NatsServer,
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "device node not synced", func() bool {
+		nodes, err := client.GetNodes(ncU, "all", rootD.ID, "", false)
+		return err == nil && len(nodes) > 0
+	})
+
+	desc := func(v, origin string, at time.Time) data.Point {
+		p := data.NewPointString(data.PointTypeDescription, "", v)
+		p.Origin = origin
+		p.Time = at
+		return p
+	}
+
+	err = client.SendNodePoint(ncU, rootD.ID, desc("before", "user-up", time.Now()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "description not synced downstream", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncD, "all", rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "before"
+	})
+
+	fmt.Println("**** disable sync and edit on both sides")
+	disable := data.NewPointFloat(data.PointTypeDisabled, "", 1)
+	disable.Origin = "test"
+	err = client.SendNodePoint(ncD, "sync-id", disable, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	now := time.Now()
+	err = client.SendNodePoint(ncD, rootD.ID, desc("down", "user-down", now), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SendNodePoint(ncU, rootD.ID, desc("up", "user-up", now.Add(time.Second)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enable := data.NewPointFloat(data.PointTypeDisabled, "", 0)
+	enable.Origin = "test"
+	err = client.SendNodePoint(ncD, "sync-id", enable, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conflicts []data.SyncConflict
+	waitFor(t, 20*time.Second, "conflict not recorded upstream", func() bool {
+		conflicts, err = client.GetSyncConflicts(ncU)
+		return err == nil && len(conflicts) == 1
+	})
+
+	c := conflicts[0]
+	if c.NodeID != rootD.ID || c.Kept.Txt() != "up" || c.KeptBy != rootU.ID ||
+		c.Dropped.Txt() != "down" || c.DroppedBy != rootD.ID {
+		t.Fatal("unexpected conflict:", c)
+	}
+
+	waitFor(t, 10*time.Second, "conflict count not reported", func() bool {
+		nodes, err := client.GetNodes(ncU, "root", rootU.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			return false
+		}
+		p, ok := nodes[0].Points.Find(data.PointTypeSyncConflicts, "")
+		return ok && p.Val() == 1
+	})
+
+	waitFor(t, 20*time.Second, "conflict not recorded downstream", func() bool {
+		conflicts, err := client.GetSyncConflicts(ncD)
+		return err == nil && len(conflicts) == 1 && conflicts[0].Dropped.Txt() == "down"
+	})
+
+	fmt.Println("**** restore the dropped value")
+	err = client.RestoreSyncConflict(ncU, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts, err = client.GetSyncConflicts(ncU)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("restored conflict still listed: %v, %v", conflicts, err)
+	}
+
+	waitFor(t, 20*time.Second, "restored value not synced downstream", func() bool {
+		nodes, err := client.GetNodesType[client.Device](ncD, "all", rootD.ID)
+		return err == nil && len(nodes) > 0 && nodes[0].Description == "down"
+	})
+
+	err = client.ResolveSyncConflict(ncU, c.ID)
+	if err == nil {
+		t.Fatal("resolving a resolved conflict succeeded")
+	}
+}
+
+// TestSyncDataUsage checks that a device totals what its sync connection moves
+// on its root node, and that the upstream sees the totals and how much of the
+// data plan set there is used.
+func TestSyncDataUsage(t *testing.T) {
+	ncU, _, stopU, err := server.TestServer("2")
+	if err != nil {
+		t.Fatal("Error starting upstream test server: ", err)
+	}
+	defer stopU()
+
+	ncD, rootD, stopD, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting downstream test server: ", err)
+	}
+	defer stopD()
+
+	sync := client.Sync{
+		ID:          "sync-id",
+		Parent:      rootD.ID,
+		Description: "sync to up",
+		URI:         server.TestServerOptions2.NatsServer,
+	}
+
+	err = client.SendNodeType(ncD, sync, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "device node not synced", func() bool {
+		nodes, err := client.GetNodes(ncU, "all", rootD.ID, "", false)
+		return err == nil && len(nodes) > 0
+	})
+
+	// a 1 kB plan, which the sync has used most of by the time it is
+	// caught up
+	err = client.SendNodePoints(ncU, rootD.ID, data.Points{
+		data.NewPointFloat(data.PointTypeDataPlan, "", 1000),
+		data.NewPointFloat(data.PointTypeDataPlanThreshold, "", 80),
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 40*time.Second, "data usage not seen upstream", func() bool {
+		nodes, err := client.GetNodes(ncU, "all", rootD.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			return false
+		}
+		pts := nodes[0].Points
+		day, _ := pts.Find(data.PointTypeDataUsageDay, data.PointKeyTotal)
+		month, _ := pts.Find(data.PointTypeDataUsageMonth, data.PointKeyTotal)
+		sent, _ := pts.Find(data.PointTypeDataUsageMonth, data.PointKeySent)
+		received, _ := pts.Find(data.PointTypeDataUsageMonth, data.PointKeyReceived)
+		used, _ := pts.Find(data.PointTypeDataPlanUsed, "")
+		over, _ := pts.Find(data.PointTypeDataPlanOver, "")
+		return day.Val() > 1000 && month.Val() == day.Val() &&
+			sent.Val() > 0 && received.Val() > 0 &&
+			sent.Val()+received.Val() == month.Val() &&
+			math.Abs(used.Val()-month.Val()/10) < 1e-6 && over.Val() == 1
+	})
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// DefaultTrashGrace is how long a deleted node is kept before a purge removes
+// it, when the purge does not say otherwise.
+const DefaultTrashGrace = 30 * 24 * time.Hour
+
+// GetTrash returns the nodes deleted from a node or from anything below it,
+// newest first.
+func GetTrash(nc *nats.Conn, id string) ([]data.TrashNode, error) {
+	return trashRequest(nc, fmt.Sprintf("trash.%v", id), nil)
+}
+
+// PurgeTrash permanently removes the nodes deleted from a node or below it
+// more than grace ago, and returns the nodes removed. A purged node can no
+// longer be restored. origin is the user or API key purging, who must be an
+// admin over the node, or "" for the instance itself.
+func PurgeTrash(nc *nats.Conn, id string, grace time.Duration, origin string) ([]data.TrashNode, error) {
+	p := data.NewPointFloat(data.PointTypePeriod, "", grace.Seconds())
+	p.Origin = origin
+	pts := data.Points{p}
+	return trashRequest(nc, fmt.Sprintf("trash.%v.purge", id), pts.Encode())
+}
+
+func trashRequest(nc *nats.Conn, subject string, payload []byte) ([]data.TrashNode, error) {
+	// purging a device deletes its streams, which takes a while
+	msg, err := nc.Request(subject, payload, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp data.TrashResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return resp.Nodes, errors.New(resp.Error)
+	}
+
+	return resp.Nodes, nil
+}
+
+// RestoreNode undeletes a node that was deleted from parent, attaching it to
+// the parent again along with everything that was below it.
+func RestoreNode(nc *nats.Conn, id, parent string, origin string) error {
+	nodes, err := GetNodes(nc, parent, id, "", true)
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) < 1 {
+		return fmt.Errorf("node %v is not in the trash of %v", id, parent)
+	}
+
+	if tombstone, _ := nodes[0].IsTombstone(); !tombstone {
+		return fmt.Errorf("node %v is not deleted from %v", id, parent)
+	}
+
+	return SendEdgePoint(nc, id, parent, func() data.Point {
+		p := data.NewPointFloat(data.PointTypeTombstone, "", 0)
+		p.Origin = origin
+		return p
+	}(), true)
+}
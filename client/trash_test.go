@@ -0,0 +1,93 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+func TestTrashRestore(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server:", err)
+	}
+	defer stop()
+
+	v := testX{ID: "ID-testX", Parent: root.ID, Description: "test X node"}
+	err = client.SendNodeType(nc, v, "test")
+	if err != nil {
+		t.Fatal("Error sending node:", err)
+	}
+
+	err = client.DeleteNode(nc, v.ID, root.ID, "test")
+	if err != nil {
+		t.Fatal("Error deleting node:", err)
+	}
+
+	trash, err := client.GetTrash(nc, root.ID)
+	if err != nil {
+		t.Fatal("Error getting trash:", err)
+	}
+	if len(trash) != 1 || trash[0].ID != v.ID || trash[0].DeletedBy != "test" {
+		t.Fatal("deleted node not in trash:", trash)
+	}
+
+	err = client.RestoreNode(nc, v.ID, root.ID, "test")
+	if err != nil {
+		t.Fatal("Error restoring node:", err)
+	}
+
+	nodes, err := client.GetNodes(nc, root.ID, v.ID, "", false)
+	if err != nil || len(nodes) != 1 {
+		t.Fatal("node not restored:", nodes, err)
+	}
+
+	trash, err = client.GetTrash(nc, root.ID)
+	if err != nil || len(trash) != 0 {
+		t.Fatal("restored node still in trash:", trash, err)
+	}
+
+	if client.RestoreNode(nc, v.ID, root.ID, "test") == nil {
+		t.Fatal("restoring a node that is not deleted should fail")
+	}
+
+	// a fresh delete is kept by the default grace period
+	err = client.DeleteNode(nc, v.ID, root.ID, "test")
+	if err != nil {
+		t.Fatal("Error deleting node:", err)
+	}
+
+	purged, err := client.PurgeTrash(nc, root.ID, client.DefaultTrashGrace, "")
+	if err != nil || len(purged) != 0 {
+		t.Fatal("purge removed a fresh delete:", purged, err)
+	}
+
+	// only an admin over the node may purge its trash
+	viewer := client.User{ID: "viewer", Parent: root.ID, Email: "viewer"}
+	err = client.SendNodeType(nc, viewer, "test")
+	if err != nil {
+		t.Fatal("Error sending user:", err)
+	}
+	err = client.SendEdgePoint(nc, viewer.ID, root.ID,
+		data.NewPointString(data.PointTypeRole, "", data.PointValueRoleViewer), true)
+	if err != nil {
+		t.Fatal("Error setting role:", err)
+	}
+
+	purged, err = client.PurgeTrash(nc, root.ID, 0, viewer.ID)
+	if err == nil || len(purged) != 0 {
+		t.Fatal("a viewer purged the trash:", purged, err)
+	}
+
+	purged, err = client.PurgeTrash(nc, root.ID, 0, "")
+	if err != nil || len(purged) != 1 {
+		t.Fatal("purge failed:", purged, err)
+	}
+
+	nodes, err = client.GetNodes(nc, root.ID, v.ID, "", true)
+	if err != nil || len(nodes) != 0 {
+		t.Fatal("purged node still there:", nodes, err)
+	}
+}
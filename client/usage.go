@@ -0,0 +1,20 @@
+package client
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// SubjectDataUsage is where the bytes a connection upstream moved are
+// reported, to be added to the data usage of this instance.
+const SubjectDataUsage = "usage.add"
+
+// SendDataUsage adds bytes a connection upstream sent and received to this
+// instance's data usage, which the server totals on the root node.
+func SendDataUsage(nc *nats.Conn, sent, received int64) error {
+	pts := data.Points{
+		data.NewPointFloat(data.PointTypeValue, data.PointKeySent, float64(sent)),
+		data.NewPointFloat(data.PointTypeValue, data.PointKeyReceived, float64(received)),
+	}
+	return nc.Publish(SubjectDataUsage, pts.Encode())
+}
@@ -18,6 +18,9 @@ type User struct {
 	Phone     string `point:"phone"`
 	Email     string `point:"email"`
 	Pass      string `point:"pass"`
+	// APIKeys are the user's API keys, whose points, such as lastUsed,
+	// change while the client runs
+	APIKeys []data.APIKey `child:"apiKey"`
 }
 
 // UserClient watches for notifications raised anywhere in the parent's
@@ -51,6 +51,13 @@ func main() {
 		fmt.Println("  - install (install SIOT and register service)")
 		fmt.Println("  - import (import nodes from YAML file)")
 		fmt.Println("  - export (export nodes to YAML file)")
+		fmt.Println("  - trash (list, restore, or purge deleted nodes)")
+		fmt.Println("  - snapshot (take, diff, or roll back to configuration snapshots)")
+		fmt.Println("  - credential (list, revoke, or restore device sync credentials)")
+		fmt.Println("  - apikey (list, create, or revoke API keys)")
+		fmt.Println("  - adoption (list, approve, or reject devices waiting to join the tree)")
+		fmt.Println("  - conflict (list or resolve sync conflicts)")
+		fmt.Println("  - sync (export or import offline sync bundles)")
 		fmt.Println("  - dump (describe a running instance for troubleshooting)")
 		fmt.Println("  - provision (check provisioning files, or print what they would do)")
 		fmt.Println("  - update (update to the latest release)")
@@ -91,6 +98,20 @@ func main() {
 		runImport(args[1:])
 	case "export":
 		runExport(args[1:])
+	case "trash":
+		runTrash(args[1:])
+	case "credential":
+		runCredential(args[1:])
+	case "apikey":
+		runAPIKey(args[1:])
+	case "adoption":
+		runAdoption(args[1:])
+	case "conflict":
+		runConflict(args[1:])
+	case "sync":
+		runSync(args[1:])
+	case "snapshot":
+		runSnapshot(args[1:])
 	case "dump":
 		runDump(args[1:])
 	case "provision":
@@ -251,19 +272,48 @@ func runStore(args []string) {
 
 	switch {
 	case *flagCheck:
-		err := client.AdminStoreVerify(nc)
+		issues, err := client.AdminStoreVerify(nc)
 		if err != nil {
 			log.Println("DB verify failed:", err)
-		} else {
+			break
+		}
+
+		if len(issues) == 0 {
 			log.Println("DB verified :-)")
+			break
+		}
+
+		log.Printf("DB verify found %v problems:\n", len(issues))
+		for _, i := range issues {
+			fmt.Println(" ", i)
 		}
+		fmt.Println("Run with -fix to repair them.")
 
 	case *flagFix:
-		err := client.AdminStoreMaint(nc)
+		found, err := client.AdminStoreVerify(nc)
+		if err != nil {
+			log.Println("DB verify failed:", err)
+			break
+		}
+
+		for _, i := range found {
+			fmt.Println("found:", i)
+		}
+
+		remain, err := client.AdminStoreMaint(nc)
 		if err != nil {
 			log.Println("DB maint failed:", err)
-		} else {
+			break
+		}
+
+		if len(remain) == 0 {
 			log.Println("DB maint success :-)")
+			break
+		}
+
+		log.Printf("DB maint could not repair %v problems:\n", len(remain))
+		for _, i := range remain {
+			fmt.Println(" ", i)
 		}
 
 	default:
@@ -498,6 +548,9 @@ func runExport(args []string) {
 	flags := flag.NewFlagSet("import", flag.ExitOnError)
 
 	flagNodeID := flags.String("nodeID", "", "node ID to export. Default is root device")
+	flagAt := flags.String("at", "",
+		"export the tree as it stood at this time: RFC3339, a local date and time "+
+			"(2006-01-02 15:04), a local date, or a duration ago (72h)")
 	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
 	flagAuthToken := flags.String("token", "", "Auth token")
 
@@ -505,6 +558,16 @@ func runExport(args []string) {
 		log.Fatal("error: ", err)
 	}
 
+	var at time.Time
+	if *flagAt != "" {
+		var err error
+		at, err = parseAt(*flagAt, time.Now())
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+		log.Println("Exporting the tree as of", at.Format(time.RFC3339))
+	}
+
 	// only consider env if command line option is something different
 	// that default
 	natsServer := *flagNatsServer
@@ -546,7 +609,7 @@ func runExport(args []string) {
 		log.Fatal("Error connecting to NATS server: ", err)
 	}
 
-	yaml, err := client.ExportNodes(nc, *flagNodeID)
+	yaml, err := client.ExportNodesAt(nc, *flagNodeID, at)
 	if err != nil {
 		log.Fatal("Error export nodes: ", err)
 	}
@@ -559,6 +622,771 @@ func runExport(args []string) {
 
 }
 
+// parseAt reads the time given to export -at. A time written without a zone
+// is local time, since that is how someone remembers when a problem started,
+// and a bare duration is that long before now.
+func parseAt(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			d = -d
+		}
+		return now.Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04",
+		"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("can't read %q as a time; use RFC3339 "+
+		"(2006-01-02T15:04:05Z), 2006-01-02 15:04, 2006-01-02, or a duration like 72h", s)
+}
+
+func runTrash(args []string) {
+	flags := flag.NewFlagSet("trash", flag.ExitOnError)
+
+	flagNodeID := flags.String("nodeID", "", "list nodes deleted under this node. Default is root device")
+	flagRestore := flags.String("restore", "", "ID of a deleted node to restore")
+	flagParent := flags.String("parent", "", "parent to restore the node to, if it was deleted from more than one")
+	flagPurge := flags.Bool("purge", false, "permanently remove nodes deleted more than -grace ago")
+	flagGrace := flags.Duration("grace", client.DefaultTrashGrace,
+		"how long deleted nodes are kept by -purge (env SIOT_TRASH_GRACE)")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	grace := *flagGrace
+	if grace == client.DefaultTrashGrace {
+		if graceE := os.Getenv("SIOT_TRASH_GRACE"); graceE != "" {
+			var err error
+			grace, err = time.ParseDuration(graceE)
+			if err != nil {
+				log.Fatal("error: SIOT_TRASH_GRACE: ", err)
+			}
+		}
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	nodeID := *flagNodeID
+	if nodeID == "" || nodeID == "root" {
+		root, err := client.GetRootNode(nc)
+		if err != nil {
+			log.Fatal("Error getting root node: ", err)
+		}
+		nodeID = root.ID
+	}
+
+	switch {
+	case *flagRestore != "":
+		parent := *flagParent
+		if parent == "" {
+			// find the parent the node was deleted from
+			trash, err := client.GetTrash(nc, nodeID)
+			if err != nil {
+				log.Fatal("Error getting trash: ", err)
+			}
+			for _, tn := range trash {
+				if tn.ID != *flagRestore {
+					continue
+				}
+				if parent != "" && parent != tn.Parent {
+					log.Fatal("Node was deleted from more than one parent, use -parent")
+				}
+				parent = tn.Parent
+			}
+			if parent == "" {
+				log.Fatal("Node is not in the trash: ", *flagRestore)
+			}
+		}
+
+		err := client.RestoreNode(nc, *flagRestore, parent, "")
+		if err != nil {
+			log.Fatal("Error restoring node: ", err)
+		}
+		log.Println("Restored node", *flagRestore, "to", parent)
+
+	case *flagPurge:
+		purged, err := client.PurgeTrash(nc, nodeID, grace, "")
+		for _, tn := range purged {
+			fmt.Println("purged:", tn)
+		}
+		if err != nil {
+			log.Fatal("Error purging trash: ", err)
+		}
+		log.Printf("Purged %v nodes deleted more than %v ago\n", len(purged), grace)
+
+	default:
+		trash, err := client.GetTrash(nc, nodeID)
+		if err != nil {
+			log.Fatal("Error getting trash: ", err)
+		}
+		for _, tn := range trash {
+			fmt.Println(tn)
+		}
+	}
+}
+
+func runCredential(args []string) {
+	flags := flag.NewFlagSet("credential", flag.ExitOnError)
+
+	flagNodeID := flags.String("nodeID", "", "list devices under this node. Default is root device")
+	flagRevoke := flags.String("revoke", "", "ID of a device whose credential to revoke")
+	flagRestore := flags.String("restore", "", "ID of a device whose revoked credential to restore")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	nodeID := *flagNodeID
+	if nodeID == "" || nodeID == "root" {
+		root, err := client.GetRootNode(nc)
+		if err != nil {
+			log.Fatal("Error getting root node: ", err)
+		}
+		nodeID = root.ID
+	}
+
+	// the revoked point is written by this instance, which is the only
+	// writer the authorizer listens to
+	setRevoked := func(id string, revoked bool) {
+		err := client.SendNodePoint(nc, id, data.NewPointFloat(data.PointTypeRevoked, "",
+			data.BoolToFloat(revoked)), true)
+		if err != nil {
+			log.Fatal("Error sending revoked point: ", err)
+		}
+	}
+
+	switch {
+	case *flagRevoke != "":
+		setRevoked(*flagRevoke, true)
+		log.Println("Revoked the credential of device", *flagRevoke)
+
+	case *flagRestore != "":
+		setRevoked(*flagRestore, false)
+		log.Println("Restored the credential of device", *flagRestore)
+
+	default:
+		devices, err := client.GetNodes(nc, nodeID, "all", data.NodeTypeDevice, false)
+		if err != nil {
+			log.Fatal("Error getting devices: ", err)
+		}
+		for _, d := range devices {
+			pubKey, revoked := "none", ""
+			for _, p := range d.Points {
+				switch {
+				case p.Type == data.PointTypePubKey && p.Txt() != "":
+					pubKey = p.Txt()
+				case p.Type == data.PointTypeRevoked && p.Val() != 0:
+					revoked = " (revoked)"
+				}
+			}
+			fmt.Printf("%v %q: %v%v\n", d.ID, d.Points.Desc(), pubKey, revoked)
+		}
+	}
+}
+
+func runAPIKey(args []string) {
+	flags := flag.NewFlagSet("apikey", flag.ExitOnError)
+
+	flagNodeID := flags.String("nodeID", "", "list keys under this node. Default is root device")
+	flagCreate := flags.String("create", "", "ID of a user or group to create a key under")
+	flagDesc := flags.String("desc", "", "description of the key to create")
+	flagScope := flags.String("scope", "", "ID of a node to limit the key to, with the nodes below it")
+	flagWrite := flags.Bool("write", false, "let the key change nodes, rather than only read them")
+	flagExpires := flags.Duration("expires", 0, "how long until the key expires. Default is never")
+	flagRevoke := flags.String("revoke", "", "ID of a key to revoke")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	switch {
+	case *flagCreate != "":
+		o := client.APIKeyOptions{
+			Description: *flagDesc,
+			Scope:       *flagScope,
+			Write:       *flagWrite,
+		}
+		if *flagExpires > 0 {
+			o.Expires = time.Now().Add(*flagExpires)
+		}
+		k, key, err := client.NewAPIKey(nc, *flagCreate, o, "")
+		if err != nil {
+			log.Fatal("Error creating API key: ", err)
+		}
+		log.Println("Created API key", k.ID)
+		// the key is not stored, so this is the only time it is shown
+		fmt.Println(key)
+
+	case *flagRevoke != "":
+		err := client.SendNodePoint(nc, *flagRevoke, data.NewPointFloat(data.PointTypeRevoked, "",
+			1), true)
+		if err != nil {
+			log.Fatal("Error sending revoked point: ", err)
+		}
+		log.Println("Revoked API key", *flagRevoke)
+
+	default:
+		nodeID := *flagNodeID
+		if nodeID == "" || nodeID == "root" {
+			root, err := client.GetRootNode(nc)
+			if err != nil {
+				log.Fatal("Error getting root node: ", err)
+			}
+			nodeID = root.ID
+		}
+
+		var list func(id string)
+		list = func(id string) {
+			children, err := client.GetNodes(nc, id, "all", "", false)
+			if err != nil {
+				log.Fatal("Error getting nodes: ", err)
+			}
+			for _, c := range children {
+				if c.Type != data.NodeTypeAPIKey {
+					list(c.ID)
+					continue
+				}
+				var k data.APIKey
+				err := data.Decode(data.NodeEdgeChildren{NodeEdge: c}, &k)
+				if err != nil {
+					log.Fatal("Error decoding API key: ", err)
+				}
+				fmt.Printf("%v %q under %v: %v\n", k.ID, k.Description, k.Parent, describeAPIKey(k))
+			}
+		}
+		list(nodeID)
+	}
+}
+
+// describeAPIKey sums up an API key's access and use for a listing.
+func describeAPIKey(k data.APIKey) string {
+	ret := k.Access
+	if ret == "" {
+		ret = data.PointValueRead
+	}
+	if k.Scope != "" {
+		ret += ", scope " + k.Scope
+	}
+	if k.Expires > 0 {
+		ret += ", expires " + time.Unix(int64(k.Expires), 0).Format(time.RFC3339)
+	}
+	if k.LastUsed > 0 {
+		ret += ", last used " + time.Unix(int64(k.LastUsed), 0).Format(time.RFC3339)
+	} else {
+		ret += ", never used"
+	}
+	if k.Revoked {
+		ret += " (revoked)"
+	}
+	return ret
+}
+
+func runAdoption(args []string) {
+	flags := flag.NewFlagSet("adoption", flag.ExitOnError)
+
+	flagApprove := flags.String("approve", "", "ID of a device to approve")
+	flagGroup := flags.String("group", "", "ID of the group to approve a device into. Default is root device")
+	flagReject := flags.String("reject", "", "ID of a device to reject")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	switch {
+	case *flagApprove != "":
+		group := *flagGroup
+		if group == "" || group == "root" {
+			root, err := client.GetRootNode(nc)
+			if err != nil {
+				log.Fatal("Error getting root node: ", err)
+			}
+			group = root.ID
+		}
+
+		err := client.ApproveAdoption(nc, *flagApprove, group)
+		if err != nil {
+			log.Fatal("Error approving device: ", err)
+		}
+		log.Printf("Approved device %v into %v\n", *flagApprove, group)
+
+	case *flagReject != "":
+		err := client.RejectAdoption(nc, *flagReject)
+		if err != nil {
+			log.Fatal("Error rejecting device: ", err)
+		}
+		log.Println("Rejected device", *flagReject)
+
+	default:
+		devices, err := client.GetAdoptions(nc)
+		if err != nil {
+			log.Fatal("Error getting devices waiting for adoption: ", err)
+		}
+		for _, d := range devices {
+			fmt.Println(d)
+		}
+	}
+}
+
+func runConflict(args []string) {
+	flags := flag.NewFlagSet("conflict", flag.ExitOnError)
+
+	flagResolve := flags.String("resolve", "", "ID of a conflict to resolve by keeping the value sync kept")
+	flagRestore := flags.String("restore", "", "ID of a conflict to resolve by restoring the value sync dropped")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	switch {
+	case *flagResolve != "":
+		err := client.ResolveSyncConflict(nc, *flagResolve)
+		if err != nil {
+			log.Fatal("Error resolving conflict: ", err)
+		}
+		log.Println("Resolved conflict", *flagResolve)
+
+	case *flagRestore != "":
+		err := client.RestoreSyncConflict(nc, *flagRestore)
+		if err != nil {
+			log.Fatal("Error restoring conflict: ", err)
+		}
+		log.Println("Restored the dropped value of conflict", *flagRestore)
+
+	default:
+		conflicts, err := client.GetSyncConflicts(nc)
+		if err != nil {
+			log.Fatal("Error getting sync conflicts: ", err)
+		}
+		for _, c := range conflicts {
+			fmt.Println(c)
+		}
+	}
+}
+
+// runSync carries sync data on a file for a site without a link: a device
+// exports a bundle of what it would push and the upstream imports it, and the
+// other way round with -device.
+func runSync(args []string) {
+	if len(args) < 1 || (args[0] != "export-bundle" && args[0] != "import-bundle") {
+		log.Fatal("usage: siot sync export-bundle|import-bundle [OPTION]...")
+	}
+	export := args[0] == "export-bundle"
+
+	flags := flag.NewFlagSet("sync "+args[0], flag.ExitOnError)
+
+	flagSyncID := flags.String("sync", "",
+		"sync node to exchange bundles through. Default is the only one on the root device")
+	flagDeviceID := flags.String("device", "",
+		"export what this device would pull from us, rather than what we would push upstream")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	if !export && *flagDeviceID != "" {
+		log.Fatal("error: -device is for export-bundle; an imported bundle names who it is from")
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	if export {
+		bundle, sum, err := client.ExportBundle(nc, *flagSyncID, *flagDeviceID)
+		if err != nil {
+			log.Fatal("Error exporting sync bundle: ", err)
+		}
+
+		_, err = os.Stdout.Write(bundle)
+		if err != nil {
+			log.Fatal("Error writing bundle to STDOUT: ", err)
+		}
+
+		log.Print(sum)
+		return
+	}
+
+	bundle, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Error reading bundle from STDIN: ", err)
+	}
+
+	sum, err := client.ImportBundle(nc, *flagSyncID, bundle)
+	if err != nil {
+		log.Print(sum)
+		log.Fatal("Error importing sync bundle: ", err)
+	}
+
+	log.Print(sum)
+}
+
+func runSnapshot(args []string) {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+
+	flagNodeID := flags.String("nodeID", "", "node to snapshot. Default is root device")
+	flagTake := flags.String("take", "", "save the configuration under this name")
+	flagDiff := flags.String("diff", "", "print what changed since the named snapshot")
+	flagRollback := flags.String("rollback", "", "roll the configuration back to the named snapshot")
+	flagDelete := flags.String("delete", "", "delete the named snapshot")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	natsServer := *flagNatsServer
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	authToken := *flagAuthToken
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Fatal("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	nodeID := *flagNodeID
+	if nodeID == "" || nodeID == "root" {
+		root, err := client.GetRootNode(nc)
+		if err != nil {
+			log.Fatal("Error getting root node: ", err)
+		}
+		nodeID = root.ID
+	}
+
+	switch {
+	case *flagTake != "":
+		snap, err := client.TakeSnapshot(nc, nodeID, *flagTake)
+		if err != nil {
+			log.Fatal("Error taking snapshot: ", err)
+		}
+		log.Println("Took snapshot", snap)
+
+	case *flagDiff != "":
+		plan, err := client.SnapshotDiff(nc, nodeID, *flagDiff)
+		if err != nil {
+			log.Fatal("Error comparing to snapshot: ", err)
+		}
+		fmt.Print(plan.String())
+
+	case *flagRollback != "":
+		plan, err := client.SnapshotRollback(nc, nodeID, *flagRollback)
+		fmt.Print(plan.String())
+		if err != nil {
+			log.Fatal("Error rolling back: ", err)
+		}
+		log.Println("Rolled back to snapshot", *flagRollback)
+
+	case *flagDelete != "":
+		err := client.DeleteSnapshot(nc, nodeID, *flagDelete)
+		if err != nil {
+			log.Fatal("Error deleting snapshot: ", err)
+		}
+		log.Println("Deleted snapshot", *flagDelete)
+
+	default:
+		snaps, err := client.GetSnapshots(nc, nodeID)
+		if err != nil {
+			log.Fatal("Error getting snapshots: ", err)
+		}
+		for _, s := range snaps {
+			fmt.Println(s)
+		}
+	}
+}
+
 func runDump(args []string) {
 	flags := flag.NewFlagSet("dump", flag.ExitOnError)
 
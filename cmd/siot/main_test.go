@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAt(t *testing.T) {
+	loc := time.FixedZone("test", -5*3600)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, loc)
+
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"72h", now.Add(-72 * time.Hour)},
+		{"-30m", now.Add(-30 * time.Minute)},
+		{"2026-10-13T08:30:00Z", time.Date(2026, 10, 13, 8, 30, 0, 0, time.UTC)},
+		{"2026-10-13 08:30", time.Date(2026, 10, 13, 8, 30, 0, 0, loc)},
+		{"2026-10-13", time.Date(2026, 10, 13, 0, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		got, err := parseAt(test.in, now)
+		if err != nil {
+			t.Errorf("%v: %v", test.in, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%v: got %v, want %v", test.in, got, test.want)
+		}
+	}
+
+	if _, err := parseAt("last tuesday", now); err == nil {
+		t.Error("expected an error for an unreadable time")
+	}
+}
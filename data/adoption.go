@@ -0,0 +1,94 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Adoption states of a device that asked to join an instance's tree.
+const (
+	// AdoptionApproved means the device is in the tree and syncs
+	AdoptionApproved = "approved"
+	// AdoptionPending means the device waits for an admin to approve it
+	AdoptionPending = "pending"
+	// AdoptionRejected means an admin turned the device away. It may not
+	// join the tree, and the replica streams it creates are removed.
+	AdoptionRejected = "rejected"
+)
+
+// Adoption is a device that asked to join an instance's tree and is waiting
+// for approval, or was rejected. It carries what the device says about
+// itself, which an admin checks against the device before approving it.
+type Adoption struct {
+	DeviceID    string `json:"deviceId"`
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+	VersionApp  string `json:"versionApp,omitempty"`
+	VersionOS   string `json:"versionOS,omitempty"`
+	VersionHW   string `json:"versionHW,omitempty"`
+	// Org is the organization the device asked to join, which it may
+	// only be approved into
+	Org string `json:"org,omitempty"`
+	// PubKey is the public key of the device credential the device asked
+	// with. Only the device holds its seed, and a later request with
+	// another key is refused.
+	PubKey string `json:"pubKey,omitempty"`
+	// Fingerprint is a short form of PubKey that the device logs while it
+	// waits, for comparing at a glance. It is empty for a device that has
+	// no credential.
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// AdoptionResponse is the response to an adoption request.
+type AdoptionResponse struct {
+	// State is the adoption state of the device a request or decision was
+	// for
+	State string `json:"state,omitempty"`
+	// Devices lists the devices waiting for approval or rejected
+	Devices []Adoption `json:"devices,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// AdoptionFingerprint returns the fingerprint of a device's NKey public key:
+// the start of its SHA-256 hash, in groups of four hex digits.
+func AdoptionFingerprint(pubKey string) string {
+	if pubKey == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(pubKey))
+	h := hex.EncodeToString(sum[:8])
+
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, "-")
+}
+
+func (a Adoption) String() string {
+	hw := []string{}
+	for _, v := range []string{a.VersionHW, a.VersionOS, a.VersionApp} {
+		if v != "" {
+			hw = append(hw, v)
+		}
+	}
+	info := strings.Join(hw, ", ")
+	if info == "" {
+		info = "-"
+	}
+
+	fp := a.Fingerprint
+	if fp == "" {
+		fp = "-"
+	}
+
+	return fmt.Sprintf("%v %v %q %v [%v], first seen %v, last seen %v",
+		a.DeviceID, a.State, a.Description, fp, info,
+		a.FirstSeen.Format(time.RFC3339), a.LastSeen.Format(time.RFC3339))
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, which tells a key apart from a login
+// token or the auth token.
+const APIKeyPrefix = "siot_"
+
+// APIKey is an apiKey node: a long-lived key an integration uses in place of
+// a user's login. The key reaches what its owner, the user or group above
+// it, can reach, limited to the Scope subtree when one is set, and only reads
+// unless Access is write.
+type APIKey struct {
+	ID          string  `node:"id"`
+	Parent      string  `node:"parent"`
+	Description string  `point:"description"`
+	KeyHash     string  `point:"keyHash"`
+	Expires     float64 `point:"expires"`
+	Scope       string  `point:"scope"`
+	Access      string  `point:"access"`
+	LastUsed    float64 `point:"lastUsed"`
+	Revoked     bool    `point:"revoked"`
+}
+
+// NewAPIKeySecret returns a new random key secret.
+func NewAPIKeySecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating key secret: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// FormatAPIKey returns the key an integration presents for the apiKey node
+// id with the given secret.
+func FormatAPIKey(id, secret string) string {
+	return APIKeyPrefix + id + "_" + secret
+}
+
+// ParseAPIKey splits a key into the ID of its apiKey node and its secret.
+func ParseAPIKey(key string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(key, APIKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, "_")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// IsAPIKey reports whether a token is an API key.
+func IsAPIKey(token string) bool {
+	_, _, ok := ParseAPIKey(token)
+	return ok
+}
+
+// APIKeyHash returns the hash of a key secret that the keyHash point holds.
+// The secret is random, so a plain SHA-256 is enough and keeps checking a
+// key cheap on every request.
+func APIKeyHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
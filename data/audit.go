@@ -0,0 +1,70 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditEntry is one change a user made to a node or edge point, rebuilt from
+// the point history in the store.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// UserID is the user node that made the change, and User its email,
+	// when the user node is still known
+	UserID string `json:"userId"`
+	User   string `json:"user,omitempty"`
+	NodeID string `json:"nodeId"`
+	// ParentID is set when the change was to an edge point
+	ParentID string `json:"parentId,omitempty"`
+	// Old is the value before the change. It is nil when the change created
+	// the point, or when the earlier value has aged out of the history.
+	Old *Point `json:"old,omitempty"`
+	New Point  `json:"new"`
+}
+
+// AuditResponse is the response to an audit request.
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// HistoryResponse is the response to a point history request.
+type HistoryResponse struct {
+	Points Points `json:"points"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (ae AuditEntry) String() string {
+	who := ae.User
+	if who == "" {
+		who = ae.UserID
+	}
+
+	what := ae.NodeID
+	if ae.ParentID != "" {
+		what = ae.ParentID + "->" + ae.NodeID
+	}
+
+	typ := ae.New.Type
+	if ae.New.Key != "" && ae.New.Key != "0" {
+		typ += "." + ae.New.Key
+	}
+
+	old := "-"
+	if ae.Old != nil {
+		old = auditValue(*ae.Old)
+	}
+
+	return fmt.Sprintf("%v %v %v %v: %v -> %v", ae.Time.Format(time.RFC3339),
+		who, what, typ, old, auditValue(ae.New))
+}
+
+func auditValue(p Point) string {
+	if p.Tombstone%2 == 1 {
+		return "(deleted)"
+	}
+	if p.DataType == PointDataTypeString || p.DataType == PointDataTypeJSON {
+		return fmt.Sprintf("%q", p.Txt())
+	}
+	return fmt.Sprintf("%v", p.Val())
+}
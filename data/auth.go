@@ -5,3 +5,18 @@ type Auth struct {
 	Token string `json:"token"`
 	Email string `json:"email"`
 }
+
+// OIDCLogin is a login through an OpenID Connect identity provider, which the
+// API sends to the store once it has checked the provider's ID token. The
+// store replies with the user and a login token, as it does for a password.
+type OIDCLogin struct {
+	Email     string `json:"email"`
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	// Groups are the values of the provider's groups claim, which group
+	// nodes map with an oidcGroup point
+	Groups []string `json:"groups,omitempty"`
+	// Parent is where a user with none of the mapped groups is created.
+	// Empty leaves such a user out.
+	Parent string `json:"parent,omitempty"`
+}
@@ -0,0 +1,48 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncConflict is a config point that two instances changed at nearly the
+// same time. The merge keeps the newer of the two everywhere, so the other
+// edit would otherwise be lost without a trace; the conflict keeps both
+// until an admin resolves it, by accepting the value that was kept or by
+// restoring the one that was dropped.
+type SyncConflict struct {
+	ID          string `json:"id"`
+	NodeID      string `json:"nodeId"`
+	Description string `json:"description,omitempty"`
+	// Kept is the point the merge kept, written by the instance KeptBy
+	Kept   Point  `json:"kept"`
+	KeptBy string `json:"keptBy"`
+	// Dropped is the point the merge dropped, written by the instance
+	// DroppedBy
+	Dropped   Point     `json:"dropped"`
+	DroppedBy string    `json:"droppedBy"`
+	Detected  time.Time `json:"detected"`
+}
+
+// SyncConflictResponse is the response to a sync conflict request.
+type SyncConflictResponse struct {
+	Conflicts []SyncConflict `json:"conflicts,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+func (c SyncConflict) String() string {
+	return fmt.Sprintf("%v %v %q %v.%v: kept %v from %v (%v), dropped %v from %v (%v)",
+		c.ID, c.NodeID, c.Description, c.Kept.Type, c.Kept.Key,
+		conflictValue(c.Kept), c.KeptBy, c.Kept.Time.Format(time.RFC3339),
+		conflictValue(c.Dropped), c.DroppedBy, c.Dropped.Time.Format(time.RFC3339))
+}
+
+func conflictValue(p Point) string {
+	if p.Tombstone%2 == 1 {
+		return "(deleted)"
+	}
+	if p.Numeric() {
+		return fmt.Sprintf("%v", p.Val())
+	}
+	return fmt.Sprintf("%q", p.Txt())
+}
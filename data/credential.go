@@ -0,0 +1,18 @@
+package data
+
+// DeviceAccess is the response to a credential request: what a device node's
+// credential is on this instance, and the streams the device replicates. Only
+// what the instance itself wrote counts for the key and the revocation, so a
+// device cannot set or lift either through its own stream.
+type DeviceAccess struct {
+	DeviceID string `json:"deviceId"`
+	// PubKey is the device's NKey public key, empty if it has none yet
+	PubKey  string `json:"pubKey,omitempty"`
+	Revoked bool   `json:"revoked,omitempty"`
+	// Boundaries holds the device's boundary and those of the devices
+	// below it
+	Boundaries []string `json:"boundaries"`
+	// Pull holds the streams in those boundaries the device copies down
+	Pull  []string `json:"pull"`
+	Error string   `json:"error,omitempty"`
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"math"
+	"slices"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
@@ -1021,3 +1022,16 @@ func BoolToFloat(v bool) float64 {
 	}
 	return 1
 }
+
+// SetpointTypes are the point types that set what a device does rather than
+// configure it, which an operator may write.
+var SetpointTypes = []string{
+	PointTypeValueSet,
+	PointTypeSwitchSet,
+	PointTypeLightSet,
+}
+
+// IsSetpoint reports whether a point type is one of the SetpointTypes.
+func IsSetpoint(typ string) bool {
+	return slices.Contains(SetpointTypes, typ)
+}
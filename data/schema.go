@@ -38,6 +38,12 @@ const (
 	PointTypeURI                = "uri"
 	PointTypeDisabled           = "disabled"
 	PointTypeControlled         = "controlled"
+	// PointTypeAsOf in a nodes request asks for the tree as it stood at
+	// the point's time rather than as it is now
+	PointTypeAsOf = "asOf"
+	// PointTypeSubtree in an audit request includes the changes to every
+	// node below the requested one
+	PointTypeSubtree = "subtree"
 
 	PointTypePeriod = "period"
 
@@ -74,9 +80,34 @@ const (
 	PointTypePass      = "pass"
 
 	// user edge points
-	PointTypeRole       = "role"
-	PointValueRoleAdmin = "admin"
-	PointValueRoleUser  = "user"
+	PointTypeRole          = "role"
+	PointValueRoleAdmin    = "admin"
+	PointValueRoleOperator = "operator"
+	PointValueRoleViewer   = "viewer"
+	// PointValueRoleUser is the role from before there were operators, and
+	// is a viewer
+	PointValueRoleUser = "user"
+
+	// apiKey nodes, under a user or a group, let an integration reach the
+	// API and NATS with a long-lived key rather than a login
+	NodeTypeAPIKey = "apiKey"
+	// PointTypeKeyHash holds the SHA-256 hash of the key's secret; the
+	// secret itself is never stored
+	PointTypeKeyHash = "keyHash"
+	// PointTypeExpires holds when the key stops working, in Unix seconds.
+	// A key without one does not expire.
+	PointTypeExpires = "expires"
+	// PointTypeScope holds the ID of the node the key is limited to, along
+	// with the nodes below it
+	PointTypeScope = "scope"
+	// PointTypeAccess is read or write. A read key is a viewer wherever
+	// its owner has a role.
+	PointTypeAccess = "access"
+	PointValueRead  = "read"
+	PointValueWrite = "write"
+	// PointTypeLastUsed holds when the key was last used, in Unix seconds,
+	// to within an hour
+	PointTypeLastUsed = "lastUsed"
 
 	// User Authentication
 	NodeTypeJWT    = "jwt"
@@ -122,6 +153,20 @@ const (
 	// A group node is used to group users and devices
 	// or generally to add structure to the node graph.
 	NodeTypeGroup = "group"
+	// PointTypeOIDCGroup on a group node names a group in the identity
+	// provider's groups claim. Users who sign in through OIDC with that
+	// group are placed in this one, and taken out when they no longer have
+	// it.
+	PointTypeOIDCGroup = "oidcGroup"
+
+	// An organization node holds one customer of an instance shared by
+	// several. Everything below it, its users included, belongs to it
+	// alone, and its users reach nothing outside it.
+	NodeTypeOrganization = "organization"
+	// PointTypeOrgName on an organization node is the name its users log
+	// in with, and its devices ask to be adopted with, as an org point.
+	// No two organizations on an instance have the same name.
+	PointTypeOrgName = "orgName"
 
 	NodeTypeDb = "db"
 
@@ -258,10 +303,124 @@ const (
 	// resolves straight away rather than waiting for a rebirth.
 	PointTypeSparkplugAlias = "sparkplugAlias"
 
+	// Line protocol ingestion. An ingest node accepts InfluxDB line protocol
+	// through the HTTP API's /api/v2/write, with the node's ID as the bucket,
+	// and on the UDP and TCP listeners it is given, and creates nodes for the
+	// points from their tags.
+	NodeTypeIngest = "ingest"
+
+	// NodeTypeIngestDevice is created automatically from a tag schema and
+	// holds the points of the series written to it.
+	NodeTypeIngestDevice = "ingestDevice"
+
+	// PointTypeTagSchema names the tags of a line protocol point whose values
+	// name the nodes it is written to, outermost first, such as "site/host".
+	// _measurement stands for the measurement.
+	PointTypeTagSchema = "tagSchema"
+
+	// PointTypeListenUDP and PointTypeListenTCP are addresses, such as
+	// ":8089", to accept line protocol on.
+	PointTypeListenUDP = "listenUDP"
+	PointTypeListenTCP = "listenTCP"
+
+	// PointTypePrecision is the unit of line protocol timestamps: ns, us, ms
+	// or s.
+	PointTypePrecision = "precision"
+
 	NodeTypeVariable      = "variable"
 	PointTypeVariableType = "variableType"
 
 	NodeTypeSync = "sync"
+	// PointTypeUpstreamID on a sync node records the root node ID of the
+	// upstream instance it connects to, which is the origin of the
+	// streams it pulls
+	PointTypeUpstreamID = "upstreamID"
+	// PointTypeLeafURI on a sync node is the address of the upstream's
+	// leafnode port. When set, the embedded NATS server connects to it and
+	// replicates the streams by sourcing rather than through the client.
+	PointTypeLeafURI = "leafURI"
+	// PointTypeNkeySeed on a sync node holds the seed of this instance's
+	// NKey, the credential it presents to the upstream in place of the
+	// shared auth token. It is generated at adoption and never leaves the
+	// instance: the store keeps it apart from the node's other points, and
+	// it is read with client.GetLocalPoints.
+	PointTypeNkeySeed = "nkeySeed"
+	// PointTypePubKey on a device node holds the public half of the
+	// device's NKey, which the upstream checks the device's connections
+	// against
+	PointTypePubKey = "pubKey"
+	// PointTypeRevoked on a device node refuses the device's credential
+	// and closes the connections made with it
+	PointTypeRevoked = "revoked"
+	// PointTypeUpstreamPubKey on a sync node holds the public key the
+	// upstream signs its sync bundles with, recorded from the first bundle
+	// the device imports
+	PointTypeUpstreamPubKey = "upstreamPubKey"
+	// PointTypeBundleSeed on the root node holds the seed this instance
+	// signs the sync bundles it writes for its devices with. Like
+	// PointTypeNkeySeed, it is kept apart from the node's other points.
+	PointTypeBundleSeed = "bundleSeed"
+	// PointTypeBundleSeq on a device node records, keyed by stream name,
+	// the last sequence of the stream the receiving instance has taken in
+	// from sync bundles. It travels back in the other direction's bundles,
+	// where it tells the sender where to resume.
+	PointTypeBundleSeq = "bundleSeq"
+	// PointTypeSyncRateLimit on a sync node caps what it sends and
+	// receives, in bytes per second
+	PointTypeSyncRateLimit = "syncRateLimit"
+	// PointTypeSyncDailyBudget on a sync node is how many bytes it may use
+	// per UTC day before it holds telemetry until the next day
+	PointTypeSyncDailyBudget = "syncDailyBudget"
+	// PointTypeSyncBacklog on a sync node is how many messages it has not
+	// yet pushed upstream
+	PointTypeSyncBacklog = "syncBacklog"
+	// PointTypeSyncRate on a sync node is the bytes per second it moved
+	// over the last few seconds
+	PointTypeSyncRate = "syncRate"
+	// PointTypeSyncBytesToday on a sync node is the bytes it used so far
+	// this UTC day
+	PointTypeSyncBytesToday = "syncBytesToday"
+	// PointTypeSyncConnected on a sync node is 1 while it is connected to
+	// its upstream
+	PointTypeSyncConnected = "syncConnected"
+	// PointTypeSyncPending on a sync node is how many messages a stream it
+	// pushes or pulls has waiting, keyed by the stream's name
+	PointTypeSyncPending = "syncPending"
+	// PointTypeSyncLag on a sync node is the age in seconds of the oldest
+	// message it has not yet pushed, 0 when it is caught up
+	PointTypeSyncLag = "syncLag"
+	// PointTypeSyncLastSync on a sync node is when it was last caught up in
+	// both directions, in Unix epoch seconds
+	PointTypeSyncLastSync = "syncLastSync"
+	// PointTypeSyncConflicts on the root node is how many sync conflicts
+	// are waiting to be resolved, for a rule to alarm on
+	PointTypeSyncConflicts = "syncConflicts"
+	// PointTypeDataUsageDay and PointTypeDataUsageMonth on the root node
+	// are the bytes its sync connections upstream moved this UTC day and
+	// month, keyed sent, received and total. The root node is the
+	// device's node upstream, so they are seen there too.
+	PointTypeDataUsageDay   = "dataUsageDay"
+	PointTypeDataUsageMonth = "dataUsageMonth"
+	// PointTypeDataPlan on the root node is the bytes the device may use
+	// per month, from its cellular plan
+	PointTypeDataPlan = "dataPlan"
+	// PointTypeDataPlanUsed on the root node is the percent of the data
+	// plan used this month
+	PointTypeDataPlanUsed = "dataPlanUsed"
+	// PointTypeDataPlanThreshold on the root node is a percent of the data
+	// plan; dataPlanOver is 1 while the month's usage is at or over it
+	PointTypeDataPlanThreshold = "dataPlanThreshold"
+	PointTypeDataPlanOver      = "dataPlanOver"
+	// The include and exclude lists on a sync node select what it keeps
+	// local rather than pushing upstream, by node type, by point type, or
+	// by the ID of the node at the top of a subtree. Each entry is a point
+	// of its own, keyed by index.
+	PointTypeSyncExcludeNodeType  = "syncExcludeNodeType"
+	PointTypeSyncIncludeNodeType  = "syncIncludeNodeType"
+	PointTypeSyncExcludePointType = "syncExcludePointType"
+	PointTypeSyncIncludePointType = "syncIncludePointType"
+	PointTypeSyncExcludeNode      = "syncExcludeNode"
+	PointTypeSyncIncludeNode      = "syncIncludeNode"
 
 	PointTypeMetricNatsCycleNodePoint          = "metricNatsCycleNodePoint"
 	PointTypeMetricNatsCycleNodeEdgePoint      = "metricNatsCycleNodeEdgePoint"
@@ -434,6 +593,8 @@ const (
 
 	PointKeyUsedPercent = "usedPercent"
 	PointKeyTotal       = "total"
+	PointKeySent        = "sent"
+	PointKeyReceived    = "received"
 	PointKeyAvailable   = "available"
 	PointKeyUsed        = "used"
 	PointKeyFree        = "free"
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Snapshot is the configuration of a subtree at a point in time, kept in the
+// store under a name so the subtree can later be compared against it or
+// rolled back to it.
+//
+// Only configuration is kept: the points users and configuration tools
+// (import, provisioning, a rollback) wrote. The values clients report, and
+// the nodes clients create on their own, are not configuration and are
+// neither kept nor rolled back.
+type Snapshot struct {
+	Name   string    `json:"name"`
+	NodeID string    `json:"nodeId"`
+	Time   time.Time `json:"time"`
+	// Nodes holds the subtree, parents before children, starting with the
+	// node the snapshot was taken of. It is left out of a snapshot list.
+	Nodes []SnapshotNode `json:"nodes,omitempty"`
+}
+
+// SnapshotNode is one node of a snapshot, holding its configuration points
+// and edge points.
+type SnapshotNode struct {
+	NodeEdge
+	// Config is set when a user or configuration tool created the node,
+	// rather than a client.
+	Config bool `json:"config,omitempty"`
+}
+
+// SnapshotResponse is the response to a snapshot request.
+type SnapshotResponse struct {
+	Snapshots []Snapshot `json:"snapshots"`
+	Error     string     `json:"error,omitempty"`
+}
+
+var reSnapshotName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CheckSnapshotName returns an error if a name can't be used for a snapshot.
+func CheckSnapshotName(name string) error {
+	if !reSnapshotName.MatchString(name) {
+		return fmt.Errorf("snapshot name %q may only hold letters, digits, - and _", name)
+	}
+	return nil
+}
+
+func (s Snapshot) String() string {
+	ret := fmt.Sprintf("%v %v of %v", s.Time.Format(time.RFC3339), s.Name, s.NodeID)
+	if len(s.Nodes) > 0 {
+		ret += fmt.Sprintf(" (%v nodes)", len(s.Nodes))
+	}
+	return ret
+}
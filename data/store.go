@@ -0,0 +1,16 @@
+package data
+
+// StoreCheckResponse is the response to a store verify or maintenance
+// request. Issues lists the problems found, or those left after a repair. Error
+// is set when the check itself could not run, in which case Issues is empty.
+type StoreCheckResponse struct {
+	Issues []string `json:"issues"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// LocalPointsResponse is the response to a local points request: the points
+// of a node that are secret to the instance and never synced.
+type LocalPointsResponse struct {
+	Points Points `json:"points"`
+	Error  string `json:"error,omitempty"`
+}
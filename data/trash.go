@@ -0,0 +1,42 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// TrashNode is a node that was deleted from a parent. Deleting a node only
+// tombstones its edge, so until the trash is purged the node can be restored
+// by clearing the tombstone.
+type TrashNode struct {
+	ID          string    `json:"id"`
+	Parent      string    `json:"parent"`
+	Type        string    `json:"type"`
+	Description string    `json:"description,omitempty"`
+	DeletedAt   time.Time `json:"deletedAt"`
+	// DeletedBy is the origin of the delete: a user node when it was made
+	// through the HTTP API, otherwise the client or instance that made it.
+	// DeletedByUser is the user's email when DeletedBy is a user.
+	DeletedBy     string `json:"deletedBy,omitempty"`
+	DeletedByUser string `json:"deletedByUser,omitempty"`
+}
+
+// TrashResponse is the response to a trash request.
+type TrashResponse struct {
+	Nodes []TrashNode `json:"nodes"`
+	Error string      `json:"error,omitempty"`
+}
+
+func (tn TrashNode) String() string {
+	by := tn.DeletedByUser
+	if by == "" {
+		by = tn.DeletedBy
+	}
+	if by == "" {
+		by = "-"
+	}
+
+	return fmt.Sprintf("%v %v %q (%v) from %v, deleted by %v",
+		tn.DeletedAt.Format(time.RFC3339), tn.ID, tn.Description, tn.Type,
+		tn.Parent, by)
+}
@@ -35,7 +35,7 @@ encode user =
 
 
 login :
-    { user : { user | email : String, password : String }
+    { user : { user | org : String, email : String, password : String }
     , onResponse : Data User -> msg
     }
     -> Cmd msg
@@ -43,7 +43,8 @@ login options =
     Http.post
         { body =
             Http.multipartBody
-                [ Http.stringPart "email" options.user.email
+                [ Http.stringPart "org" options.user.org
+                , Http.stringPart "email" options.user.email
                 , Http.stringPart "password" options.user.password
                 ]
         , url = Url.Builder.absolute [ "v1", "auth" ] []
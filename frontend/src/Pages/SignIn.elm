@@ -32,6 +32,7 @@ page shared _ =
 
 type alias Model =
     { user : Data Api.Auth.User
+    , org : String
     , email : String
     , password : String
     , error : Maybe String
@@ -50,6 +51,7 @@ init shared =
         )
         ""
         ""
+        ""
         Nothing
     , Effect.none
     )
@@ -60,7 +62,8 @@ init shared =
 
 
 type Msg
-    = EditEmail String
+    = EditOrg String
+    | EditEmail String
     | EditPass String
     | SignIn
     | GotUser (Data Api.Auth.User)
@@ -70,6 +73,9 @@ type Msg
 update : Storage -> Msg -> Model -> ( Model, Effect Msg )
 update storage msg model =
     case msg of
+        EditOrg org ->
+            ( { model | org = org }, Effect.none )
+
         EditEmail email ->
             ( { model | email = String.toLower email }, Effect.none )
 
@@ -81,7 +87,8 @@ update storage msg model =
             , Effect.fromCmd <|
                 Api.Auth.login
                     { user =
-                        { email = model.email
+                        { org = model.org
+                        , email = model.email
                         , password = model.password
                         }
                     , onResponse = GotUser
@@ -147,7 +154,14 @@ view model =
                 , el [ Font.size 24, Font.semiBold ]
                     (text "Sign in")
                 , column [ spacing 16 ]
-                    [ Input.email
+                    [ Input.text
+                        []
+                        { onChange = \o -> EditOrg o
+                        , text = model.org
+                        , placeholder = Just <| Input.placeholder [] <| text "leave empty if none"
+                        , label = Input.labelAbove [] <| text "Organization"
+                        }
+                    , Input.email
                         []
                         { onChange = \e -> EditEmail e
                         , text = model.email
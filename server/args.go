@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/simpleiot/simpleiot/api"
 	"github.com/simpleiot/simpleiot/assets/files"
 	"github.com/simpleiot/simpleiot/store"
 	"github.com/simpleiot/simpleiot/system"
@@ -44,6 +45,20 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		"store file compression ('s2' or 'none'); empty uses the default of s2")
 	flagStoreSyncInterval := flags.String("storeSyncInterval", "",
 		"JetStream file sync interval (Go duration, or 'always' to fsync every write); empty uses the NATS default of 2m")
+	flagAdoptionApproval := flags.Bool("adoptionApproval", false,
+		"hold devices that sync here for an admin to approve before they join the tree")
+	flagSyncConflictWindow := flags.String("syncConflictWindow", "",
+		"how close together two instances have to change a config point to record a sync conflict (Go duration, 0 to turn off); empty uses the default of 1m")
+	flagSyncConflictKeep := flags.Bool("syncConflictKeep", false,
+		"keep sync conflicts until they are resolved, rather than for a week")
+	flagOIDCIssuer := flags.String("oidcIssuer", "", "OpenID Connect issuer URL to log in through")
+	flagOIDCClientID := flags.String("oidcClientID", "", "OpenID Connect client ID")
+	flagOIDCRedirectURL := flags.String("oidcRedirectURL", "",
+		"URL of this server's /v1/auth/oidc/callback as registered with the identity provider")
+	flagOIDCGroupsClaim := flags.String("oidcGroupsClaim", "",
+		"ID token claim that lists the user's groups; empty uses the default of groups")
+	flagOIDCUserParent := flags.String("oidcUserParent", "",
+		"node to create OIDC users under when none of their groups is mapped; empty refuses them")
 
 	if err := flags.Parse(args); err != nil {
 		return Options{}, err
@@ -120,6 +135,17 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		natsMQTTPort = n
 	}
 
+	natsLeafPort := 0
+	natsLeafPortE := os.Getenv("SIOT_NATS_LEAF_PORT")
+	if natsLeafPortE != "" {
+		n, err := strconv.Atoi(natsLeafPortE)
+		if err != nil {
+			log.Println("Error parsing SIOT_NATS_LEAF_PORT:", err)
+			os.Exit(-1)
+		}
+		natsLeafPort = n
+	}
+
 	natsServer := *flagNatsServer
 	// only consider env if command line option is something different
 	// that default
@@ -255,6 +281,76 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		}
 	}
 
+	// =============================================
+	// Adoption
+	// =============================================
+
+	adoptionApproval := *flagAdoptionApproval
+	if v := os.Getenv("SIOT_ADOPTION_APPROVAL"); v != "" && !adoptionApproval {
+		adoptionApproval, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Println("Error parsing SIOT_ADOPTION_APPROVAL:", err)
+			os.Exit(-1)
+		}
+	}
+
+	// =============================================
+	// Sync conflicts
+	// =============================================
+
+	syncConflictWindowS := *flagSyncConflictWindow
+	if syncConflictWindowS == "" {
+		syncConflictWindowS = os.Getenv("SIOT_SYNC_CONFLICT_WINDOW")
+	}
+
+	var syncConflictWindow time.Duration
+	if syncConflictWindowS != "" {
+		syncConflictWindow, err = time.ParseDuration(syncConflictWindowS)
+		if err != nil {
+			log.Println("Error parsing sync conflict window:", err)
+			os.Exit(-1)
+		}
+		if syncConflictWindow == 0 {
+			// explicitly off
+			syncConflictWindow = -1
+		}
+	}
+
+	syncConflictKeep := *flagSyncConflictKeep
+	if v := os.Getenv("SIOT_SYNC_CONFLICT_KEEP"); v != "" && !syncConflictKeep {
+		syncConflictKeep, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Println("Error parsing SIOT_SYNC_CONFLICT_KEEP:", err)
+			os.Exit(-1)
+		}
+	}
+
+	// =============================================
+	// OpenID Connect
+	// =============================================
+
+	oidcFlag := func(flag *string, env string) string {
+		if *flag != "" {
+			return *flag
+		}
+		return os.Getenv(env)
+	}
+
+	oidc := api.OIDCConfig{
+		Issuer:   oidcFlag(flagOIDCIssuer, "SIOT_OIDC_ISSUER"),
+		ClientID: oidcFlag(flagOIDCClientID, "SIOT_OIDC_CLIENT_ID"),
+		// only read from the environment, to keep it out of process listings
+		ClientSecret: os.Getenv("SIOT_OIDC_CLIENT_SECRET"),
+		RedirectURL:  oidcFlag(flagOIDCRedirectURL, "SIOT_OIDC_REDIRECT_URL"),
+		GroupsClaim:  oidcFlag(flagOIDCGroupsClaim, "SIOT_OIDC_GROUPS_CLAIM"),
+		UserParent:   oidcFlag(flagOIDCUserParent, "SIOT_OIDC_USER_PARENT"),
+	}
+
+	if oidc.Enabled() && oidc.RedirectURL == "" {
+		log.Println("OIDC login needs a redirect URL")
+		os.Exit(-1)
+	}
+
 	// TODO, convert this to builder pattern
 	o := Options{
 		StoreFile:         storeFilePath,
@@ -269,6 +365,7 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		NatsHTTPPort:      natsHTTPPort,
 		NatsWSPort:        natsWSPort,
 		NatsMQTTPort:      natsMQTTPort,
+		NatsLeafPort:      natsLeafPort,
 		NatsTLSCert:       natsTLSCert,
 		NatsTLSKey:        natsTLSKey,
 		NatsTLSTimeout:    natsTLSTimeout,
@@ -286,6 +383,13 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		StoreCompression:       storeCompression,
 		StoreSyncInterval:      storeSyncInterval,
 		StoreSyncAlways:        storeSyncAlways,
+
+		AdoptionApproval: adoptionApproval,
+
+		SyncConflictWindow: syncConflictWindow,
+		SyncConflictKeep:   syncConflictKeep,
+
+		OIDC: oidc,
 	}
 
 	return o, nil
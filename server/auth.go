@@ -0,0 +1,501 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/store"
+)
+
+// authRecheckPeriod is how often live device connections are checked against
+// the tree even when nothing that names a credential has changed. A grant also
+// lists the streams a device pulls, and a new stream in one of its boundaries
+// only shows up this way.
+const authRecheckPeriod = time.Minute
+
+// grantLookup returns the grant of the device whose credential is a public
+// key. It is the store's DeviceGrant, and a field so tests can stand in for it.
+type grantLookup func(pubKey string) (store.DeviceGrant, bool)
+
+// sessionLookup returns the grant of the browser session whose login token is
+// token. It is the store's SessionGrant.
+type sessionLookup func(token string) (store.SessionGrant, bool)
+
+// deviceConn is a live connection authenticated with a device credential.
+type deviceConn struct {
+	pubKey string
+	grant  store.DeviceGrant
+}
+
+// sessionConn is a live connection authenticated with a user's login token.
+type sessionConn struct {
+	token string
+	grant store.SessionGrant
+}
+
+// authorizer authenticates every connection to the embedded NATS server. A
+// connection without an NKey is checked against the shared auth token and
+// gets full access, which is how the server's own client, the siot CLI and
+// token devices connect. A browser session presents the user's login token
+// instead, and gets only the nodes that user can reach (see
+// sessionPermissions). A connection with an NKey must sign the server's nonce
+// with a key a device node in the tree carries, and gets only the subjects
+// that device needs to sync (see devicePermissions). A leafnode connection
+// only ever carries stream sourcing (see leafPermissions).
+//
+// NKey and session connections are refused until the store has started,
+// since the tree is where credentials and users live. A client that connects
+// in between retries.
+type authorizer struct {
+	token string
+
+	lock     sync.Mutex
+	lookup   grantLookup
+	session  sessionLookup
+	conns    map[uint64]deviceConn
+	sessions map[uint64]sessionConn
+}
+
+func newAuthorizer(token string) *authorizer {
+	return &authorizer{
+		token:    token,
+		conns:    make(map[uint64]deviceConn),
+		sessions: make(map[uint64]sessionConn),
+	}
+}
+
+// Check is called by the NATS server for each new connection on every
+// listener.
+func (a *authorizer) Check(c server.ClientAuthentication) bool {
+	opts := c.GetOpts()
+
+	if opts.Nkey == "" {
+		shared := a.token != "" &&
+			subtle.ConstantTimeCompare([]byte(opts.Token), []byte(a.token)) == 1
+
+		if !shared && opts.Token != "" && c.Kind() == server.CLIENT {
+			if a.checkSession(c, opts.Token) {
+				return true
+			}
+			if a.token != "" {
+				return false
+			}
+			// with no auth token set, any connection gets full access
+		}
+
+		ok := shared || a.token == ""
+		if ok && c.Kind() == server.LEAF {
+			c.RegisterUser(&server.User{
+				Username:    "leafnode",
+				Permissions: leafPermissions(nil),
+			})
+		}
+		return ok
+	}
+
+	a.lock.Lock()
+	lookup := a.lookup
+	a.lock.Unlock()
+
+	if lookup == nil {
+		return false
+	}
+
+	if !verifyNonce(opts.Nkey, opts.Sig, c.GetNonce()) {
+		return false
+	}
+
+	grant, ok := lookup(opts.Nkey)
+	if !ok {
+		log.Printf("NATS auth: refused unknown or revoked credential %v from %v\n",
+			opts.Nkey, c.RemoteAddress())
+		return false
+	}
+
+	perms := devicePermissions(grant)
+	if c.Kind() == server.LEAF {
+		perms = leafPermissions(&grant)
+	}
+
+	c.RegisterUser(&server.User{
+		Username:    opts.Nkey,
+		Permissions: perms,
+	})
+
+	a.lock.Lock()
+	a.conns[c.GetID()] = deviceConn{pubKey: opts.Nkey, grant: grant}
+	a.lock.Unlock()
+
+	return true
+}
+
+// checkSession authenticates a connection whose token is a user's login
+// token, and limits it to the nodes the user can reach.
+func (a *authorizer) checkSession(c server.ClientAuthentication, token string) bool {
+	a.lock.Lock()
+	lookup := a.session
+	a.lock.Unlock()
+
+	if lookup == nil {
+		return false
+	}
+
+	grant, ok := lookup(token)
+	if !ok {
+		return false
+	}
+
+	c.RegisterUser(&server.User{
+		Username:    "user-" + grant.UserID,
+		Permissions: sessionPermissions(grant),
+	})
+
+	a.lock.Lock()
+	a.sessions[c.GetID()] = sessionConn{token: token, grant: grant}
+	a.lock.Unlock()
+
+	return true
+}
+
+// verifyNonce checks the signature a client sent over the nonce the server
+// presented, which proves the client holds the seed for the public key.
+func verifyNonce(pubKey, sig string, nonce []byte) bool {
+	if len(nonce) == 0 {
+		return false
+	}
+
+	kp, err := nkeys.FromPublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	s, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		// older clients pad the signature
+		s, err = base64.StdEncoding.DecodeString(sig)
+		if err != nil {
+			return false
+		}
+	}
+
+	return kp.Verify(nonce, s) == nil
+}
+
+// start enables NKey and session connections once the store is up, and then
+// keeps live device and session connections in step with the tree until stop
+// is closed. A connection whose credential is revoked, whose device or user
+// node is deleted, whose login token has expired, or whose grant has changed
+// is disconnected; a client whose grant changed reconnects and picks up the
+// new one.
+func (a *authorizer) start(ns *server.Server, nc *nats.Conn, lookup grantLookup,
+	session sessionLookup, stop <-chan struct{}) error {
+
+	a.lock.Lock()
+	a.lookup = lookup
+	a.session = session
+	a.lock.Unlock()
+
+	recheck := make(chan struct{}, 1)
+
+	sub, err := nc.Subscribe("up.root.>", func(msg *nats.Msg) {
+		if !credentialSubject(msg.Subject) {
+			return
+		}
+		select {
+		case recheck <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to credential changes: %v", err)
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	t := time.NewTicker(authRecheckPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-recheck:
+		case <-t.C:
+		}
+
+		a.recheck(ns)
+	}
+}
+
+// credentialSubject reports whether a point fanned up the tree can change a
+// grant: a credential point on a device node or an API key, a user's role, or
+// a node being attached, moved or deleted. Node points arrive as
+// up.<upID>.<nodeID>.<type>.<key> and edge points one token longer.
+func credentialSubject(subject string) bool {
+	tok := strings.Split(subject, ".")
+
+	switch len(tok) {
+	case 5:
+		typ := tok[3]
+		switch typ {
+		case data.PointTypePubKey, data.PointTypeRevoked, data.PointTypeKeyHash,
+			data.PointTypeExpires, data.PointTypeScope, data.PointTypeAccess:
+			return true
+		}
+		return false
+	case 6:
+		typ := tok[4]
+		return typ == data.PointTypeTombstone || typ == data.PointTypeNodeType ||
+			typ == data.PointTypeRole
+	}
+
+	return false
+}
+
+// recheck looks every live device and session connection up again and
+// disconnects the ones whose grant is gone or different.
+func (a *authorizer) recheck(ns *server.Server) {
+	a.lock.Lock()
+	lookup := a.lookup
+	session := a.session
+	conns := make(map[uint64]deviceConn, len(a.conns))
+	for id, dc := range a.conns {
+		conns[id] = dc
+	}
+	sessions := make(map[uint64]sessionConn, len(a.sessions))
+	for id, sc := range a.sessions {
+		sessions[id] = sc
+	}
+	a.lock.Unlock()
+
+	for id, sc := range sessions {
+		cz, err := ns.Connz(&server.ConnzOptions{CID: id})
+		if err != nil || len(cz.Conns) == 0 {
+			a.forget(id)
+			continue
+		}
+
+		grant, ok := session(sc.token)
+		if ok && reflect.DeepEqual(grant, sc.grant) {
+			continue
+		}
+
+		if ok {
+			log.Printf("NATS auth: access changed for user %v, reconnecting session\n",
+				sc.grant.UserID)
+		} else {
+			log.Printf("NATS auth: login of user %v no longer valid, disconnecting session\n",
+				sc.grant.UserID)
+		}
+
+		a.forget(id)
+		if err := ns.DisconnectClientByID(id); err != nil {
+			log.Printf("NATS auth: error disconnecting session of user %v: %v\n",
+				sc.grant.UserID, err)
+		}
+	}
+
+	for id, dc := range conns {
+		cz, err := ns.Connz(&server.ConnzOptions{CID: id})
+		if err != nil || len(cz.Conns) == 0 {
+			// closed since
+			a.forget(id)
+			continue
+		}
+
+		grant, ok := lookup(dc.pubKey)
+		if ok && reflect.DeepEqual(grant, dc.grant) {
+			continue
+		}
+
+		if ok {
+			log.Printf("NATS auth: access changed for device %v, reconnecting it\n",
+				dc.grant.DeviceID)
+		} else {
+			log.Printf("NATS auth: credential for device %v revoked, disconnecting\n",
+				dc.grant.DeviceID)
+		}
+
+		a.forget(id)
+		if err := ns.DisconnectClientByID(id); err != nil {
+			log.Printf("NATS auth: error disconnecting device %v: %v\n",
+				dc.grant.DeviceID, err)
+		}
+	}
+}
+
+func (a *authorizer) forget(id uint64) {
+	a.lock.Lock()
+	delete(a.conns, id)
+	delete(a.sessions, id)
+	a.lock.Unlock()
+}
+
+// devicePermissions returns what a device credential may do on this instance:
+// find this instance's root, look up and announce its own node, and replicate
+// the streams of its grant. A device that syncs over a leafnode updates its
+// replicas here to source them from its own domain, which the store checks
+// (see store/replica.go). Everything else, including every other instance's
+// streams and the request subjects the UI and CLI use, is refused. Writing a
+// credential point into its own stream is refused as well, though the store
+// would ignore it anyway since only this instance's writes count.
+func devicePermissions(g store.DeviceGrant) *server.Permissions {
+	X := g.DeviceID
+
+	pub := []string{
+		"nodes.root.all",
+		"nodes.all." + X,
+		fmt.Sprintf("ep.%v.%v", X, g.RootID),
+		"adoption.request." + X,
+		"$JS.API.STREAM.LIST",
+		"$JS.API.STREAM.NAMES",
+	}
+
+	var deny []string
+
+	for _, b := range g.Boundaries {
+		deny = append(deny,
+			fmt.Sprintf("inst.*.*.%v.p.%v.*", b, data.PointTypePubKey),
+			fmt.Sprintf("inst.*.*.%v.p.%v.*", b, data.PointTypeRevoked))
+
+		for _, o := range g.Boundaries {
+			name := fmt.Sprintf("inst_%v_%v", b, o)
+			pub = append(pub,
+				fmt.Sprintf("inst.%v.%v.>", b, o),
+				"$JS.API.STREAM.INFO."+name,
+				"$JS.API.STREAM.CREATE."+name,
+				"$JS.API.STREAM.UPDATE."+name)
+		}
+	}
+
+	for _, name := range g.Pull {
+		pub = append(pub,
+			"$JS.API.STREAM.INFO."+name,
+			"$JS.API.CONSUMER.*."+name+".*",
+			"$JS.API.CONSUMER.*."+name+".*.>",
+			"$JS.API.CONSUMER.*.*."+name+".*",
+			"$JS.ACK."+name+".>",
+			"$JS.ACK.*.*."+name+".>")
+	}
+
+	return &server.Permissions{
+		Publish: &server.SubjectPermission{
+			Allow: pub,
+			Deny:  deny,
+		},
+		Subscribe: &server.SubjectPermission{
+			Allow: []string{"_INBOX.>"},
+		},
+	}
+}
+
+// sessionPermissions returns what a browser session may do: read the nodes
+// its user can reach and their points, write setpoints where the user is an
+// operator, and write the points of the nodes it may change. Where the user is
+// an admin it may also write the edges below, which is how a node is added,
+// moved or deleted. It writes only as its user (see
+// client.SubjectNodePointsAs), so the store knows who wrote each point. An
+// admin of an organization may also list the devices waiting to join it, and
+// approve or reject them; the store checks that the device asked to join that
+// organization. Every other request subject, including admin.*, the store's
+// history and trash, and the streams, is refused. The store checks the same
+// roles again for each point, with the user as its origin.
+func sessionPermissions(g store.SessionGrant) *server.Permissions {
+	var pub []string
+	sub := []string{"_INBOX.>"}
+
+	for _, id := range g.Read {
+		pub = append(pub,
+			"nodes.*."+id,
+			"nodes."+id+".*")
+		sub = append(sub,
+			"p."+id+".>",
+			"phr."+id,
+			"ep."+id+".>",
+			"up."+id+".>")
+	}
+
+	as := "as." + g.UserID + "."
+
+	for _, id := range g.Operate {
+		for _, typ := range data.SetpointTypes {
+			pub = append(pub, as+"p."+id+"."+typ+".*")
+		}
+	}
+
+	for _, id := range g.Write {
+		pub = append(pub, as+"p."+id+".>")
+	}
+
+	for _, id := range g.Admin {
+		pub = append(pub, as+"ep.*."+id)
+		if len(g.Orgs) > 0 {
+			pub = append(pub, "adoption.approve.*."+id)
+		}
+	}
+
+	for _, id := range g.Orgs {
+		pub = append(pub,
+			"adoption.list."+id,
+			"adoption.reject.*."+id)
+	}
+
+	return &server.Permissions{
+		Publish: &server.SubjectPermission{
+			Allow: pub,
+		},
+		Subscribe: &server.SubjectPermission{
+			Allow: sub,
+		},
+	}
+}
+
+// leafSourcing is the JetStream traffic of stream sourcing that is not an API
+// request: replies to the requests that set up a source, the messages a
+// source delivers, and its flow control.
+var leafSourcing = []string{"$JSC.R.>", "$JS.S.>", "$JS.FC.>"}
+
+// leafPermissions returns what a leafnode connection from a device may carry.
+// A leafnode joins the subject spaces of the two servers, so without limits the
+// points, requests and streams of each instance would reach the other's
+// clients and store. It carries stream sourcing and nothing else.
+//
+// The permissions are written from the device's side: Publish is what the
+// device sends here and Subscribe is what it receives. The device may only
+// source the streams its grant pulls, addressed to this instance's domain;
+// a token device, with g nil, may source any. This instance may source
+// any stream from the device, since the device trusts its upstream.
+func leafPermissions(g *store.DeviceGrant) *server.Permissions {
+	pub := slices.Clone(leafSourcing)
+
+	if g == nil {
+		pub = append(pub, "$JS.*.API.>")
+	} else {
+		for _, name := range g.Pull {
+			pub = append(pub,
+				"$JS.*.API.CONSUMER.*."+name,
+				"$JS.*.API.CONSUMER.*."+name+".>")
+		}
+	}
+
+	return &server.Permissions{
+		Publish: &server.SubjectPermission{
+			Allow: pub,
+		},
+		Subscribe: &server.SubjectPermission{
+			Allow: append([]string{"$JS.*.API.>"}, leafSourcing...),
+		},
+	}
+}
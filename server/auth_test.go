@@ -0,0 +1,262 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/simpleiot/simpleiot/store"
+)
+
+// permitted reports whether a publish to subject is allowed by the allow list
+// and not refused by the deny list, matching wildcards the way the NATS
+// server does.
+func permitted(p *server.SubjectPermission, subject string) bool {
+	allowed := slices.ContainsFunc(p.Allow, func(pat string) bool {
+		return server.SubjectMatchesFilter(subject, pat)
+	})
+	denied := slices.ContainsFunc(p.Deny, func(pat string) bool {
+		return server.SubjectMatchesFilter(subject, pat)
+	})
+	return allowed && !denied
+}
+
+func TestDevicePermissions(t *testing.T) {
+	g := store.DeviceGrant{
+		DeviceID:   "dev",
+		RootID:     "up",
+		Boundaries: []string{"dev", "sub"},
+		Pull:       []string{"inst_dev_up", "inst_sub_up"},
+	}
+
+	perms := devicePermissions(g)
+
+	tests := []struct {
+		subject string
+		allow   bool
+	}{
+		{"nodes.root.all", true},
+		{"nodes.all.dev", true},
+		{"nodes.all.other", false},
+		{"nodes.up.all", false},
+		{"ep.dev.up", true},
+		{"ep.other.up", false},
+		{"adoption.request.dev", true},
+		{"adoption.request.other", false},
+		{"adoption.approve.dev.up", false},
+		{"p.dev.description.0", false},
+		{"inst.dev.dev.n1.p.value.0", true},
+		{"inst.sub.sub.n2.p.value.0", true},
+		{"inst.sub.dev.n2.p.value.0", true},
+		{"inst.dev.up.n1.p.value.0", false},
+		{"inst.other.other.n3.p.value.0", false},
+		{"inst.dev.dev.dev.p.pubKey.0", false},
+		{"inst.dev.dev.dev.p.revoked.0", false},
+		{"inst.sub.sub.sub.p.pubKey.0", false},
+		{"$JS.API.STREAM.LIST", true},
+		{"$JS.API.STREAM.NAMES", true},
+		{"$JS.API.STREAM.INFO.inst_dev_dev", true},
+		{"$JS.API.STREAM.CREATE.inst_dev_dev", true},
+		{"$JS.API.STREAM.CREATE.inst_dev_up", false},
+		{"$JS.API.STREAM.UPDATE.inst_sub_dev", true},
+		{"$JS.API.STREAM.UPDATE.inst_dev_up", false},
+		{"$JS.API.STREAM.INFO.inst_other_other", false},
+		{"$JS.API.STREAM.DELETE.inst_dev_dev", false},
+		{"$JS.API.STREAM.PURGE.inst_dev_up", false},
+		{"$JS.API.STREAM.INFO.inst_dev_up", true},
+		{"$JS.API.CONSUMER.CREATE.inst_dev_up.sync-dev", true},
+		{"$JS.API.CONSUMER.MSG.NEXT.inst_sub_up.sync-dev", true},
+		{"$JS.API.CONSUMER.CREATE.inst_other_up.sync-dev", false},
+		{"$JS.ACK.inst_dev_up.sync-dev.1.2.3.4.0", true},
+		{"$JS.ACK.inst_other_up.sync-dev.1.2.3.4.0", false},
+		{"$JS.API.INFO", false},
+		{"snapshot.up.take", false},
+	}
+
+	for _, test := range tests {
+		if got := permitted(perms.Publish, test.subject); got != test.allow {
+			t.Errorf("publish %v: got %v, expected %v", test.subject, got, test.allow)
+		}
+	}
+
+	if !permitted(perms.Subscribe, "_INBOX.abc.def") {
+		t.Error("a device must be able to receive replies")
+	}
+
+	if permitted(perms.Subscribe, "up.root.>") || permitted(perms.Subscribe, "inst.>") {
+		t.Error("a device must not be able to listen to the tree")
+	}
+}
+
+func TestLeafPermissions(t *testing.T) {
+	g := store.DeviceGrant{
+		DeviceID:   "dev",
+		RootID:     "up",
+		Boundaries: []string{"dev"},
+		Pull:       []string{"inst_dev_up"},
+	}
+
+	tests := []struct {
+		name    string
+		perms   *server.Permissions
+		subject string
+		allow   bool
+	}{
+		{"source own pull", leafPermissions(&g), "$JS.hub.API.CONSUMER.CREATE.inst_dev_up", true},
+		{"source own pull filtered", leafPermissions(&g),
+			"$JS.hub.API.CONSUMER.CREATE.inst_dev_up.JS_SRC_x.inst.>", true},
+		{"source other stream", leafPermissions(&g),
+			"$JS.hub.API.CONSUMER.CREATE.inst_other_up", false},
+		{"other API", leafPermissions(&g), "$JS.hub.API.STREAM.DELETE.inst_dev_up", false},
+		{"sourcing reply", leafPermissions(&g), "$JSC.R.abc", true},
+		{"source delivery", leafPermissions(&g), "$JS.S.abc", true},
+		{"flow control", leafPermissions(&g), "$JS.FC.hub.x.y", true},
+		{"point", leafPermissions(&g), "p.dev.value.0", false},
+		{"stream subject", leafPermissions(&g), "inst.dev.dev.n.p.value.0", false},
+		{"request", leafPermissions(&g), "nodes.root.all", false},
+		{"token source", leafPermissions(nil), "$JS.hub.API.CONSUMER.CREATE.inst_other_up", true},
+		{"token point", leafPermissions(nil), "p.dev.value.0", false},
+	}
+
+	for _, test := range tests {
+		if got := permitted(test.perms.Publish, test.subject); got != test.allow {
+			t.Errorf("%v: publish %v: got %v, expected %v", test.name, test.subject,
+				got, test.allow)
+		}
+	}
+
+	perms := leafPermissions(&g)
+	if !permitted(perms.Subscribe, "$JS.dev.API.CONSUMER.CREATE.inst_dev_dev") {
+		t.Error("the upstream must be able to source the device's streams")
+	}
+	if permitted(perms.Subscribe, "up.root.dev.value.0") || permitted(perms.Subscribe, "inst.dev.up.n.p.value.0") {
+		t.Error("a leafnode must not carry the upstream's points")
+	}
+}
+
+func TestSessionPermissions(t *testing.T) {
+	g := store.SessionGrant{
+		UserID:  "user",
+		Read:    []string{"group", "sensor", "site", "user"},
+		Operate: []string{"group"},
+		Write:   []string{"sensor", "site", "user"},
+		Admin:   []string{"sensor", "site"},
+	}
+
+	perms := sessionPermissions(g)
+
+	pub := []struct {
+		subject string
+		allow   bool
+	}{
+		{"nodes.all.group", true},
+		{"nodes.group.all", true},
+		{"nodes.site.sensor", true},
+		{"nodes.root.all", false},
+		{"nodes.all.other", false},
+		{"nodes.other.all", false},
+		{"as.user.p.site.description.0", true},
+		{"as.user.p.user.pass.0", true},
+		{"as.user.p.group.description.0", false},
+		{"as.user.p.group.valueSet.0", true},
+		{"as.user.p.group.switchSet.1", true},
+		{"as.user.p.other.description.0", false},
+		{"as.user.ep.new.site", true},
+		{"as.user.ep.site.group", false},
+		{"as.user.ep.new.user", false},
+		{"as.user.ep.other.other", false},
+		{"as.admin.p.site.description.0", false},
+		{"as.admin.ep.new.site", false},
+		{"p.site.description.0", false},
+		{"p.group.valueSet.0", false},
+		{"ep.new.site", false},
+		{"admin.storeVerify", false},
+		{"history.site", false},
+		{"trash.list.site", false},
+		{"auth.user", false},
+		{"adoption.list", false},
+		{"adoption.approve.dev.site", false},
+		{"$JS.API.STREAM.LIST", false},
+		{"inst.site.up.site.p.description.0", false},
+	}
+
+	for _, test := range pub {
+		if got := permitted(perms.Publish, test.subject); got != test.allow {
+			t.Errorf("publish %v: got %v, expected %v", test.subject, got, test.allow)
+		}
+	}
+
+	sub := []struct {
+		subject string
+		allow   bool
+	}{
+		{"_INBOX.abc.1", true},
+		{"p.group.value.0", true},
+		{"up.site.sensor.value.0", true},
+		{"p.other.value.0", false},
+		{"up.root.other.value.0", false},
+		{"p.>", false},
+	}
+
+	for _, test := range sub {
+		if got := permitted(perms.Subscribe, test.subject); got != test.allow {
+			t.Errorf("subscribe %v: got %v, expected %v", test.subject, got, test.allow)
+		}
+	}
+}
+
+func TestOrgSessionPermissions(t *testing.T) {
+	g := store.SessionGrant{
+		UserID: "user",
+		Read:   []string{"org", "site", "user"},
+		Write:  []string{"org", "site", "user"},
+		Admin:  []string{"org", "site"},
+		Orgs:   []string{"org"},
+	}
+
+	perms := sessionPermissions(g)
+
+	pub := []struct {
+		subject string
+		allow   bool
+	}{
+		{"adoption.list.org", true},
+		{"adoption.list.other", false},
+		{"adoption.list", false},
+		{"adoption.approve.dev.site", true},
+		{"adoption.approve.dev.other", false},
+		{"adoption.reject.dev.org", true},
+		{"adoption.reject.dev", false},
+		{"adoption.reject.dev.other", false},
+		{"adoption.request.dev", false},
+	}
+
+	for _, test := range pub {
+		if got := permitted(perms.Publish, test.subject); got != test.allow {
+			t.Errorf("publish %v: got %v, expected %v", test.subject, got, test.allow)
+		}
+	}
+}
+
+func TestCredentialSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		expect  bool
+	}{
+		{"up.root.dev.pubKey.0", true},
+		{"up.root.dev.revoked.0", true},
+		{"up.root.dev.description.0", false},
+		{"up.root.dev.up.tombstone.0", true},
+		{"up.root.dev.up.nodeType.0", true},
+		{"up.root.dev.up.description.0", false},
+		{"up.root.user.group.role.0", true},
+		{"up.root.key.scope.0", true},
+		{"up.root.key.lastUsed.0", false},
+	}
+
+	for _, test := range tests {
+		if got := credentialSubject(test.subject); got != test.expect {
+			t.Errorf("%v: got %v, expected %v", test.subject, got, test.expect)
+		}
+	}
+}
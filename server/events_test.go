@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// sseEvent is an event read off an event stream.
+type sseEvent struct {
+	id, event, data string
+}
+
+// openEvents opens the event stream of a node on the test server, resuming
+// after lastID if it is set.
+func openEvents(t *testing.T, node, query, lastID string) (<-chan sseEvent, func()) {
+	t.Helper()
+
+	u := fmt.Sprintf("http://localhost:%v/v1/nodes/%v/events%v",
+		TestServerOptions.HTTPPort, node, query)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var resp *http.Response
+	start := time.Now()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatal("Error creating request:", err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Error opening event stream:", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Event stream returned", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("Event stream content type:", ct)
+	}
+
+	ch := make(chan sseEvent, 100)
+	go func() {
+		defer close(ch)
+		s := bufio.NewScanner(resp.Body)
+		s.Buffer(nil, 1<<20)
+		var ev sseEvent
+		for s.Scan() {
+			line := s.Text()
+			switch {
+			case line == "":
+				if ev.event != "" {
+					ch <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[6:]
+			}
+		}
+	}()
+
+	return ch, func() {
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+func nextEvent(t *testing.T, ch <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("Event stream closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for event")
+	}
+	return sseEvent{}
+}
+
+// nextPoints returns the next points event, skipping the echoes of points sent
+// before it.
+func nextPoints(t *testing.T, ch <-chan sseEvent, typ string) (api.PointEvent, string) {
+	t.Helper()
+	for {
+		ev := nextEvent(t, ch)
+		if ev.event != "points" {
+			continue
+		}
+		var pe api.PointEvent
+		if err := json.Unmarshal([]byte(ev.data), &pe); err != nil {
+			t.Fatal("Error decoding points event:", err)
+		}
+		if len(pe.Points) > 0 && pe.Points[0].Type == typ {
+			return pe, ev.id
+		}
+	}
+}
+
+func sendValue(t *testing.T, nc *nats.Conn, node string, v float64) {
+	t.Helper()
+	err := client.SendNodePoint(nc, node, data.NewPointFloat(data.PointTypeValue, "", v), true)
+	if err != nil {
+		t.Fatal("Error sending point:", err)
+	}
+}
+
+func TestNodeEvents(t *testing.T) {
+	nc, root, stop, err := TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+	defer stop()
+
+	g := client.Group{ID: "events-group", Parent: root.ID, Description: "g"}
+	v := client.Variable{ID: "events-var", Parent: g.ID, Description: "v"}
+	for _, n := range []any{g, v} {
+		if err := client.SendNodeType(nc, n, "test"); err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	ch, closeStream := openEvents(t, g.ID, "?subtree=true", "")
+
+	ev := nextEvent(t, ch)
+	if ev.event != "nodes" || ev.id == "" {
+		t.Fatalf("stream did not start with the nodes: %+v", ev)
+	}
+	var nodes []data.NodeEdge
+	if err := json.Unmarshal([]byte(ev.data), &nodes); err != nil {
+		t.Fatal("Error decoding nodes:", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatal("expected the group and variable, got", len(nodes))
+	}
+
+	sendValue(t, nc, v.ID, 1)
+	pe, lastID := nextPoints(t, ch, data.PointTypeValue)
+	if pe.Node != v.ID || pe.Points[0].Val() != 1 {
+		t.Fatalf("wrong points event: %+v", pe)
+	}
+	closeStream()
+
+	// missed while disconnected
+	sendValue(t, nc, v.ID, 2)
+
+	ch, closeStream = openEvents(t, g.ID, "?subtree=true", lastID)
+	ev = nextEvent(t, ch)
+	if ev.event != "points" {
+		t.Fatalf("resumed stream did not start with the missed points: %+v", ev)
+	}
+	var missed api.PointEvent
+	if err := json.Unmarshal([]byte(ev.data), &missed); err != nil {
+		t.Fatal("Error decoding points event:", err)
+	}
+	if missed.Node != v.ID || missed.Points[0].Val() != 2 {
+		t.Fatalf("wrong missed points: %+v", missed)
+	}
+	closeStream()
+
+	// an ID the server does not know starts over with the nodes
+	ch, closeStream = openEvents(t, g.ID, "?subtree=true", "bogus-1")
+	if ev := nextEvent(t, ch); ev.event != "nodes" {
+		t.Fatalf("unknown ID did not start over: %+v", ev)
+	}
+	closeStream()
+
+	// without subtree, only the node's own points are sent
+	ch, closeStream = openEvents(t, g.ID, "", "")
+	defer closeStream()
+	if ev := nextEvent(t, ch); ev.event != "nodes" {
+		t.Fatalf("stream did not start with the nodes: %+v", ev)
+	}
+	sendValue(t, nc, v.ID, 3)
+	sendValue(t, nc, g.ID, 4)
+	pe, _ = nextPoints(t, ch, data.PointTypeValue)
+	if pe.Node != g.ID {
+		t.Fatalf("point of a node below sent without subtree: %+v", pe)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// leafRecheckPeriod is how often the leafnode remotes are compared with the
+// sync nodes even when no point that names them has changed.
+const leafRecheckPeriod = time.Minute
+
+// leafRemote is what a leafnode connection upstream is made from: the
+// address of the upstream's leafnode port and the credential to present.
+type leafRemote struct {
+	url   string
+	token string
+	seed  string
+}
+
+// leafnodes keeps the leafnode remotes of the embedded NATS server in step
+// with the sync nodes in the tree. Each sync node with a leafURI gets a
+// leafnode connection to that upstream, signed in with the sync node's
+// credential, and the sync client then sets the streams up to be sourced
+// over it.
+type leafnodes struct {
+	ns      *server.Server
+	opts    *server.Options
+	current []leafRemote
+}
+
+func newLeafnodes(ns *server.Server, opts *server.Options) *leafnodes {
+	return &leafnodes{ns: ns, opts: opts}
+}
+
+// start applies the sync nodes now, and then whenever one changes, until stop
+// is closed.
+func (l *leafnodes) start(nc *nats.Conn, stop <-chan struct{}) error {
+	recheck := make(chan struct{}, 1)
+	recheck <- struct{}{}
+
+	sub, err := nc.Subscribe("up.root.>", func(msg *nats.Msg) {
+		if !leafSubject(msg.Subject) {
+			return
+		}
+		select {
+		case recheck <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to sync node changes: %v", err)
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	t := time.NewTicker(leafRecheckPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-recheck:
+		case <-t.C:
+		}
+
+		remotes, err := leafRemotes(nc)
+		if err != nil {
+			log.Println("Leafnodes: error reading sync nodes:", err)
+			continue
+		}
+
+		if err := l.apply(remotes); err != nil {
+			log.Println("Leafnodes: error applying remotes:", err)
+		}
+	}
+}
+
+// leafSubject reports whether a point fanned up the tree can change a
+// leafnode remote: a sync node's address, credential or disabled point, or a
+// node being attached or deleted. Node points arrive as
+// up.<upID>.<nodeID>.<type>.<key> and edge points one token longer.
+func leafSubject(subject string) bool {
+	tok := strings.Split(subject, ".")
+
+	switch len(tok) {
+	case 5:
+		switch tok[3] {
+		case data.PointTypeLeafURI, data.PointTypeAuthToken,
+			data.PointTypeNkeySeed, data.PointTypeDisabled:
+			return true
+		}
+	case 6:
+		typ := tok[4]
+		return typ == data.PointTypeTombstone || typ == data.PointTypeNodeType
+	}
+
+	return false
+}
+
+// leafRemotes returns a remote for each enabled sync node with a leafURI.
+func leafRemotes(nc *nats.Conn) ([]leafRemote, error) {
+	root, err := client.GetRootNode(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := client.GetNodesType[client.Sync](nc, root.ID, "all")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []leafRemote
+	for _, n := range nodes {
+		if n.Disabled || n.LeafURI == "" {
+			continue
+		}
+		pts, err := client.GetLocalPoints(nc, n.ID)
+		if err != nil {
+			return nil, err
+		}
+		seed, _ := pts.Text(data.PointTypeNkeySeed, "")
+		ret = append(ret, leafRemote{url: n.LeafURI, token: n.AuthToken, seed: seed})
+	}
+
+	return ret, nil
+}
+
+// apply reloads the NATS server with a set of remotes. A remote is identified
+// by its address, and the server refuses to change the credential of one in
+// place, so a changed remote is first dropped and then added back.
+func (l *leafnodes) apply(remotes []leafRemote) error {
+	if reflect.DeepEqual(remotes, l.current) {
+		return nil
+	}
+
+	var keep []leafRemote
+	for _, r := range remotes {
+		for _, c := range l.current {
+			if r == c {
+				keep = append(keep, r)
+				break
+			}
+		}
+	}
+
+	if len(keep) < len(l.current) {
+		if err := l.reload(keep); err != nil {
+			return err
+		}
+		l.current = keep
+	}
+
+	if err := l.reload(remotes); err != nil {
+		return err
+	}
+	l.current = remotes
+
+	log.Printf("Leafnodes: %v remote(s) configured\n", len(remotes))
+	return nil
+}
+
+func (l *leafnodes) reload(remotes []leafRemote) error {
+	opts := l.opts.Clone()
+	opts.LeafNode.Remotes = nil
+
+	for _, r := range remotes {
+		u, err := url.Parse(r.url)
+		if err != nil {
+			return fmt.Errorf("error parsing leaf URI %v: %v", r.url, err)
+		}
+
+		ro := &server.RemoteLeafOpts{URLs: []*url.URL{u}}
+		if r.token != "" {
+			u.User = url.User(r.token)
+		} else if r.seed != "" {
+			ro.Nkey = r.seed
+		}
+
+		opts.LeafNode.Remotes = append(opts.LeafNode.Remotes, ro)
+	}
+
+	return l.ns.ReloadOptions(opts)
+}
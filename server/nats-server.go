@@ -6,17 +6,22 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/nats-io/nats-server/v2/server"
 )
 
 type natsServerOptions struct {
-	Port       int
-	HTTPPort   int
-	WSPort     int
-	MQTTPort   int
-	Auth       string
+	Port     int
+	HTTPPort int
+	WSPort   int
+	MQTTPort int
+	LeafPort int
+	Auth     string
+	// Authorizer checks every connection, on every listener. It replaces
+	// the built-in token check, so it is what enforces Auth as well.
+	Authorizer server.Authentication
 	TLSCert    string
 	TLSKey     string
 	TLSTimeout float64
@@ -30,15 +35,22 @@ type natsServerOptions struct {
 	SyncAlways   bool
 }
 
-// newNatsServer creates a new nats server instance
-func newNatsServer(o natsServerOptions) (*server.Server, error) {
+// newNatsServer creates a new nats server instance. It also returns the
+// options the server was created with, which a reload starts from.
+func newNatsServer(o natsServerOptions) (*server.Server, *server.Options, error) {
 	opts := server.Options{
-		Port:          o.Port,
-		HTTPPort:      o.HTTPPort,
-		Authorization: o.Auth,
-		NoSigs:        true,
-		JetStream:     true,
-		StoreDir:      o.StoreDir,
+		Port:      o.Port,
+		HTTPPort:  o.HTTPPort,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  o.StoreDir,
+		// every instance is its own JetStream domain, which is what lets
+		// one source another's streams over a leafnode connection
+		JetStreamDomain: natsDomain(o),
+		// a nonce in every INFO is what lets a device sign in with its
+		// NKey; custom authentication does not turn it on by itself
+		CustomClientAuthentication: o.Authorizer,
+		AlwaysEnableNonce:          true,
 	}
 
 	if o.SyncAlways {
@@ -63,7 +75,7 @@ func newNatsServer(o natsServerOptions) (*server.Server, error) {
 		opts.TLSConfig, err = server.GenTLSConfig(&tc)
 
 		if err != nil {
-			return nil, fmt.Errorf("error setting up TLS: %v", err)
+			return nil, nil, fmt.Errorf("error setting up TLS: %v", err)
 		}
 	}
 
@@ -73,7 +85,6 @@ func newNatsServer(o natsServerOptions) (*server.Server, error) {
 		// clients lose their sessions.
 		opts.ServerName = natsServerName(o)
 		opts.MQTT.Port = o.MQTTPort
-		opts.MQTT.Token = o.Auth
 		opts.MQTT.AuthTimeout = o.TLSTimeout
 
 		if opts.TLSConfig != nil {
@@ -82,9 +93,20 @@ func newNatsServer(o natsServerOptions) (*server.Server, error) {
 		}
 	}
 
+	if o.LeafPort != 0 {
+		// leafnode connections are checked by the authorizer like any
+		// other, which limits them to stream sourcing
+		opts.LeafNode.Port = o.LeafPort
+		opts.LeafNode.AuthTimeout = o.TLSTimeout
+
+		if opts.TLSConfig != nil {
+			opts.LeafNode.TLSConfig = opts.TLSConfig
+			opts.LeafNode.TLSTimeout = o.TLSTimeout
+		}
+	}
+
 	if o.WSPort != 0 {
 		opts.Websocket.Port = o.WSPort
-		opts.Websocket.Token = o.Auth
 		opts.Websocket.AuthTimeout = o.TLSTimeout
 		opts.Websocket.NoTLS = true // will likely be fronted by Caddy anyway
 		opts.Websocket.HandshakeTimeout = time.Second * 20
@@ -93,7 +115,7 @@ func newNatsServer(o natsServerOptions) (*server.Server, error) {
 	natsServer, err := server.NewServer(&opts)
 
 	if err != nil {
-		return nil, fmt.Errorf("error create new Nats server: %v", err)
+		return nil, nil, fmt.Errorf("error create new Nats server: %v", err)
 	}
 
 	authEnabled := "no"
@@ -114,7 +136,11 @@ func newNatsServer(o natsServerOptions) (*server.Server, error) {
 			o.MQTTPort, opts.ServerName)
 	}
 
-	return natsServer, nil
+	if o.LeafPort != 0 {
+		log.Printf("NATS server leafnodes enabled on port: %v\n", o.LeafPort)
+	}
+
+	return natsServer, &opts, nil
 }
 
 // natsServerName returns a name for this NATS server that stays the same
@@ -135,3 +161,14 @@ func natsServerName(o natsServerOptions) string {
 
 	return "siot-" + hex.EncodeToString(sum[:6])
 }
+
+// natsDomainInvalid matches what a JetStream domain may not contain.
+var natsDomainInvalid = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// natsDomain returns the JetStream domain of this instance, which is its server
+// name with anything a domain can't hold replaced. It only has to differ from
+// the domains of the instances it syncs with, and to stay the same across
+// restarts, since a stream sourced from here names it.
+func natsDomain(o natsServerOptions) string {
+	return natsDomainInvalid.ReplaceAllString(natsServerName(o), "-")
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// A scoped API key reaches only the nodes in its scope through the v1 node
+// routes, as it does through the others.
+func TestNodesKeyScope(t *testing.T) {
+	nc, root, stop, err := TestServer()
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+	defer stop()
+
+	nodes := []struct {
+		id, parent, typ string
+		points          data.Points
+	}{
+		{"scope-user", root.ID, data.NodeTypeUser, nil},
+		{"scope-in", root.ID, data.NodeTypeGroup, nil},
+		{"scope-out", root.ID, data.NodeTypeGroup, nil},
+		{"scope-key", "scope-user", data.NodeTypeAPIKey, data.Points{
+			data.NewPointString(data.PointTypeKeyHash, "", data.APIKeyHash("secret")),
+			data.NewPointString(data.PointTypeScope, "", "scope-in"),
+			data.NewPointString(data.PointTypeAccess, "", data.PointValueRead),
+		}},
+	}
+
+	for _, n := range nodes {
+		err := client.SendNode(nc, data.NodeEdge{ID: n.id, Parent: n.parent,
+			Type: n.typ, Points: n.points}, "")
+		if err != nil {
+			t.Fatalf("Error sending %v: %v", n.id, err)
+		}
+	}
+
+	// the node route reads the parent from the body
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, "scope-in", "all", http.StatusOK},
+		{http.MethodGet, "scope-in/audit", "", http.StatusOK},
+		{http.MethodGet, "scope-in/trash", "", http.StatusOK},
+		{http.MethodGet, "scope-out", "all", http.StatusForbidden},
+		{http.MethodGet, "scope-out/audit", "", http.StatusForbidden},
+		{http.MethodGet, "scope-out/trash", "", http.StatusForbidden},
+		{http.MethodGet, "scope-out/events", "", http.StatusForbidden},
+		{http.MethodPost, "scope-out/points", "[]", http.StatusForbidden},
+		{http.MethodPost, "scope-out/parents", "{}", http.StatusForbidden},
+		{http.MethodDelete, "scope-out", "{}", http.StatusForbidden},
+		{http.MethodPost, "gone/restore", `{"Parent":"scope-out"}`, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		u := fmt.Sprintf("http://localhost:%v/v1/nodes/%v",
+			TestServerOptions.HTTPPort, test.path)
+		req, err := http.NewRequest(test.method, u, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal("Error creating request:", err)
+		}
+		req.Close = true
+		req.Header.Set("Authorization", "Bearer "+data.FormatAPIKey("scope-key", "secret"))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Error requesting", test.path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%v %v: returned %v, expected %v", test.method, test.path,
+				resp.StatusCode, test.status)
+		}
+	}
+}
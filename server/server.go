@@ -40,7 +40,10 @@ type Options struct {
 	NatsWSPort        int
 	// NatsMQTTPort enables the built-in MQTT broker on this port. Zero, the
 	// default, leaves it off.
-	NatsMQTTPort   int
+	NatsMQTTPort int
+	// NatsLeafPort accepts leafnode connections from devices that sync
+	// over one on this port. Zero, the default, leaves it off.
+	NatsLeafPort   int
 	NatsTLSCert    string
 	NatsTLSKey     string
 	NatsTLSTimeout float64
@@ -79,6 +82,19 @@ type Options struct {
 	// StoreSyncAlways fsyncs every write, for edge devices with
 	// unreliable power, at a write-throughput cost.
 	StoreSyncAlways bool
+	// AdoptionApproval holds new devices that sync to this instance in a
+	// pending list until an admin approves or rejects them.
+	AdoptionApproval bool
+	// SyncConflictWindow is how close together two instances have to
+	// change a config point for it to be recorded as a sync conflict. 0
+	// uses the default of a minute and a negative window turns detection
+	// off.
+	SyncConflictWindow time.Duration
+	// SyncConflictKeep keeps sync conflicts until they are resolved,
+	// rather than letting them expire after a week.
+	SyncConflictKeep bool
+	// OIDC configures login through an OpenID Connect identity provider.
+	OIDC api.OIDCConfig
 }
 
 // Server represents a SIOT server process
@@ -86,6 +102,7 @@ type Server struct {
 	nc                 *nats.Conn
 	options            Options
 	natsServer         *server.Server
+	natsServerOpts     *server.Options
 	clients            *client.RunGroup
 	chNatsClientClosed chan struct{}
 	chStop             chan struct{}
@@ -179,12 +196,16 @@ func (s *Server) Run() error {
 		jsDir = "jetstream"
 	}
 
+	auth := newAuthorizer(o.AuthToken)
+
 	natsOptions := natsServerOptions{
 		Port:         o.NatsPort,
 		HTTPPort:     o.NatsHTTPPort,
 		WSPort:       o.NatsWSPort,
 		MQTTPort:     o.NatsMQTTPort,
+		LeafPort:     o.NatsLeafPort,
 		Auth:         o.AuthToken,
+		Authorizer:   auth,
 		TLSCert:      o.NatsTLSCert,
 		TLSKey:       o.NatsTLSKey,
 		TLSTimeout:   o.NatsTLSTimeout,
@@ -195,7 +216,7 @@ func (s *Server) Run() error {
 	}
 
 	if !o.NatsDisableServer {
-		s.natsServer, err = newNatsServer(natsOptions)
+		s.natsServer, s.natsServerOpts, err = newNatsServer(natsOptions)
 		if err != nil {
 			return fmt.Errorf("error setting up nats server: %v", err)
 		}
@@ -233,6 +254,9 @@ func (s *Server) Run() error {
 			MaxMsgsPerSubject: o.StoreMaxMsgsPerSubject,
 			Compression:       o.StoreCompression,
 		},
+		AdoptionApproval:   o.AdoptionApproval,
+		SyncConflictWindow: o.SyncConflictWindow,
+		SyncConflictKeep:   o.SyncConflictKeep,
 	}
 
 	siotStore, err := store.NewStore(storeParams)
@@ -326,6 +350,79 @@ func (s *Server) Run() error {
 		logLS("LS: Shutdown: version reporting")
 	})
 
+	// ====================================
+	// Device credentials
+	// ====================================
+
+	if s.natsServer != nil {
+		cancelAuth := make(chan struct{})
+		storeWg.Add(1)
+		g.Add(func() error {
+			defer storeWg.Done()
+			err := siotStore.WaitStart(siotWaitCtx)
+			if err != nil {
+				logLS("LS: Exited: device credentials timeout waiting for store")
+				return err
+			}
+
+			err = auth.start(s.natsServer, s.nc, siotStore.DeviceGrant,
+				siotStore.SessionGrant, cancelAuth)
+			logLS("LS: Exited: device credentials")
+			return err
+		}, func(_ error) {
+			close(cancelAuth)
+			logLS("LS: Shutdown: device credentials")
+		})
+	}
+
+	// ====================================
+	// Leafnode remotes
+	// ====================================
+
+	if s.natsServer != nil {
+		leaf := newLeafnodes(s.natsServer, s.natsServerOpts)
+		cancelLeaf := make(chan struct{})
+		storeWg.Add(1)
+		g.Add(func() error {
+			defer storeWg.Done()
+			err := siotStore.WaitStart(siotWaitCtx)
+			if err != nil {
+				logLS("LS: Exited: leafnodes timeout waiting for store")
+				return err
+			}
+
+			err = leaf.start(s.nc, cancelLeaf)
+			logLS("LS: Exited: leafnodes")
+			return err
+		}, func(_ error) {
+			close(cancelLeaf)
+			logLS("LS: Shutdown: leafnodes")
+		})
+	}
+
+	// ====================================
+	// Data usage
+	// ====================================
+
+	usage := newDataUsage(s.nc, s.natsServer)
+	cancelUsage := make(chan struct{})
+	storeWg.Add(1)
+	g.Add(func() error {
+		defer storeWg.Done()
+		err := siotStore.WaitStart(siotWaitCtx)
+		if err != nil {
+			logLS("LS: Exited: data usage timeout waiting for store")
+			return err
+		}
+
+		err = usage.start(cancelUsage)
+		logLS("LS: Exited: data usage")
+		return err
+	}, func(_ error) {
+		close(cancelUsage)
+		logLS("LS: Shutdown: data usage")
+	})
+
 	// ====================================
 	// Build in clients manager
 	// ====================================
@@ -455,6 +552,11 @@ func (s *Server) Run() error {
 		JwtAuth:    siotStore.GetAuthorizer(),
 		AuthToken:  o.AuthToken,
 		Nc:         s.nc,
+		OIDC:       o.OIDC,
+		CanWrite:   siotStore.CanWrite,
+		Metrics: func() []client.PromMetric {
+			return append(siotStore.PromMetrics(), client.ManagerMetrics()...)
+		},
 	})
 
 	g.Add(func() error {
@@ -20,6 +20,7 @@ var TestServerOptions = Options{
 	NatsHTTPPort: 8902,
 	NatsWSPort:   8903,
 	NatsMQTTPort: 8904,
+	NatsLeafPort: 8905,
 	NatsServer:   "nats://localhost:8900",
 	ID:           "inst1",
 }
@@ -31,10 +32,24 @@ var TestServerOptions2 = Options{
 	NatsHTTPPort: 8912,
 	NatsWSPort:   8913,
 	NatsMQTTPort: 8914,
+	NatsLeafPort: 8915,
 	NatsServer:   "nats://localhost:8910",
 	ID:           "inst2",
 }
 
+// TestServerOptions3 options used for 3rd test server, for tests that need
+// a tier between the other two
+var TestServerOptions3 = Options{
+	NatsPort:     8920,
+	HTTPPort:     "8921",
+	NatsHTTPPort: 8922,
+	NatsWSPort:   8923,
+	NatsMQTTPort: 8924,
+	NatsLeafPort: 8925,
+	NatsServer:   "nats://localhost:8920",
+	ID:           "inst3",
+}
+
 // TestServer starts a test server and returns a function to stop it
 func TestServer(args ...string) (*nats.Conn, data.NodeEdge, func(), error) {
 	opts := TestServerOptions
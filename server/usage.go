@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// usageReportPeriod is how often the data usage points are brought up to
+// date, when they changed.
+const usageReportPeriod = 10 * time.Second
+
+// usageCount is bytes sent and received.
+type usageCount struct {
+	sent, received int64
+}
+
+func (c usageCount) total() int64 {
+	return c.sent + c.received
+}
+
+// dataUsage totals the bytes this instance moves to and from its upstreams,
+// for devices that pay per byte on a cellular link. The sync clients report
+// what their connections upstream moved, and the leafnode connections
+// upstream are read from the NATS server here. The totals for the UTC day and
+// month go on the root node, which is the device's node in the upstream's
+// tree, along with how much of the data plan set there is used.
+type dataUsage struct {
+	nc *nats.Conn
+	// ns is nil when the NATS server is not embedded
+	ns *server.Server
+
+	day, month           usageCount
+	dayStart, monthStart time.Time
+
+	// leafs is what each leafnode connection had moved when it was last
+	// read, by connection ID
+	leafs map[uint64]usageCount
+
+	// reported is what the points on the root node were last set to
+	reported data.Points
+}
+
+func newDataUsage(nc *nats.Conn, ns *server.Server) *dataUsage {
+	return &dataUsage{nc: nc, ns: ns, leafs: make(map[uint64]usageCount)}
+}
+
+// start totals the reported usage until stop is closed.
+func (u *dataUsage) start(stop <-chan struct{}) error {
+	root, err := client.GetRootNode(u.nc)
+	if err != nil {
+		return fmt.Errorf("error getting root node: %v", err)
+	}
+	u.restore(root.Points, time.Now())
+
+	added := make(chan usageCount, 100)
+	sub, err := u.nc.Subscribe(client.SubjectDataUsage, func(msg *nats.Msg) {
+		pts, err := data.DecodePoints(msg.Data)
+		if err != nil {
+			log.Println("Data usage: error decoding report:", err)
+			return
+		}
+		var c usageCount
+		for _, p := range pts {
+			switch p.Key {
+			case data.PointKeySent:
+				c.sent += int64(p.Val())
+			case data.PointKeyReceived:
+				c.received += int64(p.Val())
+			}
+		}
+		added <- c
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to data usage: %v", err)
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	t := time.NewTicker(usageReportPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case c := <-added:
+			u.add(c, time.Now())
+		case now := <-t.C:
+			u.add(u.readLeafs(), now)
+			u.report(root.ID, now)
+		}
+	}
+}
+
+// restore picks up the usage so far this day and month from the root node,
+// so a restart does not start the counts again.
+func (u *dataUsage) restore(points data.Points, now time.Time) {
+	u.roll(now)
+
+	for _, p := range points {
+		var c *usageCount
+		switch {
+		case p.Type == data.PointTypeDataUsageDay && !p.Time.Before(u.dayStart):
+			c = &u.day
+		case p.Type == data.PointTypeDataUsageMonth && !p.Time.Before(u.monthStart):
+			c = &u.month
+		default:
+			continue
+		}
+		switch p.Key {
+		case data.PointKeySent:
+			c.sent = int64(p.Val())
+		case data.PointKeyReceived:
+			c.received = int64(p.Val())
+		}
+	}
+
+	u.reported = points
+}
+
+// roll starts a new day or month when the UTC date moves on.
+func (u *dataUsage) roll(now time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if day.After(u.dayStart) {
+		u.dayStart = day
+		u.day = usageCount{}
+	}
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month.After(u.monthStart) {
+		u.monthStart = month
+		u.month = usageCount{}
+	}
+}
+
+func (u *dataUsage) add(c usageCount, now time.Time) {
+	u.roll(now)
+	u.day.sent += c.sent
+	u.day.received += c.received
+	u.month.sent += c.sent
+	u.month.received += c.received
+}
+
+// readLeafs returns what the leafnode connections this instance made
+// upstream moved since they were last read. A hub connection, from a device
+// to this instance, is the device's usage and not ours.
+func (u *dataUsage) readLeafs() usageCount {
+	var ret usageCount
+	if u.ns == nil {
+		return ret
+	}
+
+	leafz, err := u.ns.Leafz(&server.LeafzOptions{})
+	if err != nil {
+		log.Println("Data usage: error reading leafnode connections:", err)
+		return ret
+	}
+
+	seen := make(map[uint64]usageCount, len(leafz.Leafs))
+	for _, l := range leafz.Leafs {
+		if !l.IsSpoke {
+			continue
+		}
+		cur := usageCount{sent: l.OutBytes, received: l.InBytes}
+		last := u.leafs[l.ID]
+		ret.sent += cur.sent - last.sent
+		ret.received += cur.received - last.received
+		seen[l.ID] = cur
+	}
+	// a connection that closed since it was last read is dropped; what it
+	// moved after that read is not seen
+	u.leafs = seen
+
+	return ret
+}
+
+// report sets the usage points on the root node that changed, and works
+// out how much of the data plan is used.
+func (u *dataUsage) report(rootID string, now time.Time) {
+	u.roll(now)
+
+	nodes, err := client.GetNodes(u.nc, "root", rootID, "", false)
+	if err != nil || len(nodes) < 1 {
+		log.Println("Data usage: error getting root node:", err)
+		return
+	}
+	rootPoints := nodes[0].Points
+
+	pts := data.Points{
+		data.NewPointFloat(data.PointTypeDataUsageDay, data.PointKeySent, float64(u.day.sent)),
+		data.NewPointFloat(data.PointTypeDataUsageDay, data.PointKeyReceived, float64(u.day.received)),
+		data.NewPointFloat(data.PointTypeDataUsageDay, data.PointKeyTotal, float64(u.day.total())),
+		data.NewPointFloat(data.PointTypeDataUsageMonth, data.PointKeySent, float64(u.month.sent)),
+		data.NewPointFloat(data.PointTypeDataUsageMonth, data.PointKeyReceived, float64(u.month.received)),
+		data.NewPointFloat(data.PointTypeDataUsageMonth, data.PointKeyTotal, float64(u.month.total())),
+	}
+
+	plan, _ := rootPoints.Find(data.PointTypeDataPlan, "")
+	if plan.Val() > 0 {
+		used := float64(u.month.total()) / plan.Val() * 100
+		pts = append(pts, data.NewPointFloat(data.PointTypeDataPlanUsed, "", used))
+
+		threshold, ok := rootPoints.Find(data.PointTypeDataPlanThreshold, "")
+		over := ok && threshold.Val() > 0 && used >= threshold.Val()
+		pts = append(pts, data.NewPointFloat(data.PointTypeDataPlanOver, "",
+			data.BoolToFloat(over)))
+	}
+
+	var send data.Points
+	for _, p := range pts {
+		// an instance that never synced gets no usage points
+		last, ok := u.reported.Find(p.Type, p.Key)
+		if (!ok && p.Val() != 0) || (ok && last.Val() != p.Val()) {
+			send = append(send, p)
+		}
+	}
+	if len(send) == 0 {
+		return
+	}
+
+	err = client.SendNodePoints(u.nc, rootID, send, false)
+	if err != nil {
+		log.Println("Data usage: error sending points:", err)
+		return
+	}
+
+	u.reported = pts
+}
@@ -0,0 +1,377 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Devices that asked to join the tree and wait for approval, or were
+// rejected, are kept in a KV bucket of their own, keyed by device ID. They
+// are not in the tree until an admin approves them, and the bucket is not
+// synced.
+const adoptionBucket = "ADOPTION"
+
+// adoptions caches the ADOPTION bucket, which the store is the only writer
+// of. It is read on every edge write and replica scan.
+type adoptions struct {
+	lock    sync.Mutex
+	kv      jetstream.KeyValue
+	devices map[string]data.Adoption
+}
+
+// adoptionLoad opens the ADOPTION bucket and reads it, the first time it is
+// needed. The lock must be held.
+func (db *DbJetStream) adoptionLoad() (*adoptions, error) {
+	a := &db.adoptions
+	if a.kv != nil {
+		return a, nil
+	}
+
+	ctx := context.Background()
+	kv, err := db.js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      adoptionBucket,
+		Description: "devices waiting for adoption approval or rejected",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v KV bucket: %v", adoptionBucket, err)
+	}
+
+	devices := make(map[string]data.Adoption)
+	lister, err := kv.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for key := range lister.Keys() {
+		entry, err := kv.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		var ad data.Adoption
+		if err := json.Unmarshal(entry.Value(), &ad); err != nil {
+			log.Printf("STORE: error decoding adoption of %v: %v", key, err)
+			continue
+		}
+		devices[key] = ad
+	}
+
+	a.kv = kv
+	a.devices = devices
+	return a, nil
+}
+
+// adoptionState returns the state of a device that is waiting for approval or
+// was rejected, and "" for any other node.
+func (db *DbJetStream) adoptionState(id string) string {
+	db.adoptions.lock.Lock()
+	defer db.adoptions.lock.Unlock()
+
+	a, err := db.adoptionLoad()
+	if err != nil {
+		log.Println("STORE:", err)
+		return ""
+	}
+	return a.devices[id].State
+}
+
+// put records a device waiting for approval or rejected. The lock must be
+// held.
+func (a *adoptions) put(ad data.Adoption) error {
+	v, err := json.Marshal(ad)
+	if err != nil {
+		return err
+	}
+	_, err = a.kv.Put(context.Background(), ad.DeviceID, v)
+	if err != nil {
+		return fmt.Errorf("error saving adoption of %v: %v", ad.DeviceID, err)
+	}
+	a.devices[ad.DeviceID] = ad
+	return nil
+}
+
+// inTree reports whether a node has an edge in the tree, deleted or not.
+func (db *DbJetStream) inTree(id string) bool {
+	return len(db.edgeCache.Parents(id)) > 0
+}
+
+// requestAdoption handles a device asking to join the tree. Without approval
+// a new device is attached to the root at once, as it always was; with it, it
+// waits in the ADOPTION bucket until an admin decides. A device already in the
+// tree, attached or deleted, is approved, since it was decided on before. A
+// device that names an organization in an org point joins that organization:
+// it is attached to it, or waits for one of its admins. A waiting device is
+// held to the credential in the pubKey point of its first request, which its
+// fingerprint is taken from.
+func (st *Store) requestAdoption(id string, points data.Points) (string, error) {
+	db := st.db
+
+	if db.inTree(id) {
+		return data.AdoptionApproved, nil
+	}
+
+	org, pubKey := "", ""
+	for _, p := range points {
+		switch {
+		case p.Type == data.PointTypeOrg && p.Txt() != "":
+			var ok bool
+			org, ok = db.orgByName(p.Txt())
+			if !ok {
+				return "", fmt.Errorf("no organization is named %v", p.Txt())
+			}
+		case p.Type == data.PointTypePubKey && p.Txt() != "":
+			pubKey = p.Txt()
+			if !nkeys.IsValidPublicUserKey(pubKey) {
+				return "", fmt.Errorf("%v is not a device credential", pubKey)
+			}
+		}
+	}
+
+	if !st.params.AdoptionApproval {
+		parent := db.rootNodeID()
+		if org != "" {
+			parent = org
+		}
+		err := client.SendEdgePoints(st.nc, id, parent, data.Points{
+			data.NewPointFloat(data.PointTypeTombstone, "", 0),
+			data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
+		}, true)
+		if err != nil {
+			return "", fmt.Errorf("error adding device %v: %v", id, err)
+		}
+		return data.AdoptionApproved, nil
+	}
+
+	db.adoptions.lock.Lock()
+	defer db.adoptions.lock.Unlock()
+
+	a, err := db.adoptionLoad()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	ad, ok := a.devices[id]
+	if !ok {
+		ad = data.Adoption{
+			DeviceID:  id,
+			State:     data.AdoptionPending,
+			FirstSeen: now,
+		}
+	}
+
+	switch {
+	case ad.PubKey == "" && pubKey != "":
+		// the first request, or one from before devices sent their
+		// credential
+		ad.PubKey = pubKey
+		ad.Fingerprint = data.AdoptionFingerprint(pubKey)
+	case ad.PubKey != pubKey:
+		return "", fmt.Errorf("device %v asked with credential %v before, not %v",
+			id, ad.PubKey, pubKey)
+	}
+
+	if !ok {
+		log.Printf("STORE: device %v (%v) is waiting for adoption approval",
+			id, ad.Fingerprint)
+	}
+
+	if ad.State == data.AdoptionPending {
+		ad.Org = org
+		for _, p := range points {
+			switch p.Type {
+			case data.PointTypeDescription:
+				ad.Description = p.Txt()
+			case data.PointTypeVersionApp:
+				ad.VersionApp = p.Txt()
+			case data.PointTypeVersionOS:
+				ad.VersionOS = p.Txt()
+			case data.PointTypeVersionHW:
+				ad.VersionHW = p.Txt()
+			}
+		}
+	}
+	ad.LastSeen = now
+
+	err = a.put(ad)
+	if err != nil {
+		return "", err
+	}
+
+	return ad.State, nil
+}
+
+// approveAdoption takes a device that is waiting or was rejected into the tree
+// below parent, which must be in the organization the device asked to join, or
+// outside every organization if it named none.
+func (st *Store) approveAdoption(id, parent string) error {
+	db := st.db
+
+	if parent != db.rootNodeID() {
+		attached := false
+		for _, e := range db.edgeCache.Parents(parent) {
+			if !e.IsTombstone() {
+				attached = true
+			}
+		}
+		if !attached {
+			return fmt.Errorf("parent %v is not in the tree", parent)
+		}
+	}
+
+	db.adoptions.lock.Lock()
+	a, err := db.adoptionLoad()
+	if err == nil {
+		ad, ok := a.devices[id]
+		switch {
+		case !ok:
+			err = fmt.Errorf("device %v is not waiting for adoption", id)
+		case db.orgOf(parent) != ad.Org:
+			err = fmt.Errorf("device %v asked to join %v, not %v", id,
+				orgLabel(ad.Org), orgLabel(db.orgOf(parent)))
+		}
+	}
+	if err == nil {
+		err = a.kv.Delete(context.Background(), id)
+	}
+	if err == nil {
+		delete(a.devices, id)
+	}
+	db.adoptions.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("STORE: device %v approved into %v", id, parent)
+
+	return client.SendEdgePoints(st.nc, id, parent, data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", 0),
+		data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
+	}, true)
+}
+
+// rejectAdoption turns a waiting device away. A device in the tree is deleted
+// instead, like any other node. When org is set, only a device that asked to
+// join that organization is.
+func (db *DbJetStream) rejectAdoption(id, org string) error {
+	db.adoptions.lock.Lock()
+	defer db.adoptions.lock.Unlock()
+
+	a, err := db.adoptionLoad()
+	if err != nil {
+		return err
+	}
+
+	ad, ok := a.devices[id]
+	if !ok || (org != "" && ad.Org != org) {
+		return fmt.Errorf("device %v is not waiting for adoption", id)
+	}
+
+	ad.State = data.AdoptionRejected
+	log.Printf("STORE: device %v rejected", id)
+	return a.put(ad)
+}
+
+// listAdoptions returns the devices waiting for approval and those rejected,
+// the ones waiting first, oldest first. When org is set, only the devices that
+// asked to join that organization are.
+func (db *DbJetStream) listAdoptions(org string) ([]data.Adoption, error) {
+	db.adoptions.lock.Lock()
+	defer db.adoptions.lock.Unlock()
+
+	a, err := db.adoptionLoad()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]data.Adoption, 0, len(a.devices))
+	for _, ad := range a.devices {
+		if org != "" && ad.Org != org {
+			continue
+		}
+		ret = append(ret, ad)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].State != ret[j].State {
+			return ret[i].State == data.AdoptionPending
+		}
+		return ret[i].FirstSeen.Before(ret[j].FirstSeen)
+	})
+
+	return ret, nil
+}
+
+// checkAdoption refuses a local edge write for a device that is waiting for
+// approval or was rejected: it joins the tree through approveAdoption only.
+func (db *DbJetStream) checkAdoption(id string) error {
+	switch db.adoptionState(id) {
+	case data.AdoptionPending:
+		return fmt.Errorf("device %v is waiting for adoption approval", id)
+	case data.AdoptionRejected:
+		return fmt.Errorf("device %v was rejected", id)
+	}
+	return nil
+}
+
+// handleAdoption serves adoption.request.<deviceId>, from a device asking to
+// join the tree, and adoption.list, adoption.approve.<deviceId>.<parentId> and
+// adoption.reject.<deviceId>, which an admin decides with. An organization's
+// admins use adoption.list.<orgId> and adoption.reject.<deviceId>.<orgId>,
+// which only see the devices that asked to join it.
+func (st *Store) handleAdoption(msg *nats.Msg) {
+	var resp data.AdoptionResponse
+	var err error
+
+	chunks := strings.Split(msg.Subject, ".")
+	switch {
+	case len(chunks) == 3 && chunks[1] == "request":
+		var pts data.Points
+		pts, err = data.DecodePoints(msg.Data)
+		if err == nil {
+			resp.State, err = st.requestAdoption(chunks[2], pts)
+		}
+	case len(chunks) == 2 && chunks[1] == "list":
+		resp.Devices, err = st.db.listAdoptions("")
+	case len(chunks) == 3 && chunks[1] == "list":
+		resp.Devices, err = st.db.listAdoptions(chunks[2])
+	case len(chunks) == 4 && chunks[1] == "approve":
+		err = st.approveAdoption(chunks[2], chunks[3])
+		resp.State = data.AdoptionApproved
+	case len(chunks) == 3 && chunks[1] == "reject":
+		err = st.db.rejectAdoption(chunks[2], "")
+		resp.State = data.AdoptionRejected
+	case len(chunks) == 4 && chunks[1] == "reject":
+		err = st.db.rejectAdoption(chunks[2], chunks[3])
+		resp.State = data.AdoptionRejected
+	default:
+		err = errors.New("error in message subject: " + msg.Subject)
+	}
+
+	if err != nil {
+		resp = data.AdoptionResponse{Error: err.Error()}
+	}
+
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to adoption request:", err)
+	}
+}
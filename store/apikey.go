@@ -0,0 +1,174 @@
+package store
+
+import (
+	"crypto/subtle"
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// apiKeyUsedPeriod is how often the lastUsed point of a key in use is
+// brought up to date. A key is checked on every API request and every minute
+// while it holds a NATS connection, so it is not written each time.
+const apiKeyUsedPeriod = time.Hour
+
+// apiKey is what an apiKey node holds. Like a device's credential, only the
+// points this instance wrote count, so a key cannot be made or widened
+// through a device's stream, while a revocation counts from anywhere.
+type apiKey struct {
+	hash    string
+	expires time.Time
+	scope   string
+	write   bool
+	revoked bool
+}
+
+// usable reports whether the key may be used at now.
+func (k apiKey) usable(now time.Time) bool {
+	return !k.revoked && (k.expires.IsZero() || now.Before(k.expires))
+}
+
+func (db *DbJetStream) apiKey(id string) (apiKey, bool) {
+	if !db.isAPIKey(id) {
+		return apiKey{}, false
+	}
+
+	self := db.meta.RootID
+	var k apiKey
+
+	db.pointMu.RLock()
+	defer db.pointMu.RUnlock()
+
+	for _, p := range db.pointCache[id] {
+		local := db.pointOrigin[id][p.Type+"|"+p.Key] == self
+		live := p.Tombstone%2 == 0
+		switch p.Type {
+		case data.PointTypeKeyHash:
+			if local && live {
+				k.hash = p.Txt()
+			}
+		case data.PointTypeExpires:
+			if local && live && p.Val() > 0 {
+				k.expires = time.Unix(int64(p.Val()), 0)
+			}
+		case data.PointTypeScope:
+			if local && live {
+				k.scope = p.Txt()
+			}
+		case data.PointTypeAccess:
+			if local && live {
+				k.write = p.Txt() == data.PointValueWrite
+			}
+		case data.PointTypeRevoked:
+			if !local || (live && p.Val() != 0) {
+				k.revoked = true
+			}
+		}
+	}
+
+	return k, true
+}
+
+// isAPIKey reports whether a node is a live apiKey node.
+func (db *DbJetStream) isAPIKey(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, e := range db.edgeCache.Parents(id) {
+		if !e.IsTombstone() && e.Type == data.NodeTypeAPIKey {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyValid returns the ID of the apiKey node of a key, if the key is one
+// this instance accepts: its node is live, not revoked or expired, and holds
+// the hash of the key's secret.
+func (db *DbJetStream) apiKeyValid(key string, now time.Time) (string, bool) {
+	id, secret, ok := data.ParseAPIKey(key)
+	if !ok {
+		return "", false
+	}
+
+	k, ok := db.apiKey(id)
+	if !ok || k.hash == "" || !k.usable(now) {
+		return "", false
+	}
+
+	hash := data.APIKeyHash(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(k.hash)) != 1 {
+		return "", false
+	}
+
+	return id, true
+}
+
+// apiKeyRole returns the role an API key holds over a node: its owner's, the
+// user or group it is under, within the key's scope, and no more than a
+// viewer unless the key may write. A key under a group is placed like a user
+// in the group.
+func (db *DbJetStream) apiKeyRole(keyID, nodeID string) Role {
+	k, ok := db.apiKey(keyID)
+	if !ok || !k.usable(time.Now()) {
+		return RoleNone
+	}
+	if k.scope != "" && !db.inSubtree(k.scope, nodeID) {
+		return RoleNone
+	}
+
+	var ret Role
+	for _, e := range db.edgeCache.Parents(keyID) {
+		if e.IsTombstone() {
+			continue
+		}
+		var r Role
+		if db.isUser(e.Up) {
+			r = db.userRole(e.Up, nodeID)
+		} else if db.inSubtree(e.Up, nodeID) {
+			r = db.placeRole(e)
+		}
+		if r > ret {
+			ret = r
+		}
+	}
+
+	if !k.write && ret > RoleViewer {
+		ret = RoleViewer
+	}
+
+	return ret
+}
+
+// validAPIKey checks an API key for the authorizer, and records that the key
+// was used.
+func (st *Store) validAPIKey(key string) (bool, string) {
+	now := time.Now()
+
+	id, ok := st.db.apiKeyValid(key, now)
+	if !ok {
+		return false, ""
+	}
+
+	st.keyUsedMu.Lock()
+	due := now.Sub(st.keyUsed[id]) >= apiKeyUsedPeriod
+	if due {
+		st.keyUsed[id] = now
+	}
+	st.keyUsedMu.Unlock()
+
+	if due {
+		// written in the background, since the NATS server waits on
+		// the check to let the connection in
+		go func() {
+			err := st.db.nodePoints(id, data.Points{
+				data.NewPointFloat(data.PointTypeLastUsed, "", float64(now.Unix()))})
+			if err != nil {
+				log.Printf("STORE: error recording use of API key %v: %v\n", id, err)
+			}
+		}()
+	}
+
+	return true, id
+}
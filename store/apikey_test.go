@@ -0,0 +1,140 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func mkTestAPIKey(t *testing.T, db *DbJetStream, owner, id, secret, scope, access string) {
+	t.Helper()
+	mkTestNode(t, db, owner, id, data.NodeTypeAPIKey, "")
+	err := db.nodePoints(id, data.Points{
+		data.NewPointString(data.PointTypeKeyHash, "", data.APIKeyHash(secret)),
+		data.NewPointString(data.PointTypeScope, "", scope),
+		data.NewPointString(data.PointTypeAccess, "", access),
+	})
+	if err != nil {
+		t.Fatalf("Error writing %v points: %v", id, err)
+	}
+}
+
+func TestAPIKeyValid(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	mkTestNode(t, db, rootID, "user", data.NodeTypeUser, "")
+	mkTestAPIKey(t, db, "user", "key", "secret", "", data.PointValueRead)
+
+	now := time.Now()
+
+	if id, ok := db.apiKeyValid(data.FormatAPIKey("key", "secret"), now); !ok || id != "key" {
+		t.Fatal("valid key refused")
+	}
+	if _, ok := db.apiKeyValid(data.FormatAPIKey("key", "wrong"), now); ok {
+		t.Fatal("key with the wrong secret accepted")
+	}
+	if _, ok := db.apiKeyValid(data.FormatAPIKey("user", "secret"), now); ok {
+		t.Fatal("a node that is not a key accepted")
+	}
+
+	err := db.nodePoints("key", data.Points{
+		data.NewPointFloat(data.PointTypeExpires, "", float64(now.Add(time.Hour).Unix()))})
+	if err != nil {
+		t.Fatal("Error setting expiry:", err)
+	}
+	if _, ok := db.apiKeyValid(data.FormatAPIKey("key", "secret"), now); !ok {
+		t.Fatal("key refused before it expired")
+	}
+	if _, ok := db.apiKeyValid(data.FormatAPIKey("key", "secret"), now.Add(2*time.Hour)); ok {
+		t.Fatal("expired key accepted")
+	}
+
+	err = db.nodePoints("key", data.Points{data.NewPointFloat(data.PointTypeRevoked, "", 1)})
+	if err != nil {
+		t.Fatal("Error revoking key:", err)
+	}
+	if _, ok := db.apiKeyValid(data.FormatAPIKey("key", "secret"), now); ok {
+		t.Fatal("revoked key accepted")
+	}
+}
+
+func TestAPIKeyRole(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	// root
+	//   site (group)
+	//     admin (user, admin)
+	//       read (key, read)
+	//       write (key, write, scope area)
+	//     area (group)
+	//       pump (device)
+	//     ops (group, operators)
+	//       opsKey (key, write)
+	//     tank (device)
+	mkTestNode(t, db, rootID, "site", data.NodeTypeGroup, "site")
+	mkTestNode(t, db, "site", "admin", data.NodeTypeUser, "")
+	mkTestNode(t, db, "site", "area", data.NodeTypeGroup, "area")
+	mkTestNode(t, db, "area", "pump", data.NodeTypeDevice, "pump")
+	mkTestNode(t, db, "site", "ops", data.NodeTypeGroup, "ops")
+	mkTestNode(t, db, "site", "tank", data.NodeTypeDevice, "tank")
+	setTestRole(t, db, "admin", "site", data.PointValueRoleAdmin)
+	setTestRole(t, db, "ops", "site", data.PointValueRoleOperator)
+	mkTestAPIKey(t, db, "admin", "read", "s", "", data.PointValueRead)
+	mkTestAPIKey(t, db, "admin", "write", "s", "area", data.PointValueWrite)
+	mkTestAPIKey(t, db, "ops", "opsKey", "s", "", data.PointValueWrite)
+
+	tests := []struct {
+		key, node string
+		role      Role
+	}{
+		{"read", "tank", RoleViewer},
+		{"write", "pump", RoleAdmin},
+		{"write", "tank", RoleNone},
+		{"opsKey", "ops", RoleOperator},
+		{"opsKey", "tank", RoleNone},
+	}
+
+	for _, test := range tests {
+		if got := db.principalRole(test.key, test.node); got != test.role {
+			t.Errorf("role of %v over %v: got %v, expected %v", test.key,
+				test.node, got, test.role)
+		}
+	}
+
+	point := func(typ, origin string) data.Points {
+		p := data.NewPointFloat(typ, "", 1)
+		p.Origin = origin
+		return data.Points{p}
+	}
+
+	if _, err := db.authorizePoints("", "tank", point(data.PointTypeValueSet, "read")); err == nil {
+		t.Error("a read key wrote a point")
+	}
+	if _, err := db.authorizePoints("", "pump", point(data.PointTypeDisabled, "write")); err != nil {
+		t.Error("a write key could not write in its scope:", err)
+	}
+	if _, err := db.authorizePoints("", "write", point(data.PointTypeExpires, "write")); err == nil {
+		t.Error("a key changed its own node")
+	}
+
+	g, ok := db.sessionGrant("write")
+	if !ok {
+		t.Fatal("no grant for a key")
+	}
+	if !slices.Equal(g.Read, []string{"area", "pump"}) ||
+		!slices.Equal(g.Admin, []string{"area", "pump"}) {
+		t.Errorf("key grant not limited to its scope: %+v", g)
+	}
+
+	g, ok = db.sessionGrant("read")
+	if !ok || len(g.Write) != 0 || !slices.Contains(g.Read, "tank") {
+		t.Errorf("read key grant wrong: %+v", g)
+	}
+}
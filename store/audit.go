@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// This file builds the audit trail. The HTTP API records the authenticated
+// user as the origin of every point it writes, and the origin is kept with
+// the point in the stream, so the changes users made can be read back out
+// of the point history along with the value each one replaced.
+
+// auditWrite is one write of one point, as read from a stream.
+type auditWrite struct {
+	nodeID   string
+	parentID string
+	point    data.Point
+}
+
+// audit returns the changes users made to a node, and optionally to
+// everything below it, between start and end, oldest first. A zero start or
+// end leaves that side open. When limit is above zero, only the newest limit
+// changes are returned.
+func (db *DbJetStream) audit(nodeID string, subtree bool, start, end time.Time, limit int) ([]data.AuditEntry, error) {
+	nodes := map[string]bool{nodeID: true}
+	if subtree {
+		db.auditDescendants(nodeID, nodes)
+	}
+
+	users := make(map[string]string)
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeUser) {
+		db.pointMu.RLock()
+		p, _ := db.pointCache[e.Down].Find(data.PointTypeEmail, "")
+		db.pointMu.RUnlock()
+		users[e.Down] = p.Txt()
+	}
+
+	// every write to each point, so the value a change replaced can be
+	// found whoever wrote it
+	writes := make(map[string][]auditWrite)
+
+	ctx := context.Background()
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		if _, _, ok := streamBoundaryOrigin(si.Config); !ok {
+			continue
+		}
+
+		s, err := db.js.Stream(ctx, si.Config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting stream %v: %v", si.Config.Name, err)
+		}
+
+		err = scanStream(ctx, s, "", func(subject string, payload []byte) {
+			auditMsg(writes, nodes, subject, payload)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading history of %v: %v", si.Config.Name, err)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, err
+	}
+
+	var ret []data.AuditEntry
+
+	for _, ws := range writes {
+		sort.SliceStable(ws, func(i, j int) bool {
+			return ws[i].point.Time.Before(ws[j].point.Time)
+		})
+
+		var prev *data.Point
+		for i := range ws {
+			p := ws[i].point
+			if prev != nil && auditSameWrite(*prev, p) {
+				// the copy a boundary migration leaves in the new
+				// boundary's stream
+				continue
+			}
+
+			email, isUser := users[p.Origin]
+			inRange := (start.IsZero() || !p.Time.Before(start)) &&
+				(end.IsZero() || !p.Time.After(end))
+
+			if isUser && inRange {
+				ret = append(ret, data.AuditEntry{
+					Time:     p.Time,
+					UserID:   p.Origin,
+					User:     email,
+					NodeID:   ws[i].nodeID,
+					ParentID: ws[i].parentID,
+					Old:      prev,
+					New:      p,
+				})
+			}
+
+			prev = &ws[i].point
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if !ret[i].Time.Equal(ret[j].Time) {
+			return ret[i].Time.Before(ret[j].Time)
+		}
+		return ret[i].NodeID < ret[j].NodeID
+	})
+
+	if limit > 0 && len(ret) > limit {
+		ret = ret[len(ret)-limit:]
+	}
+
+	return ret, nil
+}
+
+// auditDescendants adds every node below id to nodes, including deleted
+// ones, as deleting a node is itself a change worth auditing.
+func (db *DbJetStream) auditDescendants(id string, nodes map[string]bool) {
+	for _, e := range db.edgeCache.Children(id) {
+		if nodes[e.Down] {
+			continue
+		}
+		nodes[e.Down] = true
+		db.auditDescendants(e.Down, nodes)
+	}
+}
+
+// auditMsg adds the points in one stream message to writes when they belong
+// to one of the audited nodes. Edge points are audited with the child node.
+func auditMsg(writes map[string][]auditWrite, nodes map[string]bool, subject string, payload []byte) {
+	tok := strings.Split(subject, ".")
+
+	var nodeID, parentID string
+	switch {
+	case len(tok) == 7 && tok[4] == "p":
+		nodeID = tok[3]
+	case len(tok) == 6 && tok[4] == "ep":
+		parentID, nodeID = tok[3], tok[5]
+	default:
+		return
+	}
+
+	if !nodes[nodeID] {
+		return
+	}
+
+	pts, err := data.DecodePoints(payload)
+	if err != nil {
+		return
+	}
+
+	for _, p := range pts {
+		if parentID == "" {
+			if p.Type == "" {
+				p.Type = tok[5]
+			}
+			if p.Key == "" {
+				p.Key = tok[6]
+			}
+		}
+		if p.Key == "" {
+			p.Key = "0"
+		}
+		if p.Type == data.PointTypePass {
+			// the audit shows that a password changed, never what to
+			p.PutString("********")
+		}
+
+		k := nodeID + "|" + parentID + "|" + p.Type + "|" + p.Key
+		writes[k] = append(writes[k], auditWrite{nodeID: nodeID, parentID: parentID, point: p})
+	}
+}
+
+// auditSameWrite reports whether two points are copies of the same write.
+func auditSameWrite(a, b data.Point) bool {
+	return a.Time.Equal(b.Time) && a.Origin == b.Origin &&
+		a.DataType == b.DataType && string(a.Data) == string(b.Data) &&
+		a.Tombstone == b.Tombstone
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestAudit(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	user := uuid.New().String()
+	dev := uuid.New().String()
+	sensor := uuid.New().String()
+
+	mkTestNode(t, db, rootID, user, data.NodeTypeUser, "")
+	mkTestNode(t, db, rootID, dev, data.NodeTypeDevice, "device")
+	mkTestNode(t, db, dev, sensor, data.NodeTypeVariable, "sensor")
+
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	byUser := func(p data.Point, s int) data.Points {
+		p.Origin = user
+		p.Time = at(s)
+		return data.Points{p}
+	}
+
+	write := func(id string, pts data.Points) {
+		t.Helper()
+		if err := db.nodePoints(id, pts); err != nil {
+			t.Fatal("Error writing points:", err)
+		}
+	}
+
+	write(user, data.Points{data.NewPointString(data.PointTypeEmail, "", "admin@example.com")})
+	write(dev, byUser(data.NewPointString(data.PointTypeDescription, "", "pump A"), 1))
+	write(dev, byUser(data.NewPointString(data.PointTypeDescription, "", "pump B"), 2))
+	// a point a client wrote is not a user change
+	write(dev, data.Points{data.Point{Type: data.PointTypeValue, Time: at(3)}})
+	write(sensor, byUser(data.NewPointString(data.PointTypeDescription, "", "flow"), 4))
+	write(user, byUser(data.NewPointString(data.PointTypePass, "", "secret"), 5))
+
+	err := db.edgePoints(sensor, dev, byUser(data.NewPointFloat(data.PointTypeTombstone, "", 1), 6))
+	if err != nil {
+		t.Fatal("Error deleting sensor:", err)
+	}
+
+	audit := func(id string, subtree bool, start time.Time, limit int) []data.AuditEntry {
+		t.Helper()
+		entries, err := db.audit(id, subtree, start, time.Time{}, limit)
+		if err != nil {
+			t.Fatal("Error reading audit:", err)
+		}
+		return entries
+	}
+
+	entries := audit(dev, false, time.Time{}, 0)
+	if len(entries) != 2 {
+		t.Fatal("expected 2 changes to device, got:", entries)
+	}
+	e := entries[0]
+	if e.UserID != user || e.User != "admin@example.com" {
+		t.Fatal("change not attributed to user:", e)
+	}
+	if e.Old == nil || e.Old.Txt() != "device" || e.New.Txt() != "pump A" {
+		t.Fatal("wrong old/new values:", e)
+	}
+	if entries[1].Old == nil || entries[1].Old.Txt() != "pump A" {
+		t.Fatal("second change has wrong old value:", entries[1])
+	}
+
+	entries = audit(dev, true, time.Time{}, 0)
+	if len(entries) != 4 {
+		t.Fatal("expected 4 changes in subtree, got:", entries)
+	}
+	last := entries[3]
+	if last.NodeID != sensor || last.ParentID != dev ||
+		last.New.Type != data.PointTypeTombstone || last.New.Val() != 1 {
+		t.Fatal("sensor delete not audited:", last)
+	}
+
+	entries = audit(dev, true, time.Time{}, 1)
+	if len(entries) != 1 || entries[0].New.Type != data.PointTypeTombstone {
+		t.Fatal("limit did not keep the newest change:", entries)
+	}
+
+	entries = audit(dev, true, at(3), 0)
+	if len(entries) != 2 || entries[0].NodeID != sensor {
+		t.Fatal("start did not limit changes:", entries)
+	}
+
+	entries = audit(user, false, time.Time{}, 0)
+	if len(entries) != 1 || entries[0].New.Txt() == "secret" {
+		t.Fatal("password change not redacted:", entries)
+	}
+}
@@ -0,0 +1,388 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// When two instances change the same config point at nearly the same time,
+// the tip rule keeps the newer write everywhere and the other one is lost.
+// The store notices this as the other instance's write comes in through its
+// replica stream, and records a conflict with both values in a KV bucket of
+// its own. The bucket is not synced: each instance records the conflicts it
+// sees.
+const conflictBucket = "SYNC_CONFLICTS"
+
+// DefaultSyncConflictWindow is how close together two writes of a point from
+// different instances have to be to count as a conflict.
+const DefaultSyncConflictWindow = time.Minute
+
+// conflictRetention is how long a conflict is kept before it expires, unless
+// conflicts are kept until they are resolved.
+const conflictRetention = 7 * 24 * time.Hour
+
+// conflicts holds the conflict settings and the SYNC_CONFLICTS bucket.
+type conflicts struct {
+	window time.Duration
+	keep   bool
+
+	lock sync.Mutex
+	kv   jetstream.KeyValue
+	// loaded is the last sequence of each stream when the caches were
+	// loaded from it at startup. The replica consumers deliver those
+	// messages again, and what was merged before does not count as a
+	// new conflict.
+	loaded map[string]uint64
+}
+
+// conflictWindow resolves the configured conflict window: 0 uses the
+// default and a negative window turns detection off.
+func conflictWindow(window time.Duration) time.Duration {
+	switch {
+	case window == 0:
+		return DefaultSyncConflictWindow
+	case window < 0:
+		return 0
+	}
+	return window
+}
+
+// conflictLoaded records how far the caches were loaded from a stream.
+func (db *DbJetStream) conflictLoaded(name string, seq uint64) {
+	db.conflicts.lock.Lock()
+	defer db.conflicts.lock.Unlock()
+
+	if db.conflicts.loaded == nil {
+		db.conflicts.loaded = make(map[string]uint64)
+	}
+	db.conflicts.loaded[name] = seq
+}
+
+// conflictDetect reports whether a replica message is new to this instance,
+// and so may be a conflict with what it has.
+func (db *DbJetStream) conflictDetect(name string, seq uint64) bool {
+	db.conflicts.lock.Lock()
+	defer db.conflicts.lock.Unlock()
+
+	return db.conflicts.window > 0 && seq > db.conflicts.loaded[name]
+}
+
+// conflictKV opens the SYNC_CONFLICTS bucket the first time it is needed.
+// The lock must be held.
+func (db *DbJetStream) conflictKV() (jetstream.KeyValue, error) {
+	c := &db.conflicts
+	if c.kv != nil {
+		return c.kv, nil
+	}
+
+	cfg := jetstream.KeyValueConfig{
+		Bucket:      conflictBucket,
+		Description: "config points changed by two instances at once",
+	}
+	if !c.keep {
+		cfg.TTL = conflictRetention
+	}
+
+	kv, err := db.js.CreateOrUpdateKeyValue(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v KV bucket: %v", conflictBucket, err)
+	}
+
+	c.kv = kv
+	return kv, nil
+}
+
+// checkConflict looks at a point that came in from another instance against
+// the tip it was merged with, and records a conflict if the two are config
+// points with different values written by different instances within the
+// conflict window. won is whether the incoming point became the tip.
+func (db *DbJetStream) checkConflict(nodeID string, pIn data.Point, origin string,
+	prev data.Point, prevOrigin string, won bool) {
+
+	if prev.Type == "" || prevOrigin == "" || prevOrigin == origin {
+		return
+	}
+
+	dt := pIn.Time.Sub(prev.Time)
+	if dt < 0 {
+		dt = -dt
+	}
+	if dt > db.conflicts.window {
+		return
+	}
+
+	if pIn.Tombstone%2 == prev.Tombstone%2 && pIn.DataType == prev.DataType &&
+		bytes.Equal(pIn.Data, prev.Data) {
+		return
+	}
+
+	if !db.configWriter(pIn.Origin) || !db.configWriter(prev.Origin) {
+		return
+	}
+
+	c := data.SyncConflict{
+		NodeID:    nodeID,
+		Kept:      prev,
+		KeptBy:    prevOrigin,
+		Dropped:   pIn,
+		DroppedBy: origin,
+		Detected:  time.Now(),
+	}
+	if won {
+		c.Kept, c.KeptBy, c.Dropped, c.DroppedBy = pIn, origin, prev, prevOrigin
+	}
+
+	db.recordConflict(c)
+}
+
+// configWriter reports whether a point was written by a user or a
+// configuration tool, rather than by a client reporting what it measures.
+// Like configOrigin, but without a list of the users: a user of another
+// instance is not in this tree at all.
+func (db *DbJetStream) configWriter(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	parents := db.edgeCache.Parents(origin)
+	for _, e := range parents {
+		if e.Type == data.NodeTypeUser {
+			return true
+		}
+	}
+	return len(parents) == 0
+}
+
+// conflictID identifies a conflict by the two writes in it, so one seen
+// again, live and then through the replica stream, is recorded once.
+func conflictID(c data.SyncConflict) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%v|%v|%v|%v|%v|%v", c.NodeID, c.Kept.Type, c.Kept.Key,
+		c.Kept.Time.UnixNano(), c.KeptBy, c.Dropped.Time.UnixNano(), c.DroppedBy)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (db *DbJetStream) recordConflict(c data.SyncConflict) {
+	c.ID = conflictID(c)
+
+	db.pointMu.RLock()
+	c.Description = db.pointCache[c.NodeID].Desc()
+	db.pointMu.RUnlock()
+
+	v, err := json.Marshal(c)
+	if err != nil {
+		log.Println("STORE: error encoding sync conflict:", err)
+		return
+	}
+
+	db.conflicts.lock.Lock()
+	defer db.conflicts.lock.Unlock()
+
+	kv, err := db.conflictKV()
+	if err != nil {
+		log.Println("STORE:", err)
+		return
+	}
+
+	_, err = kv.Create(context.Background(), c.ID, v)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return
+	} else if err != nil {
+		log.Printf("STORE: error recording sync conflict %v: %v", c.ID, err)
+		return
+	}
+
+	log.Println("STORE: sync conflict:", c)
+	db.reportConflicts(kv)
+}
+
+// reportConflicts sets the syncConflicts point of the root node to the
+// number of conflicts waiting, for a rule to alarm on. The lock must be
+// held.
+func (db *DbJetStream) reportConflicts(kv jetstream.KeyValue) {
+	n, err := conflictCount(kv)
+	if err != nil {
+		log.Println("STORE: error counting sync conflicts:", err)
+		return
+	}
+
+	root := db.rootNodeID()
+	db.pointMu.RLock()
+	cur, ok := db.pointCache[root].Find(data.PointTypeSyncConflicts, "")
+	db.pointMu.RUnlock()
+	if ok && cur.Val() == float64(n) {
+		return
+	}
+
+	err = client.SendNodePoint(db.nc, root,
+		data.NewPointFloat(data.PointTypeSyncConflicts, "", float64(n)), false)
+	if err != nil {
+		log.Println("STORE: error reporting sync conflicts:", err)
+	}
+}
+
+func conflictCount(kv jetstream.KeyValue) (int, error) {
+	lister, err := kv.ListKeys(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for range lister.Keys() {
+		n++
+	}
+	return n, nil
+}
+
+// listConflicts returns the conflicts waiting to be resolved, newest first.
+func (db *DbJetStream) listConflicts() ([]data.SyncConflict, error) {
+	db.conflicts.lock.Lock()
+	defer db.conflicts.lock.Unlock()
+
+	kv, err := db.conflictKV()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	lister, err := kv.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []data.SyncConflict
+	for key := range lister.Keys() {
+		entry, err := kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			// expired since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var c data.SyncConflict
+		if err := json.Unmarshal(entry.Value(), &c); err != nil {
+			log.Printf("STORE: error decoding sync conflict %v: %v", key, err)
+			continue
+		}
+		ret = append(ret, c)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Detected.After(ret[j].Detected)
+	})
+
+	// entries that expired are counted out here
+	db.reportConflicts(kv)
+
+	return ret, nil
+}
+
+// takeConflict removes a conflict and returns it.
+func (db *DbJetStream) takeConflict(id string) (data.SyncConflict, error) {
+	db.conflicts.lock.Lock()
+	defer db.conflicts.lock.Unlock()
+
+	var c data.SyncConflict
+
+	kv, err := db.conflictKV()
+	if err != nil {
+		return c, err
+	}
+
+	ctx := context.Background()
+	entry, err := kv.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return c, fmt.Errorf("sync conflict %v not found", id)
+	} else if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(entry.Value(), &c)
+	if err != nil {
+		return c, err
+	}
+
+	err = kv.Delete(ctx, id)
+	if err != nil {
+		return c, fmt.Errorf("error removing sync conflict %v: %v", id, err)
+	}
+
+	db.reportConflicts(kv)
+
+	return c, nil
+}
+
+// restoreConflict resolves a conflict in favor of the value the merge
+// dropped, by writing it again now. The new write is the newest, so every
+// instance takes it. It is stamped after the kept one even if that came from
+// a clock running ahead.
+func (st *Store) restoreConflict(id string) error {
+	c, err := st.db.takeConflict(id)
+	if err != nil {
+		return err
+	}
+
+	p := c.Dropped
+	p.Time = time.Now()
+	if !p.Time.After(c.Kept.Time) {
+		p.Time = c.Kept.Time.Add(time.Millisecond)
+	}
+
+	log.Printf("STORE: sync conflict %v resolved by restoring %v", id, p)
+
+	return client.SendNodePoint(st.nc, c.NodeID, p, true)
+}
+
+// handleConflict serves conflict.list, conflict.resolve.<id>, which accepts
+// the value the merge kept, and conflict.restore.<id>, which brings back the
+// one it dropped.
+func (st *Store) handleConflict(msg *nats.Msg) {
+	var resp data.SyncConflictResponse
+	var err error
+
+	chunks := strings.Split(msg.Subject, ".")
+	switch {
+	case len(chunks) == 2 && chunks[1] == "list":
+		resp.Conflicts, err = st.db.listConflicts()
+	case len(chunks) == 3 && chunks[1] == "resolve":
+		var c data.SyncConflict
+		c, err = st.db.takeConflict(chunks[2])
+		if err == nil {
+			log.Printf("STORE: sync conflict %v resolved by keeping %v", c.ID, c.Kept)
+		}
+	case len(chunks) == 3 && chunks[1] == "restore":
+		err = st.restoreConflict(chunks[2])
+	default:
+		err = errors.New("error in message subject: " + msg.Subject)
+	}
+
+	if err != nil {
+		resp = data.SyncConflictResponse{Error: err.Error()}
+	}
+
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to conflict request:", err)
+	}
+}
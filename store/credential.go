@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// DeviceGrant is what a device's NKey credential gives it on this instance:
+// the streams it replicates and nothing else. It is worked out from the tree
+// each time the device connects rather than stored, so there is nothing to
+// configure and nothing that can drift.
+type DeviceGrant struct {
+	// DeviceID is the root node ID of the device, which is the device node
+	// carrying the credential here.
+	DeviceID string
+	// RootID is this instance's root node ID, which the device announces
+	// itself under.
+	RootID string
+	// Boundaries holds the device's boundary and those of the devices
+	// below it, which sync through it and which it forwards.
+	Boundaries []string
+	// Pull holds the streams in those boundaries that this instance wrote
+	// or was passed from above, which the device copies down. The stream
+	// this instance writes for each boundary is listed whether or not it
+	// exists yet, since the first configuration write creates it.
+	Pull []string
+}
+
+// DeviceGrant returns the grant of the device whose credential is pubKey.
+// It returns false if no live device node carries the key, or the device's
+// credential is revoked.
+func (st *Store) DeviceGrant(pubKey string) (DeviceGrant, bool) {
+	return st.db.deviceGrant(pubKey)
+}
+
+func (db *DbJetStream) deviceGrant(pubKey string) (DeviceGrant, bool) {
+	if pubKey == "" {
+		return DeviceGrant{}, false
+	}
+
+	deviceID := ""
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeDevice) {
+		// a detached device has no access until it is attached again
+		if e.IsTombstone() || e.Down == db.meta.RootID {
+			continue
+		}
+
+		key, revoked := db.deviceCredential(e.Down)
+		if key != pubKey {
+			continue
+		}
+		if revoked {
+			return DeviceGrant{}, false
+		}
+
+		if deviceID != "" && db.orgOf(deviceID) != db.orgOf(e.Down) {
+			// checkOrgPoints refuses such a key, but one replicated
+			// here, or written before there were organizations, must
+			// not pick either side
+			log.Printf("STORE: credential %v is carried by devices %v and %v in different organizations, refusing it",
+				pubKey, deviceID, e.Down)
+			return DeviceGrant{}, false
+		}
+		if deviceID == "" {
+			deviceID = e.Down
+		}
+	}
+
+	if deviceID == "" {
+		return DeviceGrant{}, false
+	}
+
+	return db.grantFor(deviceID), true
+}
+
+// grantFor works out the grant of a device node, whatever its credential.
+func (db *DbJetStream) grantFor(deviceID string) DeviceGrant {
+	g := DeviceGrant{
+		DeviceID:   deviceID,
+		RootID:     db.meta.RootID,
+		Boundaries: db.deviceBoundaries(deviceID),
+	}
+
+	inGrant := make(map[string]bool)
+	for _, b := range g.Boundaries {
+		inGrant[b] = true
+	}
+
+	self := db.meta.RootID
+	pull := make(map[string]bool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, b := range g.Boundaries {
+		pull[streamName(b, self)] = true
+
+		lister := db.js.ListStreams(ctx,
+			jetstream.WithStreamListSubject(fmt.Sprintf("inst.%v.>", b)))
+		for si := range lister.Info() {
+			sb, so, ok := streamBoundaryOrigin(si.Config)
+			if !ok || sb != b || inGrant[so] {
+				continue
+			}
+			pull[si.Config.Name] = true
+		}
+	}
+
+	for name := range pull {
+		g.Pull = append(g.Pull, name)
+	}
+	sort.Strings(g.Pull)
+
+	return g
+}
+
+// deviceAccess answers a credential request for a device node: the key this
+// instance honors for it, whether it is revoked, and what it replicates. It is
+// what a sync bundle from or for the device is checked and built against.
+func (db *DbJetStream) deviceAccess(deviceID string) data.DeviceAccess {
+	g := db.grantFor(deviceID)
+	pubKey, revoked := db.deviceCredential(deviceID)
+
+	return data.DeviceAccess{
+		DeviceID:   deviceID,
+		PubKey:     pubKey,
+		Revoked:    revoked,
+		Boundaries: g.Boundaries,
+		Pull:       g.Pull,
+	}
+}
+
+// deviceCredential returns the public key a device node carries and whether
+// it is revoked. Only what this instance wrote counts: the credential is this
+// instance's decision, and a value another instance wrote -- the device itself
+// through its own stream, or an instance it forwards for -- must not be able
+// to set a key or lift a revocation. A key written elsewhere is ignored and a
+// revocation written elsewhere stands, so both fail closed.
+func (db *DbJetStream) deviceCredential(id string) (pubKey string, revoked bool) {
+	self := db.meta.RootID
+
+	db.pointMu.RLock()
+	defer db.pointMu.RUnlock()
+
+	for _, p := range db.pointCache[id] {
+		local := db.pointOrigin[id][p.Type+"|"+p.Key] == self
+		switch p.Type {
+		case data.PointTypePubKey:
+			if local && p.Tombstone%2 == 0 {
+				pubKey = p.Txt()
+			}
+		case data.PointTypeRevoked:
+			if !local || (p.Tombstone%2 == 0 && p.Val() != 0) {
+				revoked = true
+			}
+		}
+	}
+
+	return pubKey, revoked
+}
+
+// deviceBoundaries returns a device's boundary followed by the boundaries of
+// the devices in its subtree, in tree order. A device in the subtree only
+// counts when every live edge to it is in the subtree: a device can attach
+// any node below itself in its own stream, and that must not let it claim a
+// device that syncs here directly or sits somewhere else in the tree.
+func (db *DbJetStream) deviceBoundaries(deviceID string) []string {
+	var order []EdgeEntry
+	inTree := map[string]bool{deviceID: true}
+	frontier := []string{deviceID}
+
+	for len(frontier) > 0 {
+		var next []string
+		for _, id := range frontier {
+			children := db.edgeCache.Children(id)
+			sort.Slice(children, func(i, j int) bool {
+				return children[i].Down < children[j].Down
+			})
+			for _, e := range children {
+				if e.IsTombstone() || inTree[e.Down] {
+					continue
+				}
+				inTree[e.Down] = true
+				order = append(order, e)
+				next = append(next, e.Down)
+			}
+		}
+		frontier = next
+	}
+
+	ret := []string{deviceID}
+
+nodes:
+	for _, e := range order {
+		if e.Type != data.NodeTypeDevice {
+			continue
+		}
+		for _, up := range db.edgeCache.Parents(e.Down) {
+			if !up.IsTombstone() && !inTree[up.Up] {
+				continue nodes
+			}
+		}
+		ret = append(ret, e.Down)
+	}
+
+	return ret
+}
@@ -106,6 +106,33 @@ func (ec *EdgeCache) Get(parentID, childID string) (EdgeEntry, bool) {
 	return EdgeEntry{}, false
 }
 
+// IsTip reports whether an edge point is the current tip of its type and
+// key, as written by origin.
+func (ec *EdgeCache) IsTip(parentID, childID string, pIn data.Point, origin string) bool {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	if pIn.Key == "" {
+		pIn.Key = "0"
+	}
+
+	for _, e := range ec.byUp[parentID] {
+		if e.Down != childID {
+			continue
+		}
+		if e.origins[pIn.Type+"|"+pIn.Key] != origin {
+			return false
+		}
+		for _, p := range e.Points {
+			if p.Type == pIn.Type && p.Key == pIn.Key {
+				return p.Time.Equal(pIn.Time)
+			}
+		}
+	}
+
+	return false
+}
+
 // UpIDs returns the upstream node IDs for a given child node.
 // If includeDeleted is false, tombstoned edges are filtered out.
 func (ec *EdgeCache) UpIDs(childID string, includeDeleted bool) []string {
@@ -137,6 +164,36 @@ func (ec *EdgeCache) AllByType(nodeType string) []EdgeEntry {
 	return result
 }
 
+// All returns every edge entry in the cache.
+func (ec *EdgeCache) All() []EdgeEntry {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	var result []EdgeEntry
+	for _, entries := range ec.byUp {
+		result = append(result, entries...)
+	}
+	return result
+}
+
+// TipOrigin returns the instance that wrote the current tip of an edge
+// point, or "" when the edge or point is not known.
+func (ec *EdgeCache) TipOrigin(parentID, childID, typ, key string) string {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+
+	if key == "" {
+		key = "0"
+	}
+
+	for _, e := range ec.byUp[parentID] {
+		if e.Down == childID {
+			return e.origins[typ+"|"+key]
+		}
+	}
+	return ""
+}
+
 // MergeEdgePoints merges an edge point set — a stream subject tip, or
 // points just written locally — into the cache, applying the ADR-7 tip
 // merge rule per point. origin is the instance that wrote the points.
@@ -286,6 +343,37 @@ func (ec *EdgeCache) OwningBoundary(id, rootID string) string {
 	return rootID
 }
 
+// Remove drops an edge from the cache. It is used when an edge's subjects
+// are purged from the store, not to delete a node, which is a tombstone.
+func (ec *EdgeCache) Remove(parentID, childID string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	var up []EdgeEntry
+	for _, e := range ec.byUp[parentID] {
+		if e.Down != childID {
+			up = append(up, e)
+		}
+	}
+	if len(up) > 0 {
+		ec.byUp[parentID] = up
+	} else {
+		delete(ec.byUp, parentID)
+	}
+
+	var down []EdgeEntry
+	for _, e := range ec.byDown[childID] {
+		if e.Up != parentID {
+			down = append(down, e)
+		}
+	}
+	if len(down) > 0 {
+		ec.byDown[childID] = down
+	} else {
+		delete(ec.byDown, childID)
+	}
+}
+
 // Reset clears all entries from the cache.
 func (ec *EdgeCache) Reset() {
 	ec.mu.Lock()
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// This file rebuilds the tree as it stood at an earlier time. Streams keep
+// every point written, up to each subject's retention limit, with the time it
+// was written embedded in the point, so merging only the points written at or
+// before a time gives the tree and point tips as they were then. The same
+// merge rule as the live caches applies, so the view of a past time is what
+// the live caches held at that time, given the data that had arrived.
+
+// historyViewTTL is how long a rebuilt view is kept for further requests at
+// the same time. An export of a past tree asks for every node in turn, and
+// rebuilding reads every stream end to end, so one rebuild serves them all.
+const historyViewTTL = time.Minute
+
+// historyFetchBatch is how many messages a history scan asks for at a time.
+const historyFetchBatch = 1000
+
+// treeView is the tree and point tips as of a time.
+type treeView struct {
+	at      time.Time
+	built   time.Time
+	edges   *EdgeCache
+	points  map[string]data.Points
+	origins map[string]map[string]string
+}
+
+// historyCache holds the most recently built view.
+type historyCache struct {
+	mu   sync.Mutex
+	view *treeView
+}
+
+// mergePoint merges one point into the view, applying the ADR-7 tip rule.
+func (v *treeView) mergePoint(nodeID string, pIn data.Point, origin string) {
+	if pIn.Key == "" {
+		pIn.Key = "0"
+	}
+	k := pIn.Type + "|" + pIn.Key
+
+	origins := v.origins[nodeID]
+	if origins == nil {
+		origins = make(map[string]string)
+		v.origins[nodeID] = origins
+	}
+
+	pts := v.points[nodeID]
+	for i, p := range pts {
+		if p.Type == pIn.Type && p.Key == pIn.Key {
+			if tipWins(p.Time, origins[k], pIn.Time, origin) {
+				pts[i] = pIn
+				origins[k] = origin
+			}
+			return
+		}
+	}
+
+	v.points[nodeID] = append(pts, pIn)
+	origins[k] = origin
+}
+
+// historyView returns the tree as of a time, reusing the last view built
+// for the same time while it is fresh.
+func (db *DbJetStream) historyView(at time.Time) (*treeView, error) {
+	db.history.mu.Lock()
+	defer db.history.mu.Unlock()
+
+	v := db.history.view
+	if v != nil && v.at.Equal(at) && time.Since(v.built) < historyViewTTL {
+		return v, nil
+	}
+
+	v, err := db.buildHistoryView(at)
+	if err != nil {
+		return nil, err
+	}
+
+	db.history.view = v
+	return v, nil
+}
+
+// buildHistoryView reads every boundary-origin stream from the start and
+// merges the points written at or before at.
+func (db *DbJetStream) buildHistoryView(at time.Time) (*treeView, error) {
+	start := time.Now()
+	ctx := context.Background()
+
+	v := &treeView{
+		at:      at,
+		built:   start,
+		edges:   NewEdgeCache(),
+		points:  make(map[string]data.Points),
+		origins: make(map[string]map[string]string),
+	}
+
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		_, origin, ok := streamBoundaryOrigin(si.Config)
+		if !ok {
+			continue
+		}
+
+		s, err := db.js.Stream(ctx, si.Config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting stream %v: %v", si.Config.Name, err)
+		}
+
+		err = scanStream(ctx, s, "", func(subject string, payload []byte) {
+			db.mergeHistoryMsg(v, subject, payload, origin)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading history of %v: %v", si.Config.Name, err)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("STORE: rebuilt tree as of %v in %v", at.Format(time.RFC3339),
+		time.Since(start))
+
+	return v, nil
+}
+
+// mergeHistoryMsg merges the points in one stream message that were written
+// at or before the view's time.
+func (db *DbJetStream) mergeHistoryMsg(v *treeView, subject string, payload []byte, origin string) {
+	tok := strings.Split(subject, ".")
+
+	pts, err := data.DecodePoints(payload)
+	if err != nil {
+		log.Printf("STORE: error decoding history msg %v: %v", subject, err)
+		return
+	}
+
+	var past data.Points
+	for _, p := range pts {
+		if !p.Time.After(v.at) {
+			past = append(past, p)
+		}
+	}
+	if len(past) == 0 {
+		return
+	}
+
+	switch {
+	case len(tok) == 7 && tok[4] == "p":
+		for _, p := range past {
+			if p.Type == "" {
+				p.Type = tok[5]
+			}
+			if p.Key == "" {
+				p.Key = tok[6]
+			}
+			v.mergePoint(tok[3], p, origin)
+		}
+	case len(tok) == 6 && tok[4] == "ep":
+		parentID, childID := tok[3], tok[5]
+		if parentID == "root" && origin != db.meta.RootID {
+			// a replica's root anchor is instance-local (see
+			// loadEdgeSubjects)
+			return
+		}
+		nodeType := ""
+		for _, p := range past {
+			if p.Type == data.PointTypeNodeType {
+				nodeType = p.Txt()
+			}
+		}
+		if _, ok := v.edges.Get(parentID, childID); !ok && nodeType == "" {
+			// the edge did not exist yet
+			return
+		}
+		v.edges.MergeEdgePoints(parentID, childID, nodeType, origin, past)
+	}
+}
+
+// getNodesAt works like getNodes, on the tree as it stood at a time.
+func (db *DbJetStream) getNodesAt(parent, id, typ string, includeDel bool, at time.Time) ([]data.NodeEdge, error) {
+	v, err := db.historyView(at)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectNodes(v.edges, db.meta.RootID, parent, id, typ, includeDel,
+		func(id string) data.Points {
+			return append(data.Points{}, v.points[id]...)
+		})
+}
+
+// scanStream calls fn for every message in a stream, in stream order,
+// optionally limited to the subjects matching filter. It returns once the
+// messages that were in the stream when it started have all been read.
+func scanStream(ctx context.Context, s jetstream.Stream, filter string,
+	fn func(subject string, payload []byte)) error {
+	cfg := jetstream.OrderedConsumerConfig{}
+	if filter != "" {
+		cfg.FilterSubjects = []string{filter}
+	}
+
+	info, err := s.Info(ctx)
+	if err != nil {
+		return err
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+
+	c, err := s.OrderedConsumer(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	for {
+		batch, err := c.FetchNoWait(historyFetchBatch)
+		if err != nil {
+			return err
+		}
+
+		got := 0
+		pending := uint64(0)
+		for msg := range batch.Messages() {
+			got++
+			fn(msg.Subject(), msg.Data())
+			if meta, err := msg.Metadata(); err == nil {
+				pending = meta.NumPending
+			}
+		}
+		// a fetch that finds nothing waiting reports a timeout, which only
+		// means the scan reached the end
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return err
+		}
+
+		if got == 0 || pending == 0 {
+			return nil
+		}
+	}
+}
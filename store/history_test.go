@@ -0,0 +1,75 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestGetNodesAt(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	kept := uuid.New().String()
+	deleted := uuid.New().String()
+	added := uuid.New().String()
+
+	mkTestNode(t, db, rootID, kept, data.NodeTypeVariable, "setpoint 10")
+	mkTestNode(t, db, rootID, deleted, data.NodeTypeVariable, "deleted later")
+
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	err := db.nodePoints(kept, data.Points{
+		data.NewPointString(data.PointTypeDescription, "", "setpoint 20"),
+	})
+	if err != nil {
+		t.Fatal("Error writing points:", err)
+	}
+
+	err = db.edgePoints(deleted, rootID, data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", 1),
+	})
+	if err != nil {
+		t.Fatal("Error deleting node:", err)
+	}
+
+	mkTestNode(t, db, rootID, added, data.NodeTypeVariable, "added later")
+
+	past, err := db.getNodesAt(rootID, "all", "", false, at)
+	if err != nil {
+		t.Fatal("Error getting past nodes:", err)
+	}
+
+	byID := make(map[string]data.NodeEdge)
+	for _, n := range past {
+		byID[n.ID] = n
+	}
+
+	if len(byID) != 3 {
+		// the admin user, kept, and deleted
+		t.Fatal("expected 3 children in the past tree, got:", len(byID))
+	}
+	if byID[kept].Desc() != "setpoint 10" {
+		t.Fatal("past description wrong:", byID[kept].Desc())
+	}
+	if _, ok := byID[deleted]; !ok {
+		t.Fatal("node deleted later is missing from the past tree")
+	}
+	if _, ok := byID[added]; ok {
+		t.Fatal("node added later is in the past tree")
+	}
+
+	// the live tree is unaffected
+	now, err := db.getNodes(nil, rootID, kept, "", false)
+	if err != nil || len(now) != 1 {
+		t.Fatal("Error getting current node:", err)
+	}
+	if now[0].Desc() != "setpoint 20" {
+		t.Fatal("current description wrong:", now[0].Desc())
+	}
+}
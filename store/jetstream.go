@@ -83,6 +83,7 @@ type DbJetStream struct {
 	js        jetstream.JetStream
 	nc        *nats.Conn
 	metaKV    jetstream.KeyValue
+	localKV   jetstream.KeyValue
 	meta      Meta
 	cfg       JsConfig
 	edgeCache *EdgeCache
@@ -98,6 +99,12 @@ type DbJetStream struct {
 	// stream per process
 	streamMu sync.Mutex
 	streams  map[string]jetstream.Stream
+
+	// history holds the last tree rebuilt as of an earlier time
+	history historyCache
+
+	adoptions adoptions
+	conflicts conflicts
 }
 
 // streamName returns the stream name for a (boundary, origin) pair.
@@ -200,6 +207,11 @@ func NewJetStreamDb(nc *nats.Conn, rootID string, cfg JsConfig) (*DbJetStream, e
 		return nil, fmt.Errorf("error loading streams: %v", err)
 	}
 
+	err = db.openLocal()
+	if err != nil {
+		return nil, err
+	}
+
 	if db.meta.RootID == "" {
 		db.meta.RootID, err = db.initRoot(rootID)
 		if err != nil {
@@ -207,6 +219,16 @@ func NewJetStreamDb(nc *nats.Conn, rootID string, cfg JsConfig) (*DbJetStream, e
 		}
 	}
 
+	err = db.migratePasswords()
+	if err != nil {
+		return nil, fmt.Errorf("error migrating passwords: %v", err)
+	}
+
+	err = db.migrateLocalPoints()
+	if err != nil {
+		return nil, fmt.Errorf("error migrating local points: %v", err)
+	}
+
 	if len(db.meta.JWTKey) == 0 {
 		err = db.initJwtKey()
 		if err != nil {
@@ -363,6 +385,21 @@ func (db *DbJetStream) maxMsgsForStream(_ string) int64 {
 // the ADR-7 tip merge rule. It returns true if the point became the
 // current tip.
 func (db *DbJetStream) mergePointTip(nodeID string, pIn data.Point, origin string) bool {
+	won, _, _ := db.mergePointTipPrev(nodeID, pIn, origin)
+	return won
+}
+
+// mergePointTipPrev is mergePointTip that also returns the tip the point
+// was merged with and the instance that wrote it, for conflict detection.
+// prev is the zero point if the subject had no tip.
+func (db *DbJetStream) mergePointTipPrev(nodeID string, pIn data.Point,
+	origin string) (won bool, prev data.Point, prevOrigin string) {
+
+	if localPoint(pIn.Type) {
+		// only in the LOCAL bucket, even when a stream still has one
+		return false, data.Point{}, ""
+	}
+
 	if pIn.Key == "" {
 		pIn.Key = "0"
 	}
@@ -381,21 +418,22 @@ func (db *DbJetStream) mergePointTip(nodeID string, pIn data.Point, origin strin
 	for i, p := range pts {
 		if p.Type == pIn.Type && p.Key == pIn.Key {
 			if !tipWins(p.Time, origins[k], pIn.Time, origin) {
-				return false
+				return false, p, origins[k]
 			}
 			// copy-on-write so slices handed out by getNodes are not
 			// mutated underneath readers
 			npts := append(data.Points{}, pts...)
 			npts[i] = pIn
 			db.pointCache[nodeID] = npts
+			prevOrigin = origins[k]
 			origins[k] = origin
-			return true
+			return true, p, prevOrigin
 		}
 	}
 
 	db.pointCache[nodeID] = append(pts, pIn)
 	origins[k] = origin
-	return true
+	return true, data.Point{}, ""
 }
 
 // pointIsTip reports whether the point would become the current tip if
@@ -418,7 +456,8 @@ func (db *DbJetStream) pointIsTip(nodeID string, pIn data.Point, origin string)
 }
 
 // nodePoints writes node points to this instance's origin stream for
-// the node's owning boundary and updates the point cache.
+// the node's owning boundary and updates the point cache. Local points go to
+// the LOCAL bucket instead, and to neither.
 func (db *DbJetStream) nodePoints(id string, points data.Points) error {
 	points.Collapse()
 
@@ -453,6 +492,19 @@ func (db *DbJetStream) nodePoints(id string, points data.Points) error {
 			continue
 		}
 
+		pIn, err = hashPassword(pIn)
+		if err != nil {
+			return err
+		}
+
+		if localPoint(pIn.Type) {
+			err = db.putLocalPoint(id, pIn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		subject := nodePointSubject(boundary, origin, id, pIn.Type, pIn.Key)
 		pts := data.Points{pIn}
 		_, err = db.js.Publish(ctx, subject, pts.Encode())
@@ -778,6 +830,7 @@ func (db *DbJetStream) loadStream(cfg jetstream.StreamConfig) error {
 	if err != nil {
 		return err
 	}
+	db.conflictLoaded(cfg.Name, s.CachedInfo().State.LastSeq)
 
 	db.loadEdgeSubjects(s, origin, fmt.Sprintf("inst.%v.%v.*.ep.>", boundary, origin))
 	db.loadPointSubjects(s, origin, fmt.Sprintf("inst.%v.%v.*.p.>", boundary, origin))
@@ -935,6 +988,31 @@ func (db *DbJetStream) ensureNodePointsCached(boundary, id string) error {
 // If parent is set and id is "all", all children are returned.
 // If parent is "root" and id is "all", the root node is returned.
 func (db *DbJetStream) getNodes(_ any, parent, id, typ string, includeDel bool) ([]data.NodeEdge, error) {
+	return selectNodes(db.edgeCache, db.meta.RootID, parent, id, typ, includeDel,
+		func(id string) data.Points {
+			// The cache is the read path; a miss means the node has not
+			// been seen since startup, so load it once as a backstop
+			db.pointMu.RLock()
+			points, ok := db.pointCache[id]
+			db.pointMu.RUnlock()
+			if !ok {
+				boundary := db.edgeCache.OwningBoundary(id, db.meta.RootID)
+				err := db.ensureNodePointsCached(boundary, id)
+				if err != nil {
+					log.Printf("error loading node points for %v: %v", id, err)
+				}
+				db.pointMu.RLock()
+				points = db.pointCache[id]
+				db.pointMu.RUnlock()
+			}
+			return append(data.Points{}, points...)
+		})
+}
+
+// selectNodes applies the getNodes filters to a tree, calling points for
+// the points of each node selected. rootID is the instance root node ID.
+func selectNodes(ec *EdgeCache, rootID, parent, id, typ string, includeDel bool,
+	points func(id string) data.Points) ([]data.NodeEdge, error) {
 	if parent == "" || parent == "none" {
 		return nil, errors.New("parent must be set to valid ID, or all")
 	}
@@ -952,11 +1030,11 @@ func (db *DbJetStream) getNodes(_ any, parent, id, typ string, includeDel bool)
 		// virtual "root" parent keeps a stray edge -- a replica's root
 		// anchor loaded by an older version, say -- from standing in as
 		// this instance's root
-		want := db.meta.RootID
+		want := rootID
 		if id != "all" && id != want {
 			want = ""
 		}
-		for _, e := range db.edgeCache.Children("root") {
+		for _, e := range ec.Children("root") {
 			if e.Down == want {
 				edges = append(edges, e)
 			}
@@ -964,11 +1042,11 @@ func (db *DbJetStream) getNodes(_ any, parent, id, typ string, includeDel bool)
 	case parent == "all" && id == "all":
 		return nil, errors.New("invalid combination of parent and id")
 	case parent == "all":
-		edges = db.edgeCache.Parents(id)
+		edges = ec.Parents(id)
 	case id == "all":
-		edges = db.edgeCache.Children(parent)
+		edges = ec.Children(parent)
 	default:
-		e, ok := db.edgeCache.Get(parent, id)
+		e, ok := ec.Get(parent, id)
 		if ok {
 			edges = []EdgeEntry{e}
 		}
@@ -1000,22 +1078,7 @@ func (db *DbJetStream) getNodes(_ any, parent, id, typ string, includeDel bool)
 			}
 		}
 
-		// The cache is the read path; a miss means the node has not
-		// been seen since startup, so load it once as a backstop
-		db.pointMu.RLock()
-		points, ok := db.pointCache[edge.Down]
-		db.pointMu.RUnlock()
-		if !ok {
-			boundary := db.edgeCache.OwningBoundary(edge.Down, db.meta.RootID)
-			err := db.ensureNodePointsCached(boundary, edge.Down)
-			if err != nil {
-				log.Printf("error loading node points for %v: %v", edge.Down, err)
-			}
-			db.pointMu.RLock()
-			points = db.pointCache[edge.Down]
-			db.pointMu.RUnlock()
-		}
-		ne.Points = append(data.Points{}, points...)
+		ne.Points = points(edge.Down)
 
 		ret = append(ret, ne)
 	}
@@ -1028,8 +1091,29 @@ func (db *DbJetStream) up(id string, includeDeleted bool) ([]string, error) {
 	return db.edgeCache.UpIDs(id, includeDeleted), nil
 }
 
-// userCheck checks user authentication.
-func (db *DbJetStream) userCheck(email, password string) (data.Nodes, error) {
+// userCheck checks user authentication: the email and password of a user
+// of the organization named org, or of one of the instance's own users when
+// org is empty.
+func (db *DbJetStream) userCheck(org, email, password string) (data.Nodes, error) {
+	orgID := ""
+	if org != "" {
+		var ok bool
+		orgID, ok = db.orgByName(org)
+		if !ok {
+			return nil, nil
+		}
+	}
+
+	// each organization has users of its own, and the same email can be
+	// in several
+	return db.findUsers(func(u data.User) bool {
+		return u.Email == email && db.orgOf(u.ID) == orgID &&
+			passwordMatch(u.Pass, password)
+	}), nil
+}
+
+// findUsers returns the users match accepts, nearest the root first.
+func (db *DbJetStream) findUsers(match func(u data.User) bool) data.Nodes {
 	// Find all user-type edges
 	userEdges := db.edgeCache.AllByType(data.NodeTypeUser)
 
@@ -1046,8 +1130,7 @@ func (db *DbJetStream) userCheck(email, password string) (data.Nodes, error) {
 		}
 
 		n := ne[0].ToNode()
-		u := n.ToUser()
-		if u.Email == email && u.Pass == password {
+		if match(n.ToUser()) {
 			users = append(users, ne...)
 		}
 	}
@@ -1085,7 +1168,7 @@ func (db *DbJetStream) userCheck(email, password string) (data.Nodes, error) {
 		ret = append(ret, f.node)
 	}
 
-	return ret, nil
+	return ret
 }
 
 // depthToRoot returns the number of edges on the shortest undeleted path
@@ -240,7 +240,7 @@ func TestDbJetStreamUserCheck(t *testing.T) {
 	db, cleanup := newTestJsDb(t)
 	defer cleanup()
 
-	nodes, err := db.userCheck("admin", "admin")
+	nodes, err := db.userCheck("", "admin", "admin")
 	if err != nil {
 		t.Fatal("userCheck returned error:", err)
 	}
@@ -275,7 +275,7 @@ func TestDbJetStreamUserCheckDuplicateCredentials(t *testing.T) {
 	}
 
 	for i := 0; i < 10; i++ {
-		users, err := db.userCheck("admin", "admin")
+		users, err := db.userCheck("", "admin", "admin")
 		if err != nil {
 			t.Fatal("userCheck returned error:", err)
 		}
@@ -1102,7 +1102,7 @@ func TestDbJetStreamReset(t *testing.T) {
 	}
 
 	// admin user is re-created
-	users, err := db.userCheck("admin", "admin")
+	users, err := db.userCheck("", "admin", "admin")
 	if err != nil || len(users) < 1 {
 		t.Fatal("admin user missing after reset:", err)
 	}
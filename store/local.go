@@ -0,0 +1,240 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Some points are secrets that belong to this instance alone, such as the
+// seed of the NKey a device signs in to its upstream with, or the seed the
+// instance signs sync bundles with. Any stream may end
+// up on another instance, through a sync pump, a leafnode source or a bundle,
+// and anything in the point cache is handed to whoever can reach the node, so
+// these points are kept in a KV bucket of their own, keyed by node, type and
+// key, and read only through a local.<nodeID> request, which sessions and
+// devices are not allowed to make. The bucket is not synced.
+const localBucket = "LOCAL"
+
+// localTypes are the point types that stay out of the streams and the point
+// cache.
+var localTypes = []string{data.PointTypeNkeySeed, data.PointTypeBundleSeed}
+
+// localPoint reports whether points of a type are local.
+func localPoint(typ string) bool {
+	return slices.Contains(localTypes, typ)
+}
+
+// withoutLocal returns points less the local ones.
+func withoutLocal(points data.Points) data.Points {
+	ret := make(data.Points, 0, len(points))
+	for _, p := range points {
+		if !localPoint(p.Type) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// localKey returns the LOCAL bucket key of a node point.
+func localKey(nodeID string, p data.Point) string {
+	return nodeID + "." + p.Type + "." + p.Key
+}
+
+// openLocal opens the LOCAL bucket.
+func (db *DbJetStream) openLocal() error {
+	kv, err := db.js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      localBucket,
+		Description: "node points that are never synced",
+	})
+	if err != nil {
+		return fmt.Errorf("error opening %v KV bucket: %v", localBucket, err)
+	}
+	db.localKV = kv
+	return nil
+}
+
+// putLocalPoint writes a point to the LOCAL bucket.
+func (db *DbJetStream) putLocalPoint(nodeID string, p data.Point) error {
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	if p.Key == "" {
+		p.Key = "0"
+	}
+
+	pts := data.Points{p}
+	key := localKey(nodeID, p)
+	_, err := db.localKV.Put(context.Background(), key, pts.Encode())
+	if err != nil {
+		return fmt.Errorf("error writing local point %v: %v", key, err)
+	}
+	return nil
+}
+
+// localKeys returns the LOCAL bucket keys of a node.
+func (db *DbJetStream) localKeys(nodeID string) ([]string, error) {
+	lister, err := db.localKV.ListKeysFiltered(context.Background(), nodeID+".>")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for key := range lister.Keys() {
+		ret = append(ret, key)
+	}
+	return ret, nil
+}
+
+// localPoints returns the local points of a node.
+func (db *DbJetStream) localPoints(nodeID string) (data.Points, error) {
+	keys, err := db.localKeys(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret data.Points
+	for _, key := range keys {
+		entry, err := db.localKV.Get(context.Background(), key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading local point %v: %v", key, err)
+		}
+		pts, err := data.DecodePoints(entry.Value())
+		if err != nil || len(pts) < 1 {
+			log.Printf("STORE: error decoding local point %v: %v", key, err)
+			continue
+		}
+		ret = append(ret, pts[0])
+	}
+
+	return ret, nil
+}
+
+// writeLocalPoints writes the local points of a node. Any other point is
+// refused, as it would never reach the tree.
+func (db *DbJetStream) writeLocalPoints(nodeID string, points data.Points) error {
+	for _, p := range points {
+		if !localPoint(p.Type) {
+			return fmt.Errorf("%v is not a local point", p.Type)
+		}
+	}
+
+	for _, p := range points {
+		err := db.putLocalPoint(nodeID, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeLocalPoints removes a node's points from the LOCAL bucket.
+func (db *DbJetStream) purgeLocalPoints(nodeID string) error {
+	keys, err := db.localKeys(nodeID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := db.localKV.Purge(context.Background(), key)
+		if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return fmt.Errorf("error purging local point %v: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLocalPoints moves the local points this instance wrote to its
+// streams before they were kept apart into the LOCAL bucket, unless the
+// bucket already holds a newer value, and purges them from the streams. A
+// copy already synced elsewhere stays there.
+func (db *DbJetStream) migrateLocalPoints() error {
+	ctx := context.Background()
+	self := db.meta.RootID
+
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		b, o, ok := streamBoundaryOrigin(si.Config)
+		if !ok || o != self {
+			continue
+		}
+
+		s, err := db.js.Stream(ctx, si.Config.Name)
+		if err != nil {
+			return fmt.Errorf("error getting stream %v: %v", si.Config.Name, err)
+		}
+
+		for _, typ := range localTypes {
+			err := db.migrateLocalSubjects(s, fmt.Sprintf("inst.%v.%v.*.p.%v.*", b, o, typ))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return lister.Err()
+}
+
+// migrateLocalSubjects moves the tips of the point subjects matching filter
+// to the LOCAL bucket and purges the subjects.
+func (db *DbJetStream) migrateLocalSubjects(s jetstream.Stream, filter string) error {
+	ctx := context.Background()
+
+	info, err := s.Info(ctx, jetstream.WithSubjectFilter(filter))
+	if err != nil {
+		return fmt.Errorf("error getting stream info for %v: %v", filter, err)
+	}
+
+	for subject := range info.State.Subjects {
+		// inst.<boundary>.<origin>.<nodeID>.p.<type>.<key>
+		tok := strings.Split(subject, ".")
+		if len(tok) != 7 {
+			continue
+		}
+		nodeID := tok[3]
+
+		msg, err := s.GetLastMsgForSubject(ctx, subject)
+		if err != nil {
+			return fmt.Errorf("error getting %v: %v", subject, err)
+		}
+
+		pts, err := data.DecodePoints(msg.Data)
+		if err == nil && len(pts) > 0 {
+			p := pts[0]
+			p.Type, p.Key = tok[5], tok[6]
+
+			current, err := db.localPoints(nodeID)
+			if err != nil {
+				return err
+			}
+			c, ok := current.Find(p.Type, p.Key)
+			if !ok || c.Time.Before(p.Time) {
+				err = db.putLocalPoint(nodeID, p)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = s.Purge(ctx, jetstream.WithPurgeSubject(subject))
+		if err != nil {
+			return fmt.Errorf("error purging %v: %v", subject, err)
+		}
+
+		log.Printf("STORE: moved %v of node %v out of the streams", tok[5], nodeID)
+	}
+
+	return nil
+}
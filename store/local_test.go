@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// inStream reports whether this instance's stream holds a point subject.
+func inStream(t *testing.T, db *DbJetStream, id, typ string) bool {
+	t.Helper()
+	rootID := db.rootNodeID()
+
+	s, err := db.js.Stream(context.Background(), streamName(rootID, rootID))
+	if err != nil {
+		t.Fatal("Error getting stream:", err)
+	}
+	_, err = s.GetLastMsgForSubject(context.Background(),
+		nodePointSubject(rootID, rootID, id, typ, "0"))
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return false
+	}
+	if err != nil {
+		t.Fatal("Error getting point:", err)
+	}
+	return true
+}
+
+func TestLocalPoints(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	sync := uuid.New().String()
+	mkTestNode(t, db, rootID, sync, data.NodeTypeSync, "")
+
+	err := db.nodePoints(sync, data.Points{
+		data.NewPointString(data.PointTypeNkeySeed, "", "SUSEED"),
+	})
+	if err != nil {
+		t.Fatal("Error writing seed:", err)
+	}
+
+	if inStream(t, db, sync, data.PointTypeNkeySeed) {
+		t.Fatal("seed written to the stream")
+	}
+	if _, ok := db.pointCache[sync].Find(data.PointTypeNkeySeed, ""); ok {
+		t.Fatal("seed in the point cache")
+	}
+
+	local := func() string {
+		t.Helper()
+		pts, err := db.localPoints(sync)
+		if err != nil {
+			t.Fatal("Error reading local points:", err)
+		}
+		seed, _ := pts.Find(data.PointTypeNkeySeed, "")
+		return seed.Txt()
+	}
+
+	if seed := local(); seed != "SUSEED" {
+		t.Fatal("seed not kept, got:", seed)
+	}
+
+	if db.writeLocalPoints(sync, data.Points{
+		data.NewPointString(data.PointTypeDescription, "", "sync")}) == nil {
+		t.Fatal("point that is not local written as one")
+	}
+
+	// written the way an older version did, straight to the stream
+	p := data.NewPointString(data.PointTypeNkeySeed, "", "SUOLD")
+	p.Time = time.Now()
+	p.Key = "0"
+	enc := data.Points{p}
+	_, err = db.js.Publish(context.Background(),
+		nodePointSubject(rootID, rootID, sync, p.Type, p.Key), enc.Encode())
+	if err != nil {
+		t.Fatal("Error publishing point:", err)
+	}
+
+	db, err = NewJetStreamDb(db.nc, "", JsConfig{})
+	if err != nil {
+		t.Fatal("Error re-opening JetStream db:", err)
+	}
+
+	if inStream(t, db, sync, data.PointTypeNkeySeed) {
+		t.Fatal("seed not moved out of the stream")
+	}
+	if _, ok := db.pointCache[sync].Find(data.PointTypeNkeySeed, ""); ok {
+		t.Fatal("seed from the stream in the point cache")
+	}
+	if seed := local(); seed != "SUOLD" {
+		t.Fatal("moved seed not kept, got:", seed)
+	}
+
+	err = db.removeOrphan(sync)
+	if err != nil {
+		t.Fatal("Error removing node:", err)
+	}
+	_, err = db.localKV.Get(context.Background(),
+		localKey(sync, data.NewPointString(data.PointTypeNkeySeed, "0", "")))
+	if !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Fatal("seed of a removed node kept: ", err)
+	}
+}
+
+func TestLocalBundleSeed(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	// written the way an older version did, straight to the stream
+	p := data.NewPointString(data.PointTypeBundleSeed, "", "SUBUNDLE")
+	p.Time = time.Now()
+	p.Key = "0"
+	enc := data.Points{p}
+	_, err := db.js.Publish(context.Background(),
+		nodePointSubject(rootID, rootID, rootID, p.Type, p.Key), enc.Encode())
+	if err != nil {
+		t.Fatal("Error publishing point:", err)
+	}
+
+	db, err = NewJetStreamDb(db.nc, "", JsConfig{})
+	if err != nil {
+		t.Fatal("Error re-opening JetStream db:", err)
+	}
+
+	if inStream(t, db, rootID, data.PointTypeBundleSeed) {
+		t.Fatal("bundle seed not moved out of the stream")
+	}
+	if _, ok := db.pointCache[rootID].Find(data.PointTypeBundleSeed, ""); ok {
+		t.Fatal("bundle seed in the point cache")
+	}
+
+	pts, err := db.localPoints(rootID)
+	if err != nil {
+		t.Fatal("Error reading local points:", err)
+	}
+	seed, _ := pts.Find(data.PointTypeBundleSeed, "")
+	if seed.Txt() != "SUBUNDLE" {
+		t.Fatal("moved bundle seed not kept, got:", seed.Txt())
+	}
+}
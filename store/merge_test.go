@@ -133,3 +133,39 @@ func TestMergeEdgePointsCrossOrigin(t *testing.T) {
 		t.Error("origin tie-break failed, got:", d)
 	}
 }
+
+// TestRemoteTips checks that only what a replica consumer merged from an
+// origin is taken as that origin's, so a message that merely claims to come
+// from another instance changes and fans out nothing.
+func TestRemoteTips(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	now := time.Now()
+	p := data.NewPointFloat(data.PointTypeValue, "0", 1)
+	p.Time = now
+	db.mergePointTip("dev", p, "remote")
+
+	forged := p
+	forged.Time = now.Add(time.Second)
+
+	if got := db.remoteNodeTips("dev", data.Points{p}, "remote"); len(got) != 1 {
+		t.Error("merged tip not kept: ", got)
+	}
+	if got := db.remoteNodeTips("dev", data.Points{forged}, "remote"); len(got) != 0 {
+		t.Error("point never merged kept: ", got)
+	}
+	if got := db.remoteNodeTips("dev", data.Points{p}, "other"); len(got) != 0 {
+		t.Error("tip kept for another origin: ", got)
+	}
+
+	e := data.Point{Type: data.PointTypeTombstone, Key: "0", Time: now}
+	db.edgeCache.MergeEdgePoints("hub", "dev", data.NodeTypeDevice, "remote", data.Points{e})
+
+	if got := db.remoteEdgeTips("dev", "hub", data.Points{e}, "remote"); len(got) != 1 {
+		t.Error("merged edge tip not kept: ", got)
+	}
+	if got := db.remoteEdgeTips("dev", "up", data.Points{e}, "remote"); len(got) != 0 {
+		t.Error("edge never merged kept: ", got)
+	}
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"sync/atomic"
+
+	"github.com/simpleiot/simpleiot/client"
+)
+
+// storeCounts are the counts the store keeps for the HTTP API's /metrics.
+type storeCounts struct {
+	nodePoints        atomic.Uint64
+	edgePoints        atomic.Uint64
+	pendingNodePoints atomic.Int64
+	pendingEdgePoints atomic.Int64
+}
+
+// PromMetrics returns the internal metrics of the store: the points it has
+// handled, the points waiting to be handled, and the number of nodes.
+func (st *Store) PromMetrics() []client.PromMetric {
+	nodes := make(map[string]bool)
+	for _, e := range st.db.edgeCache.All() {
+		if !e.IsTombstone() {
+			nodes[e.Down] = true
+		}
+	}
+
+	return []client.PromMetric{
+		{Name: "siot_store_nodes", Help: "Nodes in the tree.",
+			Value: float64(len(nodes))},
+		{Name: "siot_store_points_total", Help: "Node points the store has handled.",
+			Counter: true, Value: float64(st.counts.nodePoints.Load())},
+		{Name: "siot_store_edge_points_total", Help: "Edge points the store has handled.",
+			Counter: true, Value: float64(st.counts.edgePoints.Load())},
+		{Name: "siot_store_pending_points", Help: "Node points waiting to be handled.",
+			Value: float64(st.counts.pendingNodePoints.Load())},
+		{Name: "siot_store_pending_edge_points", Help: "Edge points waiting to be handled.",
+			Value: float64(st.counts.pendingEdgePoints.Load())},
+	}
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/internal/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// handleAuthOIDC signs in a user who logged in through an OpenID Connect
+// identity provider. The API has already checked the provider's ID token; the
+// store finds or creates the user and replies the way auth.user does, with
+// the user node and a JWT node, or with the reason the login is refused.
+func (st *Store) handleAuthOIDC(msg *nats.Msg) {
+	resp := &pb.NodesRequest{}
+
+	var login data.OIDCLogin
+	err := json.Unmarshal(msg.Data, &login)
+	if err != nil {
+		resp.Error = fmt.Sprintf("error decoding OIDC login: %v", err)
+	} else {
+		var nodes data.Nodes
+		nodes, err = st.oidcUser(login)
+		if err != nil {
+			log.Println("STORE: OIDC login refused:", err)
+			resp.Error = err.Error()
+		} else {
+			resp.Nodes, err = nodes.ToPbNodes()
+			if err != nil {
+				resp.Error = fmt.Sprintf("Error pb encoding node: %v\n", err)
+			}
+		}
+	}
+
+	reply, err := proto.Marshal(resp)
+	if err != nil {
+		log.Println("Error marshalling OIDC login response:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to auth.oidc:", err)
+	}
+}
+
+// oidcUser returns the user nodes of an OIDC login followed by a JWT node. A
+// user is matched by email, ignoring case, and created when there is none:
+// in the first group the login maps to, or under the login's parent. The
+// user is then put in each mapped group its login has and taken out of those
+// it no longer has, which leaves groups without an oidcGroup point alone.
+func (st *Store) oidcUser(l data.OIDCLogin) (data.Nodes, error) {
+	if l.Email == "" {
+		return nil, errors.New("the ID token has no email")
+	}
+
+	managed, want := st.db.oidcGroups(l.Groups)
+
+	// the identity provider is the instance's, so it signs in the
+	// instance's own users and never one of an organization
+	users := st.db.findUsers(func(u data.User) bool {
+		return strings.EqualFold(u.Email, l.Email) && st.db.orgOf(u.ID) == ""
+	})
+
+	var userID string
+	if len(users) > 0 {
+		userID = users[0].ID
+		err := st.oidcNames(userID, users[0].Points, l)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		place := l.Parent
+		if len(want) > 0 {
+			place = want[0]
+		}
+		if place == "" {
+			return nil, fmt.Errorf("no user has email %v, and none of its groups is mapped", l.Email)
+		}
+
+		userID = uuid.New().String()
+		err := client.SendNodePoints(st.nc, userID, data.Points{
+			data.NewPointString(data.PointTypeEmail, "", l.Email),
+			data.NewPointString(data.PointTypeFirstName, "", l.FirstName),
+			data.NewPointString(data.PointTypeLastName, "", l.LastName),
+		}, true)
+		if err != nil {
+			return nil, fmt.Errorf("error creating user: %v", err)
+		}
+		err = st.oidcPlace(userID, place, true)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("STORE: created user %v for OIDC login %v\n", userID, l.Email)
+	}
+
+	places := make(map[string]bool)
+	for _, e := range st.db.edgeCache.Parents(userID) {
+		if !e.IsTombstone() {
+			places[e.Up] = true
+		}
+	}
+
+	for _, g := range managed {
+		in := slices.Contains(want, g)
+		if in == places[g] {
+			continue
+		}
+		err := st.oidcPlace(userID, g, in)
+		if err != nil {
+			return nil, err
+		}
+		if in {
+			places[g] = true
+		} else {
+			delete(places, g)
+		}
+	}
+
+	if len(places) == 0 {
+		if l.Parent == "" {
+			return nil, fmt.Errorf("user %v is in none of its groups", l.Email)
+		}
+		err := st.oidcPlace(userID, l.Parent, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nodes, err := st.db.getNodes(nil, "all", userID, "", false)
+	if err != nil || len(nodes) == 0 {
+		return nil, fmt.Errorf("error getting user %v: %v", userID, err)
+	}
+
+	token, err := st.authorizer.NewToken(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token: %v", err)
+	}
+
+	return append(nodes, data.NodeEdge{
+		Type: data.NodeTypeJWT,
+		Points: data.Points{
+			data.NewPointString(data.PointTypeToken, "0", token),
+		},
+	}), nil
+}
+
+// oidcPlace puts a user in a group, or takes it out.
+func (st *Store) oidcPlace(userID, group string, in bool) error {
+	err := client.SendEdgePoints(st.nc, userID, group, data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", data.BoolToFloat(!in)),
+		data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeUser),
+	}, true)
+	if err != nil {
+		return fmt.Errorf("error placing user %v in %v: %v", userID, group, err)
+	}
+	return nil
+}
+
+// oidcNames brings a user's names up to date with the identity provider's.
+func (st *Store) oidcNames(userID string, points data.Points, l data.OIDCLogin) error {
+	var update data.Points
+	for _, n := range []struct{ typ, v string }{
+		{data.PointTypeFirstName, l.FirstName},
+		{data.PointTypeLastName, l.LastName},
+	} {
+		cur, _ := points.Text(n.typ, "")
+		if n.v != "" && n.v != cur {
+			update = append(update, data.NewPointString(n.typ, "", n.v))
+		}
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	return client.SendNodePoints(st.nc, userID, update, true)
+}
+
+// oidcGroups returns the live groups that map a group of the identity
+// provider, and those of them that one of claims maps. Groups in an
+// organization never map one.
+func (db *DbJetStream) oidcGroups(claims []string) (managed, want []string) {
+	seen := make(map[string]bool)
+
+	db.pointMu.RLock()
+	defer db.pointMu.RUnlock()
+
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeGroup) {
+		if e.IsTombstone() || seen[e.Down] || db.orgOf(e.Down) != "" {
+			continue
+		}
+		mapped, wanted := false, false
+		for _, p := range db.pointCache[e.Down] {
+			if p.Type != data.PointTypeOIDCGroup || p.Tombstone%2 != 0 || p.Txt() == "" {
+				continue
+			}
+			mapped = true
+			if slices.Contains(claims, p.Txt()) {
+				wanted = true
+			}
+		}
+		if !mapped {
+			continue
+		}
+		seen[e.Down] = true
+		managed = append(managed, e.Down)
+		if wanted {
+			want = append(want, e.Down)
+		}
+	}
+
+	sort.Strings(managed)
+	sort.Strings(want)
+	return managed, want
+}
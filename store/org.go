@@ -0,0 +1,224 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// isOrg reports whether a node is an organization.
+func (db *DbJetStream) isOrg(id string) bool {
+	for _, e := range db.edgeCache.Parents(id) {
+		if e.Type == data.NodeTypeOrganization {
+			return true
+		}
+	}
+	return false
+}
+
+// orgOf returns the organization a node belongs to: the node itself if it is
+// one, or the nearest organization above it through live edges. It returns ""
+// for a node outside every organization, which belongs to the instance.
+func (db *DbJetStream) orgOf(id string) string {
+	visited := map[string]bool{id: true}
+	frontier := []string{id}
+
+	for len(frontier) > 0 {
+		var next []string
+		for _, n := range frontier {
+			if db.isOrg(n) {
+				return n
+			}
+			for _, e := range db.edgeCache.Parents(n) {
+				if e.IsTombstone() || visited[e.Up] {
+					continue
+				}
+				visited[e.Up] = true
+				next = append(next, e.Up)
+			}
+		}
+		frontier = next
+	}
+
+	return ""
+}
+
+// orgAllows reports whether a user or an API key may hold a role over a node:
+// a principal in an organization only over the nodes of that organization. The
+// instance's own users are not limited.
+func (db *DbJetStream) orgAllows(principal, nodeID string) bool {
+	org := db.orgOf(principal)
+	return org == "" || db.orgOf(nodeID) == org
+}
+
+// orgByName returns the live organization whose orgName is name.
+func (db *DbJetStream) orgByName(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+
+	db.pointMu.RLock()
+	defer db.pointMu.RUnlock()
+
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeOrganization) {
+		if e.IsTombstone() {
+			continue
+		}
+		pts := db.pointCache[e.Down]
+		n, _ := pts.Text(data.PointTypeOrgName, "")
+		if n == name {
+			return e.Down, true
+		}
+	}
+
+	return "", false
+}
+
+// orgLabel names an organization in errors, and the instance for "".
+func orgLabel(org string) string {
+	if org == "" {
+		return "the instance"
+	}
+	return "organization " + org
+}
+
+// checkOrgEdge refuses an edge that would let a node cross organizations. A
+// node and everything below it belong to one organization, or to none, so an
+// edge that places a node in one may not leave it, or a node below it, with a
+// live edge in another. A node moves between organizations by leaving the one
+// it is in before it joins the other, as client.MoveNode does. Organizations
+// do not nest.
+func (db *DbJetStream) checkOrgEdge(nodeID, parentID string, points data.Points) error {
+	current, exists := db.edgeCache.Get(parentID, nodeID)
+	live := !exists || !current.IsTombstone()
+	typ := current.Type
+	for _, p := range points {
+		switch p.Type {
+		case data.PointTypeTombstone:
+			live = p.Val() == 0
+		case data.PointTypeNodeType:
+			typ = p.Txt()
+		}
+	}
+	if !live {
+		return nil
+	}
+
+	org := ""
+	if parentID != "root" && parentID != "none" && parentID != "" {
+		org = db.orgOf(parentID)
+	}
+
+	if typ == data.NodeTypeOrganization || db.isOrg(nodeID) {
+		return db.orgNest(nodeID, org)
+	}
+
+	// the node and the nodes below it, short of any organization there
+	below := map[string]bool{nodeID: true}
+	frontier := []string{nodeID}
+	for len(frontier) > 0 {
+		var next []string
+		for _, n := range frontier {
+			for _, e := range db.edgeCache.Children(n) {
+				if e.IsTombstone() || below[e.Down] {
+					continue
+				}
+				if e.Type == data.NodeTypeOrganization {
+					if err := db.orgNest(e.Down, org); err != nil {
+						return err
+					}
+					continue
+				}
+				below[e.Down] = true
+				next = append(next, e.Down)
+			}
+		}
+		frontier = next
+	}
+
+	for n := range below {
+		for _, e := range db.edgeCache.Parents(n) {
+			if e.IsTombstone() || below[e.Up] || (n == nodeID && e.Up == parentID) {
+				continue
+			}
+			if o := db.orgOf(e.Up); o != org {
+				err := fmt.Errorf("node %v is in %v and may not also be placed in %v",
+					n, orgLabel(o), orgLabel(org))
+				log.Println("Store:", err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// orgNest refuses an organization placed in org, unless org is the instance.
+func (db *DbJetStream) orgNest(id, org string) error {
+	if org == "" {
+		return nil
+	}
+	err := fmt.Errorf("organization %v may not be placed in %v", id, orgLabel(org))
+	log.Println("Store:", err)
+	return err
+}
+
+// checkOrgPoints drops the node points that would tie organizations together:
+// an orgName another organization already has, which its users log in with,
+// and a device credential a device in another organization carries, which
+// would let that device sync into this one. The error lists what was rejected.
+func (db *DbJetStream) checkOrgPoints(nodeID string, points data.Points) (data.Points, error) {
+	accepted := make(data.Points, 0, len(points))
+	var rejected []string
+
+	for _, p := range points {
+		if p.Tombstone%2 != 0 || p.Txt() == "" {
+			accepted = append(accepted, p)
+			continue
+		}
+
+		switch p.Type {
+		case data.PointTypeOrgName:
+			if id, ok := db.orgByName(p.Txt()); ok && id != nodeID {
+				rejected = append(rejected, fmt.Sprintf("organization %v is already named %v",
+					id, p.Txt()))
+				continue
+			}
+		case data.PointTypePubKey:
+			org := db.orgOf(nodeID)
+			if other, ok := db.pubKeyOtherOrg(p.Txt(), nodeID, org); ok {
+				rejected = append(rejected, fmt.Sprintf("device %v in %v already carries key %v",
+					other, orgLabel(db.orgOf(other)), p.Txt()))
+				continue
+			}
+		}
+
+		accepted = append(accepted, p)
+	}
+
+	if len(rejected) == 0 {
+		return points, nil
+	}
+
+	err := fmt.Errorf("node %v: %v", nodeID, strings.Join(rejected, "; "))
+	log.Println("Store:", err)
+
+	return accepted, err
+}
+
+// pubKeyOtherOrg returns a live device other than deviceID that carries
+// pubKey and belongs to an organization other than org.
+func (db *DbJetStream) pubKeyOtherOrg(pubKey, deviceID, org string) (string, bool) {
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeDevice) {
+		if e.IsTombstone() || e.Down == deviceID {
+			continue
+		}
+		key, _ := db.deviceCredential(e.Down)
+		if key == pubKey && db.orgOf(e.Down) != org {
+			return e.Down, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestOrgIsolation(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	// root
+	//   boss (user)
+	//   acme (organization)
+	//     acme-site (group)
+	//       acme-pump (device)
+	//     alice-a (user)
+	//   globex (organization)
+	//     globex-site (group)
+	//     alice-g (user)
+	mkTestNode(t, db, rootID, "boss", data.NodeTypeUser, "")
+	for _, org := range []string{"acme", "globex"} {
+		mkTestNode(t, db, rootID, org, data.NodeTypeOrganization, org)
+		mkTestNode(t, db, org, org+"-site", data.NodeTypeGroup, "site")
+	}
+	mkTestNode(t, db, "acme-site", "acme-pump", data.NodeTypeDevice, "pump")
+	mkTestNode(t, db, "acme", "alice-a", data.NodeTypeUser, "")
+	mkTestNode(t, db, "globex", "alice-g", data.NodeTypeUser, "")
+
+	orgs := []struct {
+		node, org string
+	}{
+		{"acme", "acme"},
+		{"acme-pump", "acme"},
+		{"alice-g", "globex"},
+		{"boss", ""},
+		{rootID, ""},
+	}
+
+	for _, test := range orgs {
+		if got := db.orgOf(test.node); got != test.org {
+			t.Errorf("organization of %v: got %q, expected %q", test.node, got, test.org)
+		}
+	}
+
+	roles := []struct {
+		user, node string
+		role       Role
+	}{
+		{"alice-a", "acme-pump", RoleAdmin},
+		{"alice-a", "globex-site", RoleNone},
+		{"alice-a", rootID, RoleNone},
+		{"alice-g", "acme-pump", RoleNone},
+		{"boss", "acme-pump", RoleAdmin},
+		{"boss", "globex-site", RoleAdmin},
+	}
+
+	for _, test := range roles {
+		if got := db.principalRole(test.user, test.node); got != test.role {
+			t.Errorf("role of %v over %v: got %v, expected %v", test.user,
+				test.node, got, test.role)
+		}
+	}
+
+	g, ok := db.sessionGrant("alice-a")
+	if !ok {
+		t.Fatal("no grant for alice-a")
+	}
+	if slices.Contains(g.Read, "globex-site") || !slices.Contains(g.Read, "acme-pump") {
+		t.Error("alice-a reads outside its organization: ", g.Read)
+	}
+	if !slices.Equal(g.Orgs, []string{"acme"}) {
+		t.Error("alice-a is not an admin of acme: ", g.Orgs)
+	}
+
+	// a node in one organization may not also be placed in another, or
+	// outside it
+	mirror := data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", 0),
+		data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
+	}
+	if db.checkOrgEdge("acme-pump", "globex-site", mirror) == nil {
+		t.Error("node mirrored into another organization")
+	}
+	if db.checkOrgEdge("acme-pump", rootID, mirror) == nil {
+		t.Error("node mirrored out of its organization")
+	}
+	if db.checkOrgEdge("acme-pump", "acme", mirror) != nil {
+		t.Error("node not mirrored within its organization")
+	}
+
+	// a deleted edge places nothing
+	deleted := data.Points{data.NewPointFloat(data.PointTypeTombstone, "", 1)}
+	if db.checkOrgEdge("acme-pump", "globex-site", deleted) != nil {
+		t.Error("deleting an edge refused")
+	}
+
+	// a node moves by leaving its organization first, and only when
+	// nothing below it stays behind
+	mkTestNode(t, db, "globex", "crew", data.NodeTypeGroup, "crew")
+	mkTestNode(t, db, "crew", "shared", data.NodeTypeDevice, "shared")
+	err := db.edgePoints("crew", "globex", deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.checkOrgEdge("crew", "acme", mirror) != nil {
+		t.Error("group moving to another organization refused")
+	}
+	err = db.edgePoints("shared", "globex-site", mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.checkOrgEdge("crew", "acme", mirror) == nil {
+		t.Error("group whose child stays in another organization accepted")
+	}
+
+	// organizations do not nest
+	org := data.Points{
+		data.NewPointFloat(data.PointTypeTombstone, "", 0),
+		data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeOrganization),
+	}
+	if db.checkOrgEdge("initech", "acme-site", org) == nil {
+		t.Error("organization placed in another")
+	}
+	if db.checkOrgEdge("initech", rootID, org) != nil {
+		t.Error("organization refused at the root")
+	}
+}
+
+func TestOrgPoints(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	mkTestNode(t, db, rootID, "acme", data.NodeTypeOrganization, "acme")
+	mkTestNode(t, db, rootID, "globex", data.NodeTypeOrganization, "globex")
+	mkTestNode(t, db, "acme", "dev-a", data.NodeTypeDevice, "")
+	mkTestNode(t, db, "acme", "dev-a2", data.NodeTypeDevice, "")
+	mkTestNode(t, db, "globex", "dev-g", data.NodeTypeDevice, "")
+
+	err := db.nodePoints("acme", data.Points{
+		data.NewPointString(data.PointTypeOrgName, "", "acme")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.nodePoints("dev-a", data.Points{
+		data.NewPointString(data.PointTypePubKey, "", "UKEY")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, ok := db.orgByName("acme"); !ok || id != "acme" {
+		t.Errorf("acme not found by name: %v, %v", id, ok)
+	}
+
+	pts, err := db.checkOrgPoints("globex", data.Points{
+		data.NewPointString(data.PointTypeOrgName, "", "acme"),
+		data.NewPointString(data.PointTypeDescription, "", "Globex"),
+	})
+	if err == nil || len(pts) != 1 || pts[0].Type != data.PointTypeDescription {
+		t.Errorf("taken name accepted: %v, %v", pts, err)
+	}
+	if _, err := db.checkOrgPoints("acme", data.Points{
+		data.NewPointString(data.PointTypeOrgName, "", "acme")}); err != nil {
+		t.Error("organization may not keep its own name: ", err)
+	}
+
+	key := data.Points{data.NewPointString(data.PointTypePubKey, "", "UKEY")}
+	if _, err := db.checkOrgPoints("dev-g", key); err == nil {
+		t.Error("key of a device in another organization accepted")
+	}
+	if _, err := db.checkOrgPoints("dev-a2", key); err != nil {
+		t.Error("key of a device in the same organization refused: ", err)
+	}
+
+	// a key that reached two organizations anyway is refused in both
+	if _, ok := db.deviceGrant("UKEY"); !ok {
+		t.Fatal("no grant for dev-a")
+	}
+	err = db.nodePoints("dev-g", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.deviceGrant("UKEY"); ok {
+		t.Error("key carried in two organizations granted")
+	}
+}
+
+func TestOrgUserCheck(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	for _, org := range []string{"acme", "globex"} {
+		mkTestNode(t, db, rootID, org, data.NodeTypeOrganization, org)
+		err := db.nodePoints(org, data.Points{
+			data.NewPointString(data.PointTypeOrgName, "", org)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the same email in both
+		user := "alice-" + org
+		mkTestNode(t, db, org, user, data.NodeTypeUser, "")
+		p, err := hashPassword(data.NewPointString(data.PointTypePass, "", org+"-pass"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.nodePoints(user, data.Points{
+			data.NewPointString(data.PointTypeEmail, "", "alice@example.com"), p})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		org, pass, user string
+	}{
+		{"acme", "acme-pass", "alice-acme"},
+		{"globex", "globex-pass", "alice-globex"},
+		{"acme", "globex-pass", ""},
+		{"", "acme-pass", ""},
+		{"initech", "acme-pass", ""},
+	}
+
+	for _, test := range tests {
+		users, err := db.userCheck(test.org, "alice@example.com", test.pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if len(users) > 0 {
+			got = users[0].ID
+		}
+		if got != test.user {
+			t.Errorf("login to %q with %v: got %q, expected %q", test.org,
+				test.pass, got, test.user)
+		}
+	}
+
+	// the instance's own admin logs in without an organization
+	users, err := db.userCheck("", "admin", "admin")
+	if err != nil || len(users) == 0 {
+		t.Errorf("instance admin could not log in: %v, %v", users, err)
+	}
+}
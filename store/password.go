@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User passwords are stored as bcrypt hashes. The pass point is hashed as it
+// is written, so the password itself never reaches a stream, a replica or an
+// export. A value that is already a hash is written as it is, which lets a
+// hash be copied between instances and imported again.
+
+// passwordHashed reports whether a pass value is a bcrypt hash rather than
+// a password.
+func passwordHashed(v string) bool {
+	_, err := bcrypt.Cost([]byte(v))
+	return err == nil
+}
+
+// hashPassword returns the pass point with its password replaced by a hash.
+// A deleted or empty point, or one that already holds a hash, is returned as
+// it is.
+func hashPassword(p data.Point) (data.Point, error) {
+	if p.Type != data.PointTypePass || p.Tombstone%2 != 0 {
+		return p, nil
+	}
+
+	v := p.Txt()
+	if v == "" || passwordHashed(v) {
+		return p, nil
+	}
+
+	h, err := bcrypt.GenerateFromPassword([]byte(v), bcrypt.DefaultCost)
+	if err != nil {
+		return p, fmt.Errorf("error hashing password: %v", err)
+	}
+
+	p.PutString(string(h))
+	return p, nil
+}
+
+// passwordMatch checks a password against a stored pass value. A value still
+// in plain text, which an instance from before passwords were hashed can
+// sync in, is compared in constant time.
+func passwordMatch(stored, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if passwordHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// migratePasswords hashes the passwords this instance wrote before they were
+// hashed, and purges the plain text from the stream history.
+func (db *DbJetStream) migratePasswords() error {
+	self := db.meta.RootID
+
+	type plain struct {
+		id string
+		p  data.Point
+	}
+	var found []plain
+
+	db.pointMu.RLock()
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeUser) {
+		p, ok := db.pointCache[e.Down].Find(data.PointTypePass, "")
+		if !ok || p.Tombstone%2 != 0 || p.Txt() == "" || passwordHashed(p.Txt()) {
+			continue
+		}
+		if db.pointOrigin[e.Down][p.Type+"|"+p.Key] != self {
+			// another instance's user, which that instance migrates
+			continue
+		}
+		found = append(found, plain{id: e.Down, p: p})
+	}
+	db.pointMu.RUnlock()
+
+	for _, f := range found {
+		p := f.p
+		p.Time = time.Now()
+		if !p.Time.After(f.p.Time) {
+			p.Time = f.p.Time.Add(time.Millisecond)
+		}
+
+		err := db.nodePoints(f.id, data.Points{p})
+		if err != nil {
+			return fmt.Errorf("error hashing password of user %v: %v", f.id, err)
+		}
+
+		boundary := db.edgeCache.OwningBoundary(f.id, self)
+		s, err := db.ensureOriginStream(boundary)
+		if err != nil {
+			return err
+		}
+		err = purgePasswordHistory(s, nodePointSubject(boundary, self, f.id, p.Type, p.Key))
+		if err != nil {
+			return err
+		}
+
+		log.Println("STORE: hashed stored password of user", f.id)
+	}
+
+	return nil
+}
+
+// purgePasswordHistory removes all but the latest message on a pass point
+// subject, so an older plain text value does not stay in the history.
+func purgePasswordHistory(s jetstream.Stream, subject string) error {
+	err := s.Purge(context.Background(), jetstream.WithPurgeSubject(subject),
+		jetstream.WithPurgeKeep(1))
+	if err != nil {
+		return fmt.Errorf("error purging %v: %v", subject, err)
+	}
+	return nil
+}
+
+// passwordReplicated purges the history of a replica stream's pass point once
+// a hash arrives on it, so the plain text an instance wrote before it was
+// upgraded does not stay in the copy here either.
+func passwordReplicated(s jetstream.Stream, subject string, payload []byte) {
+	tok := strings.Split(subject, ".")
+	if len(tok) != 7 || tok[4] != "p" || tok[5] != data.PointTypePass {
+		return
+	}
+
+	pts, err := data.DecodePoints(payload)
+	if err != nil || len(pts) == 0 || !passwordHashed(pts[0].Txt()) {
+		return
+	}
+
+	err = purgePasswordHistory(s, subject)
+	if err != nil {
+		log.Println("STORE:", err)
+	}
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestPasswordMatch(t *testing.T) {
+	p, err := hashPassword(data.NewPointString(data.PointTypePass, "", "secret"))
+	if err != nil {
+		t.Fatal("Error hashing password:", err)
+	}
+	if !passwordHashed(p.Txt()) {
+		t.Fatal("password not hashed:", p.Txt())
+	}
+
+	again, err := hashPassword(p)
+	if err != nil || again.Txt() != p.Txt() {
+		t.Fatal("a hash was hashed again")
+	}
+
+	if !passwordMatch(p.Txt(), "secret") || passwordMatch(p.Txt(), "wrong") {
+		t.Fatal("hashed password did not check")
+	}
+	if passwordMatch(p.Txt(), p.Txt()) {
+		t.Fatal("the hash itself logged in")
+	}
+	if !passwordMatch("legacy", "legacy") || passwordMatch("legacy", "wrong") {
+		t.Fatal("plain text password did not check")
+	}
+	if passwordMatch("", "") {
+		t.Fatal("empty password logged in")
+	}
+}
+
+// passSubjectMsgs returns the pass point values held in a stream for a node,
+// oldest first.
+func passSubjectMsgs(t *testing.T, db *DbJetStream, id string) []string {
+	t.Helper()
+	ctx := context.Background()
+	rootID := db.rootNodeID()
+
+	s, err := db.js.Stream(ctx, streamName(rootID, rootID))
+	if err != nil {
+		t.Fatal("Error getting stream:", err)
+	}
+
+	subject := nodePointSubject(rootID, rootID, id, data.PointTypePass, "0")
+	c, err := s.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+	})
+	if err != nil {
+		t.Fatal("Error creating consumer:", err)
+	}
+
+	var ret []string
+	for {
+		msg, err := c.Next(jetstream.FetchMaxWait(200 * time.Millisecond))
+		if err != nil {
+			break
+		}
+		pts, err := data.DecodePoints(msg.Data())
+		if err != nil || len(pts) != 1 {
+			t.Fatal("Error decoding pass point:", err)
+		}
+		ret = append(ret, pts[0].Txt())
+	}
+	return ret
+}
+
+func TestPasswordStoredHashed(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	user := uuid.New().String()
+	mkTestNode(t, db, rootID, user, data.NodeTypeUser, "")
+
+	err := db.nodePoints(user, data.Points{
+		data.NewPointString(data.PointTypeEmail, "", "test"),
+		data.NewPointString(data.PointTypePass, "", "secret"),
+	})
+	if err != nil {
+		t.Fatal("Error writing user points:", err)
+	}
+
+	msgs := passSubjectMsgs(t, db, user)
+	if len(msgs) != 1 || !passwordHashed(msgs[0]) {
+		t.Fatal("password not stored hashed:", msgs)
+	}
+
+	users, err := db.userCheck("", "test", "secret")
+	if err != nil || len(users) != 1 {
+		t.Fatal("user did not log in:", err, len(users))
+	}
+	users, err = db.userCheck("", "test", msgs[0])
+	if err != nil || len(users) != 0 {
+		t.Fatal("user logged in with the hash:", err, len(users))
+	}
+}
+
+// An instance from before passwords were hashed has them in plain text in
+// its stream. Opening the store hashes them and purges the old value.
+func TestPasswordMigration(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	user := uuid.New().String()
+	mkTestNode(t, db, rootID, user, data.NodeTypeUser, "")
+
+	// written the way an older version did, straight to the stream
+	pts := data.Points{
+		data.NewPointString(data.PointTypeEmail, "", "old"),
+		data.NewPointString(data.PointTypePass, "", "plain"),
+	}
+	for _, p := range pts {
+		p.Time = time.Now()
+		p.Key = "0"
+		subject := nodePointSubject(rootID, rootID, user, p.Type, p.Key)
+		enc := data.Points{p}
+		_, err := db.js.Publish(context.Background(), subject, enc.Encode())
+		if err != nil {
+			t.Fatal("Error publishing point:", err)
+		}
+	}
+
+	if msgs := passSubjectMsgs(t, db, user); len(msgs) != 1 || msgs[0] != "plain" {
+		t.Fatal("plain text password not in place:", msgs)
+	}
+
+	db, err := NewJetStreamDb(db.nc, "", JsConfig{})
+	if err != nil {
+		t.Fatal("Error re-opening JetStream db:", err)
+	}
+
+	msgs := passSubjectMsgs(t, db, user)
+	if len(msgs) != 1 || !passwordHashed(msgs[0]) {
+		t.Fatal("password not migrated, stream holds:", msgs)
+	}
+
+	users, err := db.userCheck("", "old", "plain")
+	if err != nil || len(users) != 1 {
+		t.Fatal("migrated user did not log in:", err, len(users))
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// pointHistory returns the values a node's points have held, oldest first,
+// read from the streams the way the audit trail is. typ and key, when set,
+// limit the points returned, and a zero start or end leaves that side of the
+// time range open. When limit is above zero, only the newest limit values are
+// returned. Points the store does not keep in its streams, such as high-rate
+// points, have no history.
+func (db *DbJetStream) pointHistory(nodeID, typ, key string, start, end time.Time, limit int) (data.Points, error) {
+	if typ == "" {
+		typ = "*"
+	}
+	if key == "" {
+		key = "*"
+	}
+
+	// every write to each point, keyed as auditMsg keys them
+	writes := make(map[string][]auditWrite)
+	nodes := map[string]bool{nodeID: true}
+
+	ctx := context.Background()
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		b, o, ok := streamBoundaryOrigin(si.Config)
+		if !ok {
+			continue
+		}
+
+		s, err := db.js.Stream(ctx, si.Config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting stream %v: %v", si.Config.Name, err)
+		}
+
+		filter := fmt.Sprintf("inst.%v.%v.%v.p.%v.%v", b, o, nodeID, typ, key)
+		err = scanStream(ctx, s, filter, func(subject string, payload []byte) {
+			auditMsg(writes, nodes, subject, payload)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading history of %v: %v", si.Config.Name, err)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, err
+	}
+
+	var ret data.Points
+
+	for _, ws := range writes {
+		sort.SliceStable(ws, func(i, j int) bool {
+			return ws[i].point.Time.Before(ws[j].point.Time)
+		})
+
+		for i, w := range ws {
+			if i > 0 && auditSameWrite(ws[i-1].point, w.point) {
+				// the copy a boundary migration leaves in the new
+				// boundary's stream
+				continue
+			}
+
+			p := w.point
+			if (start.IsZero() || !p.Time.Before(start)) &&
+				(end.IsZero() || !p.Time.After(end)) {
+				ret = append(ret, p)
+			}
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if !ret[i].Time.Equal(ret[j].Time) {
+			return ret[i].Time.Before(ret[j].Time)
+		}
+		if ret[i].Type != ret[j].Type {
+			return ret[i].Type < ret[j].Type
+		}
+		return ret[i].Key < ret[j].Key
+	})
+
+	if limit > 0 && len(ret) > limit {
+		ret = ret[len(ret)-limit:]
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestPointHistory(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	dev := uuid.New().String()
+	other := uuid.New().String()
+
+	mkTestNode(t, db, rootID, dev, data.NodeTypeDevice, "device")
+	mkTestNode(t, db, rootID, other, data.NodeTypeDevice, "other")
+
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	write := func(id, typ, key string, v float64, s int) {
+		t.Helper()
+		p := data.NewPointFloat(typ, key, v)
+		p.Time = at(s)
+		if err := db.nodePoints(id, data.Points{p}); err != nil {
+			t.Fatal("Error writing points:", err)
+		}
+	}
+
+	write(dev, data.PointTypeValue, "", 1, 1)
+	write(dev, data.PointTypeValue, "", 2, 2)
+	write(dev, data.PointTypeValue, "a", 10, 3)
+	write(dev, data.PointTypeTemperature, "", 20, 4)
+	write(other, data.PointTypeValue, "", 99, 5)
+
+	history := func(typ, key string, start, end time.Time, limit int) string {
+		t.Helper()
+		points, err := db.pointHistory(dev, typ, key, start, end, limit)
+		if err != nil {
+			t.Fatal("Error reading history:", err)
+		}
+		var ret []string
+		for _, p := range points {
+			if p.Time.Before(at(1)) {
+				// the points the node was created with
+				continue
+			}
+			ret = append(ret, fmt.Sprintf("%v.%v=%v", p.Type, p.Key, p.Val()))
+		}
+		return fmt.Sprint(ret)
+	}
+
+	tests := []struct {
+		name       string
+		typ, key   string
+		start, end time.Time
+		limit      int
+		exp        string
+	}{
+		{"all", "", "", time.Time{}, time.Time{}, 0,
+			"[value.0=1 value.0=2 value.a=10 temp.0=20]"},
+		{"type", data.PointTypeValue, "", time.Time{}, time.Time{}, 0,
+			"[value.0=1 value.0=2 value.a=10]"},
+		{"key", data.PointTypeValue, "a", time.Time{}, time.Time{}, 0, "[value.a=10]"},
+		{"range", "", "", at(2), at(3), 0, "[value.0=2 value.a=10]"},
+		{"limit", "", "", time.Time{}, time.Time{}, 2, "[value.a=10 temp.0=20]"},
+	}
+
+	for _, test := range tests {
+		if got := history(test.typ, test.key, test.start, test.end, test.limit); got != test.exp {
+			t.Errorf("%v: got %v, expected %v", test.name, got, test.exp)
+		}
+	}
+}
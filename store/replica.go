@@ -28,29 +28,44 @@ import (
 // changed subject is sent once the backlog drains, so state clients see
 // converged state rather than a replay of intermediate points.
 
-// mergeRemoteNodePoints merges points written by another instance into
-// the point cache without persisting them.
-func (db *DbJetStream) mergeRemoteNodePoints(id string, points data.Points, origin string) {
-	for _, p := range points {
-		db.mergePointTip(id, p, origin)
+// remoteNodeTips keeps the points of a message carrying the origin header
+// that are the tips the replica consumer already merged from origin. The
+// store's own re-broadcasts always are, so a client that sets the header
+// itself can neither write points past the role checks nor fan out points
+// that were never merged.
+func (db *DbJetStream) remoteNodeTips(id string, points data.Points, origin string) data.Points {
+	db.pointMu.RLock()
+	defer db.pointMu.RUnlock()
+
+	var ret data.Points
+	for _, pIn := range points {
+		if pIn.Key == "" {
+			pIn.Key = "0"
+		}
+		if db.pointOrigin[id][pIn.Type+"|"+pIn.Key] != origin {
+			continue
+		}
+		for _, p := range db.pointCache[id] {
+			if p.Type == pIn.Type && p.Key == pIn.Key && p.Time.Equal(pIn.Time) {
+				ret = append(ret, pIn)
+				break
+			}
+		}
 	}
+
+	return ret
 }
 
-// mergeRemoteEdgePoints merges edge points written by another instance
-// into the edge cache without persisting them. Edges with the virtual
-// "root" parent are instance-local (they anchor the writing instance's
-// own tree) and are never merged from a remote origin.
-func (db *DbJetStream) mergeRemoteEdgePoints(nodeID, parentID string, points data.Points, origin string) {
-	if parentID == "root" {
-		return
-	}
-	nodeType := ""
+// remoteEdgeTips is remoteNodeTips for edge points.
+func (db *DbJetStream) remoteEdgeTips(nodeID, parentID string, points data.Points,
+	origin string) data.Points {
+	var ret data.Points
 	for _, p := range points {
-		if p.Type == data.PointTypeNodeType {
-			nodeType = p.Txt()
+		if db.edgeCache.IsTip(parentID, nodeID, p, origin) {
+			ret = append(ret, p)
 		}
 	}
-	db.edgeCache.MergeEdgePoints(parentID, nodeID, nodeType, origin, points)
+	return ret
 }
 
 // replicaManager tracks running replica stream consumers.
@@ -109,13 +124,29 @@ func (rm *replicaManager) scan() {
 	ctx := context.Background()
 	self := rm.db.meta.RootID
 
+	domain := ""
+	if info, err := rm.db.js.AccountInfo(ctx); err == nil {
+		domain = info.Domain
+	}
+
 	lister := rm.db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
 	for si := range lister.Info() {
-		_, origin, ok := streamBoundaryOrigin(si.Config)
+		boundary, origin, ok := streamBoundaryOrigin(si.Config)
 		if !ok || origin == self {
 			continue
 		}
 
+		// a device waiting for adoption approval is not taken in until
+		// it is approved, and one that was rejected may not keep streams
+		// here at all
+		if rm.heldForAdoption(si.Config.Name, boundary, origin) {
+			continue
+		}
+
+		// checked every scan, since a device may update its replicas
+		// here at any time
+		cfg := rm.checkSources(si.Config, domain)
+
 		rm.mu.Lock()
 		_, already := rm.running[si.Config.Name]
 		rm.mu.Unlock()
@@ -126,7 +157,7 @@ func (rm *replicaManager) scan() {
 		// the local store owns stream configuration: the sync pumps
 		// create replica streams bare, and this instance's storage
 		// policy is applied when the stream is discovered
-		rm.applyPolicy(si.Config)
+		rm.applyPolicy(cfg)
 
 		cc, err := rm.consumeReplica(si.Config.Name, origin)
 		if err != nil {
@@ -144,6 +175,85 @@ func (rm *replicaManager) scan() {
 	}
 }
 
+// heldForAdoption reports whether a replica stream belongs to a device that is
+// waiting for adoption approval or was rejected, and removes the stream in the
+// second case.
+func (rm *replicaManager) heldForAdoption(name, boundary, origin string) bool {
+	rejected := false
+	held := false
+	for _, id := range []string{boundary, origin} {
+		switch rm.db.adoptionState(id) {
+		case data.AdoptionRejected:
+			rejected = true
+		case data.AdoptionPending:
+			held = true
+		}
+	}
+
+	if !rejected {
+		return held
+	}
+
+	rm.mu.Lock()
+	if cc, ok := rm.running[name]; ok {
+		cc.Stop()
+		delete(rm.running, name)
+	}
+	rm.mu.Unlock()
+
+	err := rm.db.js.DeleteStream(context.Background(), name)
+	if err != nil {
+		log.Printf("STORE: error removing replica %v of a rejected device: %v", name, err)
+	} else {
+		log.Printf("STORE: removed replica %v of a rejected device", name)
+	}
+	return true
+}
+
+// checkSources drops the sources of a replica stream unless it has the one a
+// sync over a leafnode sets up: the stream of the same name, in the domain of
+// another instance. Anything else would let a device that may update its
+// replicas here copy in a stream it has no business writing, or one of this
+// instance's own. It returns the configuration the stream is left with.
+func (rm *replicaManager) checkSources(cfg jetstream.StreamConfig, domain string) jetstream.StreamConfig {
+	if len(cfg.Sources) == 0 && cfg.Mirror == nil {
+		return cfg
+	}
+
+	if cfg.Mirror == nil && len(cfg.Sources) == 1 {
+		src := cfg.Sources[0]
+		d := sourceDomain(src)
+		if src.Name == cfg.Name && d != "" && d != domain {
+			return cfg
+		}
+	}
+
+	log.Printf("STORE: dropping the sources of replica %v, which are not its own stream in another domain",
+		cfg.Name)
+
+	cfg.Sources = nil
+	cfg.Mirror = nil
+	_, err := rm.db.js.UpdateStream(context.Background(), cfg)
+	if err != nil {
+		log.Printf("STORE: error dropping the sources of %v: %v", cfg.Name, err)
+	}
+	return cfg
+}
+
+// sourceDomain returns the domain a stream source reads from, which the server
+// hands back only as the API prefix it became.
+func sourceDomain(ss *jetstream.StreamSource) string {
+	if ss.External == nil {
+		return ss.Domain
+	}
+
+	tok := strings.Split(ss.External.APIPrefix, ".")
+	if len(tok) != 3 || tok[0] != "$JS" || tok[2] != "API" {
+		return ""
+	}
+	return tok[1]
+}
+
 // applyPolicy brings a replica stream's per-subject retention and file
 // store compression in line with this instance's policy, leaving the
 // rest of its configuration as is. Both are settings about how this
@@ -191,13 +301,16 @@ func (rm *replicaManager) consumeReplica(name, origin string) (jetstream.Consume
 	caughtUp := false
 
 	return c.Consume(func(msg jetstream.Msg) {
-		changed := rm.db.mergeReplicaMsg(msg.Subject(), msg.Data(), origin)
-
 		backlog := uint64(0)
+		detect := false
 		if meta, err := msg.Metadata(); err == nil {
 			backlog = meta.NumPending
+			detect = rm.db.conflictDetect(name, meta.Sequence.Stream)
 		}
 
+		changed := rm.db.mergeReplicaMsg(msg.Subject(), msg.Data(), origin, detect)
+		passwordReplicated(s, msg.Subject(), msg.Data())
+
 		switch {
 		case caughtUp:
 			if changed {
@@ -225,7 +338,9 @@ func (rm *replicaManager) consumeReplica(name, origin string) (jetstream.Consume
 // returning true if it changed a subject tip. The storage subject is
 // inst.<boundary>.<origin>.<nodeID>.p.<type>.<key> for node points or
 // inst.<boundary>.<origin>.<parentID>.ep.<childID> for edge points.
-func (db *DbJetStream) mergeReplicaMsg(subject string, payload []byte, origin string) bool {
+// detect checks the node points for sync conflicts as they are merged.
+func (db *DbJetStream) mergeReplicaMsg(subject string, payload []byte, origin string,
+	detect bool) bool {
 	tok := strings.Split(subject, ".")
 
 	pts, err := data.DecodePoints(payload)
@@ -245,9 +360,13 @@ func (db *DbJetStream) mergeReplicaMsg(subject string, payload []byte, origin st
 			if p.Key == "" {
 				p.Key = tok[6]
 			}
-			if db.mergePointTip(nodeID, p, origin) {
+			won, prev, prevOrigin := db.mergePointTipPrev(nodeID, p, origin)
+			if won {
 				changed = true
 			}
+			if detect {
+				db.checkConflict(nodeID, p, origin, prev, prevOrigin, won)
+			}
 		}
 		return changed
 	case len(tok) == 6 && tok[4] == "ep":
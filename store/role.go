@@ -0,0 +1,331 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Role is what a user may do with the nodes below a place it holds in the
+// tree. Roles are ordered: each can do what the ones before it can.
+type Role int
+
+// The roles a user can hold. RoleNone is held where the user has no place at
+// all.
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleOperator
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return data.PointValueRoleViewer
+	case RoleOperator:
+		return data.PointValueRoleOperator
+	case RoleAdmin:
+		return data.PointValueRoleAdmin
+	}
+	return "none"
+}
+
+// parseRole reads a role point. The user role from before there were
+// operators is a viewer. It returns false when no role is set.
+func parseRole(v string) (Role, bool) {
+	switch v {
+	case data.PointValueRoleAdmin:
+		return RoleAdmin, true
+	case data.PointValueRoleOperator:
+		return RoleOperator, true
+	case data.PointValueRoleViewer, data.PointValueRoleUser:
+		return RoleViewer, true
+	}
+	return RoleNone, false
+}
+
+// edgeRole returns the role set on an edge, if one is.
+func edgeRole(e EdgeEntry) (Role, bool) {
+	v, _ := e.Points.Text(data.PointTypeRole, "")
+	return parseRole(v)
+}
+
+// placeRole returns the role a user holds through one of its edges: the role
+// set on the edge, or when none is, the role of the group the user is in (see
+// groupRole). A user with no role set anywhere is an admin, as every user was
+// before there were roles.
+func (db *DbJetStream) placeRole(e EdgeEntry) Role {
+	if r, ok := edgeRole(e); ok {
+		return r
+	}
+	if r, ok := db.groupRole(e.Up, make(map[string]bool)); ok {
+		return r
+	}
+	return RoleAdmin
+}
+
+// groupRole returns the role set on the edges of a group, which its members
+// hold, taken from the group above it when none is. A group in several places
+// gives the highest of their roles.
+func (db *DbJetStream) groupRole(id string, visited map[string]bool) (Role, bool) {
+	if visited[id] {
+		return RoleNone, false
+	}
+	visited[id] = true
+
+	ret, found := RoleNone, false
+	for _, e := range db.edgeCache.Parents(id) {
+		if e.IsTombstone() || e.Type != data.NodeTypeGroup {
+			continue
+		}
+		r, ok := edgeRole(e)
+		if !ok {
+			r, ok = db.groupRole(e.Up, visited)
+		}
+		if ok && (!found || r > ret) {
+			ret, found = r, true
+		}
+	}
+
+	return ret, found
+}
+
+// userRole returns the highest role a user holds over a node: through each
+// of its places whose subtree the node is in.
+func (db *DbJetStream) userRole(userID, nodeID string) Role {
+	var ret Role
+
+	for _, e := range db.edgeCache.Parents(userID) {
+		if e.IsTombstone() || e.Up == "root" {
+			continue
+		}
+		if !db.inSubtree(e.Up, nodeID) {
+			continue
+		}
+		if r := db.placeRole(e); r > ret {
+			ret = r
+		}
+	}
+
+	return ret
+}
+
+// inSubtree reports whether id is top or below it through live edges.
+func (db *DbJetStream) inSubtree(top, id string) bool {
+	visited := map[string]bool{id: true}
+	frontier := []string{id}
+
+	for len(frontier) > 0 {
+		var next []string
+		for _, n := range frontier {
+			if n == top {
+				return true
+			}
+			for _, e := range db.edgeCache.Parents(n) {
+				if e.IsTombstone() || visited[e.Up] {
+					continue
+				}
+				visited[e.Up] = true
+				next = append(next, e.Up)
+			}
+		}
+		frontier = next
+	}
+
+	return false
+}
+
+// principalRole returns the role a user or an API key holds over a node.
+// A principal in an organization holds no role outside it.
+func (db *DbJetStream) principalRole(id, nodeID string) Role {
+	if !db.orgAllows(id, nodeID) {
+		return RoleNone
+	}
+	if db.isAPIKey(id) {
+		return db.apiKeyRole(id, nodeID)
+	}
+	return db.userRole(id, nodeID)
+}
+
+// isPrincipal reports whether a node is a user or an API key, the writers
+// whose roles are checked.
+func (db *DbJetStream) isPrincipal(id string) bool {
+	return db.isUser(id) || db.isAPIKey(id)
+}
+
+// principalKind names what a principal is in errors.
+func (db *DbJetStream) principalKind(id string) string {
+	if db.isAPIKey(id) {
+		return "API key"
+	}
+	return "user"
+}
+
+// isUser reports whether a node is a user.
+func (db *DbJetStream) isUser(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, e := range db.edgeCache.Parents(id) {
+		if e.Type == data.NodeTypeUser {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizePoints drops the node points a writer may not write. A browser
+// session or an API key connection writes as its principal (see
+// client.SubjectNodePointsAs), and its points carry that principal as their
+// origin: a blank origin is set to it, and a point that names another is
+// rejected. Other points are checked against the user in their origin, which
+// is how the API marks a user's writes; a point written by a client, a device
+// or a tool rather than by a user is not checked, since those connect with the
+// instance's own credentials, and neither is a node not yet in the tree.
+// Viewers may not write at all, and operators only setpoints (see
+// data.IsSetpoint). Users may always change their own node; an API key may not
+// change its own. The error lists what was rejected.
+func (db *DbJetStream) authorizePoints(principal, nodeID string, points data.Points) (data.Points, error) {
+	accepted := make(data.Points, 0, len(points))
+	var rejected []string
+
+	// a node being created gets its points before its edge, and the edge
+	// is what is checked
+	placed := len(db.edgeCache.Parents(nodeID)) > 0
+
+	for _, p := range points {
+		if principal != "" {
+			if p.Origin == "" {
+				p.Origin = principal
+			}
+			if p.Origin != principal {
+				rejected = append(rejected, fmt.Sprintf("%v %v may not write %v as %v",
+					db.principalKind(principal), principal, p.Type, p.Origin))
+				continue
+			}
+		} else if !db.isPrincipal(p.Origin) || !placed {
+			accepted = append(accepted, p)
+			continue
+		}
+
+		if p.Origin == nodeID && !db.isAPIKey(nodeID) {
+			accepted = append(accepted, p)
+			continue
+		}
+
+		role := db.principalRole(p.Origin, nodeID)
+		if role == RoleAdmin || (role == RoleOperator && data.IsSetpoint(p.Type)) {
+			accepted = append(accepted, p)
+			continue
+		}
+
+		rejected = append(rejected, fmt.Sprintf("%v %v (%v) may not write %v",
+			db.principalKind(p.Origin), p.Origin, role, p.Type))
+	}
+
+	if len(rejected) == 0 {
+		return accepted, nil
+	}
+
+	err := fmt.Errorf("not authorized: node %v: %v", nodeID, strings.Join(rejected, "; "))
+	log.Println("Store:", err)
+
+	return accepted, err
+}
+
+// authorizeEdge checks that the writer of an edge is an admin over the
+// parent: adding, moving and deleting nodes, and handing out roles, is for
+// admins. An edge that places a node somewhere it is not yet also needs an
+// admin over the places the node already has, or had last if it was deleted,
+// so only someone who may change a node where it is can move or mirror it.
+// The writer is found as in authorizePoints, and the points are returned with
+// the origin of a principal set.
+func (db *DbJetStream) authorizeEdge(principal, nodeID, parentID string,
+	points data.Points) (data.Points, error) {
+	scope := parentID
+	if scope == "root" || scope == "none" || scope == "" {
+		scope = nodeID
+	}
+
+	scopes := []string{scope}
+	if db.edgeBecomesLive(nodeID, parentID, points) {
+		scopes = append(scopes, db.nodePlaces(nodeID, parentID)...)
+	}
+
+	ret := make(data.Points, len(points))
+
+	for i, p := range points {
+		if principal != "" {
+			if p.Origin == "" {
+				p.Origin = principal
+			}
+			if p.Origin != principal {
+				err := fmt.Errorf("not authorized: %v %v may not write %v as %v",
+					db.principalKind(principal), principal, p.Type, p.Origin)
+				log.Println("Store:", err)
+				return nil, err
+			}
+		}
+		ret[i] = p
+
+		if !db.isPrincipal(p.Origin) {
+			continue
+		}
+
+		for _, s := range scopes {
+			role := db.principalRole(p.Origin, s)
+			if role != RoleAdmin {
+				err := fmt.Errorf("not authorized: %v %v (%v) may not change the nodes of %v",
+					db.principalKind(p.Origin), p.Origin, role, s)
+				log.Println("Store:", err)
+				return nil, err
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// edgeBecomesLive reports whether writing points to an edge makes it live
+// where it was not: a new edge, or a deleted one restored.
+func (db *DbJetStream) edgeBecomesLive(nodeID, parentID string, points data.Points) bool {
+	current, exists := db.edgeCache.Get(parentID, nodeID)
+	live := !exists || !current.IsTombstone()
+	for _, p := range points {
+		if p.Type == data.PointTypeTombstone {
+			live = p.Val() == 0
+		}
+	}
+	return live && (!exists || current.IsTombstone())
+}
+
+// nodePlaces returns the parents of a node other than parentID: those with a
+// live edge, or when it has none, those it was deleted from.
+func (db *DbJetStream) nodePlaces(nodeID, parentID string) []string {
+	var live, deleted []string
+	for _, e := range db.edgeCache.Parents(nodeID) {
+		if e.Up == parentID || e.Up == "root" || e.Up == "none" {
+			continue
+		}
+		if e.IsTombstone() {
+			deleted = append(deleted, e.Up)
+		} else {
+			live = append(live, e.Up)
+		}
+	}
+
+	if len(live) > 0 {
+		return live
+	}
+	return deleted
+}
+
+// CanWrite reports whether a user or an API key is an admin over a node, and
+// so may write its points and add nodes below it. The HTTP API checks it before
+// handing a write to a client that writes with its own origin.
+func (st *Store) CanWrite(principal, nodeID string) bool {
+	return st.db.principalRole(principal, nodeID) == RoleAdmin
+}
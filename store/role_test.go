@@ -0,0 +1,181 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func setTestRole(t *testing.T, db *DbJetStream, id, parent, role string) {
+	t.Helper()
+	err := db.edgePoints(id, parent, data.Points{
+		data.NewPointString(data.PointTypeRole, "", role)})
+	if err != nil {
+		t.Fatalf("Error setting role of %v: %v", id, err)
+	}
+}
+
+func TestUserRole(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	// root
+	//   site (group, operators)
+	//     crew (group)
+	//       op (user, no role of its own)
+	//     pump (device)
+	//     viewer (user, viewer)
+	//   other (group)
+	//     legacy (user, no role anywhere)
+	mkTestNode(t, db, rootID, "site", data.NodeTypeGroup, "site")
+	mkTestNode(t, db, "site", "crew", data.NodeTypeGroup, "crew")
+	mkTestNode(t, db, "crew", "op", data.NodeTypeUser, "")
+	mkTestNode(t, db, "site", "pump", data.NodeTypeDevice, "pump")
+	mkTestNode(t, db, "site", "viewer", data.NodeTypeUser, "")
+	mkTestNode(t, db, rootID, "other", data.NodeTypeGroup, "other")
+	mkTestNode(t, db, "other", "legacy", data.NodeTypeUser, "")
+
+	setTestRole(t, db, "site", rootID, data.PointValueRoleOperator)
+	setTestRole(t, db, "viewer", "site", data.PointValueRoleViewer)
+
+	tests := []struct {
+		user, node string
+		role       Role
+	}{
+		{"op", "crew", RoleOperator},
+		{"op", "pump", RoleNone},
+		{"viewer", "pump", RoleViewer},
+		{"viewer", "other", RoleNone},
+		{"legacy", "other", RoleAdmin},
+		{"legacy", "site", RoleNone},
+	}
+
+	for _, test := range tests {
+		if got := db.userRole(test.user, test.node); got != test.role {
+			t.Errorf("role of %v over %v: got %v, expected %v", test.user,
+				test.node, got, test.role)
+		}
+	}
+
+	// a role on the user's own edge wins over the group's
+	setTestRole(t, db, "op", "crew", data.PointValueRoleAdmin)
+	if got := db.userRole("op", "crew"); got != RoleAdmin {
+		t.Error("role on the user's edge not used, got", got)
+	}
+	setTestRole(t, db, "op", "crew", "")
+	if got := db.userRole("op", "crew"); got != RoleOperator {
+		t.Error("group role not used once the user's is cleared, got", got)
+	}
+}
+
+func TestAuthorizeWrites(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+
+	mkTestNode(t, db, rootID, "site", data.NodeTypeGroup, "site")
+	mkTestNode(t, db, "site", "pump", data.NodeTypeDevice, "pump")
+	mkTestNode(t, db, "site", "viewer", data.NodeTypeUser, "")
+	mkTestNode(t, db, "site", "op", data.NodeTypeUser, "")
+	mkTestNode(t, db, "site", "admin", data.NodeTypeUser, "")
+	setTestRole(t, db, "viewer", "site", data.PointValueRoleViewer)
+	setTestRole(t, db, "op", "site", data.PointValueRoleOperator)
+	setTestRole(t, db, "admin", "site", data.PointValueRoleAdmin)
+
+	point := func(typ, origin string) data.Point {
+		p := data.NewPointFloat(typ, "", 1)
+		p.Origin = origin
+		return p
+	}
+
+	// principal is set for a session or API key connection, which writes
+	// as it
+	tests := []struct {
+		principal, node string
+		point           data.Point
+		allow           bool
+	}{
+		{"", "pump", point(data.PointTypeValueSet, "viewer"), false},
+		{"", "pump", point(data.PointTypeDisabled, "viewer"), false},
+		{"", "viewer", point(data.PointTypeFirstName, "viewer"), true},
+		{"", "pump", point(data.PointTypeValueSet, "op"), true},
+		{"", "pump", point(data.PointTypeDisabled, "op"), false},
+		{"", "pump", point(data.PointTypeDisabled, "admin"), true},
+		{"", "pump", point(data.PointTypeValue, "pump"), true},
+		{"", "pump", point(data.PointTypeValue, ""), true},
+		{"", "new-node", point(data.PointTypeDescription, "viewer"), true},
+		{"op", "pump", point(data.PointTypeValueSet, ""), true},
+		{"op", "pump", point(data.PointTypeDisabled, ""), false},
+		{"op", "pump", point(data.PointTypeDisabled, "admin"), false},
+		{"op", "pump", point(data.PointTypeDisabled, "pump"), false},
+		{"admin", "pump", point(data.PointTypeDisabled, ""), true},
+		{"viewer", "new-node", point(data.PointTypeDescription, ""), false},
+	}
+
+	for _, test := range tests {
+		accepted, err := db.authorizePoints(test.principal, test.node,
+			data.Points{test.point})
+		if got := len(accepted) == 1; got != test.allow || (err == nil) != test.allow {
+			t.Errorf("%q as %q writing %v to %v: got %v (%v), expected %v",
+				test.principal, test.point.Origin, test.point.Type, test.node, got, err,
+				test.allow)
+		}
+		if test.allow && test.principal != "" && accepted[0].Origin != test.principal {
+			t.Errorf("%v wrote as %q", test.principal, accepted[0].Origin)
+		}
+	}
+
+	edge := func(origin string) data.Points {
+		p := data.NewPointFloat(data.PointTypeTombstone, "", 1)
+		p.Origin = origin
+		return data.Points{p}
+	}
+
+	if _, err := db.authorizeEdge("", "pump", "site", edge("op")); err == nil {
+		t.Error("an operator deleted a node")
+	}
+	if _, err := db.authorizeEdge("", "pump", "site", edge("viewer")); err == nil {
+		t.Error("a viewer deleted a node")
+	}
+	if _, err := db.authorizeEdge("", "pump", "site", edge("admin")); err != nil {
+		t.Error("an admin could not delete a node:", err)
+	}
+	if _, err := db.authorizeEdge("", "op", "site", edge("op")); err == nil {
+		t.Error("an operator changed its own edge")
+	}
+	if _, err := db.authorizeEdge("op", "pump", "site", edge("admin")); err == nil {
+		t.Error("an operator wrote an edge as an admin")
+	}
+	if _, err := db.authorizeEdge("admin", "pump", "site", edge("")); err != nil {
+		t.Error("an admin session could not delete a node:", err)
+	}
+
+	// a node placed elsewhere is only attached by an admin over it there
+	mkTestNode(t, db, rootID, "yard", data.NodeTypeGroup, "yard")
+	mkTestNode(t, db, "yard", "gate", data.NodeTypeDevice, "gate")
+	mkTestNode(t, db, rootID, "boss", data.NodeTypeUser, "")
+
+	attach := func(origin string) data.Points {
+		ps := data.Points{
+			data.NewPointFloat(data.PointTypeTombstone, "", 0),
+			data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice),
+		}
+		for i := range ps {
+			ps[i].Origin = origin
+		}
+		return ps
+	}
+
+	if _, err := db.authorizeEdge("", "gate", "site", attach("admin")); err == nil {
+		t.Error("an admin attached a node from outside its place")
+	}
+	if _, err := db.authorizeEdge("", "gate", "site", attach("boss")); err != nil {
+		t.Error("an admin over both places could not attach a node:", err)
+	}
+	if _, err := db.authorizeEdge("", "new-node", "site", attach("admin")); err != nil {
+		t.Error("an admin could not add a node:", err)
+	}
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// SessionGrant is what a user's login token gives a browser session on the
+// NATS websocket: the nodes the user can reach, which are the ones
+// GetNodesForUser returns, and which of those it may change. An API key gets
+// the grant of its owner, limited to the key's scope and access.
+type SessionGrant struct {
+	// UserID is the user, or the apiKey node of a key
+	UserID string
+	// Read holds the nodes the user can see: the node above each of the
+	// user's places in the tree and everything below it.
+	Read []string
+	// Operate holds the nodes where the user is an operator, and may write
+	// setpoints (see data.IsSetpoint).
+	Operate []string
+	// Write holds the nodes the user can change: those where the user is an
+	// admin, and the user's own node. Only an admin may add, move or delete
+	// nodes below them.
+	Write []string
+	// Admin holds the nodes where the user is an admin.
+	Admin []string
+	// Orgs holds the organizations where the user is an admin, whose
+	// devices waiting for adoption it may list and decide on.
+	Orgs []string
+}
+
+// SessionGrant returns the grant of the session whose login token or API key
+// is token. It returns false if the token is not valid, or its user has no
+// place in the tree.
+func (st *Store) SessionGrant(token string) (SessionGrant, bool) {
+	valid, userID := st.authorizer.ValidToken(token)
+	if !valid || userID == "" {
+		return SessionGrant{}, false
+	}
+	return st.db.sessionGrant(userID)
+}
+
+func (db *DbJetStream) sessionGrant(userID string) (SessionGrant, bool) {
+	key := db.isAPIKey(userID)
+
+	var roles map[string]Role
+	if key {
+		roles = db.apiKeyRoles(userID)
+	} else {
+		roles = db.userRoles(userID)
+	}
+
+	// a user in an organization reaches nothing outside it
+	for id := range roles {
+		if !db.orgAllows(userID, id) {
+			delete(roles, id)
+		}
+	}
+
+	if len(roles) == 0 {
+		return SessionGrant{}, false
+	}
+
+	read := make(map[string]bool)
+	operate := make(map[string]bool)
+	write := make(map[string]bool)
+	if !key {
+		write[userID] = true
+	}
+	admin := make(map[string]bool)
+	orgs := make(map[string]bool)
+	for id, r := range roles {
+		read[id] = true
+		switch r {
+		case RoleOperator:
+			operate[id] = true
+		case RoleAdmin:
+			write[id] = true
+			admin[id] = true
+			if db.isOrg(id) {
+				orgs[id] = true
+			}
+		}
+	}
+
+	return SessionGrant{
+		UserID:  userID,
+		Read:    sortedIDs(read),
+		Operate: sortedIDs(operate),
+		Write:   sortedIDs(write),
+		Admin:   sortedIDs(admin),
+		Orgs:    sortedIDs(orgs),
+	}, true
+}
+
+// userRoles returns the highest role a user holds over each node it can
+// reach.
+func (db *DbJetStream) userRoles(userID string) map[string]Role {
+	roles := make(map[string]Role)
+
+	for _, e := range db.edgeCache.Parents(userID) {
+		if e.IsTombstone() || e.Up == "root" {
+			continue
+		}
+		db.addPlaceRoles(roles, e.Up, db.placeRole(e))
+	}
+
+	return roles
+}
+
+// apiKeyRoles returns the role an API key holds over each node it can reach,
+// worked out the way apiKeyRole does for one node.
+func (db *DbJetStream) apiKeyRoles(keyID string) map[string]Role {
+	k, ok := db.apiKey(keyID)
+	if !ok || !k.usable(time.Now()) {
+		return nil
+	}
+
+	owner := make(map[string]Role)
+	for _, e := range db.edgeCache.Parents(keyID) {
+		if e.IsTombstone() {
+			continue
+		}
+		if db.isUser(e.Up) {
+			for id, r := range db.userRoles(e.Up) {
+				if r > owner[id] {
+					owner[id] = r
+				}
+			}
+			continue
+		}
+		db.addPlaceRoles(owner, e.Up, db.placeRole(e))
+	}
+
+	roles := make(map[string]Role, len(owner))
+	for id, r := range owner {
+		if k.scope != "" && !db.inSubtree(k.scope, id) {
+			continue
+		}
+		if !k.write && r > RoleViewer {
+			r = RoleViewer
+		}
+		roles[id] = r
+	}
+
+	return roles
+}
+
+// addPlaceRoles raises the role over top and the live nodes below it to at
+// least role.
+func (db *DbJetStream) addPlaceRoles(roles map[string]Role, top string, role Role) {
+	nodes := map[string]bool{top: true}
+	db.sessionDescendants(top, nodes)
+	for id := range nodes {
+		if role > roles[id] {
+			roles[id] = role
+		}
+	}
+}
+
+// sessionDescendants adds the live nodes below id to nodes.
+func (db *DbJetStream) sessionDescendants(id string, nodes map[string]bool) {
+	for _, e := range db.edgeCache.Children(id) {
+		if e.IsTombstone() || nodes[e.Down] {
+			continue
+		}
+		nodes[e.Down] = true
+		db.sessionDescendants(e.Down, nodes)
+	}
+}
+
+func sortedIDs(ids map[string]bool) []string {
+	ret := make([]string, 0, len(ids))
+	for id := range ids {
+		ret = append(ret, id)
+	}
+	sort.Strings(ret)
+	return ret
+}
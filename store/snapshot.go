@@ -0,0 +1,237 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Snapshots are kept in a KV bucket of their own, keyed by the node a
+// snapshot was taken of and its name. They are not part of any boundary
+// stream, so they stay on the instance that took them and are not synced.
+const snapshotBucket = "SNAPSHOTS"
+
+func (db *DbJetStream) snapshotKV() (jetstream.KeyValue, error) {
+	kv, err := db.js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      snapshotBucket,
+		Description: "named configuration snapshots",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v KV bucket: %v", snapshotBucket, err)
+	}
+	return kv, nil
+}
+
+func snapshotKey(nodeID, name string) string {
+	return nodeID + "." + name
+}
+
+// liveSnapshot returns the configuration of the subtree below nodeID as it
+// is now.
+func (db *DbJetStream) liveSnapshot(nodeID string) (data.Snapshot, error) {
+	var top *EdgeEntry
+	for _, e := range db.edgeCache.Parents(nodeID) {
+		if !e.IsTombstone() {
+			top = &e
+			break
+		}
+	}
+	if top == nil {
+		return data.Snapshot{}, fmt.Errorf("node %v not found", nodeID)
+	}
+
+	users := make(map[string]bool)
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeUser) {
+		users[e.Down] = true
+	}
+
+	ret := data.Snapshot{NodeID: nodeID, Time: time.Now()}
+
+	root := db.snapshotNode(*top, users)
+	// the edge above the snapshot is not part of it
+	root.EdgePoints = nil
+	ret.Nodes = append(ret.Nodes, root)
+
+	visited := map[string]bool{nodeID: true}
+	frontier := []string{nodeID}
+	for len(frontier) > 0 {
+		var next []string
+		for _, id := range frontier {
+			children := db.edgeCache.Children(id)
+			sort.Slice(children, func(i, j int) bool {
+				return children[i].Down < children[j].Down
+			})
+			for _, e := range children {
+				if e.IsTombstone() {
+					continue
+				}
+				ret.Nodes = append(ret.Nodes, db.snapshotNode(e, users))
+				if !visited[e.Down] {
+					// a node mirrored under two parents in the subtree is
+					// kept under both, and its children once
+					visited[e.Down] = true
+					next = append(next, e.Down)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	return ret, nil
+}
+
+// snapshotNode returns the configuration of the node below an edge.
+func (db *DbJetStream) snapshotNode(e EdgeEntry, users map[string]bool) data.SnapshotNode {
+	db.pointMu.RLock()
+	points := db.pointCache[e.Down]
+	db.pointMu.RUnlock()
+
+	n := data.SnapshotNode{
+		NodeEdge: data.NodeEdge{ID: e.Down, Type: e.Type, Parent: e.Up},
+	}
+
+	for _, p := range points {
+		if p.Tombstone%2 == 0 && db.configOrigin(p.Origin, users) {
+			n.Points = append(n.Points, p)
+		}
+	}
+
+	for _, p := range e.Points {
+		if p.Type == data.PointTypeNodeType {
+			n.Config = db.configOrigin(p.Origin, users)
+			continue
+		}
+		if p.Type == data.PointTypeTombstone {
+			continue
+		}
+		if db.configOrigin(p.Origin, users) {
+			n.EdgePoints = append(n.EdgePoints, p)
+		}
+	}
+
+	return n
+}
+
+// configOrigin reports whether a point origin is a user or a configuration
+// tool. Clients record their own node ID as the origin of what they write,
+// or leave it blank when writing to their own node.
+func (db *DbJetStream) configOrigin(origin string, users map[string]bool) bool {
+	if origin == "" {
+		return false
+	}
+	if users[origin] {
+		return true
+	}
+	return len(db.edgeCache.Parents(origin)) == 0
+}
+
+// takeSnapshot saves the configuration of the subtree below nodeID under a
+// name, replacing any earlier snapshot of the same name.
+func (db *DbJetStream) takeSnapshot(nodeID, name string) (data.Snapshot, error) {
+	if err := data.CheckSnapshotName(name); err != nil {
+		return data.Snapshot{}, err
+	}
+
+	s, err := db.liveSnapshot(nodeID)
+	if err != nil {
+		return data.Snapshot{}, err
+	}
+	s.Name = name
+
+	kv, err := db.snapshotKV()
+	if err != nil {
+		return data.Snapshot{}, err
+	}
+
+	value, err := json.Marshal(s)
+	if err != nil {
+		return data.Snapshot{}, err
+	}
+
+	_, err = kv.Put(context.Background(), snapshotKey(nodeID, name), value)
+	if err != nil {
+		return data.Snapshot{}, fmt.Errorf("error saving snapshot: %v", err)
+	}
+
+	return s, nil
+}
+
+// getSnapshot returns a saved snapshot.
+func (db *DbJetStream) getSnapshot(nodeID, name string) (data.Snapshot, error) {
+	if err := data.CheckSnapshotName(name); err != nil {
+		return data.Snapshot{}, err
+	}
+
+	kv, err := db.snapshotKV()
+	if err != nil {
+		return data.Snapshot{}, err
+	}
+
+	entry, err := kv.Get(context.Background(), snapshotKey(nodeID, name))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return data.Snapshot{}, fmt.Errorf("no snapshot %v of %v", name, nodeID)
+	}
+	if err != nil {
+		return data.Snapshot{}, err
+	}
+
+	var s data.Snapshot
+	err = json.Unmarshal(entry.Value(), &s)
+	return s, err
+}
+
+// listSnapshots returns the snapshots taken of a node, oldest first,
+// without their nodes.
+func (db *DbJetStream) listSnapshots(nodeID string) ([]data.Snapshot, error) {
+	kv, err := db.snapshotKV()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	keys, err := kv.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []data.Snapshot
+	for key := range keys.Keys() {
+		name, ok := strings.CutPrefix(key, nodeID+".")
+		if !ok {
+			continue
+		}
+		s, err := db.getSnapshot(nodeID, name)
+		if err != nil {
+			return nil, err
+		}
+		s.Nodes = nil
+		ret = append(ret, s)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+
+	return ret, nil
+}
+
+// deleteSnapshot removes a saved snapshot.
+func (db *DbJetStream) deleteSnapshot(nodeID, name string) error {
+	if _, err := db.getSnapshot(nodeID, name); err != nil {
+		return err
+	}
+
+	kv, err := db.snapshotKV()
+	if err != nil {
+		return err
+	}
+
+	return kv.Purge(context.Background(), snapshotKey(nodeID, name))
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func withOrigin(p data.Point, origin string) data.Point {
+	p.Origin = origin
+	return p
+}
+
+func TestSnapshotKeepsConfigOnly(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	dev := uuid.New().String()
+	found := uuid.New().String()
+
+	// a device created by import, and a node the device created itself
+	err := db.edgePoints(dev, rootID, data.Points{
+		withOrigin(data.NewPointFloat(data.PointTypeTombstone, "", 0), "import"),
+		withOrigin(data.NewPointString(data.PointTypeNodeType, "", data.NodeTypeDevice), "import"),
+	})
+	if err != nil {
+		t.Fatal("Error creating device:", err)
+	}
+
+	err = db.nodePoints(dev, data.Points{
+		withOrigin(data.NewPointString(data.PointTypeDescription, "0", "device"), "import"),
+		// reported by the device itself
+		data.NewPointString(data.PointTypeVersionOS, "0", "1.2.3"),
+	})
+	if err != nil {
+		t.Fatal("Error writing points:", err)
+	}
+
+	mkTestNode(t, db, dev, found, data.NodeTypeVariable, "found")
+
+	s, err := db.takeSnapshot(rootID, "first")
+	if err != nil {
+		t.Fatal("Error taking snapshot:", err)
+	}
+
+	var devNode, foundNode *data.SnapshotNode
+	for i, n := range s.Nodes {
+		switch n.ID {
+		case dev:
+			devNode = &s.Nodes[i]
+		case found:
+			foundNode = &s.Nodes[i]
+		}
+	}
+
+	if devNode == nil || foundNode == nil {
+		t.Fatal("snapshot is missing nodes:", s.Nodes)
+	}
+
+	if !devNode.Config || foundNode.Config {
+		t.Fatal("config nodes not told apart from client nodes")
+	}
+
+	if len(devNode.Points) != 1 || devNode.Points[0].Type != data.PointTypeDescription {
+		t.Fatal("snapshot kept more than config points:", devNode.Points)
+	}
+
+	if len(foundNode.Points) != 0 {
+		t.Fatal("snapshot kept client points:", foundNode.Points)
+	}
+
+	got, err := db.getSnapshot(rootID, "first")
+	if err != nil || len(got.Nodes) != len(s.Nodes) {
+		t.Fatal("saved snapshot differs:", got, err)
+	}
+
+	list, err := db.listSnapshots(rootID)
+	if err != nil || len(list) != 1 || len(list[0].Nodes) != 0 {
+		t.Fatal("snapshot list wrong:", list, err)
+	}
+
+	if _, err := db.takeSnapshot(rootID, "bad name"); err == nil {
+		t.Fatal("snapshot name with a space accepted")
+	}
+
+	if err := db.deleteSnapshot(rootID, "first"); err != nil {
+		t.Fatal("Error deleting snapshot:", err)
+	}
+
+	if err := db.deleteSnapshot(rootID, "first"); err == nil {
+		t.Fatal("deleting a missing snapshot should fail")
+	}
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -51,6 +52,13 @@ type Store struct {
 	// once rather than continuously
 	pointErrMu   sync.Mutex
 	pointErrLast map[string]time.Time
+
+	// when the lastUsed point of each API key was last written
+	keyUsedMu sync.Mutex
+	keyUsed   map[string]time.Time
+
+	// counts for the HTTP API's /metrics
+	counts storeCounts
 }
 
 // Params are used to configure a store
@@ -63,6 +71,17 @@ type Params struct {
 	ID string
 	// JsConfig holds JetStream tunables (retention, etc.)
 	JsConfig JsConfig
+	// AdoptionApproval holds new devices that sync to this instance for an
+	// admin to approve, rather than adding them to the tree at once.
+	AdoptionApproval bool
+	// SyncConflictWindow is how close together two instances have to
+	// change a config point for it to be recorded as a sync conflict. 0
+	// uses DefaultSyncConflictWindow and a negative window turns detection
+	// off.
+	SyncConflictWindow time.Duration
+	// SyncConflictKeep keeps sync conflicts until an admin resolves them,
+	// rather than letting them expire after a week.
+	SyncConflictKeep bool
 }
 
 // NewStore creates a new NATS client for handling SIOT requests
@@ -71,6 +90,8 @@ func NewStore(p Params) (*Store, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error opening db: %v", err)
 	}
+	db.conflicts.window = conflictWindow(p.SyncConflictWindow)
+	db.conflicts.keep = p.SyncConflictKeep
 
 	authorizer, err := api.NewKey(db.meta.JWTKey)
 	if err != nil {
@@ -78,13 +99,13 @@ func NewStore(p Params) (*Store, error) {
 	}
 
 	log.Println("store connecting to nats server:", p.Server)
-	return &Store{
+	st := &Store{
 		params:        p,
 		nc:            p.Nc,
 		db:            db,
-		authorizer:    authorizer,
 		subscriptions: make(map[string]*nats.Subscription),
 		pointErrLast:  make(map[string]time.Time),
+		keyUsed:       make(map[string]time.Time),
 		chStop:        make(chan struct{}),
 		chStopMetrics: make(chan struct{}),
 		chWaitStart:   make(chan struct{}),
@@ -96,7 +117,10 @@ func NewStore(p Params) (*Store, error) {
 			data.PointTypeMetricNatsCycleNode, reportMetricsPeriod),
 		metricCycleNodeChildren: client.NewMetric(p.Nc, "",
 			data.PointTypeMetricNatsCycleNodeChildren, reportMetricsPeriod),
-	}, nil
+	}
+	st.authorizer = authorizer.WithAPIKeys(st.validAPIKey)
+
+	return st, nil
 }
 
 // GetAuthorizer returns a type that can be used in JWT Auth mechanisms
@@ -118,6 +142,18 @@ func (st *Store) Run() error {
 		return fmt.Errorf("subscribe edge points error: %w", err)
 	}
 
+	// sessions and API keys write as their principal (see
+	// client.SubjectNodePointsAs)
+	st.subscriptions["nodePointsAs"], err = nc.Subscribe("as.*.p.>", st.handleNodePoints)
+	if err != nil {
+		return fmt.Errorf("subscribe node points error: %w", err)
+	}
+
+	st.subscriptions["edgePointsAs"], err = nc.Subscribe("as.*.ep.*.*", st.handleEdgePoints)
+	if err != nil {
+		return fmt.Errorf("subscribe edge points error: %w", err)
+	}
+
 	if st.subscriptions["nodes"], err = nc.Subscribe("nodes.*.*", st.handleNodesRequest); err != nil {
 		return fmt.Errorf("subscribe node error: %w", err)
 	}
@@ -126,10 +162,46 @@ func (st *Store) Run() error {
 		return fmt.Errorf("subscribe auth error: %w", err)
 	}
 
+	if st.subscriptions["auth.oidc"], err = nc.Subscribe("auth.oidc", st.handleAuthOIDC); err != nil {
+		return fmt.Errorf("subscribe auth error: %w", err)
+	}
+
 	if st.subscriptions["auth.getNatsURI"], err = nc.Subscribe("auth.getNatsURI", st.handleAuthGetNatsURI); err != nil {
 		return fmt.Errorf("subscribe auth error: %w", err)
 	}
 
+	if st.subscriptions["audit"], err = nc.Subscribe("audit.*", st.handleAudit); err != nil {
+		return fmt.Errorf("subscribe audit error: %w", err)
+	}
+
+	if st.subscriptions["history"], err = nc.Subscribe("history.*", st.handleHistory); err != nil {
+		return fmt.Errorf("subscribe history error: %w", err)
+	}
+
+	if st.subscriptions["trash"], err = nc.Subscribe("trash.>", st.handleTrash); err != nil {
+		return fmt.Errorf("subscribe trash error: %w", err)
+	}
+
+	if st.subscriptions["snapshot"], err = nc.Subscribe("snapshot.*.*", st.handleSnapshot); err != nil {
+		return fmt.Errorf("subscribe snapshot error: %w", err)
+	}
+
+	if st.subscriptions["local"], err = nc.Subscribe("local.*", st.handleLocal); err != nil {
+		return fmt.Errorf("subscribe local error: %w", err)
+	}
+
+	if st.subscriptions["credential"], err = nc.Subscribe("credential.*", st.handleCredential); err != nil {
+		return fmt.Errorf("subscribe credential error: %w", err)
+	}
+
+	if st.subscriptions["adoption"], err = nc.Subscribe("adoption.>", st.handleAdoption); err != nil {
+		return fmt.Errorf("subscribe adoption error: %w", err)
+	}
+
+	if st.subscriptions["conflict"], err = nc.Subscribe("conflict.>", st.handleConflict); err != nil {
+		return fmt.Errorf("subscribe conflict error: %w", err)
+	}
+
 	if st.subscriptions["admin.storeVerify"], err = nc.Subscribe("admin.storeVerify", st.handleStoreVerify); err != nil {
 		return fmt.Errorf("subscribe dbVerify error: %w", err)
 	}
@@ -225,6 +297,7 @@ func (st *Store) StartMetrics(nodeID string) error {
 				log.Println("Error getting pendingNodePoints:", err)
 			}
 
+			st.counts.pendingNodePoints.Store(int64(pendingNodePoints))
 			err = st.metricPendingNodePoint.AddSample(float64(pendingNodePoints))
 			if err != nil {
 				log.Println("Error handling metric:", err)
@@ -235,6 +308,7 @@ func (st *Store) StartMetrics(nodeID string) error {
 				log.Println("Error getting pendingEdgePoints:", err)
 			}
 
+			st.counts.pendingEdgePoints.Store(int64(pendingEdgePoints))
 			err = st.metricPendingNodeEdgePoint.AddSample(float64(pendingEdgePoints))
 			if err != nil {
 				log.Println("Error handling metric:", err)
@@ -249,6 +323,42 @@ func (st *Store) StopMetrics(_ error) {
 	close(st.chStopMetrics)
 }
 
+// checkPointSubject drops the points of a node point message whose type or
+// key differ from the ones its subject names, and returns an error describing
+// what was dropped. The server grants sessions and API keys the right to write
+// a node point by its subject (see server/auth.go), so a point must be the one
+// its subject says it is.
+func checkPointSubject(subject, nodeID string, points []data.Point) ([]data.Point, error) {
+	accepted := make([]data.Point, 0, len(points))
+	var rejected []string
+
+	for _, p := range points {
+		typ, key := p.Type, p.Key
+		if typ == "" {
+			typ = "_"
+		}
+		if key == "" {
+			key = "0"
+		}
+		if client.SubjectNodePoint(nodeID, typ, key) != subject {
+			rejected = append(rejected, fmt.Sprintf("point %v.%v does not match subject %v",
+				typ, key, subject))
+			continue
+		}
+
+		accepted = append(accepted, p)
+	}
+
+	if len(rejected) == 0 {
+		return points, nil
+	}
+
+	err := fmt.Errorf("node %v: %v", nodeID, strings.Join(rejected, "; "))
+	log.Println("Store: rejected points:", err)
+
+	return accepted, err
+}
+
 // checkPoints drops points whose type or key cannot be represented in a NATS
 // subject and returns the ones that can, along with an error describing what
 // was dropped.
@@ -316,7 +426,13 @@ func (st *Store) handleNodePoints(msg *nats.Msg) {
 		}
 	}()
 
-	nodeID, points, err := client.DecodeNodePointsMsg(msg)
+	principal, subject := client.SplitPrincipal(msg.Subject)
+	if principal == "" && msg.Header.Get(client.OriginHeader) == st.db.rootNodeID() {
+		// written under a principal already (see rebroadcast)
+		return
+	}
+
+	nodeID, points, err := client.DecodeNodePointsMsg(&nats.Msg{Subject: subject, Data: msg.Data})
 
 	if err != nil {
 		fmt.Printf("Error decoding nats message: %v: %v", msg.Subject, err)
@@ -324,19 +440,49 @@ func (st *Store) handleNodePoints(msg *nats.Msg) {
 		return
 	}
 
+	st.counts.nodePoints.Add(uint64(len(points)))
+
+	points, errSubject := checkPointSubject(subject, nodeID, points)
 	points, errCheck := st.checkPoints(nodeID, points)
+	errCheck = errors.Join(errSubject, errCheck)
 	if len(points) == 0 {
 		st.reply(msg.Reply, errCheck)
 		return
 	}
 
-	if origin := msg.Header.Get(client.OriginHeader); origin != "" &&
-		origin != st.db.rootNodeID() {
-		// points from another instance are merged for reads and fanned
-		// out, but never persisted here: the replica stream is the
-		// persistent copy (single-writer streams, ADR-7)
-		st.db.mergeRemoteNodePoints(nodeID, points, origin)
+	if origin := msg.Header.Get(client.OriginHeader); principal == "" && origin != "" {
+		// points from another instance are fanned out, but never
+		// persisted here: the replica stream is the persistent copy
+		// (single-writer streams, ADR-7), and the replica consumer has
+		// already merged them for reads
+		points = st.db.remoteNodeTips(nodeID, points, origin)
+		if len(points) == 0 {
+			st.reply(msg.Reply, errCheck)
+			return
+		}
 	} else {
+		var errAuth error
+		points, errAuth = st.db.authorizePoints(principal, nodeID, points)
+		errCheck = errors.Join(errCheck, errAuth)
+		if len(points) > 0 {
+			points, errAuth = st.db.checkOrgPoints(nodeID, points)
+			errCheck = errors.Join(errCheck, errAuth)
+		}
+		if len(points) == 0 {
+			st.reply(msg.Reply, errCheck)
+			return
+		}
+
+		// hash a password before anything else sees it, including the
+		// subscribers the points are fanned out to below
+		for i := range points {
+			points[i], err = hashPassword(points[i])
+			if err != nil {
+				st.reply(msg.Reply, err)
+				return
+			}
+		}
+
 		// write points to database
 		err = st.db.nodePoints(nodeID, points)
 
@@ -347,6 +493,17 @@ func (st *Store) handleNodePoints(msg *nats.Msg) {
 			st.reply(msg.Reply, err)
 			return
 		}
+
+		// local points are not passed on to anyone
+		points = withoutLocal(points)
+		if len(points) == 0 {
+			st.reply(msg.Reply, errCheck)
+			return
+		}
+
+		if principal != "" {
+			st.rebroadcast(subject, points)
+		}
 	}
 
 	// process point in upstream nodes
@@ -370,7 +527,14 @@ func (st *Store) handleEdgePoints(msg *nats.Msg) {
 		}
 	}()
 
-	nodeID, parentID, points, err := client.DecodeEdgePointsMsg(msg)
+	principal, subject := client.SplitPrincipal(msg.Subject)
+	if principal == "" && msg.Header.Get(client.OriginHeader) == st.db.rootNodeID() {
+		// written under a principal already (see rebroadcast)
+		return
+	}
+
+	nodeID, parentID, points, err := client.DecodeEdgePointsMsg(&nats.Msg{Subject: subject,
+		Data: msg.Data})
 
 	if err != nil {
 		fmt.Printf("Error decoding nats message: %v: %v", msg.Subject, err)
@@ -378,18 +542,42 @@ func (st *Store) handleEdgePoints(msg *nats.Msg) {
 		return
 	}
 
+	st.counts.edgePoints.Add(uint64(len(points)))
+
 	points, errCheck := st.checkPoints(nodeID, points)
 	if len(points) == 0 {
 		st.reply(msg.Reply, errCheck)
 		return
 	}
 
-	if origin := msg.Header.Get(client.OriginHeader); origin != "" &&
-		origin != st.db.rootNodeID() {
-		// remote-origin edge points: merge and fan out only (see
+	if origin := msg.Header.Get(client.OriginHeader); principal == "" && origin != "" {
+		// remote-origin edge points: fan out only (see
 		// handleNodePoints)
-		st.db.mergeRemoteEdgePoints(nodeID, parentID, points, origin)
+		points = st.db.remoteEdgeTips(nodeID, parentID, points, origin)
+		if len(points) == 0 {
+			st.reply(msg.Reply, errCheck)
+			return
+		}
 	} else {
+		// a device waiting for adoption approval joins the tree when it
+		// is approved, and not by writing its own edge
+		if err := st.db.checkAdoption(nodeID); err != nil {
+			st.reply(msg.Reply, err)
+			return
+		}
+
+		points, err = st.db.authorizeEdge(principal, nodeID, parentID, points)
+		if err != nil {
+			st.reply(msg.Reply, err)
+			return
+		}
+
+		// nothing may be in two organizations, or in one and outside it
+		if err := st.db.checkOrgEdge(nodeID, parentID, points); err != nil {
+			st.reply(msg.Reply, err)
+			return
+		}
+
 		// write points to database. Its important that we write to the DB
 		// before sending points upstream, or clients may do a rescan and not
 		// see the node is deleted.
@@ -401,6 +589,10 @@ func (st *Store) handleEdgePoints(msg *nats.Msg) {
 			st.reply(msg.Reply, err)
 			return
 		}
+
+		if principal != "" {
+			st.rebroadcast(subject, points)
+		}
 	}
 
 	// process point in upstream nodes
@@ -430,6 +622,7 @@ func (st *Store) handleNodesRequest(msg *nats.Msg) {
 	var nodeID string
 	var includeDel bool
 	var nodeType string
+	var asOf time.Time
 	var nodes data.Nodes
 
 	chunks := strings.Split(msg.Subject, ".")
@@ -454,11 +647,17 @@ func (st *Store) handleNodesRequest(msg *nats.Msg) {
 				includeDel = data.FloatToBool(p.Val())
 			case data.PointTypeNodeType:
 				nodeType = p.Txt()
+			case data.PointTypeAsOf:
+				asOf = p.Time
 			}
 		}
 	}
 
-	nodes, err = st.db.getNodes(nil, parent, nodeID, nodeType, includeDel)
+	if asOf.IsZero() {
+		nodes, err = st.db.getNodes(nil, parent, nodeID, nodeType, includeDel)
+	} else {
+		nodes, err = st.db.getNodesAt(parent, nodeID, nodeType, includeDel, asOf)
+	}
 
 	if err != nil {
 		if err != data.ErrDocumentNotFound {
@@ -486,6 +685,287 @@ handleNodeDone:
 	}
 }
 
+// handleAudit replies with the changes users made to a node, read from the
+// point history. Options are points in the payload, as for nodes requests.
+func (st *Store) handleAudit(msg *nats.Msg) {
+	var resp data.AuditResponse
+	var subtree bool
+	var start, end time.Time
+	var limit int
+
+	chunks := strings.Split(msg.Subject, ".")
+	if len(chunks) != 2 || chunks[1] == "" {
+		resp.Error = fmt.Sprintf("Error in message subject: %v", msg.Subject)
+		goto handleAuditDone
+	}
+
+	if len(msg.Data) > 0 {
+		pts, err := data.DecodePoints(msg.Data)
+		if err != nil {
+			resp.Error = fmt.Sprintf("Error decoding points %v", err)
+			goto handleAuditDone
+		}
+
+		for _, p := range pts {
+			switch p.Type {
+			case data.PointTypeSubtree:
+				subtree = data.FloatToBool(p.Val())
+			case data.PointTypeStart:
+				start = p.Time
+			case data.PointTypeEnd:
+				end = p.Time
+			case data.PointTypeCount:
+				limit = int(p.Val())
+			}
+		}
+	}
+
+	{
+		entries, err := st.db.audit(chunks[1], subtree, start, end, limit)
+		if err != nil {
+			resp.Error = fmt.Sprintf("Error reading audit trail: %v", err)
+		}
+		resp.Entries = entries
+	}
+
+handleAuditDone:
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to audit request:", err)
+	}
+}
+
+// handleHistory returns the values the points of a node (history.<id>) have
+// held. The type, key, time range and count are points in the payload, as in
+// an audit request.
+func (st *Store) handleHistory(msg *nats.Msg) {
+	var resp data.HistoryResponse
+	var typ, key string
+	var start, end time.Time
+	var limit int
+
+	chunks := strings.Split(msg.Subject, ".")
+	if len(chunks) != 2 || chunks[1] == "" {
+		resp.Error = fmt.Sprintf("Error in message subject: %v", msg.Subject)
+		goto handleHistoryDone
+	}
+
+	if len(msg.Data) > 0 {
+		pts, err := data.DecodePoints(msg.Data)
+		if err != nil {
+			resp.Error = fmt.Sprintf("Error decoding points %v", err)
+			goto handleHistoryDone
+		}
+
+		for _, p := range pts {
+			switch p.Type {
+			case data.PointTypePointType:
+				typ = p.Txt()
+			case data.PointTypePointKey:
+				key = p.Txt()
+			case data.PointTypeStart:
+				start = p.Time
+			case data.PointTypeEnd:
+				end = p.Time
+			case data.PointTypeCount:
+				limit = int(p.Val())
+			}
+		}
+	}
+
+	{
+		points, err := st.db.pointHistory(chunks[1], typ, key, start, end, limit)
+		if err != nil {
+			resp.Error = fmt.Sprintf("Error reading point history: %v", err)
+		}
+		resp.Points = points
+	}
+
+handleHistoryDone:
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to history request:", err)
+	}
+}
+
+// handleTrash lists the nodes deleted under a node (trash.<id>), or purges
+// those deleted more than a grace period ago (trash.<id>.purge). The grace
+// period is a period point in the payload, in seconds, and its origin the user
+// or API key purging, which must be an admin over the node.
+func (st *Store) handleTrash(msg *nats.Msg) {
+	var resp data.TrashResponse
+
+	chunks := strings.Split(msg.Subject, ".")
+	switch {
+	case len(chunks) == 2 && chunks[1] != "":
+		resp.Nodes = st.db.trash(chunks[1])
+	case len(chunks) == 3 && chunks[1] != "" && chunks[2] == "purge":
+		grace := client.DefaultTrashGrace
+		pts, err := data.DecodePoints(msg.Data)
+		if err != nil {
+			resp.Error = fmt.Sprintf("Error decoding points %v", err)
+			break
+		}
+		origin := ""
+		for _, p := range pts {
+			if p.Type == data.PointTypePeriod {
+				grace = time.Duration(p.Val() * float64(time.Second))
+				origin = p.Origin
+			}
+		}
+		if st.db.isPrincipal(origin) {
+			if role := st.db.principalRole(origin, chunks[1]); role != RoleAdmin {
+				resp.Error = fmt.Sprintf("not authorized: %v %v (%v) may not purge the trash of %v",
+					st.db.principalKind(origin), origin, role, chunks[1])
+				log.Println("Store:", resp.Error)
+				break
+			}
+		}
+		resp.Nodes, err = st.db.purgeTrash(chunks[1], grace)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	default:
+		resp.Error = fmt.Sprintf("Error in message subject: %v", msg.Subject)
+	}
+
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to trash request:", err)
+	}
+}
+
+// handleSnapshot serves snapshot.<nodeId>.<op> requests: take, get and
+// delete work on the snapshot named by a name point in the payload, list
+// returns the snapshots of the node, and live returns its configuration as
+// it is now, for comparing against a snapshot.
+func (st *Store) handleSnapshot(msg *nats.Msg) {
+	var resp data.SnapshotResponse
+	var err error
+
+	chunks := strings.Split(msg.Subject, ".")
+	nodeID, op := chunks[1], chunks[2]
+
+	var name string
+	pts, err := data.DecodePoints(msg.Data)
+	if err != nil {
+		resp.Error = fmt.Sprintf("Error decoding points %v", err)
+		goto handleSnapshotDone
+	}
+	for _, p := range pts {
+		if p.Type == data.PointTypeName {
+			name = p.Txt()
+		}
+	}
+
+	switch op {
+	case "take":
+		var s data.Snapshot
+		s, err = st.db.takeSnapshot(nodeID, name)
+		resp.Snapshots = []data.Snapshot{s}
+	case "get":
+		var s data.Snapshot
+		s, err = st.db.getSnapshot(nodeID, name)
+		resp.Snapshots = []data.Snapshot{s}
+	case "live":
+		var s data.Snapshot
+		s, err = st.db.liveSnapshot(nodeID)
+		resp.Snapshots = []data.Snapshot{s}
+	case "list":
+		resp.Snapshots, err = st.db.listSnapshots(nodeID)
+	case "delete":
+		err = st.db.deleteSnapshot(nodeID, name)
+	default:
+		err = fmt.Errorf("unknown snapshot operation %q", op)
+	}
+
+	if err != nil {
+		resp.Snapshots = nil
+		resp.Error = err.Error()
+	}
+
+handleSnapshotDone:
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to snapshot request:", err)
+	}
+}
+
+// handleCredential answers credential.<deviceID> with the device's
+// credential on this instance and the streams it replicates.
+func (st *Store) handleCredential(msg *nats.Msg) {
+	chunks := strings.Split(msg.Subject, ".")
+	resp := st.db.deviceAccess(chunks[1])
+
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to credential request:", err)
+	}
+}
+
+// handleLocal writes the local points in a request, if there are any, and
+// replies with all the local points of the node (see store/local.go).
+func (st *Store) handleLocal(msg *nats.Msg) {
+	nodeID := strings.Split(msg.Subject, ".")[1]
+
+	var resp data.LocalPointsResponse
+	var err error
+	if len(msg.Data) > 0 {
+		var points data.Points
+		points, err = data.DecodePoints(msg.Data)
+		if err == nil {
+			err = st.db.writeLocalPoints(nodeID, points)
+		}
+	}
+	if err == nil {
+		resp.Points, err = st.db.localPoints(nodeID)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	reply, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("marshal error:", err)
+		return
+	}
+
+	err = st.nc.Publish(msg.Reply, reply)
+	if err != nil {
+		log.Println("NATS: Error publishing response to local request:", err)
+	}
+}
+
 // TODO, maybe someday we should return error node instead of no data
 func (st *Store) handleAuthUser(msg *nats.Msg) {
 	var points data.Points
@@ -526,7 +1006,11 @@ func (st *Store) handleAuthUser(msg *nats.Msg) {
 		return
 	}
 
-	nodes, err := st.db.userCheck(emailP.Txt(), passP.Txt())
+	// users of an organization log in with its name, and the instance's
+	// own users without one
+	orgP, _ := points.Find(data.PointTypeOrg, "")
+
+	nodes, err := st.db.userCheck(orgP.Txt(), emailP.Txt(), passP.Txt())
 
 	if err != nil || len(nodes) <= 0 {
 		log.Println("Error, invalid user")
@@ -577,19 +1061,53 @@ func (st *Store) handleAuthGetNatsURI(msg *nats.Msg) {
 	}
 }
 
+// handleStoreVerify replies with the problems the store verifier finds. No
+// issues means the caches agree with the streams and the tree is consistent.
 func (st *Store) handleStoreVerify(msg *nats.Msg) {
-	// Hash verification is no longer needed with JetStream store
-	err := st.nc.Publish(msg.Reply, []byte(""))
+	issues, err := st.db.verify()
+	st.replyIssues(msg.Reply, issues, err)
+}
+
+// handleStoreMaint repairs what the store verifier finds and replies with
+// whatever is still wrong afterward, in the same form as handleStoreVerify.
+func (st *Store) handleStoreMaint(msg *nats.Msg) {
+	issues, err := st.db.repair()
+	st.replyIssues(msg.Reply, issues, err)
+}
+
+func (st *Store) replyIssues(subject string, issues []storeIssue, err error) {
+	var resp data.StoreCheckResponse
 	if err != nil {
-		log.Println("NATS: Error publishing response to store verify:", err)
+		resp.Error = fmt.Sprintf("error checking store: %v", err)
+	} else {
+		resp.Issues = make([]string, len(issues))
+		for i, issue := range issues {
+			resp.Issues[i] = issue.String()
+		}
+	}
+
+	d, e := json.Marshal(resp)
+	if e != nil {
+		log.Println("Error encoding store check response:", e)
+		return
+	}
+
+	e = st.nc.Publish(subject, d)
+	if e != nil {
+		log.Println("NATS: Error publishing response to store check:", e)
 	}
 }
 
-func (st *Store) handleStoreMaint(msg *nats.Msg) {
-	// Hash maintenance is no longer needed with JetStream store
-	err := st.nc.Publish(msg.Reply, []byte(""))
+// rebroadcast publishes points written under a principal on the plain
+// subject they were written for, which is the one clients follow. The origin
+// header names this instance, so the store's own handlers leave them be.
+func (st *Store) rebroadcast(subject string, points data.Points) {
+	msg := nats.NewMsg(subject)
+	msg.Data = points.Encode()
+	msg.Header.Set(client.OriginHeader, st.db.rootNodeID())
+	err := st.nc.PublishMsg(msg)
 	if err != nil {
-		log.Println("NATS: Error publishing response to store maint:", err)
+		log.Printf("Store: error publishing %v: %v", subject, err)
 	}
 }
 
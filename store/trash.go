@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Deleting a node tombstones its edge and leaves everything else in place,
+// so a deleted node can be listed and restored until it is purged. Purging
+// removes what this instance wrote for the node and everything below it
+// that is not still attached somewhere else.
+
+// trash returns the nodes deleted from nodeID or from anything below it,
+// newest first. The nodes below a deleted node are deleted with it and are
+// not listed separately.
+func (db *DbJetStream) trash(nodeID string) []data.TrashNode {
+	users := make(map[string]string)
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeUser) {
+		db.pointMu.RLock()
+		p, _ := db.pointCache[e.Down].Find(data.PointTypeEmail, "")
+		db.pointMu.RUnlock()
+		users[e.Down] = p.Txt()
+	}
+
+	var ret []data.TrashNode
+
+	visited := map[string]bool{nodeID: true}
+	frontier := []string{nodeID}
+	for len(frontier) > 0 {
+		var next []string
+		for _, id := range frontier {
+			for _, e := range db.edgeCache.Children(id) {
+				if !e.IsTombstone() {
+					if !visited[e.Down] {
+						visited[e.Down] = true
+						next = append(next, e.Down)
+					}
+					continue
+				}
+
+				tomb, _ := e.Points.Find(data.PointTypeTombstone, "")
+				db.pointMu.RLock()
+				desc := db.pointCache[e.Down].Desc()
+				db.pointMu.RUnlock()
+
+				ret = append(ret, data.TrashNode{
+					ID:            e.Down,
+					Parent:        e.Up,
+					Type:          e.Type,
+					Description:   desc,
+					DeletedAt:     tomb.Time,
+					DeletedBy:     tomb.Origin,
+					DeletedByUser: users[tomb.Origin],
+				})
+			}
+		}
+		frontier = next
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].DeletedAt.After(ret[j].DeletedAt)
+	})
+
+	return ret
+}
+
+// purgeTrash permanently removes the nodes deleted from nodeID or below it
+// more than grace ago, and returns the nodes it removed. A node deleted by
+// another instance is left alone: the delete lives in that instance's
+// stream, which this one does not write.
+func (db *DbJetStream) purgeTrash(nodeID string, grace time.Duration) ([]data.TrashNode, error) {
+	cutoff := time.Now().Add(-grace)
+	self := db.meta.RootID
+
+	var ret []data.TrashNode
+	for _, tn := range db.trash(nodeID) {
+		if tn.DeletedAt.After(cutoff) {
+			continue
+		}
+		if o := db.edgeCache.TipOrigin(tn.Parent, tn.ID, data.PointTypeTombstone, ""); o != self {
+			log.Printf("STORE: not purging %v, deleted by instance %v", tn.ID, o)
+			continue
+		}
+
+		err := db.purgeDeletedNode(tn.Parent, tn.ID)
+		if err != nil {
+			return ret, fmt.Errorf("error purging %v: %v", tn.ID, err)
+		}
+		ret = append(ret, tn)
+	}
+
+	return ret, nil
+}
+
+// purgeDeletedNode removes a deleted edge and, unless the node is still
+// attached to another parent, the node and the part of its subtree that is
+// not attached anywhere else.
+func (db *DbJetStream) purgeDeletedNode(parentID, id string) error {
+	gone := map[string]bool{}
+
+	if !db.trashAttached(id, parentID, nil) {
+		gone[id] = true
+		stack := []string{id}
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, e := range db.edgeCache.Children(n) {
+				if gone[e.Down] || db.trashAttached(e.Down, n, gone) {
+					continue
+				}
+				gone[e.Down] = true
+				stack = append(stack, e.Down)
+			}
+		}
+	}
+
+	// boundaries must be known before their edges leave the cache
+	var boundaries []string
+	for n := range gone {
+		if db.edgeCache.IsBoundary(n, db.meta.RootID) {
+			boundaries = append(boundaries, n)
+		}
+	}
+
+	err := db.purgeEdgeSubject(parentID, id)
+	if err != nil {
+		return err
+	}
+	db.edgeCache.Remove(parentID, id)
+
+	for n := range gone {
+		err := db.purgeNodeSubjectsExcept(n, "")
+		if err != nil {
+			return err
+		}
+		err = db.purgeLocalPoints(n)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range db.edgeCache.Children(n) {
+			db.edgeCache.Remove(n, e.Down)
+		}
+
+		db.pointMu.Lock()
+		delete(db.pointCache, n)
+		delete(db.pointOrigin, n)
+		db.pointMu.Unlock()
+	}
+
+	// a purged device takes its streams with it, including the replica of
+	// what the device wrote itself
+	for _, b := range boundaries {
+		err := db.deleteBoundaryStreams(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trashAttached reports whether a node has a live parent edge other than
+// from, from a parent that is not itself being purged.
+func (db *DbJetStream) trashAttached(id, from string, gone map[string]bool) bool {
+	for _, e := range db.edgeCache.Parents(id) {
+		if e.Up == from || e.IsTombstone() || gone[e.Up] {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// purgeEdgeSubject removes an edge's subject from every local-origin stream.
+func (db *DbJetStream) purgeEdgeSubject(parentID, childID string) error {
+	ctx := context.Background()
+	self := db.meta.RootID
+
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		b, o, ok := streamBoundaryOrigin(si.Config)
+		if !ok || o != self {
+			continue
+		}
+
+		s, err := db.js.Stream(ctx, si.Config.Name)
+		if err != nil {
+			return fmt.Errorf("error getting stream %v: %v", si.Config.Name, err)
+		}
+
+		subject := edgePointSubject(b, o, parentID, childID)
+		err = s.Purge(ctx, jetstream.WithPurgeSubject(subject))
+		if err != nil {
+			return fmt.Errorf("error purging %v: %v", subject, err)
+		}
+	}
+
+	return lister.Err()
+}
+
+// deleteBoundaryStreams deletes every stream of a boundary, whatever its
+// origin.
+func (db *DbJetStream) deleteBoundaryStreams(boundary string) error {
+	ctx := context.Background()
+
+	var names []string
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		b, _, ok := streamBoundaryOrigin(si.Config)
+		if ok && b == boundary {
+			names = append(names, si.Config.Name)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err := db.js.DeleteStream(ctx, name)
+		if err != nil {
+			return fmt.Errorf("error deleting stream %v: %v", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func deleteTestNode(t *testing.T, db *DbJetStream, parent, id, origin string) {
+	t.Helper()
+	p := data.NewPointFloat(data.PointTypeTombstone, "", 1)
+	p.Origin = origin
+	if err := db.edgePoints(id, parent, data.Points{p}); err != nil {
+		t.Fatalf("Error deleting %v: %v", id, err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	user := uuid.New().String()
+	dev := uuid.New().String()
+	group := uuid.New().String()
+	sensor := uuid.New().String()
+
+	mkTestNode(t, db, rootID, user, data.NodeTypeUser, "")
+	mkTestNode(t, db, rootID, dev, data.NodeTypeDevice, "device")
+	mkTestNode(t, db, dev, group, data.NodeTypeGroup, "group")
+	mkTestNode(t, db, group, sensor, data.NodeTypeVariable, "sensor")
+
+	err := db.nodePoints(user, data.Points{
+		data.NewPointString(data.PointTypeEmail, "", "admin@example.com")})
+	if err != nil {
+		t.Fatal("Error writing points:", err)
+	}
+
+	deleteTestNode(t, db, group, sensor, user)
+	deleteTestNode(t, db, dev, group, "")
+
+	trash := db.trash(rootID)
+	if len(trash) != 1 {
+		t.Fatal("expected only the group in the trash, got:", trash)
+	}
+	if trash[0].ID != group || trash[0].Parent != dev || trash[0].Description != "group" {
+		t.Fatal("wrong trash entry:", trash[0])
+	}
+
+	trash = db.trash(group)
+	if len(trash) != 1 || trash[0].ID != sensor {
+		t.Fatal("sensor not in the trash of its group:", trash)
+	}
+	if trash[0].DeletedBy != user || trash[0].DeletedByUser != "admin@example.com" {
+		t.Fatal("delete not attributed to user:", trash[0])
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	dev := uuid.New().String()
+	group := uuid.New().String()
+	sensor := uuid.New().String()
+	shared := uuid.New().String()
+
+	mkTestNode(t, db, rootID, dev, data.NodeTypeDevice, "device")
+	mkTestNode(t, db, dev, group, data.NodeTypeGroup, "group")
+	mkTestNode(t, db, group, sensor, data.NodeTypeVariable, "sensor")
+	mkTestNode(t, db, group, shared, data.NodeTypeVariable, "shared")
+	// shared is mirrored under the device, so it outlives the group
+	mkTestNode(t, db, dev, shared, data.NodeTypeVariable, "")
+
+	deleteTestNode(t, db, dev, group, "")
+
+	purged, err := db.purgeTrash(rootID, time.Hour)
+	if err != nil || len(purged) != 0 {
+		t.Fatal("purge did not respect the grace period:", purged, err)
+	}
+
+	purged, err = db.purgeTrash(rootID, 0)
+	if err != nil {
+		t.Fatal("Error purging:", err)
+	}
+	if len(purged) != 1 || purged[0].ID != group {
+		t.Fatal("group not purged:", purged)
+	}
+
+	devStream := streamName(dev, rootID)
+	for _, id := range []string{group, sensor} {
+		if n := streamSubjectCount(t, db, devStream,
+			fmt.Sprintf("inst.%v.%v.%v.>", dev, rootID, id)); n != 0 {
+			t.Fatalf("%v subjects remain: %v", id, n)
+		}
+		if _, ok := db.pointCache[id]; ok {
+			t.Fatalf("%v points remain cached", id)
+		}
+	}
+	if n := streamSubjectCount(t, db, devStream,
+		edgePointSubject(dev, rootID, dev, group)); n != 0 {
+		t.Fatal("deleted edge remains:", n)
+	}
+	if _, ok := db.edgeCache.Get(dev, group); ok {
+		t.Fatal("deleted edge remains cached")
+	}
+
+	nodes, err := db.getNodes(nil, dev, shared, "", false)
+	if err != nil || len(nodes) != 1 || nodes[0].Desc() != "shared" {
+		t.Fatal("mirrored node did not survive the purge:", nodes, err)
+	}
+
+	// purging a device takes its stream with it
+	deleteTestNode(t, db, rootID, dev, "")
+	purged, err = db.purgeTrash(rootID, 0)
+	if err != nil || len(purged) != 1 {
+		t.Fatal("device not purged:", purged, err)
+	}
+
+	_, err = db.js.Stream(context.Background(), devStream)
+	if !errors.Is(err, jetstream.ErrStreamNotFound) {
+		t.Fatal("device stream not deleted:", err)
+	}
+
+	if issues := verifyTest(t, db); len(issues) > 0 {
+		t.Fatal("purge left problems:", issues)
+	}
+}
@@ -0,0 +1,503 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Kinds of problem the store verifier reports. Each is a way the caches and
+// the streams can disagree, or the tree they describe can be inconsistent,
+// that the normal write paths do not correct by themselves.
+const (
+	// a stream subject tip is newer than what the caches hold, so reads
+	// are serving an older value than the store has persisted
+	issueStaleCache = "stale cache"
+	// a node's subjects sit in a local-origin stream for a boundary that
+	// no longer owns it, left behind by an interrupted boundary migration
+	issueStranded = "stranded subjects"
+	// an undeleted edge hangs below a parent that is not in the tree
+	issueMissingParent = "missing parent"
+	// a node has points but no edge attaching it anywhere
+	issueOrphanNode = "orphan node"
+	// a replica stream whose origin is neither a node in this tree nor
+	// the upstream of a sync node
+	issueOrphanReplica = "orphan replica"
+)
+
+// verifyMaxPasses bounds how often repair re-verifies and fixes. A fix can
+// expose another problem -- detaching the children of a missing parent can
+// leave nothing keeping that parent -- so repair runs until nothing fixable
+// is left, but never indefinitely.
+const verifyMaxPasses = 3
+
+// storeIssue is one problem found by verify. fix is nil when the problem
+// cannot be repaired automatically, usually because the data belongs to
+// another instance's stream and only that instance can change it.
+type storeIssue struct {
+	kind   string
+	id     string
+	detail string
+	fix    func() error
+}
+
+func (i storeIssue) String() string {
+	s := fmt.Sprintf("%v %v: %v", i.kind, i.id, i.detail)
+	if i.fix == nil {
+		s += " (not repairable here)"
+	}
+	return s
+}
+
+// issueOrder is the order repair applies fixes in. Caches are brought up to
+// date and subjects moved to their owners first, so the tree checks that
+// follow see what is actually stored.
+var issueOrder = map[string]int{
+	issueStaleCache:    0,
+	issueStranded:      1,
+	issueMissingParent: 2,
+	issueOrphanNode:    3,
+	issueOrphanReplica: 4,
+}
+
+// verify cross-checks the edge and point caches against the subject tips of
+// every boundary-origin stream, and the tree the caches describe against
+// itself. It changes nothing.
+func (db *DbJetStream) verify() ([]storeIssue, error) {
+	var issues []storeIssue
+
+	streamIssues, err := db.verifyStreams()
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, streamIssues...)
+	issues = append(issues, db.verifyMissingParents()...)
+	issues = append(issues, db.verifyOrphanNodes()...)
+
+	replicaIssues, err := db.verifyReplicas()
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, replicaIssues...)
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issueOrder[issues[i].kind] != issueOrder[issues[j].kind] {
+			return issueOrder[issues[i].kind] < issueOrder[issues[j].kind]
+		}
+		return issues[i].id < issues[j].id
+	})
+
+	return issues, nil
+}
+
+// repair verifies the store and applies every available fix, repeating
+// until a pass finds nothing it can fix. It returns what is still wrong
+// afterward, which is empty for a store that is now consistent.
+func (db *DbJetStream) repair() ([]storeIssue, error) {
+	for pass := 0; pass < verifyMaxPasses; pass++ {
+		issues, err := db.verify()
+		if err != nil {
+			return nil, err
+		}
+
+		fixed := 0
+		for _, i := range issues {
+			if i.fix == nil {
+				continue
+			}
+			err := i.fix()
+			if err != nil {
+				log.Printf("STORE: error repairing %v: %v", i, err)
+				continue
+			}
+			log.Println("STORE: repaired", i)
+			fixed++
+		}
+
+		if fixed == 0 {
+			return issues, nil
+		}
+	}
+
+	return db.verify()
+}
+
+// verifyStreams walks the subject tips of every boundary-origin stream,
+// reporting tips the caches do not reflect and, in this instance's own
+// streams, subjects stored under a boundary that does not own them.
+func (db *DbJetStream) verifyStreams() ([]storeIssue, error) {
+	ctx := context.Background()
+	self := db.meta.RootID
+
+	var issues []storeIssue
+	// a node stranded in a stream is reported once, however many of its
+	// subjects are there
+	stranded := make(map[string]bool)
+
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		b, o, ok := streamBoundaryOrigin(si.Config)
+		if !ok {
+			continue
+		}
+
+		s, err := db.js.Stream(ctx, si.Config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting stream %v: %v", si.Config.Name, err)
+		}
+
+		info, err := s.Info(ctx, jetstream.WithSubjectFilter(streamCaptureSubject(b, o)))
+		if err != nil {
+			return nil, fmt.Errorf("error getting stream info for %v: %v", si.Config.Name, err)
+		}
+
+		for subject := range info.State.Subjects {
+			tok := strings.Split(subject, ".")
+
+			var nodeID string
+			switch {
+			case len(tok) == 7 && tok[4] == "p":
+				nodeID = tok[3]
+				if i, ok := db.verifyPointTip(s, subject, tok, o); !ok {
+					issues = append(issues, i)
+				}
+			case len(tok) == 6 && tok[4] == "ep":
+				nodeID = tok[3]
+				if nodeID == "root" && o != self {
+					// a replica's root anchor is never loaded (see
+					// loadEdgeSubjects)
+					continue
+				}
+				if i, ok := db.verifyEdgeTip(s, subject, tok, o); !ok {
+					issues = append(issues, i)
+				}
+			default:
+				continue
+			}
+
+			if o != self || nodeID == "root" || stranded[b+"."+nodeID] {
+				continue
+			}
+
+			// a fully deleted node keeps its subjects where they are
+			// (see edgePoints), so only a node still in the tree can be
+			// stranded
+			if nodeID != self && len(db.edgeCache.UpIDs(nodeID, false)) == 0 {
+				continue
+			}
+
+			owner := db.edgeCache.OwningBoundary(nodeID, self)
+			if owner == b {
+				continue
+			}
+
+			stranded[b+"."+nodeID] = true
+			id := nodeID
+			issues = append(issues, storeIssue{
+				kind: issueStranded,
+				id:   id,
+				detail: fmt.Sprintf("stored in %v, owned by boundary %v",
+					si.Config.Name, owner),
+				fix: func() error {
+					return db.migrateBoundary(id, make(map[string]bool))
+				},
+			})
+		}
+	}
+
+	return issues, lister.Err()
+}
+
+// verifyPointTip checks that the point cache holds a node point subject's
+// tip, or something newer. ok is false when it does not.
+func (db *DbJetStream) verifyPointTip(s jetstream.Stream, subject string,
+	tok []string, origin string) (storeIssue, bool) {
+	if localPoint(tok[5]) {
+		// never cached, though a replica from an older version may have one
+		return storeIssue{}, true
+	}
+
+	msg, err := s.GetLastMsgForSubject(context.Background(), subject)
+	if err != nil {
+		log.Printf("STORE: verify: error getting tip for %v: %v", subject, err)
+		return storeIssue{}, true
+	}
+
+	pts, err := data.DecodePoints(msg.Data)
+	if err != nil || len(pts) < 1 {
+		return storeIssue{
+			kind:   issueStaleCache,
+			id:     tok[3],
+			detail: fmt.Sprintf("tip of %v cannot be decoded: %v", subject, err),
+		}, false
+	}
+
+	tip := pts[0]
+	if tip.Type == "" {
+		tip.Type = tok[5]
+	}
+	if tip.Key == "" {
+		tip.Key = tok[6]
+	}
+
+	db.pointMu.RLock()
+	cached, found := db.pointCache[tok[3]].Find(tip.Type, tip.Key)
+	db.pointMu.RUnlock()
+
+	if found && !cached.Time.Before(tip.Time) {
+		return storeIssue{}, true
+	}
+
+	nodeID := tok[3]
+	return storeIssue{
+		kind: issueStaleCache,
+		id:   nodeID,
+		detail: fmt.Sprintf("point %v.%v stored at %v is not the cached value",
+			tip.Type, tip.Key, tip.Time.Format(time.RFC3339Nano)),
+		fix: func() error {
+			db.mergePointTip(nodeID, tip, origin)
+			return nil
+		},
+	}, false
+}
+
+// verifyEdgeTip checks that the edge cache holds an edge point subject's
+// tip, or something newer for each of its points. ok is false when it does
+// not.
+func (db *DbJetStream) verifyEdgeTip(s jetstream.Stream, subject string,
+	tok []string, origin string) (storeIssue, bool) {
+	parentID, childID := tok[3], tok[5]
+
+	msg, err := s.GetLastMsgForSubject(context.Background(), subject)
+	if err != nil {
+		log.Printf("STORE: verify: error getting tip for %v: %v", subject, err)
+		return storeIssue{}, true
+	}
+
+	pts, err := data.DecodePoints(msg.Data)
+	if err != nil {
+		return storeIssue{
+			kind:   issueStaleCache,
+			id:     childID,
+			detail: fmt.Sprintf("tip of %v cannot be decoded: %v", subject, err),
+		}, false
+	}
+
+	entry, found := db.edgeCache.Get(parentID, childID)
+
+	var stale []string
+	for _, p := range pts {
+		if p.Key == "" {
+			p.Key = "0"
+		}
+		if found {
+			cached, ok := entry.Points.Find(p.Type, p.Key)
+			if ok && !cached.Time.Before(p.Time) {
+				continue
+			}
+		}
+		stale = append(stale, p.Type)
+	}
+
+	if len(stale) == 0 {
+		return storeIssue{}, true
+	}
+
+	nodeType := ""
+	for _, p := range pts {
+		if p.Type == data.PointTypeNodeType {
+			nodeType = p.Txt()
+		}
+	}
+
+	return storeIssue{
+		kind: issueStaleCache,
+		id:   childID,
+		detail: fmt.Sprintf("edge from %v: stored %v not the cached value",
+			parentID, strings.Join(stale, ", ")),
+		fix: func() error {
+			if !found && nodeType == "" {
+				return fmt.Errorf("edge %v -> %v has no node type", parentID, childID)
+			}
+			db.edgeCache.MergeEdgePoints(parentID, childID, nodeType, origin, pts)
+			return nil
+		},
+	}, false
+}
+
+// verifyMissingParents reports undeleted edges whose parent is not in the
+// tree. The fix tombstones the edge, which detaches the child the way a
+// delete would and keeps it recoverable.
+func (db *DbJetStream) verifyMissingParents() []storeIssue {
+	self := db.meta.RootID
+
+	var issues []storeIssue
+	for _, e := range db.edgeCache.All() {
+		if e.IsTombstone() || e.Up == "root" || e.Up == self {
+			continue
+		}
+		if len(db.edgeCache.Parents(e.Up)) > 0 {
+			continue
+		}
+
+		up, down := e.Up, e.Down
+		issues = append(issues, storeIssue{
+			kind:   issueMissingParent,
+			id:     down,
+			detail: fmt.Sprintf("edge to parent %v, which is not in the tree", up),
+			fix: func() error {
+				return db.edgePoints(down, up, data.Points{
+					data.NewPointFloat(data.PointTypeTombstone, "", 1),
+				})
+			},
+		})
+	}
+
+	return issues
+}
+
+// verifyOrphanNodes reports nodes that hold points but have no edge at all.
+// Only an orphan whose points were all written here, and that has no
+// children, is removed: anything else is someone else's data, or would
+// take a subtree with it.
+func (db *DbJetStream) verifyOrphanNodes() []storeIssue {
+	self := db.meta.RootID
+
+	db.pointMu.RLock()
+	type orphan struct {
+		id     string
+		points int
+		remote bool
+	}
+	var orphans []orphan
+	for id, pts := range db.pointCache {
+		if id == self || len(pts) == 0 {
+			continue
+		}
+		if len(db.edgeCache.Parents(id)) > 0 {
+			continue
+		}
+		o := orphan{id: id, points: len(pts)}
+		for _, origin := range db.pointOrigin[id] {
+			if origin != self {
+				o.remote = true
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	db.pointMu.RUnlock()
+
+	var issues []storeIssue
+	for _, o := range orphans {
+		i := storeIssue{
+			kind:   issueOrphanNode,
+			id:     o.id,
+			detail: fmt.Sprintf("%v points and no parent edge", o.points),
+		}
+
+		children := len(db.edgeCache.Children(o.id))
+		switch {
+		case o.remote:
+			i.detail += ", written by another instance"
+		case children > 0:
+			i.detail += fmt.Sprintf(", %v children; add an edge to recover them",
+				children)
+		default:
+			id := o.id
+			i.fix = func() error {
+				return db.removeOrphan(id)
+			}
+		}
+
+		issues = append(issues, i)
+	}
+
+	return issues
+}
+
+// removeOrphan purges an orphan node's subjects from this instance's streams,
+// and its local points, and drops it from the point cache.
+func (db *DbJetStream) removeOrphan(id string) error {
+	// no boundary is named "", so this purges every local-origin stream
+	err := db.purgeNodeSubjectsExcept(id, "")
+	if err != nil {
+		return err
+	}
+	err = db.purgeLocalPoints(id)
+	if err != nil {
+		return err
+	}
+
+	db.pointMu.Lock()
+	delete(db.pointCache, id)
+	delete(db.pointOrigin, id)
+	db.pointMu.Unlock()
+
+	return nil
+}
+
+// verifyReplicas reports replica streams that nothing in this instance
+// accounts for. A downstream's replica is accounted for by its device node,
+// deleted or not, and a replica pulled from an upstream by the sync node
+// that records that upstream. An upstream also passes on what the tiers
+// above it wrote for the boundaries we replicate, so a replica in our own
+// boundary or a device's is accounted for by any sync node. Until every
+// sync node has recorded its upstream, pulled replicas cannot be
+// attributed and are not reported.
+func (db *DbJetStream) verifyReplicas() ([]storeIssue, error) {
+	ctx := context.Background()
+	self := db.meta.RootID
+
+	upstreams := make(map[string]bool)
+	allKnown := true
+	for _, e := range db.edgeCache.AllByType(data.NodeTypeSync) {
+		if e.IsTombstone() {
+			continue
+		}
+		db.pointMu.RLock()
+		p, _ := db.pointCache[e.Down].Find(data.PointTypeUpstreamID, "")
+		db.pointMu.RUnlock()
+		id := p.Txt()
+		if id == "" {
+			allKnown = false
+			continue
+		}
+		upstreams[id] = true
+	}
+
+	var issues []storeIssue
+
+	lister := db.js.ListStreams(ctx, jetstream.WithStreamListSubject("inst.>"))
+	for si := range lister.Info() {
+		b, o, ok := streamBoundaryOrigin(si.Config)
+		if !ok || o == self {
+			continue
+		}
+
+		if len(db.edgeCache.Parents(o)) > 0 || upstreams[o] {
+			continue
+		}
+
+		replicated := b == self || len(db.edgeCache.Parents(b)) > 0
+		if replicated && (!allKnown || len(upstreams) > 0) {
+			continue
+		}
+
+		// only reported, since the stream holds another instance's
+		// data and may be the last copy of it
+		issues = append(issues, storeIssue{
+			kind: issueOrphanReplica,
+			id:   si.Config.Name,
+			detail: fmt.Sprintf("origin %v is not a node here or the upstream of a sync node",
+				o),
+		})
+	}
+
+	return issues, lister.Err()
+}
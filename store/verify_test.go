@@ -0,0 +1,211 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// issuesOfKind returns the issues of one kind about one ID.
+func issuesOfKind(issues []storeIssue, kind, id string) []storeIssue {
+	var ret []storeIssue
+	for _, i := range issues {
+		if i.kind == kind && i.id == id {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+func verifyTest(t *testing.T, db *DbJetStream) []storeIssue {
+	t.Helper()
+	issues, err := db.verify()
+	if err != nil {
+		t.Fatal("Error verifying store:", err)
+	}
+	return issues
+}
+
+func repairTest(t *testing.T, db *DbJetStream) {
+	t.Helper()
+	remain, err := db.repair()
+	if err != nil {
+		t.Fatal("Error repairing store:", err)
+	}
+	if len(remain) > 0 {
+		t.Fatal("repair left problems:", remain)
+	}
+}
+
+func TestVerifyCleanStore(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	dev := uuid.New().String()
+	sensor := uuid.New().String()
+
+	mkTestNode(t, db, rootID, dev, data.NodeTypeDevice, "device")
+	mkTestNode(t, db, dev, sensor, data.NodeTypeVariable, "sensor")
+
+	if issues := verifyTest(t, db); len(issues) > 0 {
+		t.Fatal("fresh store has problems:", issues)
+	}
+}
+
+func TestVerifyStaleCache(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	node := uuid.New().String()
+	mkTestNode(t, db, rootID, node, data.NodeTypeVariable, "before")
+
+	// a write that reached the stream but not the cache
+	p := data.NewPointString(data.PointTypeDescription, "0", "after")
+	p.Time = time.Now().Add(time.Minute)
+	pts := data.Points{p}
+	_, err := db.js.Publish(context.Background(),
+		nodePointSubject(rootID, rootID, node, p.Type, p.Key), pts.Encode())
+	if err != nil {
+		t.Fatal("Error publishing:", err)
+	}
+
+	if len(issuesOfKind(verifyTest(t, db), issueStaleCache, node)) != 1 {
+		t.Fatal("stale cache not reported")
+	}
+
+	repairTest(t, db)
+
+	nodes, err := db.getNodes(nil, rootID, node, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("Error getting node:", err)
+	}
+	if nodes[0].Desc() != "after" {
+		t.Fatal("cache not repaired, description:", nodes[0].Desc())
+	}
+}
+
+func TestVerifyStrandedSubjects(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	dev := uuid.New().String()
+	sensor := uuid.New().String()
+
+	mkTestNode(t, db, rootID, dev, data.NodeTypeDevice, "device")
+	mkTestNode(t, db, dev, sensor, data.NodeTypeVariable, "sensor")
+
+	// what an interrupted migration leaves behind: a copy of the sensor's
+	// point in the root boundary, which does not own it
+	p, _ := db.pointCache[sensor].Find(data.PointTypeDescription, "")
+	pts := data.Points{p}
+	_, err := db.js.Publish(context.Background(),
+		nodePointSubject(rootID, rootID, sensor, p.Type, p.Key), pts.Encode())
+	if err != nil {
+		t.Fatal("Error publishing:", err)
+	}
+
+	if len(issuesOfKind(verifyTest(t, db), issueStranded, sensor)) != 1 {
+		t.Fatal("stranded subjects not reported")
+	}
+
+	repairTest(t, db)
+
+	rootStream := streamName(rootID, rootID)
+	if n := streamSubjectCount(t, db, rootStream,
+		fmt.Sprintf("inst.%v.%v.%v.>", rootID, rootID, sensor)); n != 0 {
+		t.Fatal("sensor subjects remain in root stream:", n)
+	}
+	if n := streamSubjectCount(t, db, streamName(dev, rootID),
+		fmt.Sprintf("inst.%v.%v.%v.>", dev, rootID, sensor)); n == 0 {
+		t.Fatal("sensor subjects missing from device stream")
+	}
+}
+
+func TestVerifyMissingParent(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	missing := uuid.New().String()
+	child := uuid.New().String()
+	mkTestNode(t, db, missing, child, data.NodeTypeVariable, "child")
+
+	if len(issuesOfKind(verifyTest(t, db), issueMissingParent, child)) != 1 {
+		t.Fatal("missing parent not reported")
+	}
+
+	repairTest(t, db)
+
+	e, ok := db.edgeCache.Get(missing, child)
+	if !ok || !e.IsTombstone() {
+		t.Fatal("edge to missing parent not tombstoned")
+	}
+}
+
+func TestVerifyOrphanNode(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	rootID := db.rootNodeID()
+	orphan := uuid.New().String()
+
+	err := db.nodePoints(orphan, data.Points{
+		data.NewPointString(data.PointTypeDescription, "", "orphan"),
+	})
+	if err != nil {
+		t.Fatal("Error writing points:", err)
+	}
+
+	if len(issuesOfKind(verifyTest(t, db), issueOrphanNode, orphan)) != 1 {
+		t.Fatal("orphan node not reported")
+	}
+
+	repairTest(t, db)
+
+	if n := streamSubjectCount(t, db, streamName(rootID, rootID),
+		fmt.Sprintf("inst.%v.%v.%v.>", rootID, rootID, orphan)); n != 0 {
+		t.Fatal("orphan subjects remain:", n)
+	}
+}
+
+func TestVerifyOrphanReplica(t *testing.T) {
+	db, cleanup := newTestJsDb(t)
+	defer cleanup()
+
+	// a replica of an instance that is not in the tree
+	gone := uuid.New().String()
+	name := streamName(gone, gone)
+	ctx := context.Background()
+	_, err := db.js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     name,
+		Subjects: []string{streamCaptureSubject(gone, gone)},
+	})
+	if err != nil {
+		t.Fatal("Error creating replica stream:", err)
+	}
+
+	if len(issuesOfKind(verifyTest(t, db), issueOrphanReplica, name)) != 1 {
+		t.Fatal("orphan replica not reported")
+	}
+
+	// another instance's data is never deleted by a repair
+	remain, err := db.repair()
+	if err != nil {
+		t.Fatal("Error repairing store:", err)
+	}
+	if len(issuesOfKind(remain, issueOrphanReplica, name)) != 1 {
+		t.Fatal("orphan replica not reported after repair")
+	}
+
+	_, err = db.js.Stream(ctx, name)
+	if err != nil {
+		t.Fatal("orphan replica deleted:", err)
+	}
+}